@@ -0,0 +1,129 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config for monitor_metrics - see SampleConfig for details
+// Other sections (e.g. notifications used by monitor_metrics.py) may be present in the same file and are ignored.
+type Config struct {
+	MetricsRoot    string        `yaml:"metrics_root"`
+	SDPInstance    string        `yaml:"sdp_instance"` // If this is set then it defines the other variables such as P4Port
+	P4Port         string        `yaml:"p4port"`       // P4PORT value (if not set in env or as parameter)
+	P4User         string        `yaml:"p4user"`       // ditto
+	P4Config       string        `yaml:"p4config"`     // P4CONFIG file - useful if non-SDP
+	P4Bin          string        `yaml:"p4bin"`        // Only useful if non SDP - path to "p4" binary if not in $PATH
+	LogFile        string        `yaml:"log_file"`     // Log file for blocked commands - defaults to <SDP logs>/monitor_metrics.log
+	CaptureFile    string        `yaml:"capture_file"` // If set, lslocks/monitor output is appended to this file for replay with --test.file
+	UpdateInterval time.Duration `yaml:"update_interval"`
+}
+
+// SampleConfig shows a sample config file - this can be used as a template
+// for creating your own config file and is also output if you run monitor_metrics
+// with the --sample.config flag.
+const SampleConfig = `
+# Sample monitor_metrics configuration file - normally called monitor_metrics.yaml
+# Generated by: monitor_metrics --sample.config
+# Edit as required - see comments below
+# Blank lines and lines starting with # are comments and ignored
+# This file may be shared with monitor_metrics.py - its notifications section is ignored.
+
+# ----------------------
+# metrics_root: Directory into which to write metrics files for processing by node_exporter.
+# Ensure that node_exporter user has read access to this folder (and any parent directories)!
+# Metrics are written to locks-<sdp_instance>-<serverid>.prom (locks.prom if neither is known)
+metrics_root: /p4/metrics
+
+# ----------------------
+# sdp_instance: SDP instance - typically integer, but can be alphanumeric
+# If this value is blank then it is assumed to be a non-SDP instance, and you will want
+# to set other values with a prefix of p4 below.
+sdp_instance:
+
+# ----------------------
+# p4port: The value of P4PORT to use
+# IGNORED if sdp_instance is non-blank!
+p4port:
+
+# ----------------------
+# p4user: The value of P4USER to use
+# IGNORED if sdp_instance is non-blank!
+p4user:
+
+# ----------------------
+# p4config: The value of a P4CONFIG to use
+# IGNORED if sdp_instance is non-blank!
+p4config:
+
+# ----------------------
+# p4bin: The absolute path to the p4 binary to be used - important if not available in your PATH
+# IGNORED if sdp_instance is non-blank! (Will use $P4BIN from SDP vars)
+p4bin:
+
+# ----------------------
+# log_file: Log file for blocked commands and blocking trees.
+# Defaults to $LOGS/monitor_metrics.log (SDP logs dir), or /p4/1/logs/monitor_metrics.log if LOGS is not set
+log_file:
+
+# ----------------------
+# capture_file: If set, the output of lslocks and p4 monitor show is appended to this file on every run
+# so that lock incidents can be replayed offline with: monitor_metrics --test.file <capture_file>
+# Note that this file is not rotated - only enable while investigating!
+capture_file:
+
+# ----------------------
+# update_interval: how frequently metrics should be updated when run with --daemon
+# Go duration format, e.g. 30s or 1m
+update_interval: 60s
+`
+
+// Unmarshal the config
+func Unmarshal(config []byte) (*Config, error) {
+	// Default values specified here
+	cfg := &Config{
+		MetricsRoot:    "/p4/metrics",
+		UpdateInterval: 60 * time.Second,
+	}
+	err := yaml.Unmarshal(config, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v. make sure to use 'single quotes' around strings with special characters (like match patterns or label templates), and make sure to use '-' only for lists (metrics) but not for maps (labels)", err.Error())
+	}
+	err = cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// LoadConfigFile - loads monitor_metrics config file
+func LoadConfigFile(filename string) (*Config, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %v: %v", filename, err.Error())
+	}
+	cfg, err := LoadConfigString(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %v: %v", filename, err.Error())
+	}
+	return cfg, nil
+}
+
+// LoadConfigString - loads a string
+func LoadConfigString(content []byte) (*Config, error) {
+	cfg, err := Unmarshal([]byte(content))
+	return cfg, err
+}
+
+func (c *Config) validate() error {
+	if c.MetricsRoot == "" {
+		return fmt.Errorf("metrics_root must be specified")
+	}
+	if c.UpdateInterval < time.Second {
+		return fmt.Errorf("update_interval must be at least 1s: %v", c.UpdateInterval)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const validConfig = `
+metrics_root: /hxlogs/metrics
+sdp_instance: 1
+update_interval: 30s
+capture_file: /tmp/locks_capture.jsonl
+notifications:
+  min_blocked_commands: 5
+`
+
+func TestValidConfigLoaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		loader func(t *testing.T) (*Config, error)
+	}{
+		{
+			name: "Unmarshal",
+			loader: func(t *testing.T) (*Config, error) {
+				return Unmarshal([]byte(validConfig))
+			},
+		},
+		{
+			name: "LoadConfigFile",
+			loader: func(t *testing.T) (*Config, error) {
+				cfgPath := filepath.Join(t.TempDir(), "monitor_metrics.yaml")
+				if err := os.WriteFile(cfgPath, []byte(validConfig), 0o600); err != nil {
+					t.Fatalf("failed to write temp config: %v", err)
+				}
+				return LoadConfigFile(cfgPath)
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := tc.loader(t)
+			if err != nil {
+				t.Fatalf("%s returned unexpected error: %v", tc.name, err)
+			}
+			if cfg.MetricsRoot != "/hxlogs/metrics" {
+				t.Fatalf("unexpected MetricsRoot: got %q", cfg.MetricsRoot)
+			}
+			if cfg.SDPInstance != "1" {
+				t.Fatalf("unexpected SDPInstance: got %q", cfg.SDPInstance)
+			}
+			if cfg.UpdateInterval != 30*time.Second {
+				t.Fatalf("unexpected UpdateInterval: got %v", cfg.UpdateInterval)
+			}
+			if cfg.CaptureFile != "/tmp/locks_capture.jsonl" {
+				t.Fatalf("unexpected CaptureFile: got %q", cfg.CaptureFile)
+			}
+		})
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	cfg, err := Unmarshal([]byte(""))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.MetricsRoot != "/p4/metrics" || cfg.UpdateInterval != 60*time.Second || cfg.LogFile != "" {
+		t.Fatalf("unexpected defaults: %+v", cfg)
+	}
+}
+
+func TestSampleConfig(t *testing.T) {
+	if _, err := Unmarshal([]byte(SampleConfig)); err != nil {
+		t.Fatalf("failed to load SampleConfig: %v", err)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for _, cfg := range []string{
+		"metrics_root: [unterminated",
+		"metrics_root: ''",
+		"update_interval: 10ms",
+	} {
+		if _, err := Unmarshal([]byte(cfg)); err == nil {
+			t.Fatalf("expected Unmarshal to fail for %q", cfg)
+		}
+	}
+}
+
+func TestLoadConfigFileMissing(t *testing.T) {
+	_, err := LoadConfigFile(filepath.Join(t.TempDir(), "missing.yaml"))
+	if err == nil || !strings.Contains(err.Error(), "failed to load") {
+		t.Fatalf("expected failed to load error, got: %v", err)
+	}
+}
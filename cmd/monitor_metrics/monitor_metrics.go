@@ -6,26 +6,32 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
-	"errors"
-	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
+
+	"github.com/perforce/p4prometheus/cmd/monitor_metrics/config"
+	"github.com/perforce/p4prometheus/sdpenv"
+	"github.com/perforce/p4prometheus/version"
+	"github.com/rcowham/kingpin"
+	"github.com/sirupsen/logrus"
 )
 
 const (
-	metricsRootDefault = "/p4/metrics"
-	metricsFile        = "locks.prom"
-	logDirDefault      = "/p4/1/logs"
+	metricsFile     = "locks.prom"
+	logDirDefault   = "/p4/1/logs"
+	timestampFormat = "2006-01-02 15:04:05"
 )
 
 // MonitorPid models a process from monitor output
@@ -39,172 +45,576 @@ type MonitorPid struct {
 }
 
 // Blocker models a blocking pid
-// ...existing code...
+// DirectBlocked/IndirectBlocked/Depth/OldestWait are calculated from the full blocker graph
+// (pids blocked by pids blocked by this pid etc) by buildBlockingTree
 type Blocker struct {
-	Pid            string
-	User           string
-	Cmd            string
-	Elapsed        string
-	Table          string
-	BlockedPids    []string
-	DirectBlocked  int
+	Pid             string
+	User            string
+	Cmd             string
+	Elapsed         string
+	Table           string
+	BlockedPids     []string
+	DirectBlocked   int
 	IndirectBlocked int
+	Depth           int  // Number of levels of blocked pids below this one
+	OldestWait      int  // Max elapsed seconds of any (transitively) blocked pid
+	Cyclic          bool // Set for a root chosen to break a cycle (A blocked by B blocked by A)
 }
 
 // MonitorMetrics holds all metrics
 // ...existing code...
 type MonitorMetrics struct {
-	DbReadLocks           int
-	DbWriteLocks          int
-	ClientEntityReadLocks int
+	DbReadLocks            int
+	DbWriteLocks           int
+	ClientEntityReadLocks  int
 	ClientEntityWriteLocks int
-	MetaReadLocks         int
-	MetaWriteLocks        int
-	BlockedCommands       int
-	Msgs                  []string
-	BlockingCommands      map[string]*Blocker
-	MonitorCommands       map[string]*MonitorPid
+	MetaReadLocks          int
+	MetaWriteLocks         int
+	BlockedCommands        int
+	Msgs                   []string
+	BlockingCommands       map[string]*Blocker
+	MonitorCommands        map[string]*MonitorPid
+	RootBlockers           []*Blocker // Blockers not blocked by anything else - ordered by total blocked
+	TreeLines              []string   // Blocking tree formatted for the log
 }
 
-func main() {
-	// Flags
-	p4port := flag.String("p4port", "", "Perforce server port")
-	p4user := flag.String("p4user", "", "Perforce user")
-	logFile := flag.String("log", filepath.Join(logDirDefault, "monitor_metrics.log"), "Log file")
-	sdpInstance := flag.String("sdp-instance", "", "SDP instance")
-	testFile := flag.String("test-file", "", "Test file")
-	metricsRoot := flag.String("metrics-root", metricsRootDefault, "Metrics directory")
-	verbosity := flag.String("verbosity", "DEBUG", "Verbosity level")
-	flag.Parse()
-
-	logger := log.New(os.Stderr, "", log.LstdFlags)
-	if *logFile != "" {
-		f, err := os.OpenFile(*logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err == nil {
-			logger.SetOutput(f)
+// lockField is a JSON value from lslocks which may be a string, number, bool or null
+// (newer lslocks versions output pid/blocker as numbers, and path may be null)
+type lockField string
+
+func (f *lockField) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		*f = ""
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*f = lockField(s)
+		return nil
+	}
+	*f = lockField(strings.Trim(string(b), `"`))
+	return nil
+}
+
+// LockInfo is a single lock record as output by lslocks -J
+type LockInfo struct {
+	Command lockField `json:"command"`
+	Pid     lockField `json:"pid"`
+	Type    lockField `json:"type"`
+	Size    lockField `json:"size"`
+	Mode    lockField `json:"mode"`
+	M       lockField `json:"m"`
+	Start   lockField `json:"start"`
+	End     lockField `json:"end"`
+	Path    lockField `json:"path"`
+	Blocker lockField `json:"blocker"`
+}
+
+// MonitorLocks runs lslocks/monitor show and writes log and metrics files
+type MonitorLocks struct {
+	config   *config.Config
+	env      map[string]string
+	logger   *logrus.Logger
+	logFile  string
+	serverID string
+}
+
+func newMonitorLocks(cfg *config.Config, env map[string]string, logger *logrus.Logger) *MonitorLocks {
+	ml := &MonitorLocks{config: cfg, env: env, logger: logger}
+	ml.logFile = cfg.LogFile
+	if ml.logFile == "" {
+		logDir := sdpenv.GetVar(env, "LOGS")
+		if logDir == "" {
+			logDir = logDirDefault
 		}
+		ml.logFile = filepath.Join(logDir, "monitor_metrics.log")
 	}
+	ml.serverID = findServerID(sdpenv.GetVar(env, "P4ROOT"))
+	return ml
+}
 
-	if *testFile != "" {
-		parseTestFile(*testFile, logger, *metricsRoot)
+// findServerID reads server.id from P4ROOT if available
+func findServerID(p4root string) string {
+	if p4root == "" {
+		return ""
+	}
+	data, err := os.ReadFile(filepath.Join(p4root, "server.id"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.SplitN(string(data), "\n", 2)[0])
+}
+
+// metricsFilename returns locks-<instance>-<serverid>.prom so that multiple instances on the same
+// machine don't overwrite each others metrics - omitting any values which aren't known.
+func (ml *MonitorLocks) metricsFilename() string {
+	name := strings.TrimSuffix(metricsFile, ".prom")
+	if ml.config.SDPInstance != "" {
+		name += "-" + ml.config.SDPInstance
+	}
+	if ml.serverID != "" {
+		name += "-" + ml.serverID
+	}
+	return filepath.Join(ml.config.MetricsRoot, name+".prom")
+}
+
+// removeLegacyMetricsFile removes locks.prom written by earlier versions, which would otherwise be left stale
+// (and still be scraped) once metrics are written to a per instance/serverid file
+func (ml *MonitorLocks) removeLegacyMetricsFile() {
+	legacy := filepath.Join(ml.config.MetricsRoot, metricsFile)
+	if legacy == ml.metricsFilename() {
 		return
 	}
+	if err := os.Remove(legacy); err == nil {
+		ml.logger.Infof("Removed %s written by an earlier version - metrics are now written to %s", legacy, ml.metricsFilename())
+	}
+}
 
-	// Run commands
-	lockData, err := runLslocks(logger)
+// replayOutput returns the log and metrics files for replaying --test.file in dir (a new temporary directory if
+// empty), named as for a live run. The live files are refused so that a replay never overwrites real metrics or
+// appends to the live log.
+func (ml *MonitorLocks) replayOutput(dir string) (string, string, error) {
+	var err error
+	if dir == "" {
+		dir, err = os.MkdirTemp("", "monitor_metrics_replay")
+	} else {
+		err = os.MkdirAll(dir, 0755)
+	}
 	if err != nil {
-		logger.Printf("Failed to run lslocks: %v", err)
+		return "", "", err
+	}
+	logFile := filepath.Join(dir, filepath.Base(ml.logFile))
+	metricsFilename := filepath.Join(dir, filepath.Base(ml.metricsFilename()))
+	if samePath(logFile, ml.logFile) || samePath(metricsFilename, ml.metricsFilename()) {
+		return "", "", fmt.Errorf("replay output directory %s contains the live log or metrics file", dir)
+	}
+	return logFile, metricsFilename, nil
+}
+
+// samePath returns true if the paths are the same once made absolute
+func samePath(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+// legacyFlags are the single dash flags of earlier versions (which used the flag package) - still accepted
+var legacyFlags = []string{"p4port", "p4user", "log", "sdp-instance", "test-file", "metrics-root", "verbosity"}
+
+// legacyArgs converts single dash legacy flags (e.g. -sdp-instance 1) to the double dash form kingpin expects
+func legacyArgs(args []string) []string {
+	result := make([]string, 0, len(args))
+	for _, a := range args {
+		if strings.HasPrefix(a, "-") && !strings.HasPrefix(a, "--") {
+			name := strings.SplitN(a[1:], "=", 2)[0]
+			for _, f := range legacyFlags {
+				if name == f {
+					a = "-" + a
+					break
+				}
+			}
+		}
+		result = append(result, a)
+	}
+	return result
+}
+
+// p4Params returns p4 binary and connection values - from SDP vars if SDP, otherwise from config falling back to env
+func (ml *MonitorLocks) p4Params() (p4bin, p4port, p4user, p4config string) {
+	p4bin, p4port, p4user = sdpenv.GetVar(ml.env, "P4BIN"), sdpenv.GetVar(ml.env, "P4PORT"), sdpenv.GetVar(ml.env, "P4USER")
+	p4config = sdpenv.GetVar(ml.env, "P4CONFIG")
+	if ml.config.SDPInstance == "" {
+		if ml.config.P4Bin != "" {
+			p4bin = ml.config.P4Bin
+		}
+		if ml.config.P4Port != "" {
+			p4port = ml.config.P4Port
+		}
+		if ml.config.P4User != "" {
+			p4user = ml.config.P4User
+		}
+		if ml.config.P4Config != "" {
+			p4config = ml.config.P4Config
+		}
+	}
+	if p4bin == "" {
+		p4bin = "p4"
+	}
+	return
+}
+
+// run collects lock data once, writing log and metrics files (and capture file if configured)
+func (ml *MonitorLocks) run() {
+	lockData, err := runLslocks(ml.logger)
+	if err != nil {
+		ml.logger.Errorf("Failed to run lslocks: %v", err)
 		return
 	}
-	monData, err := runMonitorShow(*p4port, *p4user, logger)
+	monData, err := runMonitorShow(ml.p4Params())
 	if err != nil {
-		logger.Printf("Failed to run monitor show: %v", err)
+		ml.logger.Errorf("Failed to run monitor show: %v", err)
 		return
 	}
-	metrics := findLocks(lockData, monData, logger)
-	writeLog(formatLog(metrics), *logFile)
-	writeMetrics(formatMetrics(metrics), *metricsRoot)
+	snap := &Snapshot{Timestamp: time.Now().Format(timestampFormat), Lslocks: lockData, Monitor: monData}
+	if ml.config.CaptureFile != "" {
+		if err := writeCapture(snap, ml.config.CaptureFile); err != nil {
+			ml.logger.Errorf("Failed to write capture file: %v", err)
+		}
+	}
+	metrics, logLines, metricLines := processSnapshot(snap, ml.config.SDPInstance, ml.logger)
+	ml.logger.Debugf("Blocking tree:\n%s", strings.Join(metrics.TreeLines, "\n"))
+	if err := writeLog(logLines, ml.logFile); err != nil {
+		ml.logger.Errorf("Failed to write log file: %v", err)
+	}
+	if err := writeMetrics(metricLines, ml.metricsFilename()); err != nil {
+		ml.logger.Errorf("Failed to write metrics file: %v", err)
+	}
 }
 
-// runLslocks executes lslocks and returns output
-func runLslocks(logger *log.Logger) (string, error) {
-	cmd := exec.Command("sudo", "lslocks", "-o", "+BLOCKER", "-J")
-	out, err := cmd.CombinedOutput()
+func loadConfig(logger *logrus.Logger, configFileName, sdpInstance, p4port, p4user, p4config, captureFile, logFile, metricsRoot string) (*config.Config, error) {
+	var cfg *config.Config
+	var err error
+	if configFileName == "" {
+		cfg, err = config.LoadConfigString([]byte(""))
+	} else {
+		logger.Debugf("Loading config file: %q", configFileName)
+		cfg, err = config.LoadConfigFile(configFileName)
+	}
 	if err != nil {
-		logger.Printf("lslocks failed, retrying without sudo: %v", err)
-		cmd = exec.Command("lslocks", "-o", "+BLOCKER", "-J")
-		out, err = cmd.CombinedOutput()
+		return nil, err
+	}
+	if sdpInstance != "" {
+		cfg.SDPInstance = sdpInstance
+	}
+	if p4port != "" {
+		cfg.P4Port = p4port
+	}
+	if p4user != "" {
+		cfg.P4User = p4user
+	}
+	if p4config != "" {
+		cfg.P4Config = p4config
+	}
+	if captureFile != "" {
+		cfg.CaptureFile = captureFile
+	}
+	if logFile != "" {
+		cfg.LogFile = logFile
+	}
+	if metricsRoot != "" {
+		cfg.MetricsRoot = metricsRoot
+	}
+	if cfg.SDPInstance != "" && (p4port != "" || p4user != "" || p4config != "") {
+		logger.Warnf("SDP instance %q specified so ignoring --p4port/--p4user/--p4config", cfg.SDPInstance)
+	}
+	logger.Infof("%v", version.Print("monitor_metrics"))
+	logger.Debugf("Config: %+v", *cfg)
+	return cfg, nil
+}
+
+func main() {
+	var (
+		configFilename = kingpin.Flag(
+			"config",
+			"Config file for monitor_metrics (optional - defaults are used if not specified).",
+		).Short('c').Default("").String()
+		sdpInstance = kingpin.Flag(
+			"sdp.instance",
+			"SDP Instance, typically 1 or alphanumeric.",
+		).Default("").String()
+		p4port = kingpin.Flag(
+			"p4port",
+			"P4PORT to use (if sdp.instance is not set).",
+		).Default("").String()
+		p4user = kingpin.Flag(
+			"p4user",
+			"P4USER to use (if sdp.instance is not set).",
+		).Default("").String()
+		p4config = kingpin.Flag(
+			"p4config",
+			"P4CONFIG file to use (if sdp.instance is not set and no value in config file).",
+		).Default("").String()
+		testFile = kingpin.Flag(
+			"test.file",
+			"Test file to replay: capture file (see --capture) or section of log file from monitor_metrics.py.",
+		).Short('t').Default("").String()
+		testOutput = kingpin.Flag(
+			"test.output",
+			"Directory for the log and metrics files written by --test.file (default a new temporary directory - never the live files).",
+		).Default("").String()
+		captureFile = kingpin.Flag(
+			"capture",
+			"Capture file: lslocks and monitor output are appended to this file for later use with --test.file (overrides capture_file in config).",
+		).Default("").String()
+		daemon = kingpin.Flag(
+			"daemon",
+			"Run continuously, collecting data every update_interval (otherwise runs once and exits).",
+		).Short('d').Bool()
+		debug = kingpin.Flag(
+			"debug",
+			"Enable debugging.",
+		).Bool()
+		sampleConfig = kingpin.Flag(
+			"sample.config",
+			"Output a sample config file and exit. E.g. monitor_metrics --sample.config > monitor_metrics.yaml",
+		).Short('C').Bool()
+		// Flags of earlier versions - still accepted (also with a single dash) but not shown in help
+		legacySDPInstance = kingpin.Flag("sdp-instance", "Use --sdp.instance").Hidden().Default("").String()
+		legacyTestFile    = kingpin.Flag("test-file", "Use --test.file").Hidden().Default("").String()
+		legacyLogFile     = kingpin.Flag("log", "Use log_file in config file").Hidden().Default("").String()
+		legacyMetricsRoot = kingpin.Flag("metrics-root", "Use metrics_root in config file").Hidden().Default("").String()
+		legacyVerbosity   = kingpin.Flag("verbosity", "Use --debug").Hidden().Default("").String()
+	)
+
+	kingpin.Version(version.Print("monitor_metrics"))
+	kingpin.CommandLine.VersionFlag.Short('V')
+	kingpin.CommandLine.HelpFlag.Short('h')
+	kingpin.MustParse(kingpin.CommandLine.Parse(legacyArgs(os.Args[1:])))
+	if *sdpInstance == "" {
+		*sdpInstance = *legacySDPInstance
+	}
+	if *testFile == "" {
+		*testFile = *legacyTestFile
+	}
+	if strings.EqualFold(*legacyVerbosity, "DEBUG") {
+		*debug = true
+	}
+
+	if *sampleConfig {
+		fmt.Print(config.SampleConfig)
+		return
+	}
+
+	logger := logrus.New()
+	logger.Level = logrus.InfoLevel
+	if *debug {
+		logger.Level = logrus.DebugLevel
+	}
+
+	cfg, err := loadConfig(logger, *configFilename, *sdpInstance, *p4port, *p4user, *p4config, *captureFile, *legacyLogFile, *legacyMetricsRoot)
+	if err != nil {
+		logger.Fatalf("Failed to load config file: %v", err)
+	}
+	var env map[string]string
+	if cfg.SDPInstance != "" {
+		env = sdpenv.SourceSDPVars(cfg.SDPInstance, logger)
+	} else {
+		env = sdpenv.SourceEnvVars()
+	}
+	ml := newMonitorLocks(cfg, env, logger)
+
+	if *testFile != "" {
+		logFile, metricsFilename, err := ml.replayOutput(*testOutput)
 		if err != nil {
-			return "", err
+			logger.Fatalf("Failed to create test output: %v", err)
+		}
+		if err := parseTestFile(*testFile, logger, logFile, metricsFilename, cfg.SDPInstance); err != nil {
+			logger.Fatalf("Failed to process test file: %v", err)
+		}
+		logger.Infof("Replay written to %s and %s", logFile, metricsFilename)
+		return
+	}
+
+	if err := os.MkdirAll(cfg.MetricsRoot, 0755); err != nil {
+		logger.Fatalf("Failed to create MetricsRoot: %q, %v", cfg.MetricsRoot, err)
+	}
+	ml.removeLegacyMetricsFile()
+	ml.run()
+	if !*daemon {
+		return
+	}
+
+	ticker := time.NewTicker(cfg.UpdateInterval)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		select {
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				logger.Info("Received signal SIGHUP, reloading config")
+				cfg, err := loadConfig(logger, *configFilename, *sdpInstance, *p4port, *p4user, *p4config, *captureFile, *legacyLogFile, *legacyMetricsRoot)
+				if err != nil {
+					logger.Errorf("Failed to load config file: %v", err)
+					break
+				}
+				if cfg.SDPInstance != "" {
+					env = sdpenv.SourceSDPVars(cfg.SDPInstance, logger)
+				} else {
+					env = sdpenv.SourceEnvVars()
+				}
+				ml = newMonitorLocks(cfg, env, logger)
+				ticker.Reset(cfg.UpdateInterval)
+				ml.run()
+			} else {
+				logger.Infof("Terminating due to signal %v", sig)
+				ticker.Stop()
+				return
+			}
+		case <-ticker.C:
+			ml.run()
 		}
 	}
-	return string(out), nil
 }
 
-// runMonitorShow executes p4 monitor show -al
-func runMonitorShow(p4port, p4user string, logger *log.Logger) (string, error) {
-	p4bin := os.Getenv("P4BIN")
-	if p4bin == "" {
-		p4bin = "p4"
+// processSnapshot analyses a single set of lslocks/monitor output, returning log and metrics lines
+func processSnapshot(snap *Snapshot, sdpInstance string, logger *logrus.Logger) (*MonitorMetrics, []string, []string) {
+	lockData := snap.Lslocks
+	if strings.HasPrefix(strings.TrimSpace(lockData), "COMMAND") {
+		lockData = parseTextLockInfo(lockData)
+	}
+	metrics := findLocks(lockData, snap.Monitor, logger)
+	buildBlockingTree(metrics)
+	return metrics, formatLog(metrics, snap.Timestamp), formatMetrics(metrics, sdpInstance)
+}
+
+// runLslocks executes lslocks and returns output - JSON, or text for old versions which don't support -J
+// (text output is converted to JSON by processSnapshot so that captured output is as returned by lslocks)
+func runLslocks(logger *logrus.Logger) (string, error) {
+	var err error
+	for _, args := range [][]string{
+		{"sudo", "lslocks", "-o", "+BLOCKER", "-J"},
+		{"lslocks", "-o", "+BLOCKER", "-J"},
+		{"sudo", "lslocks", "-o", "+BLOCKER"},
+		{"lslocks", "-o", "+BLOCKER"},
+	} {
+		var out []byte
+		out, err = exec.Command(args[0], args[1:]...).CombinedOutput()
+		if err == nil {
+			return string(out), nil
+		}
+		logger.Debugf("%s failed, retrying: %v", strings.Join(args, " "), err)
 	}
-	if p4port == "" {
-		p4port = os.Getenv("P4PORT")
+	return "", err
+}
+
+// runMonitorShow executes p4 monitor show -al
+func runMonitorShow(p4bin, p4port, p4user, p4config string) (string, error) {
+	args := []string{}
+	if p4user != "" {
+		args = append(args, "-u", p4user)
 	}
-	if p4user == "" {
-		p4user = os.Getenv("P4USER")
+	if p4port != "" {
+		args = append(args, "-p", p4port)
 	}
-	args := []string{"-u", p4user, "-p", p4port, "-F", "%id% %runstate% %user% %elapsed% %function% %args%", "monitor", "show", "-al"}
+	args = append(args, "-F", "%id% %runstate% %user% %elapsed% %function% %args%", "monitor", "show", "-al")
 	cmd := exec.Command(p4bin, args...)
+	if p4config != "" {
+		cmd.Env = append(os.Environ(), "P4CONFIG="+p4config)
+	}
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		logger.Printf("p4 monitor show failed: %v", err)
-		return "", err
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
 	}
 	return string(out), nil
 }
 
+// parseTextLockInfo converts text output of old versions of lslocks (which can't return json) to json
+// For now assume no spaces in file paths or this won't work!
+// COMMAND           PID   TYPE SIZE MODE  M START END PATH                       BLOCKER
+// (unknown)          -1 OFDLCK   0B WRITE 0     0   0 /etc/hosts
+// p4d               107  FLOCK  16K READ* 0     0   0 /path/db.config            105
+func parseTextLockInfo(lockData string) string {
+	type textLock struct {
+		Command string  `json:"command"`
+		Pid     string  `json:"pid"`
+		Type    string  `json:"type"`
+		Size    string  `json:"size"`
+		Mode    string  `json:"mode"`
+		M       string  `json:"m"`
+		Start   string  `json:"start"`
+		End     string  `json:"end"`
+		Path    string  `json:"path"`
+		Blocker *string `json:"blocker"`
+	}
+	jlock := struct {
+		Locks []textLock `json:"locks"`
+	}{Locks: make([]textLock, 0)}
+	for _, line := range strings.Split(lockData, "\n") {
+		parts := strings.Fields(line)
+		if len(parts) < 9 || parts[0] == "COMMAND" || parts[3] == "START" {
+			continue
+		}
+		l := textLock{Command: parts[0], Pid: parts[1], Type: parts[2], Size: parts[3],
+			Mode: parts[4], M: parts[5], Start: parts[6], End: parts[7], Path: parts[8]}
+		if len(parts) == 10 {
+			l.Blocker = &parts[9]
+		}
+		jlock.Locks = append(jlock.Locks, l)
+	}
+	result, _ := json.Marshal(jlock)
+	return string(result)
+}
+
 // findLocks parses lock and monitor data
-func findLocks(lockData, monData string, logger *log.Logger) *MonitorMetrics {
+func findLocks(lockData, monData string, logger *logrus.Logger) *MonitorMetrics {
 	metrics := &MonitorMetrics{
 		BlockingCommands: make(map[string]*Blocker),
 		MonitorCommands:  make(map[string]*MonitorPid),
 	}
 	metrics.MonitorCommands = parseMonitorData(monData)
+	if lockData == "" || lockData == "{}" {
+		return metrics
+	}
 	var jlock struct {
-		Locks []struct {
-			Command string `json:"command"`
-			Pid     string `json:"pid"`
-			Type    string `json:"type"`
-			Size    string `json:"size"`
-			Mode    string `json:"mode"`
-			Path    string `json:"path"`
-			Blocker string `json:"blocker"`
-		}
+		Locks []LockInfo
 	}
 	if err := json.Unmarshal([]byte(lockData), &jlock); err != nil {
-		logger.Printf("Failed to parse lock JSON: %v", err)
+		if logger != nil {
+			logger.Errorf("Failed to parse lock JSON: %v", err)
+		}
 		return metrics
 	}
 	for _, j := range jlock.Locks {
-		if !strings.Contains(j.Command, "p4d") || j.Path == "" {
+		if !strings.Contains(string(j.Command), "p4d") {
 			continue
 		}
-		pid := j.Pid
-		if strings.Contains(j.Path, "clientEntity") {
-			if j.Mode == "READ" {
+		pid := string(j.Pid)
+		path := string(j.Path)
+		mode := string(j.Mode)
+		user, cmd := "", ""
+		if mp, ok := metrics.MonitorCommands[pid]; ok {
+			user = mp.User
+			cmd = mp.Cmd
+		}
+		if strings.Contains(path, "clientEntity") {
+			if mode == "READ" {
 				metrics.ClientEntityReadLocks++
-			} else if j.Mode == "WRITE" {
+			} else if mode == "WRITE" {
 				metrics.ClientEntityWriteLocks++
 			}
 		}
-		if strings.Contains(j.Path, "server.locks/meta") {
-			if j.Mode == "READ" {
+		if strings.Contains(path, "server.locks/meta") {
+			if mode == "READ" {
 				metrics.MetaReadLocks++
-			} else if j.Mode == "WRITE" {
+			} else if mode == "WRITE" {
 				metrics.MetaWriteLocks++
 			}
 		}
-		dbPath := dbFileInPath(j.Path)
+		dbPath := dbFileInPath(path)
 		if dbPath != "" {
-			if j.Mode == "READ" {
+			if mode == "READ" {
 				metrics.DbReadLocks++
 			}
-			if j.Mode == "WRITE" {
+			if mode == "WRITE" {
 				metrics.DbWriteLocks++
 			}
 		}
 		if j.Blocker != "" {
-			bpid := j.Blocker
+			bpid := string(j.Blocker)
 			buser, bcmd, bargs, belapsed := "unknown", "unknown", "unknown", "unknown"
+			table := dbPath
+			if table == "" {
+				table = "unknown"
+			}
 			if mp, ok := metrics.MonitorCommands[bpid]; ok {
 				buser = mp.User
 				bcmd = mp.Cmd
 				bargs = mp.Args
 				belapsed = mp.Elapsed
 			}
-			msg := fmt.Sprintf("pid %s, user %s, cmd %s, table %s, blocked by pid %s, user %s, cmd %s, args %s", pid, buser, bcmd, dbPath, bpid, buser, bcmd, bargs)
+			msg := fmt.Sprintf("pid %s, user %s, cmd %s, table %s, blocked by pid %s, user %s, cmd %s, args %s", pid, user, cmd, table, bpid, buser, bcmd, bargs)
 			if _, ok := metrics.BlockingCommands[bpid]; !ok {
-				metrics.BlockingCommands[bpid] = &Blocker{Pid: bpid, User: buser, Cmd: bcmd, Elapsed: belapsed, Table: dbPath}
+				metrics.BlockingCommands[bpid] = &Blocker{Pid: bpid, User: buser, Cmd: bcmd, Elapsed: belapsed, Table: table}
 			}
 			if !contains(metrics.BlockingCommands[bpid].BlockedPids, pid) {
 				metrics.BlockedCommands++
@@ -225,6 +635,186 @@ func contains(slice []string, s string) bool {
 	return false
 }
 
+// elapsedSeconds converts monitor elapsed time HH:MM:SS (hours may be > 24) to seconds, 0 if unknown
+func elapsedSeconds(elapsed string) int {
+	parts := strings.Split(elapsed, ":")
+	if len(parts) != 3 {
+		return 0
+	}
+	secs := 0
+	for _, p := range parts {
+		v, err := strconv.Atoi(p)
+		if err != nil {
+			return 0
+		}
+		secs = secs*60 + v
+	}
+	return secs
+}
+
+// sortPids sorts pids numerically (where possible) for consistent output
+func sortPids(pids []string) {
+	sort.Slice(pids, func(i, j int) bool {
+		a, errA := strconv.Atoi(pids[i])
+		b, errB := strconv.Atoi(pids[j])
+		if errA == nil && errB == nil {
+			return a < b
+		}
+		return pids[i] < pids[j]
+	})
+}
+
+// blockedLevels returns the pids transitively blocked by pid, by level (level 0 = directly blocked).
+// Each pid is only counted once (at its lowest level) so cycles are handled.
+func (metrics *MonitorMetrics) blockedLevels(pid string) [][]string {
+	levels := make([][]string, 0)
+	visited := map[string]bool{pid: true}
+	current := []string{pid}
+	for len(current) > 0 {
+		next := make([]string, 0)
+		for _, p := range current {
+			b, ok := metrics.BlockingCommands[p]
+			if !ok {
+				continue
+			}
+			for _, bp := range b.BlockedPids {
+				if !visited[bp] {
+					visited[bp] = true
+					next = append(next, bp)
+				}
+			}
+		}
+		if len(next) > 0 {
+			sortPids(next)
+			levels = append(levels, next)
+		}
+		current = next
+	}
+	return levels
+}
+
+// buildBlockingTree analyses the full blocker graph: for every blocker it calculates the counts of direct
+// and indirect blocked pids, chain depth and oldest wait, and it finds the root blockers (those which are not
+// blocked themselves). Cycles without a root are broken by choosing the longest running pid in the cycle as root.
+// Also formats the tree for logging.
+func buildBlockingTree(metrics *MonitorMetrics) {
+	blocked := make(map[string]bool)
+	pids := make([]string, 0, len(metrics.BlockingCommands))
+	for pid, b := range metrics.BlockingCommands {
+		pids = append(pids, pid)
+		for _, bp := range b.BlockedPids {
+			blocked[bp] = true
+		}
+	}
+	sortPids(pids)
+	for _, pid := range pids {
+		b := metrics.BlockingCommands[pid]
+		levels := metrics.blockedLevels(pid)
+		b.DirectBlocked, b.IndirectBlocked, b.Depth, b.OldestWait = 0, 0, len(levels), 0
+		for i, level := range levels {
+			if i == 0 {
+				b.DirectBlocked = len(level)
+			} else {
+				b.IndirectBlocked += len(level)
+			}
+			for _, bp := range level {
+				if mp, ok := metrics.MonitorCommands[bp]; ok {
+					if secs := elapsedSeconds(mp.Elapsed); secs > b.OldestWait {
+						b.OldestWait = secs
+					}
+				}
+			}
+		}
+	}
+
+	// Roots are blockers not blocked by anything - then any blockers not reachable from those are in cycles
+	reached := make(map[string]bool)
+	metrics.RootBlockers = make([]*Blocker, 0)
+	addRoot := func(b *Blocker) {
+		metrics.RootBlockers = append(metrics.RootBlockers, b)
+		reached[b.Pid] = true
+		for _, level := range metrics.blockedLevels(b.Pid) {
+			for _, bp := range level {
+				reached[bp] = true
+			}
+		}
+	}
+	for _, pid := range pids {
+		if !blocked[pid] {
+			addRoot(metrics.BlockingCommands[pid])
+		}
+	}
+	for {
+		var cycleRoot *Blocker
+		for _, pid := range pids {
+			if reached[pid] {
+				continue
+			}
+			b := metrics.BlockingCommands[pid]
+			if cycleRoot == nil || elapsedSeconds(b.Elapsed) > elapsedSeconds(cycleRoot.Elapsed) {
+				cycleRoot = b
+			}
+		}
+		if cycleRoot == nil {
+			break
+		}
+		cycleRoot.Cyclic = true
+		addRoot(cycleRoot)
+	}
+	sort.SliceStable(metrics.RootBlockers, func(i, j int) bool {
+		ti := metrics.RootBlockers[i].DirectBlocked + metrics.RootBlockers[i].IndirectBlocked
+		tj := metrics.RootBlockers[j].DirectBlocked + metrics.RootBlockers[j].IndirectBlocked
+		return ti > tj
+	})
+
+	metrics.TreeLines = make([]string, 0)
+	for _, root := range metrics.RootBlockers {
+		metrics.formatTree(root.Pid, 0, map[string]bool{})
+	}
+}
+
+// pidDescription returns a one line description of a pid for the blocking tree
+func (metrics *MonitorMetrics) pidDescription(pid string) string {
+	user, cmd, args, elapsed := "unknown", "unknown", "", "unknown"
+	if mp, ok := metrics.MonitorCommands[pid]; ok {
+		user, cmd, args, elapsed = mp.User, mp.Cmd, mp.Args, mp.Elapsed
+		if len(args) > 20 {
+			args = args[:20] + "..."
+		}
+	}
+	desc := fmt.Sprintf("%s %s, elapsed %s, %s %s", pid, user, elapsed, cmd, args)
+	if b, ok := metrics.BlockingCommands[pid]; ok {
+		cyclic := ""
+		if b.Cyclic {
+			cyclic = " (cyclic)"
+		}
+		desc = fmt.Sprintf("%s %s %s (blocks direct/indirect %d/%d: depth %d, oldest wait %ds)%s, elapsed %s, %s %s",
+			pid, user, b.Table, b.DirectBlocked, b.IndirectBlocked, b.Depth, b.OldestWait, cyclic, elapsed, cmd, args)
+	}
+	return strings.TrimSpace(desc)
+}
+
+// formatTree appends tree lines for pid and all pids it blocks, indented by depth
+func (metrics *MonitorMetrics) formatTree(pid string, depth int, visited map[string]bool) {
+	indent := strings.Repeat("    ", depth)
+	if depth > 0 {
+		indent = strings.Repeat("    ", depth-1) + "+-- "
+	}
+	if visited[pid] {
+		metrics.TreeLines = append(metrics.TreeLines, fmt.Sprintf("%s%s (cycle)", indent, pid))
+		return
+	}
+	visited[pid] = true
+	metrics.TreeLines = append(metrics.TreeLines, indent+metrics.pidDescription(pid))
+	if b, ok := metrics.BlockingCommands[pid]; ok {
+		blockedPids := append([]string{}, b.BlockedPids...)
+		sortPids(blockedPids)
+		for _, bp := range blockedPids {
+			metrics.formatTree(bp, depth+1, visited)
+		}
+	}
+}
+
 func dbFileInPath(path string) string {
 	parts := strings.Split(path, "/")
 	if len(parts) == 0 {
@@ -264,71 +854,287 @@ func parseMonitorData(monData string) map[string]*MonitorPid {
 	return pids
 }
 
-func formatLog(metrics *MonitorMetrics) []string {
-	prefix := time.Now().Format("2006-01-02 15:04:05")
+// formatLog formats messages and blocking tree for the log, prefixed with timestamp
+func formatLog(metrics *MonitorMetrics, timestamp string) []string {
+	prefix := timestamp
 	lines := []string{}
 	if len(metrics.Msgs) == 0 {
 		lines = append(lines, fmt.Sprintf("%s no blocked commands", prefix))
-	} else {
-		for _, m := range metrics.Msgs {
-			lines = append(lines, fmt.Sprintf("%s %s", prefix, m))
-		}
+		return lines
+	}
+	for _, m := range metrics.Msgs {
+		lines = append(lines, fmt.Sprintf("%s %s", prefix, m))
 	}
+	lines = append(lines, fmt.Sprintf("%s blocking tree (pid user table (counts), elapsed, cmd args):", prefix))
+	for _, t := range metrics.TreeLines {
+		lines = append(lines, fmt.Sprintf("%s %s", prefix, t))
+	}
+	lines = append(lines, fmt.Sprintf("%s blocking totals: %d", prefix, metrics.BlockedCommands))
 	return lines
 }
 
-func writeLog(lines []string, logFile string) {
+func writeLog(lines []string, logFile string) error {
 	f, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		return
+		return err
 	}
-	defer f.Close()
 	for _, line := range lines {
-		f.WriteString(line + "\n")
+		if _, err := f.WriteString(line + "\n"); err != nil {
+			f.Close()
+			return err
+		}
 	}
+	return f.Close()
 }
 
-func formatMetrics(metrics *MonitorMetrics) []string {
+// formatLabels formats label name/value pairs, ignoring any with empty values
+func formatLabels(labels ...string) string {
+	vals := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		if labels[i+1] != "" {
+			vals = append(vals, fmt.Sprintf("%s=\"%s\"", labels[i], labels[i+1]))
+		}
+	}
+	if len(vals) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(vals, ",") + "}"
+}
+
+// rootKey identifies root blockers for metrics aggregation
+type rootKey struct {
+	cmd   string
+	table string
+}
+
+type rootStats struct {
+	roots, direct, indirect, depth, oldestWait int
+}
+
+func formatMetrics(metrics *MonitorMetrics, sdpInstance string) []string {
 	lines := []string{}
-	name := "p4_locks_db_read"
-	lines = append(lines, fmt.Sprintf("# HELP %s Database read locks", name))
-	lines = append(lines, fmt.Sprintf("# TYPE %s gauge", name))
-	lines = append(lines, fmt.Sprintf("%s %d", name, metrics.DbReadLocks))
-	name = "p4_locks_db_write"
-	lines = append(lines, fmt.Sprintf("# HELP %s Database write locks", name))
-	lines = append(lines, fmt.Sprintf("# TYPE %s gauge", name))
-	lines = append(lines, fmt.Sprintf("%s %d", name, metrics.DbWriteLocks))
-	name = "p4_locks_cliententity_read"
-	lines = append(lines, fmt.Sprintf("# HELP %s clientEntity read locks", name))
-	lines = append(lines, fmt.Sprintf("# TYPE %s gauge", name))
-	lines = append(lines, fmt.Sprintf("%s %d", name, metrics.ClientEntityReadLocks))
-	name = "p4_locks_cliententity_write"
-	lines = append(lines, fmt.Sprintf("# HELP %s clientEntity write locks", name))
-	lines = append(lines, fmt.Sprintf("# TYPE %s gauge", name))
-	lines = append(lines, fmt.Sprintf("%s %d", name, metrics.ClientEntityWriteLocks))
-	name = "p4_locks_meta_read"
-	lines = append(lines, fmt.Sprintf("# HELP %s meta db read locks", name))
-	lines = append(lines, fmt.Sprintf("# TYPE %s gauge", name))
-	lines = append(lines, fmt.Sprintf("%s %d", name, metrics.MetaReadLocks))
-	name = "p4_locks_meta_write"
-	lines = append(lines, fmt.Sprintf("# HELP %s meta db write locks", name))
-	lines = append(lines, fmt.Sprintf("# TYPE %s gauge", name))
-	lines = append(lines, fmt.Sprintf("%s %d", name, metrics.MetaWriteLocks))
-	name = "p4_locks_cmds_blocked"
-	lines = append(lines, fmt.Sprintf("# HELP %s cmds blocked by locks", name))
-	lines = append(lines, fmt.Sprintf("# TYPE %s gauge", name))
-	lines = append(lines, fmt.Sprintf("%s %d", name, metrics.BlockedCommands))
+	labels := formatLabels("sdpinst", sdpInstance)
+	simple := []struct {
+		name  string
+		help  string
+		value int
+	}{
+		{"p4_locks_db_read", "Database read locks", metrics.DbReadLocks},
+		{"p4_locks_db_write", "Database write locks", metrics.DbWriteLocks},
+		{"p4_locks_cliententity_read", "clientEntity read locks", metrics.ClientEntityReadLocks},
+		{"p4_locks_cliententity_write", "clientEntity write locks", metrics.ClientEntityWriteLocks},
+		{"p4_locks_meta_read", "meta db read locks", metrics.MetaReadLocks},
+		{"p4_locks_meta_write", "meta db write locks", metrics.MetaWriteLocks},
+		{"p4_locks_cmds_blocked", "cmds blocked by locks", metrics.BlockedCommands},
+	}
+	for _, m := range simple {
+		lines = append(lines, fmt.Sprintf("# HELP %s %s", m.name, m.help))
+		lines = append(lines, fmt.Sprintf("# TYPE %s gauge", m.name))
+		lines = append(lines, fmt.Sprintf("%s%s %d", m.name, labels, m.value))
+	}
+
+	// Root blocker metrics aggregated by root cmd and table
+	stats := make(map[rootKey]*rootStats)
+	keys := make([]rootKey, 0)
+	for _, b := range metrics.RootBlockers {
+		k := rootKey{cmd: b.Cmd, table: b.Table}
+		s, ok := stats[k]
+		if !ok {
+			s = &rootStats{}
+			stats[k] = s
+			keys = append(keys, k)
+		}
+		s.roots++
+		s.direct += b.DirectBlocked
+		s.indirect += b.IndirectBlocked
+		s.depth = max(s.depth, b.Depth)
+		s.oldestWait = max(s.oldestWait, b.OldestWait)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].cmd != keys[j].cmd {
+			return keys[i].cmd < keys[j].cmd
+		}
+		return keys[i].table < keys[j].table
+	})
+	rootMetrics := []struct {
+		name  string
+		help  string
+		value func(s *rootStats) int
+	}{
+		{"p4_locks_root_blockers", "Count of root blocking cmds (not blocked themselves) by cmd and table", func(s *rootStats) int { return s.roots }},
+		{"p4_locks_root_blocked_direct", "Count of cmds directly blocked by root blockers by cmd and table", func(s *rootStats) int { return s.direct }},
+		{"p4_locks_root_blocked_indirect", "Count of cmds indirectly blocked by root blockers by cmd and table", func(s *rootStats) int { return s.indirect }},
+		{"p4_locks_root_chain_depth", "Max depth of blocking chains from root blockers by cmd and table", func(s *rootStats) int { return s.depth }},
+		{"p4_locks_root_oldest_wait", "Max elapsed seconds of cmds blocked by root blockers by cmd and table", func(s *rootStats) int { return s.oldestWait }},
+	}
+	for _, m := range rootMetrics {
+		if len(keys) == 0 {
+			break
+		}
+		lines = append(lines, fmt.Sprintf("# HELP %s %s", m.name, m.help))
+		lines = append(lines, fmt.Sprintf("# TYPE %s gauge", m.name))
+		for _, k := range keys {
+			lines = append(lines, fmt.Sprintf("%s%s %d", m.name,
+				formatLabels("sdpinst", sdpInstance, "cmd", k.cmd, "table", k.table), m.value(stats[k])))
+		}
+	}
 	return lines
 }
 
-func writeMetrics(lines []string, metricsRoot string) {
-	fname := filepath.Join(metricsRoot, metricsFile)
+// writeMetrics writes metrics atomically (via a temp file) so node_exporter never sees a partial file
+func writeMetrics(lines []string, fname string) error {
 	tmpfname := fname + ".tmp"
-	_ = ioutil.WriteFile(tmpfname, []byte(strings.Join(lines, "\n")+"\n"), 0644)
-	_ = os.Rename(tmpfname, fname)
+	if err := os.WriteFile(tmpfname, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpfname, fname)
+}
+
+// Snapshot is a captured set of lslocks and monitor output - written as one JSON line per snapshot
+// by --capture and replayed by --test-file
+type Snapshot struct {
+	Timestamp string `json:"timestamp"`
+	Lslocks   string `json:"lslocks"` // JSON (or text for old versions of lslocks)
+	Monitor   string `json:"monitor"` // p4 monitor show -al output (format as per runMonitorShow)
+}
+
+// writeCapture appends snapshot to captureFile
+func writeCapture(snap *Snapshot, captureFile string) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(captureFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// readSnapshots reads a capture file (JSON lines as written by writeCapture)
+// or a section of log file from monitor_metrics.py (which logged the output of the commands it ran)
+func readSnapshots(r io.Reader) ([]*Snapshot, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(strings.TrimSpace(string(data)), `{"timestamp"`) {
+		return readCaptureSnapshots(data)
+	}
+	return readPythonLogSnapshots(data), nil
+}
+
+func readCaptureSnapshots(data []byte) ([]*Snapshot, error) {
+	snaps := make([]*Snapshot, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 1024*1024), 100*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		snap := &Snapshot{}
+		if err := json.Unmarshal([]byte(line), snap); err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		snaps = append(snaps, snap)
+	}
+	return snaps, scanner.Err()
+}
+
+// readPythonLogSnapshots parses DEBUG log output of monitor_metrics.py, e.g.
+// DEBUG 2024-04-03 23:57:02,118 monitor_metrics.py 137: Running: sudo lslocks -o +BLOCKER -J
+// DEBUG 2024-04-03 23:57:02,211 monitor_metrics.py 144: Output:
+// {
+// "locks": [
+// {"command":"snapd", "pid":1249, "type":"FLOCK", "size":null, "mode":"WRITE", "m":false, "start":0, "end":0, "path":"/var/lib/snapd/state.lock", "blocker":null},
+// }
+//
+// DEBUG 2024-04-03 23:57:02,211 monitor_metrics.py 137: Running: /p4/1/bin/p4_1 -u p4sdp -p ssl:1667 -F "%id% %runstate% %user% %elapsed% %function% %args%" monitor show -al
+// DEBUG 2024-04-03 23:57:02,313 monitor_metrics.py 144: Output:
+// 2030 B svc_master-1666 05:24:42 ldapsync -g -i 1800
+// 162476 I svc_p4d_fs_brk 00:00:01 IDLE none
+func readPythonLogSnapshots(data []byte) []*Snapshot {
+	snaps := make([]*Snapshot, 0)
+	lockLines := []string{}
+	monLines := []string{}
+	timestamp := ""
+	isJSON := true
+	stage := 0 // 1 = processing locks, 2 = waiting for monitor data, 3 = processing monitor data
+	addSnap := func() {
+		snaps = append(snaps, &Snapshot{Timestamp: timestamp,
+			Lslocks: strings.Join(lockLines, "\n"), Monitor: strings.Join(monLines, "\n")})
+		lockLines = []string{}
+		monLines = []string{}
+		stage = 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		switch stage {
+		case 0:
+			if strings.HasPrefix(line, "{") {
+				stage = 1
+				isJSON = true
+				lockLines = append(lockLines, line)
+			} else if strings.HasPrefix(line, "COMMAND") {
+				stage = 1
+				isJSON = false
+				lockLines = append(lockLines, line)
+			}
+		case 1:
+			if !isJSON && line == "" {
+				stage = 2
+				continue
+			}
+			lockLines = append(lockLines, line)
+			if isJSON && line == "}" {
+				stage = 2
+			}
+		case 2:
+			if strings.HasSuffix(line, "Output:") {
+				stage = 3
+				if len(line) >= 25 {
+					timestamp = line[6:25]
+				}
+			}
+		case 3:
+			if line == "" {
+				addSnap()
+			} else {
+				monLines = append(monLines, line)
+			}
+		}
+	}
+	if len(lockLines) > 0 || len(monLines) > 0 {
+		addSnap()
+	}
+	return snaps
 }
 
-// parseTestFile: stub for test file parsing
-func parseTestFile(testFile string, logger *log.Logger, metricsRoot string) {
-	logger.Printf("Test file parsing not implemented in Go port yet.")
+// parseTestFile replays captured snapshots, writing log and metrics as for a live run - to files from replayOutput
+func parseTestFile(testFile string, logger *logrus.Logger, logFile, metricsFilename, sdpInstance string) error {
+	f, err := os.Open(testFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	snaps, err := readSnapshots(f)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Processing %d snapshots from %s", len(snaps), testFile)
+	for _, snap := range snaps {
+		_, logLines, metricLines := processSnapshot(snap, sdpInstance, logger)
+		if err := writeLog(logLines, logFile); err != nil {
+			return err
+		}
+		if err := writeMetrics(metricLines, metricsFilename); err != nil {
+			return err
+		}
+	}
+	return nil
 }
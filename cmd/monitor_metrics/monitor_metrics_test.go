@@ -2,8 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/perforce/p4prometheus/cmd/monitor_metrics/config"
+	"github.com/sirupsen/logrus"
 )
 
 func TestFindLocks(t *testing.T) {
@@ -79,3 +86,380 @@ p4d               105  FLOCK  16K WRITE 0     0   0 /path/db.configh`
 }
 
 // Additional tests for blockers, metrics formatting, and edge cases can be added similarly.
+
+func TestFindBlockersChain(t *testing.T) {
+	// Numeric pids/blockers as output by newer versions of lslocks
+	lockdata := `{
+   "locks": [
+      {"command":"p4d_1", "pid":910, "mode":"WRITE*", "path":"/hxmetadata/p4/1/db1/db.sendq", "blocker":920},
+      {"command":"p4d_1", "pid":920, "mode":"WRITE", "path":"/hxmetadata/p4/1/db1/db.sendq", "blocker":921},
+      {"command":"p4d_1", "pid":921, "mode":"READ", "path":"/hxmetadata/p4/1/db1/server.locks/meta/db", "blocker":900},
+      {"command":"p4d_1", "pid":900, "mode":"READ", "path":"/hxmetadata/p4/1/db1/server.locks/meta/db", "blocker":null}
+   ]
+}`
+	mondata := `925 R jteam      00:00:09 transmit -b8
+922 R ecagent    00:00:06 transmit -t92061 -b8 -s524288
+920 R jteam      00:00:06 sync ...
+921 R jteam      00:00:04 sync ...
+900 R jteam      00:00:04 submit -c 1234
+910 R jteam      00:00:02 transmit -b8`
+	metrics := findLocks(lockdata, mondata, nil)
+	expectedMsgs := []string{
+		"pid 910, user jteam, cmd transmit, table db.sendq, blocked by pid 920, user jteam, cmd sync, args ...",
+		"pid 920, user jteam, cmd sync, table db.sendq, blocked by pid 921, user jteam, cmd sync, args ...",
+		"pid 921, user jteam, cmd sync, table metaLock, blocked by pid 900, user jteam, cmd submit, args -c 1234",
+	}
+	if !reflect.DeepEqual(expectedMsgs, metrics.Msgs) {
+		t.Errorf("Expected %v, got %v", expectedMsgs, metrics.Msgs)
+	}
+	buildBlockingTree(metrics)
+	if len(metrics.RootBlockers) != 1 {
+		t.Fatalf("Expected 1 root blocker, got %d", len(metrics.RootBlockers))
+	}
+	root := metrics.RootBlockers[0]
+	if root.Pid != "900" || root.DirectBlocked != 1 || root.IndirectBlocked != 2 || root.Depth != 3 || root.OldestWait != 6 || root.Cyclic {
+		t.Errorf("Unexpected root blocker %+v", root)
+	}
+	if len(metrics.TreeLines) != 4 {
+		t.Fatalf("Expected 4 tree lines, got %v", metrics.TreeLines)
+	}
+	expectedTree := []string{
+		"900 jteam metaLock (blocks direct/indirect 1/2: depth 3, oldest wait 6s), elapsed 00:00:04, submit -c 1234",
+		"+-- 921 jteam db.sendq (blocks direct/indirect 1/1: depth 2, oldest wait 6s), elapsed 00:00:04, sync ...",
+		"    +-- 920 jteam db.sendq (blocks direct/indirect 1/0: depth 1, oldest wait 2s), elapsed 00:00:06, sync ...",
+		"        +-- 910 jteam, elapsed 00:00:02, transmit -b8",
+	}
+	if !reflect.DeepEqual(expectedTree, metrics.TreeLines) {
+		t.Errorf("Expected %v, got %v", expectedTree, metrics.TreeLines)
+	}
+
+	lines := formatMetrics(metrics, "1")
+	for _, exp := range []string{
+		`p4_locks_cmds_blocked{sdpinst="1"} 3`,
+		`p4_locks_root_blockers{sdpinst="1",cmd="submit",table="metaLock"} 1`,
+		`p4_locks_root_blocked_direct{sdpinst="1",cmd="submit",table="metaLock"} 1`,
+		`p4_locks_root_blocked_indirect{sdpinst="1",cmd="submit",table="metaLock"} 2`,
+		`p4_locks_root_chain_depth{sdpinst="1",cmd="submit",table="metaLock"} 3`,
+		`p4_locks_root_oldest_wait{sdpinst="1",cmd="submit",table="metaLock"} 6`,
+	} {
+		if !contains(lines, exp) {
+			t.Errorf("Expected metric line %s in %v", exp, lines)
+		}
+	}
+}
+
+func TestFindBlockersSeparateRoots(t *testing.T) {
+	lockdata := `{
+   "locks": [
+      {"command":"p4d_1", "pid":910, "mode":"WRITE*", "path":"/hxmetadata/p4/1/db1/db.sendq", "blocker":920},
+      {"command":"p4d_1", "pid":920, "mode":"WRITE", "path":"/hxmetadata/p4/1/db1/db.sendq", "blocker":null},
+      {"command":"p4d_1", "pid":921, "mode":"READ", "path":"/hxmetadata/p4/1/db1/server.locks/meta/db", "blocker":900},
+      {"command":"p4d_1", "pid":922, "mode":"READ", "path":"/hxmetadata/p4/1/db1/server.locks/meta/db", "blocker":900},
+      {"command":"p4d_1", "pid":900, "mode":"READ", "path":"/hxmetadata/p4/1/db1/server.locks/meta/db", "blocker":null}
+   ]
+}`
+	mondata := `920 R jteam      00:00:06 sync ...
+921 R jteam      00:00:04 sync ...
+922 R jteam      00:00:03 sync ...
+900 R jteam      00:00:04 sync ...
+910 R jteam      00:00:02 transmit -b8`
+	metrics := findLocks(lockdata, mondata, nil)
+	buildBlockingTree(metrics)
+	if len(metrics.RootBlockers) != 2 {
+		t.Fatalf("Expected 2 root blockers, got %d", len(metrics.RootBlockers))
+	}
+	// Ordered by total blocked
+	if metrics.RootBlockers[0].Pid != "900" || metrics.RootBlockers[0].DirectBlocked != 2 || metrics.RootBlockers[0].Depth != 1 {
+		t.Errorf("Unexpected root blocker %+v", metrics.RootBlockers[0])
+	}
+	if metrics.RootBlockers[1].Pid != "920" || metrics.RootBlockers[1].DirectBlocked != 1 || metrics.RootBlockers[1].IndirectBlocked != 0 {
+		t.Errorf("Unexpected root blocker %+v", metrics.RootBlockers[1])
+	}
+	lines := formatMetrics(metrics, "")
+	for _, exp := range []string{
+		`p4_locks_root_blockers{cmd="sync",table="metaLock"} 1`,
+		`p4_locks_root_blockers{cmd="sync",table="db.sendq"} 1`,
+		`p4_locks_root_oldest_wait{cmd="sync",table="metaLock"} 4`,
+	} {
+		if !contains(lines, exp) {
+			t.Errorf("Expected metric line %s in %v", exp, lines)
+		}
+	}
+}
+
+func TestRecursiveBlockers(t *testing.T) {
+	// A is blocked by B is blocked by A!
+	lockdata := `{
+   "locks": [
+      {"command":"p4d_1", "pid":910, "mode":"WRITE*", "path":"/hxmetadata/p4/1/db1/db.sendq", "blocker":920},
+      {"command":"p4d_1", "pid":900, "mode":"WRITE*", "path":"/hxmetadata/p4/1/db1/db.sendq", "blocker":920},
+      {"command":"p4d_1", "pid":920, "mode":"WRITE", "path":"/hxmetadata/p4/1/db1/db.sendq", "blocker":910}
+   ]
+}`
+	mondata := `925 R jteam      00:00:09 transmit -b8
+920 R jteam      00:00:06 sync ...
+900 R jteam      00:00:04 sync ...
+910 R jteam      00:00:02 transmit -b8`
+	metrics := findLocks(lockdata, mondata, nil)
+	if len(metrics.Msgs) != 3 {
+		t.Errorf("Expected 3 msgs, got %d", len(metrics.Msgs))
+	}
+	buildBlockingTree(metrics)
+	if len(metrics.RootBlockers) != 1 {
+		t.Fatalf("Expected 1 root blocker, got %d", len(metrics.RootBlockers))
+	}
+	// Longest running pid in the cycle is chosen as root, and pids are only counted once
+	root := metrics.RootBlockers[0]
+	if root.Pid != "920" || !root.Cyclic || root.DirectBlocked != 2 || root.IndirectBlocked != 0 || root.Depth != 1 {
+		t.Errorf("Unexpected root blocker %+v", root)
+	}
+	if len(metrics.TreeLines) != 4 || metrics.TreeLines[3] != "    +-- 920 (cycle)" {
+		t.Errorf("Unexpected tree %v", metrics.TreeLines)
+	}
+}
+
+func TestFindBlockersNoPath(t *testing.T) {
+	lockdata := `{
+   "locks": [
+      {"command": "crond", "pid": "1313", "type": "FLOCK", "size": "5B", "mode": "WRITE", "m": "0", "start": "0", "end": "0", "path": "/run/crond.pid", "blocker": null},
+      {"command": "p4d_1_bin", "pid": "6142", "type": "FLOCK", "size": null, "mode": "WRITE*", "m": "0", "start": "0", "end": "0", "path": null, "blocker": "3727"},
+      {"command": "p4d_1_bin", "pid": "6144", "type": "FLOCK", "size": null, "mode": "WRITE*", "m": "0", "start": "0", "end": "0", "path": null, "blocker": "3727"},
+      {"command": "p4d_1_bin", "pid": "3727", "type": "FLOCK", "size": null, "mode": "WRITE", "m": "0", "start": "0", "end": "0", "path": null, "blocker": null},
+      {"command": "lsmd", "pid": "913", "type": "FLOCK", "size": "0B", "mode": "WRITE", "m": "0", "start": "0", "end": "0", "path": "/run/lsm/ipc/.lsmd-ipc-lock", "blocker": null}
+   ]
+}`
+	mondata := ` 3727 R fred 00:11:09 reconcile -f -m -c default a:\Project_files\FE7X5.uasset
+ 4620 I swarm      00:09:00 IDLE none
+ 6142 R fred 00:04:22 reconcile -f -m -c default a:\Project_files\FE7X6.uasset
+ 6144 R fred 00:04:24 reconcile -f -m -c default a:\Project_files\0018T.uasset
+ 7535 R perforce   00:00:00 monitor show -al`
+	metrics := findLocks(lockdata, mondata, nil)
+	// Locks without a path are not counted as db locks - the table is only "unknown" in blocker messages
+	if metrics.DbReadLocks != 0 || metrics.DbWriteLocks != 0 || metrics.BlockedCommands != 2 {
+		t.Errorf("Unexpected lock counts %+v", metrics)
+	}
+	expectedMsgs := []string{
+		`pid 6142, user fred, cmd reconcile, table unknown, blocked by pid 3727, user fred, cmd reconcile, args -f -m -c default a:\Project_files\FE7X5.uasset`,
+		`pid 6144, user fred, cmd reconcile, table unknown, blocked by pid 3727, user fred, cmd reconcile, args -f -m -c default a:\Project_files\FE7X5.uasset`,
+	}
+	if !reflect.DeepEqual(expectedMsgs, metrics.Msgs) {
+		t.Errorf("Expected %v, got %v", expectedMsgs, metrics.Msgs)
+	}
+	buildBlockingTree(metrics)
+	if len(metrics.RootBlockers) != 1 || metrics.RootBlockers[0].OldestWait != 264 {
+		t.Errorf("Unexpected root blockers %+v", metrics.RootBlockers)
+	}
+}
+
+func TestCaptureReplay(t *testing.T) {
+	d := t.TempDir()
+	captureFile := filepath.Join(d, "capture.jsonl")
+	snaps := []*Snapshot{
+		{Timestamp: "2024-04-03 23:57:02",
+			Lslocks: `{"locks": [
+      {"command":"p4d_1", "pid":910, "mode":"WRITE*", "path":"/p4/1/root/db.sendq", "blocker":920},
+      {"command":"p4d_1", "pid":920, "mode":"WRITE", "path":"/p4/1/root/db.sendq", "blocker":null}]}`,
+			Monitor: "920 R jteam 00:00:06 sync ...\n910 R jteam 00:00:02 transmit -b8"},
+		{Timestamp: "2024-04-03 23:58:02",
+			Lslocks: `COMMAND           PID   TYPE SIZE MODE  M START END PATH                       BLOCKER
+p4d               107  FLOCK  16K READ* 0     0   0 /p4/1/root/db.config            105
+p4d               105  FLOCK  16K WRITE 0     0   0 /p4/1/root/db.config`,
+			Monitor: "105 R fred 00:01:00 admin checkpoint\n107 R jteam 00:00:30 counters"},
+	}
+	for _, snap := range snaps {
+		if err := writeCapture(snap, captureFile); err != nil {
+			t.Fatalf("writeCapture: %v", err)
+		}
+	}
+
+	f, err := os.Open(captureFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := readSnapshots(f)
+	if err != nil {
+		t.Fatalf("readSnapshots: %v", err)
+	}
+	if !reflect.DeepEqual(snaps, got) {
+		t.Errorf("Expected %v, got %v", snaps, got)
+	}
+
+	metrics, logLines, _ := processSnapshot(got[1], "", nil)
+	if metrics.BlockedCommands != 1 || metrics.DbWriteLocks != 1 {
+		t.Errorf("Unexpected metrics %+v", metrics)
+	}
+	if logLines[0] != "2024-04-03 23:58:02 pid 107, user jteam, cmd counters, table db.config, blocked by pid 105, user fred, cmd admin, args checkpoint" {
+		t.Errorf("Unexpected log line %s", logLines[0])
+	}
+
+	logFile := filepath.Join(d, "monitor_metrics.log")
+	logger := logrus.New()
+	logger.Out = io.Discard
+	if err := parseTestFile(captureFile, logger, logFile, filepath.Join(d, metricsFile), "1"); err != nil {
+		t.Fatalf("parseTestFile: %v", err)
+	}
+	logData, _ := os.ReadFile(logFile)
+	if !strings.Contains(string(logData), "2024-04-03 23:57:02 pid 910, user jteam, cmd transmit, table db.sendq, blocked by pid 920") {
+		t.Errorf("Unexpected log %s", logData)
+	}
+	// Metrics are from the last snapshot
+	promData, _ := os.ReadFile(filepath.Join(d, metricsFile))
+	if !strings.Contains(string(promData), `p4_locks_root_blockers{sdpinst="1",cmd="admin",table="db.config"} 1`) {
+		t.Errorf("Unexpected metrics %s", promData)
+	}
+}
+
+func TestReadPythonLogSnapshots(t *testing.T) {
+	logdata := `DEBUG 2024-04-03 23:57:02,118 monitor_metrics.py 137: Running: sudo lslocks -o +BLOCKER -J
+DEBUG 2024-04-03 23:57:02,211 monitor_metrics.py 144: Output:
+{
+   "locks": [
+      {"command":"p4d_1", "pid":910, "mode":"WRITE*", "path":"/p4/1/root/db.sendq", "blocker":920},
+      {"command":"p4d_1", "pid":920, "mode":"WRITE", "path":"/p4/1/root/db.sendq", "blocker":null}
+   ]
+}
+
+DEBUG 2024-04-03 23:57:02,211 monitor_metrics.py 137: Running: /p4/1/bin/p4_1 -u p4sdp -p ssl:1667 -F "%id% %runstate% %user% %elapsed% %function% %args%" monitor show -al
+DEBUG 2024-04-03 23:57:02,313 monitor_metrics.py 144: Output:
+920 R jteam 00:00:06 sync ...
+910 R jteam 00:00:02 transmit -b8
+
+DEBUG 2024-04-03 23:58:02,118 monitor_metrics.py 137: Running: sudo lslocks -o +BLOCKER
+DEBUG 2024-04-03 23:58:02,211 monitor_metrics.py 144: Output:
+COMMAND           PID   TYPE SIZE MODE  M START END PATH                       BLOCKER
+p4d               107  FLOCK  16K READ* 0     0   0 /p4/1/root/db.config            105
+p4d               105  FLOCK  16K WRITE 0     0   0 /p4/1/root/db.config
+
+DEBUG 2024-04-03 23:58:02,313 monitor_metrics.py 144: Output:
+105 R fred 00:01:00 admin checkpoint
+107 R jteam 00:00:30 counters
+`
+	snaps, err := readSnapshots(strings.NewReader(logdata))
+	if err != nil {
+		t.Fatalf("readSnapshots: %v", err)
+	}
+	if len(snaps) != 2 {
+		t.Fatalf("Expected 2 snapshots, got %d", len(snaps))
+	}
+	if snaps[0].Timestamp != "2024-04-03 23:57:02" || snaps[1].Timestamp != "2024-04-03 23:58:02" {
+		t.Errorf("Unexpected timestamps %s, %s", snaps[0].Timestamp, snaps[1].Timestamp)
+	}
+	for i, snap := range snaps {
+		metrics, _, _ := processSnapshot(snap, "", nil)
+		if metrics.BlockedCommands != 1 || len(metrics.RootBlockers) != 1 {
+			t.Errorf("Snapshot %d: unexpected metrics %+v", i, metrics)
+		}
+	}
+}
+
+func TestMetricsFilename(t *testing.T) {
+	d := t.TempDir()
+	if err := os.WriteFile(filepath.Join(d, "server.id"), []byte("master.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	logger := logrus.New()
+	logger.Out = io.Discard
+	tests := []struct {
+		sdpInstance string
+		env         map[string]string
+		expected    string
+		logFile     string
+	}{
+		{"", map[string]string{}, "/p4/metrics/locks.prom", filepath.Join(logDirDefault, "monitor_metrics.log")},
+		{"1", map[string]string{"LOGS": "/p4/1/logs"}, "/p4/metrics/locks-1.prom", "/p4/1/logs/monitor_metrics.log"},
+		{"1", map[string]string{"P4ROOT": d}, "/p4/metrics/locks-1-master.1.prom", filepath.Join(logDirDefault, "monitor_metrics.log")},
+		{"", map[string]string{"P4ROOT": d}, "/p4/metrics/locks-master.1.prom", filepath.Join(logDirDefault, "monitor_metrics.log")},
+	}
+	for _, tc := range tests {
+		cfg, err := config.LoadConfigString([]byte("sdp_instance: " + tc.sdpInstance))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ml := newMonitorLocks(cfg, tc.env, logger)
+		if got := ml.metricsFilename(); got != tc.expected {
+			t.Errorf("Expected %s, got %s", tc.expected, got)
+		}
+		if ml.logFile != tc.logFile {
+			t.Errorf("Expected %s, got %s", tc.logFile, ml.logFile)
+		}
+	}
+}
+
+func TestP4Params(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = io.Discard
+	env := map[string]string{"P4BIN": "/p4/1/bin/p4_1", "P4PORT": "ssl:1666", "P4USER": "perforce"}
+	cfg, _ := config.LoadConfigString([]byte("sdp_instance: 1\np4port: 1999"))
+	p4bin, p4port, p4user, _ := newMonitorLocks(cfg, env, logger).p4Params()
+	if p4bin != "/p4/1/bin/p4_1" || p4port != "ssl:1666" || p4user != "perforce" {
+		t.Errorf("Unexpected SDP params %s %s %s", p4bin, p4port, p4user)
+	}
+	cfg, _ = config.LoadConfigString([]byte("p4port: 1999\np4config: /p4/.p4config"))
+	p4bin, p4port, p4user, p4config := newMonitorLocks(cfg, map[string]string{"P4USER": "fred"}, logger).p4Params()
+	if p4bin != "p4" || p4port != "1999" || p4user != "fred" || p4config != "/p4/.p4config" {
+		t.Errorf("Unexpected non-SDP params %s %s %s %s", p4bin, p4port, p4user, p4config)
+	}
+}
+
+func TestLegacyArgs(t *testing.T) {
+	got := legacyArgs([]string{"-sdp-instance", "1", "-metrics-root=/p4/metrics", "-test-file", "f.log", "-c", "mm.yaml", "--debug", "-d"})
+	expected := []string{"--sdp-instance", "1", "--metrics-root=/p4/metrics", "--test-file", "f.log", "-c", "mm.yaml", "--debug", "-d"}
+	if strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestRemoveLegacyMetricsFile(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = io.Discard
+	d := t.TempDir()
+	legacy := filepath.Join(d, "locks.prom")
+	if err := os.WriteFile(legacy, []byte("p4_locks_db_read 0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Not removed if it is still the file being written
+	cfg, _ := config.LoadConfigString([]byte("metrics_root: " + d))
+	newMonitorLocks(cfg, map[string]string{}, logger).removeLegacyMetricsFile()
+	if _, err := os.Stat(legacy); err != nil {
+		t.Fatalf("Expected %s to exist: %v", legacy, err)
+	}
+	cfg, _ = config.LoadConfigString([]byte("metrics_root: " + d + "\nsdp_instance: 1"))
+	newMonitorLocks(cfg, map[string]string{}, logger).removeLegacyMetricsFile()
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Fatalf("Expected %s to be removed: %v", legacy, err)
+	}
+}
+
+func TestReplayOutput(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = io.Discard
+	d := t.TempDir()
+	cfg, _ := config.LoadConfigString([]byte("metrics_root: " + d + "\nlog_file: " + filepath.Join(d, "monitor_metrics.log")))
+	ml := newMonitorLocks(cfg, map[string]string{}, logger)
+
+	// Default is a new temporary directory, not the live files
+	logFile, metricsFilename, err := ml.replayOutput("")
+	if err != nil {
+		t.Fatalf("replayOutput: %v", err)
+	}
+	defer os.RemoveAll(filepath.Dir(logFile))
+	if filepath.Dir(logFile) == d || filepath.Base(metricsFilename) != "locks.prom" || filepath.Dir(metricsFilename) != filepath.Dir(logFile) {
+		t.Errorf("Unexpected replay output %s %s", logFile, metricsFilename)
+	}
+	out := filepath.Join(d, "replay")
+	if logFile, _, err = ml.replayOutput(out); err != nil || logFile != filepath.Join(out, "monitor_metrics.log") {
+		t.Errorf("Unexpected replay output %s: %v", logFile, err)
+	}
+	// Live directory is refused
+	if _, _, err = ml.replayOutput(d); err == nil {
+		t.Errorf("Expected error replaying to live metrics_root")
+	}
+	// Write errors are returned
+	if err := writeMetrics([]string{"p4_locks_db_read 0"}, filepath.Join(d, "missing", "locks.prom")); err == nil {
+		t.Errorf("Expected error writing metrics")
+	}
+	if err := writeLog([]string{"line"}, filepath.Join(d, "missing", "monitor_metrics.log")); err == nil {
+		t.Errorf("Expected error writing log")
+	}
+}
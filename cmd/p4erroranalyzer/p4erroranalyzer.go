@@ -16,6 +16,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/perforce/p4prometheus/errlookup"
 )
 
 type record struct {
@@ -88,7 +90,6 @@ type ollamaGenerateResponse struct {
 const analyzerVersion = "0.1.0"
 
 //go:generate python3 generate_errschema_go.py --in logschema.txt --out error_schema_generated.go
-//go:generate python3 generate_error_lookup_go.py --errors all_errors.txt --errornum errornum.h --out error_lookup_generated.go
 
 func main() {
 	var (
@@ -370,7 +371,7 @@ func parseRecord(row []string) (record, error) {
 			errorID = fErrorID
 		}
 	}
-	errorName = lookupErrorShortName(subsystem, errorID)
+	errorName = errlookup.ShortNameFromStrings(subsystem, errorID)
 
 	user := fieldFromSchema(row, schema, "f_user")
 	command := fieldFromSchema(row, schema, "f_func")
@@ -543,18 +544,6 @@ func errorUserCommandKey(r record) string {
 	return fmt.Sprintf("subsys=%s|err=%s|user=%s|cmd=%s", r.Subsystem, errPart, userPart, cmdPart)
 }
 
-func lookupErrorShortName(subsysStr, subcodeStr string) string {
-	subsys, err := strconv.Atoi(strings.TrimSpace(subsysStr))
-	if err != nil {
-		return ""
-	}
-	subcode, err := strconv.Atoi(strings.TrimSpace(subcodeStr))
-	if err != nil {
-		return ""
-	}
-	return generatedErrorShortBySubsysSubcode[[2]int{subsys, subcode}]
-}
-
 func isSevere(r record) bool {
 	if strings.EqualFold(r.Level, "fatal") {
 		return true
@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -42,35 +43,105 @@ type MemLimits struct {
 	Groups          []MemLimitGroup `yaml:"groups"`         // Ordered list of user groups with limits
 }
 
+// RuntimeLimitGroup defines wall-clock runtime limits for a group of users/commands
+type RuntimeLimitGroup struct {
+	Description       string         `yaml:"description"`      // Name for this group - used for logging/debugging
+	Users             string         `yaml:"users"`            // Go regex pattern matching user names
+	ReUsers           *regexp.Regexp `yaml:"-"`                // Compiled regex for users - not set from YAML
+	Commands          string         `yaml:"commands"`         // Go regex pattern matching command names - blank means all commands
+	ReCommands        *regexp.Regexp `yaml:"-"`                // Compiled regex for commands - not set from YAML
+	MaxRunningTime    string         `yaml:"max_running_time"` // Max time in state R, as seconds or Go duration (e.g. 2400 or 40m), 0/blank means no limit
+	MaxRunningSeconds int            `yaml:"-"`                // Parsed seconds value
+	MaxIdleTime       string         `yaml:"max_idle_time"`    // Max time in state I, as seconds or Go duration (e.g. 3600 or 1h), 0/blank means no limit
+	MaxIdleSeconds    int            `yaml:"-"`                // Parsed seconds value
+}
+
+// RuntimeLimits defines runtime limit monitoring/enforcement configuration
+type RuntimeLimits struct {
+	Enabled      bool                `yaml:"enabled"`       // Whether to evaluate and report runtime limits
+	EnforceKills bool                `yaml:"enforce_kills"` // Whether to actually terminate processes (requires enabled)
+	Groups       []RuntimeLimitGroup `yaml:"groups"`        // Ordered list of user/command groups with limits
+}
+
 // Config for p4metrics - see SampleConfig for details
 type Config struct {
-	MetricsRoot          string        `yaml:"metrics_root"`
-	SDPInstance          string        `yaml:"sdp_instance"` // If this is set then it defines the other variables such as P4Port
-	P4Port               string        `yaml:"p4port"`       // P4PORT value (if not set in env or as parameter)
-	P4User               string        `yaml:"p4user"`       // ditto
-	P4Config             string        `yaml:"p4config"`     // P4CONFIG file - useful if non-SDP
-	P4Bin                string        `yaml:"p4bin"`        // Only useful if non SDP - path to "p4" binary if not in $PATH
-	P4DBin               string        `yaml:"p4dbin"`       // Only useful if non SDP - path to "p4d" binary if not in $PATH
-	UpdateInterval       time.Duration `yaml:"update_interval"`
-	LongUpdateInterval   time.Duration `yaml:"long_update_interval"`
-	MonitorSwarm         bool          `yaml:"monitor_swarm"`
-	ParseJournal         bool          `yaml:"parse_journal"`       // Whether to parse active P4JOURNAL in background and emit table/type counts
-	SwarmURL             string        `yaml:"swarm_url"`           // Swarm URL - if the value returned by p4 property -l does not work (VPN etc)
-	SwarmSecure          bool          `yaml:"swarm_secure"`        // Whether to validate the Swarm HTTPS certificate
-	CmdsByUser           bool          `yaml:"cmds_by_user"`        // Whether to output metric p4_monitor_by_user
-	MemoryByUser         bool          `yaml:"memory_by_user"`      // Whether to output metric p4_active_memory_by_user
-	MaxJournalSize       string        `yaml:"max_journal_size"`    // Maximum size of journal file to monitor, e.g. 100M, 0 means no limit
-	MaxJournalPercent    string        `yaml:"max_journal_percent"` // Maximum size of journal as percentage of total P4LOGS disk space, e.g. 40, 0 means no limit
-	MaxLogSize           string        `yaml:"max_log_size"`        // Maximum size of journal file to monitor, e.g. 100M, 0 means no limit
-	MaxLogPercent        string        `yaml:"max_log_percent"`     // Maximum size of log as percentage of total P4LOGS disk space, e.g. 40, 0 means no limit
-	MaxJournalSizeInt    int64
-	MaxJournalPercentInt int
-	MaxLogSizeInt        int64
-	MaxLogPercentInt     int
-	MonitorIgnore        string         `yaml:"monitor_ignore"` // Monitor commmands to ignore - e.g. long running background tasks - values are a Go regex pattern - e.g. "admin resource-monitor|ldapsync"
-	MonitorIgnoreRe      *regexp.Regexp `yaml:"-"`              // Compiled regex for monitor_ignore - not set from YAML
-	MonitorGroups        []MonitorGroup `yaml:"monitor_groups"` // Array of command groups - each with a regex pattern to match commands and a label value to use for those commands (see SampleConfig for details)
-	MemLimits            *MemLimits     `yaml:"memlimits"`      // Optional memory limit monitoring/enforcement configuration
+	MetricsRoot                string        `yaml:"metrics_root"`
+	SDPInstance                string        `yaml:"sdp_instance"` // If this is set then it defines the other variables such as P4Port
+	P4Port                     string        `yaml:"p4port"`       // P4PORT value (if not set in env or as parameter)
+	P4User                     string        `yaml:"p4user"`       // ditto
+	P4Config                   string        `yaml:"p4config"`     // P4CONFIG file - useful if non-SDP
+	P4Bin                      string        `yaml:"p4bin"`        // Only useful if non SDP - path to "p4" binary if not in $PATH
+	P4DBin                     string        `yaml:"p4dbin"`       // Only useful if non SDP - path to "p4d" binary if not in $PATH
+	UpdateInterval             time.Duration `yaml:"update_interval"`
+	LongUpdateInterval         time.Duration `yaml:"long_update_interval"`
+	MonitorSwarm               bool          `yaml:"monitor_swarm"`
+	ParseJournal               bool          `yaml:"parse_journal"`       // Whether to parse active P4JOURNAL in background and emit table/type counts
+	SwarmURL                   string        `yaml:"swarm_url"`           // Swarm URL - if the value returned by p4 property -l does not work (VPN etc)
+	SwarmSecure                bool          `yaml:"swarm_secure"`        // Whether to validate the Swarm HTTPS certificate
+	CmdsByUser                 bool          `yaml:"cmds_by_user"`        // Whether to output metric p4_monitor_by_user
+	MemoryByUser               bool          `yaml:"memory_by_user"`      // Whether to output metric p4_active_memory_by_user
+	MaxJournalSize             string        `yaml:"max_journal_size"`    // Maximum size of journal file to monitor, e.g. 100M, 0 means no limit
+	MaxJournalPercent          string        `yaml:"max_journal_percent"` // Maximum size of journal as percentage of total P4LOGS disk space, e.g. 40, 0 means no limit
+	MaxLogSize                 string        `yaml:"max_log_size"`        // Maximum size of journal file to monitor, e.g. 100M, 0 means no limit
+	MaxLogPercent              string        `yaml:"max_log_percent"`     // Maximum size of log as percentage of total P4LOGS disk space, e.g. 40, 0 means no limit
+	MaxJournalSizeInt          int64
+	MaxJournalPercentInt       int
+	MaxLogSizeInt              int64
+	MaxLogPercentInt           int
+	MonitorIgnore              string         `yaml:"monitor_ignore"`               // Monitor commmands to ignore - e.g. long running background tasks - values are a Go regex pattern - e.g. "admin resource-monitor|ldapsync"
+	MonitorIgnoreRe            *regexp.Regexp `yaml:"-"`                            // Compiled regex for monitor_ignore - not set from YAML
+	MonitorGroups              []MonitorGroup `yaml:"monitor_groups"`               // Array of command groups - each with a regex pattern to match commands and a label value to use for those commands (see SampleConfig for details)
+	MemLimits                  *MemLimits     `yaml:"memlimits"`                    // Optional memory limit monitoring/enforcement configuration
+	RuntimeLimits              *RuntimeLimits `yaml:"runtimelimits"`                // Optional runtime limit monitoring/enforcement configuration
+	MonitorLocks               bool           `yaml:"monitor_locks"`                // Whether to monitor db/server.locks file locks via /proc/locks (Linux only)
+	LocksLog                   string         `yaml:"locks_log"`                    // File to write recent blocking chains to - defaults to <SDP logs>/p4metrics_locks.log
+	LocksLogChains             int            `yaml:"locks_log_chains"`             // How many of the most recent blocking chains to keep in locks_log
+	ErrorLabels                []string       `yaml:"error_labels"`                 // Error names (e.g. CLIENT_LockCheckFail) always given their own error label in p4_errors_count
+	ErrorLabelsTopN            int            `yaml:"error_labels_top_n"`           // Max number of other (most frequent) error names given their own error label - the rest are "other"
+	ParseAuthLog               bool           `yaml:"parse_auth_log"`               // Whether to tail auth.csv (if configured as a serverlog) and emit login metrics
+	AuthByUser                 bool           `yaml:"auth_by_user"`                 // Whether to output p4_auth_logins_by_user
+	AuthByIP                   bool           `yaml:"auth_by_ip"`                   // Whether to output p4_auth_logins_by_ip
+	AuthTopN                   int            `yaml:"auth_top_n"`                   // Max number of users/IPs given their own label - the rest are "other"
+	AuthFailedWindow           time.Duration  `yaml:"auth_failed_window"`           // Period for p4_auth_failed_logins_recent
+	ParseTriggerLog            bool           `yaml:"parse_trigger_log"`            // Whether to tail triggers.csv (if configured as a serverlog) and emit trigger metrics
+	TriggerBuckets             []float64      `yaml:"trigger_duration_buckets"`     // Buckets (seconds) for p4_triggers_duration_seconds histogram
+	TriggerLongRunning         time.Duration  `yaml:"trigger_long_running"`         // Threshold for p4_triggers_long_running
+	ParseIntegrityLog          bool           `yaml:"parse_integrity_log"`          // Whether to tail integrity.csv (if configured as a serverlog) and emit table verification metrics
+	JournalDBChecksumsInterval time.Duration  `yaml:"journaldbchecksums_interval"`  // How often to run p4 journaldbchecksums on a commit server - 0 means never
+	JournalDBChecksumsLevel    int            `yaml:"journaldbchecksums_level"`     // Value for journaldbchecksums -l - 0 means p4d default
+	MonitorTopology            bool           `yaml:"monitor_topology"`             // Whether the commit server should connect to all servers in p4 servers and output their health
+	TopologyTimeout            time.Duration  `yaml:"topology_timeout"`             // Timeout for p4 info against each server for monitor_topology
+	Canary                     bool           `yaml:"canary"`                       // Whether to run synthetic canary transactions (info/sync/submit/print) every canary_interval
+	CanaryInterval             time.Duration  `yaml:"canary_interval"`              // How often the canary is run - defaults to long_update_interval
+	CanaryDepotPath            string         `yaml:"canary_depot_path"`            // Depot directory for the canary file, e.g. //p4metrics/canary
+	CanaryClient               string         `yaml:"canary_client"`                // Canary workspace name - defaults to p4metrics_canary_<serverid>
+	CanaryRoot                 string         `yaml:"canary_root"`                  // Canary workspace root directory - defaults to <tmp>/p4metrics_canary-<serverid>
+	CanaryBuckets              []float64      `yaml:"canary_duration_buckets"`      // Buckets (seconds) for p4_canary_step_duration_seconds histogram
+	ReplicationCanary          bool           `yaml:"replication_canary"`           // Whether to measure replication propagation time via a counter written on the commit server
+	ReplicationCanaryCounter   string         `yaml:"replication_canary_counter"`   // Name of the counter for replication_canary
+	ReplicationCanaryPoll      time.Duration  `yaml:"replication_canary_poll"`      // How often replicas read the counter for replication_canary
+	LoginCheck                 bool           `yaml:"login_check"`                  // Whether to run p4 login -s and output the monitoring user's ticket expiry
+	LoginRenewBefore           time.Duration  `yaml:"login_renew_before"`           // Renew the ticket when it expires within this period
+	PasswordFile               string         `yaml:"p4passwd_file"`                // File containing the monitoring user's password for ticket renewal - SDP admin password file if SDP
+	PasswordEnv                string         `yaml:"p4passwd_env"`                 // Name of environment variable containing the monitoring user's password for ticket renewal
+	MonitorUserHygiene         bool           `yaml:"monitor_user_hygiene"`         // Whether to output user/group counts (by type, last access, password expiry) every long_update_interval
+	PasswordExpiryWarningDays  int            `yaml:"password_expiry_warning_days"` // Days for p4_users_password_expiring_count
+	MonitorWorkspaceHygiene    bool           `yaml:"monitor_workspace_hygiene"`    // Whether to output workspace and pending/shelved change counts every long_update_interval
+	WorkspaceStreamsTopN       int            `yaml:"workspace_streams_top_n"`      // Max number of streams given their own label in p4_workspaces_by_stream_count
+	MonitorDepotStorage        bool           `yaml:"monitor_depot_storage"`        // Whether to output archive sizes by depot (p4 sizes) every long_update_interval
+	DepotStorageDelay          time.Duration  `yaml:"depot_storage_delay"`          // Delay between p4 sizes for each depot to throttle monitor_depot_storage
+	MonitorDBTables            bool           `yaml:"monitor_db_tables"`            // Whether to output db.* table sizes and growth every long_update_interval
+	MonitorDBFragmentation     bool           `yaml:"monitor_db_fragmentation"`     // Whether to run p4 dbstat -f for each db table in the background for monitor_db_tables
+	DBFragmentationDelay       time.Duration  `yaml:"db_fragmentation_delay"`       // Delay between p4 dbstat -f for each table to throttle monitor_db_fragmentation
+	MonitorDrift               bool           `yaml:"monitor_drift"`                // Whether to snapshot configurables, triggers, protect and typemap and report changes
+	DriftDir                   string         `yaml:"drift_dir"`                    // Directory for monitor_drift snapshots - defaults to p4metrics_drift-<serverid> in state_dir or the SDP logs dir
+	DriftLog                   string         `yaml:"drift_log"`                    // File to which diffs of changes are appended - defaults to drift.log in drift_dir
+	SecurityPolicy             string         `yaml:"security_policy"`              // Policy file of rules for configurables/p4 info - relative to the config file
+	Policy                     *Policy        `yaml:"-"`                            // Loaded from security_policy
+	Remote                     bool           `yaml:"remote"`                       // Agentless mode - only monitors which work over the p4 protocol are run
+	Target                     string         `yaml:"target"`                       // Value of target label in remote mode - defaults to P4PORT
+	PersistCounters            bool           `yaml:"persist_counters"`             // Whether to save error/journal counters and file offsets so they survive restarts
+	StateDir                   string         `yaml:"state_dir"`                    // Directory for the state file - defaults to metrics_root
 }
 
 // SampleConfig shows a sample config file - this can be used as a template
@@ -127,6 +198,11 @@ p4dbin:     p4d
 # Values are as parsed by Go, e.g. 1m or 30s etc.
 update_interval:    1m
 
+# ----------------------
+# long_update_interval: how frequently expensive monitors (e.g. monitor_user_hygiene) are run - defaults to 1h,
+# or update_interval if that is longer. Values are as parsed by Go, e.g. 1h or 30m etc. Must not be less than update_interval.
+# long_update_interval:    1h
+
 # ----------------------
 # cmds_by_user: true/false - Whether to output metric p4_monitor_by_user
 # Normally this should be set to true as the metric is useful.
@@ -265,12 +341,315 @@ memlimits:
     user_cumulative_max_percentage: 70%
     user_cumulative_max_value:      
 
+# ----------------------
+# runtimelimits: Optional way to define which users and commands to monitor for excessive wall-clock runtime
+#   (useful for runaway commands such as 'p4 files //...' which sit in the monitor table for a long time).
+#   Commands which exceed these settings have 'p4 monitor terminate' run on them, just like memlimits above.
+#   Runtime is the time column from 'p4 monitor show -l'.
+# enabled: true/false - whether to enable this runtime monitoring functionality
+# enforce_kills: true/false - whether to actually enforce kills when limits are exceeded (if false, will only report)
+# Groups:
+#   Each entry has:
+#     description:      Name for this group of settings - used for logging and debugging, so should be unique and descriptive
+#     users:            Go regex pattern matching user names
+#     commands:         Go regex pattern matching command names - if blank then all commands match
+#     max_running_time: Max time for a command in state Running ('R'), as seconds or Go duration, e.g. 2400 or 40m, if blank or 0 then no limit
+#     max_idle_time:    Max time for a command in state Idle ('I'), as seconds or Go duration, e.g. 3600 or 1h, if blank or 0 then no limit
+# THE ORDER OF THE GROUPS IS IMPORTANT - the first group matching both user and command wins, so more specific patterns should come first
+# (e.g. admin/service users first with no limits, followed by a catch-all for other users with limits).
+# Background ('B') commands are never considered (replication, resource monitoring etc).
+# Example:
+runtimelimits:
+  enabled:         true
+  enforce_kills:   false
+  groups:
+  - description: "No limits for service or super users"
+    users: "super|perforce|p4admin|svc_.*"
+    commands:
+    max_running_time:
+    max_idle_time:
+  - description: "Reporting commands for all other users"
+    users: ".*"
+    commands: "^(annotate|changes|describe|files|filelog|fstat|grep|opened|print|sizes)$"
+    max_running_time: 40m
+    max_idle_time:    2h
+
+# ----------------------
+# monitor_locks: true/false - Whether to monitor file locks on db.* files and server.locks (Linux only)
+# Reads /proc/locks directly (no need for lslocks or sudo) and outputs p4_locks_* metrics including
+# read/write lock counts per table and count of commands blocked by locks.
+# This replaces monitor_metrics.py/monitor_wrapper.sh - so remove that cron job if enabling this, as the metric names are the same.
+monitor_locks:   false
+
+# ----------------------
+# locks_log: File to which the most recent blocking chains are written (if monitor_locks is true)
+# Each chain shows a blocked command and the command(s) blocking it, with user/cmd/runtime and table.
+# If blank defaults to p4metrics_locks.log in the SDP logs directory (and no log is written for non-SDP)
+locks_log:
+
+# ----------------------
+# locks_log_chains: How many of the most recent blocking chains to keep in locks_log (default 100)
+locks_log_chains:   100
+
+# ----------------------
+# error_labels: List of error names which always have their own value for the error label of p4_errors_count
+# Names are <subsystem>_<error> as per p4erroranalyzer, e.g. CLIENT_LockCheckFail, DM_BadRevision
+# Errors not in this list (and not in error_labels_top_n) are counted with error="other"
+error_labels:
+
+# ----------------------
+# error_labels_top_n: Max number of other error names which get their own error label - the most frequent
+# when labels are allocated. Once allocated a label is kept (so counters stay monotonic). Default 20, 0 for none.
+# If cmds_by_user is true, p4_errors_by_user and p4_errors_by_cmd are also output.
+error_labels_top_n:   20
+
 # ----------------------
 # parse_journal: true/false - Whether to parse active P4JOURNAL in the background
 # Normally this should be set to true to output p4_journal_records_count metrics.
 # Set to false if you want to disable journal tailing/parsing completely.
 parse_journal:   true
 
+# ----------------------
+# parse_auth_log: true/false - Whether to tail the auth structured log (auth.csv) if configured, e.g.
+#    p4 configure set serverlog.file.1=auth.csv
+# and output p4_auth_logins_count{method,result} and p4_auth_failed_logins_recent metrics
+parse_auth_log: false
+
+# ----------------------
+# auth_by_user: true/false - Whether to output p4_auth_logins_by_user{user,result}, and label
+#    p4_auth_failed_logins_recent by user (otherwise it is a single total and no user names are saved in state_dir)
+# auth_by_ip: true/false - Whether to output p4_auth_logins_by_ip{ip,result}
+# Both are limited to auth_top_n values (most frequent), the rest having label value "other".
+# auth_top_n also limits the number of users output for p4_auth_failed_logins_recent{user}.
+auth_by_user: false
+auth_by_ip:   false
+auth_top_n:   20
+
+# ----------------------
+# auth_failed_window: Period over which failed logins are counted for p4_auth_failed_logins_recent
+# Useful for alerting on brute force attempts/accounts about to be locked out. Go duration format, minimum 1m.
+auth_failed_window: 15m
+
+# ----------------------
+# parse_trigger_log: true/false - Whether to tail the triggers structured log (triggers.csv) if configured, e.g.
+#    p4 configure set serverlog.file.11=triggers.csv
+# and output p4_triggers_executions_count, p4_triggers_failures_count (non-zero exit) and
+# p4_triggers_duration_seconds (histogram) by trigger name.
+parse_trigger_log: false
+
+# ----------------------
+# trigger_duration_buckets: Buckets in seconds for p4_triggers_duration_seconds histogram
+# Default if not set: [0.1, 0.5, 1, 5, 10, 30, 60, 300]
+trigger_duration_buckets:
+
+# ----------------------
+# trigger_long_running: Trigger executions (child processes of p4d commands in the monitor table - Linux only)
+# running for longer than this are counted in p4_triggers_long_running. Go duration format.
+trigger_long_running: 30s
+
+# ----------------------
+# parse_integrity_log: true/false - Whether to tail the integrity structured log (integrity.csv) if configured, e.g.
+#    p4 configure set serverlog.file.12=integrity.csv
+# Replicas record there the results of verifying table checksums written to the journal by p4 journaldbchecksums
+# on the commit server. Outputs p4_integrity_checks_count and p4_integrity_mismatches_count by table and replica,
+# and p4_integrity_last_check_time by replica.
+parse_integrity_log: false
+
+# ----------------------
+# journaldbchecksums_interval: How often p4metrics should run p4 journaldbchecksums on the commit server (requires super
+# user), so that replicas verify their tables. Go duration format, e.g. 24h. Default 0 means never - leave it
+# unset if this is already scheduled by other means (e.g. cron). Minimum 1h.
+journaldbchecksums_interval: 0
+
+# ----------------------
+# journaldbchecksums_level: Value for p4 journaldbchecksums -l (1-3, see p4 help journaldbchecksums).
+# Default 0 means not specified.
+journaldbchecksums_level: 0
+
+# ----------------------
+# monitor_topology: true/false - Whether p4metrics on the commit server should connect to the Address of each
+# server in p4 servers (replicas, edges, standbys etc) and run p4 info to output p4_topology_server_up,
+# p4_topology_info_latency_seconds, p4_topology_server_version_info, p4_topology_server_uptime and
+# p4_topology_serverid_match by server - including servers without their own p4metrics.
+# For ssl addresses, the P4TRUST file (see p4config) must contain the fingerprints of the servers.
+monitor_topology: false
+
+# ----------------------
+# topology_timeout: Timeout for p4 info against each server for monitor_topology. Go duration format.
+topology_timeout: 10s
+
+# ----------------------
+# canary: true/false - Whether to run synthetic canary transactions every canary_interval, to check that users can
+# actually use the server (rather than just that p4metrics can connect). The steps are: setup (create the canary
+# workspace), info, sync, submit (edit or add and submit the canary file), print (check the submitted content) and
+# cleanup. Outputs p4_canary_success, p4_canary_step_success, p4_canary_step_failures_count and the histogram
+# p4_canary_step_duration_seconds by step.
+# Cleanup reverts anything left open in the canary workspace and deletes its empty pending changes. It then obliterates
+# the older revisions of the canary file and deletes the canary workspace's earlier (now empty) submitted changes, so
+# only the latest canary change is kept. This needs the p4user to be admin - otherwise the cleanup step fails.
+canary: false
+
+# ----------------------
+# canary_interval: How often the canary is run - defaults to long_update_interval. Must not be less than update_interval.
+# Each run submits a change (older ones are removed by cleanup).
+canary_interval:
+
+# ----------------------
+# canary_depot_path: REQUIRED if canary is true - depot directory for the canary file canary-<serverid>.txt
+# (filetype text+S), e.g. //p4metrics/canary. Use a path which is not used for anything else, as cleanup obliterates
+# older revisions of the canary file.
+canary_depot_path:
+
+# ----------------------
+# canary_client: Name of the canary workspace (created/updated by p4metrics). Defaults to p4metrics_canary_<serverid>
+canary_client:
+
+# ----------------------
+# canary_root: Root directory for the canary workspace. Defaults to <tmp>/p4metrics_canary-<sdp_instance>-<serverid>
+canary_root:
+
+# ----------------------
+# canary_duration_buckets: Buckets in seconds for p4_canary_step_duration_seconds histogram
+# Default if not set: [0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10]
+canary_duration_buckets:
+
+# ----------------------
+# replication_canary: true/false - Whether to measure end-to-end replication lag. Set on commit server and replicas.
+# p4metrics on the commit server writes the current time to replication_canary_counter on every update, and p4metrics
+# on replicas/edges reads the counter every replication_canary_poll, outputting p4_replication_propagation_seconds
+# (time from the write to the value first being visible on the replica) and p4_replication_canary_age_seconds (age of
+# the visible value - keeps increasing if replication stops). Assumes server clocks are synchronised (e.g. NTP).
+# Requires p4user to have review access on the commit server to write counters.
+replication_canary: false
+
+# ----------------------
+# replication_canary_counter: Name of the counter used by replication_canary
+replication_canary_counter: p4metrics_replication_canary
+
+# ----------------------
+# replication_canary_poll: How often replicas read the counter - the accuracy of p4_replication_propagation_seconds.
+# Go duration format, minimum 100ms.
+replication_canary_poll: 1s
+
+# ----------------------
+# login_check: true/false - Whether to run "p4 login -s" on every update and output p4_login_ticket_expiry_seconds for the monitoring user.
+# If a password is available (p4passwd_env, p4passwd_file or for SDP the admin password file) the ticket is renewed with "p4 login"
+# when it expires within login_renew_before, or after a login error - backing off from 1m to 1h after failures.
+login_check: false
+
+# ----------------------
+# login_renew_before: Renew the ticket when it expires within this period. Go duration format, at least 1m.
+login_renew_before: 24h
+
+# ----------------------
+# p4passwd_file: File containing the monitoring user's password (first line). Defaults to $SDP_ADMIN_PASSWORD_FILE for SDP.
+p4passwd_file:
+
+# ----------------------
+# p4passwd_env: Name of an environment variable containing the monitoring user's password - used in preference to p4passwd_file.
+p4passwd_env:
+
+# ----------------------
+# monitor_user_hygiene: true/false - Whether to run "p4 -ztag users -a" and "p4 -ztag groups" every long_update_interval
+# and output counts of users by type, users not accessed in 30/90/365 days, users whose password expires within
+# password_expiry_warning_days (from group PasswordTimeout) and groups. Only counts are output - no user names.
+monitor_user_hygiene: false
+
+# ----------------------
+# password_expiry_warning_days: Days for p4_users_password_expiring_count
+password_expiry_warning_days: 14
+
+# ----------------------
+# monitor_workspace_hygiene: true/false - Whether to run "p4 -ztag clients" (and clients -U) and "p4 -ztag changes -s pending/shelved"
+# every long_update_interval and output counts of workspaces (total, unloaded, by last access age and by stream) and of
+# pending and shelved changes by age - to find stale workspaces and forgotten shelves bloating db.have and db.working.
+monitor_workspace_hygiene: false
+
+# ----------------------
+# workspace_streams_top_n: Max number of streams (by workspace count) given their own label in p4_workspaces_by_stream_count
+# - the rest are "other". Classic (non-stream) workspaces are "none".
+workspace_streams_top_n: 20
+
+# ----------------------
+# monitor_depot_storage: true/false - Whether to scan depots every long_update_interval, outputting archive bytes and file counts
+# (all revisions excluding lazy copies - "p4 sizes -s -a -z") by depot and depot type, plus counts of depots and streams.
+# The scan runs in the background, sizing each top level directory of each depot in turn and pausing depot_storage_delay
+# between each "p4 sizes" so it never overloads the server - so results for large servers appear after the first scan
+# completes. Remote and graph depots are not sized. Depots which fail to be sized are left out and counted in
+# p4_depot_storage_scan_failures.
+monitor_depot_storage: false
+
+# ----------------------
+# depot_storage_delay: Pause between each "p4 sizes" (one per top level directory of a depot). Go duration format, e.g. 10s
+depot_storage_delay: 10s
+
+# ----------------------
+# monitor_db_tables: true/false - Whether to output the size (bytes and pages) of each db.* table every long_update_interval,
+# with growth in bytes per hour since the previous sample. Files in P4ROOT are read directly if local, otherwise
+# (e.g. remote: true) "p4 dbstat -s" is used, which requires super.
+monitor_db_tables: false
+
+# ----------------------
+# monitor_db_fragmentation: true/false - Whether to also output p4_db_table_fragmentation_percent for monitor_db_tables.
+# "p4 dbstat -f" reads the whole table, so after each long_update_interval sample it is run in the background for one
+# table at a time, pausing db_fragmentation_delay between tables - results are output with the next sample. Requires super.
+monitor_db_fragmentation: false
+
+# ----------------------
+# db_fragmentation_delay: Pause between "p4 dbstat -f" for each table. Go duration format, e.g. 1m
+db_fragmentation_delay: 1m
+
+# ----------------------
+# monitor_drift: true/false - Whether to detect configuration drift. On every update "p4 configure show allservers",
+# "p4 triggers -o", "p4 protect -o" and "p4 typemap -o" are snapshotted to drift_dir (comments removed), outputting
+# p4_drift_hash_info and p4_drift_last_changed_time by artefact, and unified diffs of any changes are appended to drift_log
+# for later review. Requires p4user to be super.
+monitor_drift: false
+
+# ----------------------
+# drift_dir: Directory for monitor_drift snapshots - defaults to p4metrics_drift-<serverid> in state_dir (or the SDP
+# logs dir, e.g. /p4/1/logs). One of these must be set for monitor_drift - metrics_root is not used as it is usually
+# readable by node_exporter and others.
+# Snapshots include protections and configurables, so the directory is set to mode 0700 and files to 0600.
+drift_dir:
+
+# ----------------------
+# drift_log: File to which diffs are appended - defaults to drift.log in drift_dir. Created with mode 0600.
+drift_log:
+
+# ----------------------
+# security_policy: YAML file of rules checking configurables (p4 configure show allservers) and p4 -ztag info fields
+# against expected values, lists, regexes or numeric ranges - see p4metrics_policy.yaml for an example. A relative
+# path is relative to this config file. Outputs p4_policy_rule_pass by rule, p4_policy_score and p4_policy_rules_failed.
+# Requires p4user to be super. Run "p4metrics --check.policy" to print a report.
+security_policy:
+
+# ----------------------
+# remote: true/false - Agentless mode for monitoring a p4d server on another host (e.g. a managed appliance
+# where nothing can be installed). Only monitors which work over the p4 protocol are run (p4 info, monitor show,
+# servers, pull, license, configure, diskspace, counters etc). Monitors needing local files or /proc are disabled -
+# see p4_monitor_disabled for the list and reasons. Disk space is output from p4 diskspace as p4_diskspace_*.
+# Requires sdp_instance to be blank - set p4port/p4user/p4config instead. Run one p4metrics (with its own config file)
+# per target server - they can share metrics_root and node_exporter.
+remote: false
+
+# ----------------------
+# target: Value of the target label added to all metrics in remote mode (and to metrics file names),
+# so that one collector host can watch many servers. Defaults to p4port.
+target:
+
+# ----------------------
+# persist_counters: true/false - Whether to save the counters derived from tailing errors.csv and P4JOURNAL
+# (p4_errors_count, p4_journal_records_count etc) together with how far each file has been read.
+# On restart the counters are restored and any lines written while p4metrics was not running are replayed,
+# allowing for the files having been rotated (detected by inode changing).
+persist_counters: false
+
+# ----------------------
+# state_dir: Directory in which to write the state file p4metrics_state-<sdp_instance>-<serverid>.json
+# Defaults to metrics_root if not set. The file is only readable by the owner (mode 0600) as it may contain user names.
+state_dir:
+
 `
 
 // parsePercentage parses a percentage string (e.g. "30" or "30%") into an integer 0-99.
@@ -290,6 +669,29 @@ func parsePercentage(val string) (int, error) {
 	return n, nil
 }
 
+// parseSeconds parses a time limit given either as an integer number of seconds (e.g. "2400")
+// or as a Go duration (e.g. "40m"). Returns 0 for blank or "0" inputs (meaning no limit).
+func parseSeconds(val string) (int, error) {
+	s := strings.TrimSpace(val)
+	if s == "" || s == "0" {
+		return 0, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 0 {
+			return 0, fmt.Errorf("invalid time value %q: must not be negative", val)
+		}
+		return n, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time value %q: must be seconds or a duration such as 40m", val)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid time value %q: must not be negative", val)
+	}
+	return int(d.Seconds()), nil
+}
+
 func ConvertToBytes(size string) (int64, error) {
 	if len(size) == 0 {
 		return 0, nil
@@ -334,10 +736,23 @@ func ConvertToBytes(size string) (int64, error) {
 func Unmarshal(config []byte) (*Config, error) {
 	// Default values specified here
 	cfg := &Config{
-		UpdateInterval: 60 * time.Second,
-		MonitorSwarm:   false,
-		ParseJournal:   true,
-		SwarmSecure:    true}
+		UpdateInterval:            60 * time.Second,
+		MonitorSwarm:              false,
+		ParseJournal:              true,
+		LocksLogChains:            100,
+		ErrorLabelsTopN:           20,
+		AuthTopN:                  20,
+		AuthFailedWindow:          15 * time.Minute,
+		TriggerLongRunning:        30 * time.Second,
+		TopologyTimeout:           10 * time.Second,
+		ReplicationCanaryCounter:  "p4metrics_replication_canary",
+		ReplicationCanaryPoll:     time.Second,
+		LoginRenewBefore:          24 * time.Hour,
+		PasswordExpiryWarningDays: 14,
+		WorkspaceStreamsTopN:      20,
+		DepotStorageDelay:         10 * time.Second,
+		DBFragmentationDelay:      time.Minute,
+		SwarmSecure:               true}
 	err := yaml.Unmarshal(config, cfg)
 	if err != nil {
 		return nil, fmt.Errorf("invalid configuration: %v. make sure to use 'single quotes' around strings with special characters (like match patterns or label templates), and make sure to use '-' only for lists (metrics) but not for maps (labels)", err.Error())
@@ -366,6 +781,15 @@ func LoadConfigFile(filename string) (*Config, error) {
 	if cfg.P4DBin == "" {
 		cfg.P4DBin = "p4d"
 	}
+	if cfg.SecurityPolicy != "" {
+		policyFile := cfg.SecurityPolicy
+		if !filepath.IsAbs(policyFile) {
+			policyFile = filepath.Join(filepath.Dir(filename), policyFile)
+		}
+		if cfg.Policy, err = LoadPolicyFile(policyFile); err != nil {
+			return nil, err
+		}
+	}
 	return cfg, nil
 }
 
@@ -479,5 +903,110 @@ func (c *Config) validate() error {
 			}
 		}
 	}
+	if c.LocksLogChains < 0 {
+		return fmt.Errorf("invalid locks_log_chains: %d must not be negative", c.LocksLogChains)
+	}
+	if c.AuthTopN < 0 {
+		return fmt.Errorf("invalid auth_top_n: %d must not be negative", c.AuthTopN)
+	}
+	if c.AuthFailedWindow < time.Minute {
+		return fmt.Errorf("invalid auth_failed_window: %v must be at least 1m", c.AuthFailedWindow)
+	}
+	for i, b := range c.TriggerBuckets {
+		if b <= 0 || (i > 0 && b <= c.TriggerBuckets[i-1]) {
+			return fmt.Errorf("invalid trigger_duration_buckets: %v must be positive and in increasing order", c.TriggerBuckets)
+		}
+	}
+	if c.TriggerLongRunning <= 0 {
+		return fmt.Errorf("invalid trigger_long_running: %v must be positive", c.TriggerLongRunning)
+	}
+	if c.TopologyTimeout < time.Second {
+		return fmt.Errorf("invalid topology_timeout: %v must be at least 1s", c.TopologyTimeout)
+	}
+	if c.Canary {
+		c.CanaryDepotPath = strings.TrimSuffix(strings.TrimSuffix(c.CanaryDepotPath, "/..."), "/")
+		if !strings.HasPrefix(c.CanaryDepotPath, "//") || strings.ContainsAny(c.CanaryDepotPath, "*@#%\"") || strings.Contains(c.CanaryDepotPath, "...") {
+			return fmt.Errorf("invalid canary_depot_path: %q must be a depot directory, e.g. //p4metrics/canary", c.CanaryDepotPath)
+		}
+	}
+	for i, b := range c.CanaryBuckets {
+		if b <= 0 || (i > 0 && b <= c.CanaryBuckets[i-1]) {
+			return fmt.Errorf("invalid canary_duration_buckets: %v must be positive and in increasing order", c.CanaryBuckets)
+		}
+	}
+	if c.ReplicationCanaryPoll < 100*time.Millisecond {
+		return fmt.Errorf("invalid replication_canary_poll: %v must be at least 100ms", c.ReplicationCanaryPoll)
+	}
+	if strings.TrimSpace(c.ReplicationCanaryCounter) == "" || strings.ContainsAny(c.ReplicationCanaryCounter, " \t\"") {
+		return fmt.Errorf("invalid replication_canary_counter: %q", c.ReplicationCanaryCounter)
+	}
+	if c.LoginRenewBefore < time.Minute {
+		return fmt.Errorf("invalid login_renew_before: %v must be at least 1m", c.LoginRenewBefore)
+	}
+	if c.LongUpdateInterval == 0 {
+		// Not set, so don't fail older configs with a long update_interval
+		c.LongUpdateInterval = time.Hour
+		if c.UpdateInterval > c.LongUpdateInterval {
+			c.LongUpdateInterval = c.UpdateInterval
+		}
+	} else if c.LongUpdateInterval < c.UpdateInterval {
+		return fmt.Errorf("invalid long_update_interval: %v must not be less than update_interval %v", c.LongUpdateInterval, c.UpdateInterval)
+	}
+	if c.CanaryInterval == 0 {
+		c.CanaryInterval = c.LongUpdateInterval
+	} else if c.CanaryInterval < c.UpdateInterval {
+		return fmt.Errorf("invalid canary_interval: %v must not be less than update_interval %v", c.CanaryInterval, c.UpdateInterval)
+	}
+	if c.PasswordExpiryWarningDays < 1 {
+		return fmt.Errorf("invalid password_expiry_warning_days: %d must be at least 1", c.PasswordExpiryWarningDays)
+	}
+	if c.WorkspaceStreamsTopN < 0 {
+		return fmt.Errorf("invalid workspace_streams_top_n: %d must not be negative", c.WorkspaceStreamsTopN)
+	}
+	if c.DepotStorageDelay < 0 {
+		return fmt.Errorf("invalid depot_storage_delay: %v must not be negative", c.DepotStorageDelay)
+	}
+	if c.DBFragmentationDelay < 0 {
+		return fmt.Errorf("invalid db_fragmentation_delay: %v must not be negative", c.DBFragmentationDelay)
+	}
+	if c.Remote && c.SDPInstance != "" {
+		return fmt.Errorf("invalid remote: true cannot be used with sdp_instance %q", c.SDPInstance)
+	}
+	if c.JournalDBChecksumsInterval != 0 && c.JournalDBChecksumsInterval < time.Hour {
+		return fmt.Errorf("invalid journaldbchecksums_interval: %v must be 0 or at least 1h", c.JournalDBChecksumsInterval)
+	}
+	if c.JournalDBChecksumsLevel < 0 || c.JournalDBChecksumsLevel > 3 {
+		return fmt.Errorf("invalid journaldbchecksums_level: %d must be between 0 and 3", c.JournalDBChecksumsLevel)
+	}
+	if c.ErrorLabelsTopN < 0 {
+		return fmt.Errorf("invalid error_labels_top_n: %d must not be negative", c.ErrorLabelsTopN)
+	}
+	// Validate runtimelimits
+	if c.RuntimeLimits != nil {
+		rl := c.RuntimeLimits
+		for i, g := range rl.Groups {
+			if g.Users == "" {
+				return fmt.Errorf("runtimelimits.groups[%d]: users cannot be empty", i)
+			}
+			re, err := regexp.Compile(g.Users)
+			if err != nil {
+				return fmt.Errorf("runtimelimits.groups[%d]: failed to parse users '%s' as a regex: %v", i, g.Users, err)
+			}
+			rl.Groups[i].ReUsers = re
+			if g.Commands != "" {
+				re, err := regexp.Compile(g.Commands)
+				if err != nil {
+					return fmt.Errorf("runtimelimits.groups[%d]: failed to parse commands '%s' as a regex: %v", i, g.Commands, err)
+				}
+				rl.Groups[i].ReCommands = re
+			}
+			if rl.Groups[i].MaxRunningSeconds, err = parseSeconds(g.MaxRunningTime); err != nil {
+				return fmt.Errorf("runtimelimits.groups[%d]: invalid max_running_time: %v", i, err)
+			}
+			if rl.Groups[i].MaxIdleSeconds, err = parseSeconds(g.MaxIdleTime); err != nil {
+				return fmt.Errorf("runtimelimits.groups[%d]: invalid max_idle_time: %v", i, err)
+			}
+		}
+	}
 	return nil
 }
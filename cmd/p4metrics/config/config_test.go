@@ -1,6 +1,9 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -367,3 +370,298 @@ func TestInvalidMemLimits(t *testing.T) {
 	ensureFail(t, configMemLimitsInvalidCumulativePercent, "invalid user_cumulative_max_percentage")
 	ensureFail(t, configMemLimitsInvalidCumulativeValue, "invalid user_cumulative_max_value unit")
 }
+
+const configWithRuntimeLimits = `
+metrics_root:   /hxlogs/metrics
+sdp_instance:   1
+runtimelimits:
+  enabled:       true
+  enforce_kills: true
+  groups:
+  - description: "No limits for admin"
+    users: "super|perforce"
+    commands:
+    max_running_time:
+    max_idle_time:
+  - description: "Reporting commands"
+    users: ".*"
+    commands: "^(files|fstat)$"
+    max_running_time: 40m
+    max_idle_time:    3600
+`
+
+func TestValidRuntimeLimits(t *testing.T) {
+	cfg := loadOrFail(t, configWithRuntimeLimits)
+	if cfg.RuntimeLimits == nil {
+		t.Fatal("Expected RuntimeLimits to be set")
+	}
+	rl := cfg.RuntimeLimits
+	if !rl.Enabled || !rl.EnforceKills {
+		t.Fatal("Expected RuntimeLimits.Enabled and EnforceKills to be true")
+	}
+	if len(rl.Groups) != 2 {
+		t.Fatalf("Expected 2 runtimelimits groups, got %d", len(rl.Groups))
+	}
+	g0 := rl.Groups[0]
+	if g0.ReUsers == nil {
+		t.Fatal("Expected Groups[0].ReUsers to be compiled")
+	}
+	if g0.ReCommands != nil {
+		t.Fatal("Expected Groups[0].ReCommands to be nil for blank commands")
+	}
+	checkValueInt(t, "Groups[0].MaxRunningSeconds", int64(g0.MaxRunningSeconds), 0)
+	checkValueInt(t, "Groups[0].MaxIdleSeconds", int64(g0.MaxIdleSeconds), 0)
+	g1 := rl.Groups[1]
+	checkValue(t, "Groups[1].Commands", g1.Commands, "^(files|fstat)$")
+	if g1.ReCommands == nil {
+		t.Fatal("Expected Groups[1].ReCommands to be compiled")
+	}
+	checkValueInt(t, "Groups[1].MaxRunningSeconds", int64(g1.MaxRunningSeconds), 2400)
+	checkValueInt(t, "Groups[1].MaxIdleSeconds", int64(g1.MaxIdleSeconds), 3600)
+}
+
+func TestNoRuntimeLimits(t *testing.T) {
+	cfg := loadOrFail(t, defaultConfig)
+	if cfg.RuntimeLimits != nil {
+		t.Fatal("Expected RuntimeLimits to be nil when not configured")
+	}
+}
+
+const configRuntimeLimitsEmptyUsers = `
+metrics_root:   /hxlogs/metrics
+sdp_instance:   1
+runtimelimits:
+  groups:
+  - description: "test"
+    users: ""
+`
+
+const configRuntimeLimitsInvalidCommands = `
+metrics_root:   /hxlogs/metrics
+sdp_instance:   1
+runtimelimits:
+  groups:
+  - description: "test"
+    users: ".*"
+    commands: "files|[invalid"
+`
+
+const configRuntimeLimitsInvalidRunning = `
+metrics_root:   /hxlogs/metrics
+sdp_instance:   1
+runtimelimits:
+  groups:
+  - description: "test"
+    users: ".*"
+    max_running_time: 10 minutes
+`
+
+const configRuntimeLimitsNegativeIdle = `
+metrics_root:   /hxlogs/metrics
+sdp_instance:   1
+runtimelimits:
+  groups:
+  - description: "test"
+    users: ".*"
+    max_idle_time: -5m
+`
+
+func TestInvalidRuntimeLimits(t *testing.T) {
+	ensureFail(t, configRuntimeLimitsEmptyUsers, "empty users field")
+	ensureFail(t, configRuntimeLimitsInvalidCommands, "invalid regex in commands")
+	ensureFail(t, configRuntimeLimitsInvalidRunning, "invalid max_running_time")
+	ensureFail(t, configRuntimeLimitsNegativeIdle, "negative max_idle_time")
+}
+
+// TestOptionalConfig checks the default of each optional setting (with only metrics_root set), and that it can be overridden
+func TestOptionalConfig(t *testing.T) {
+	const base = "metrics_root: /hxlogs/metrics\n"
+	defaults := loadOrFail(t, base)
+	tests := []struct {
+		name     string
+		value    func(*Config) interface{}
+		expected interface{} // Default
+		yaml     string      // Setting(s) to override the default
+		override interface{} // Value with yaml
+	}{
+		{"MonitorLocks", func(c *Config) interface{} { return c.MonitorLocks }, false, "monitor_locks: true", true},
+		{"LocksLog", func(c *Config) interface{} { return c.LocksLog }, "", "locks_log: /tmp/locks.log", "/tmp/locks.log"},
+		{"LocksLogChains", func(c *Config) interface{} { return c.LocksLogChains }, 100, "locks_log_chains: 10", 10},
+		{"ErrorLabels", func(c *Config) interface{} { return c.ErrorLabels }, []string(nil),
+			"error_labels:\n  - CLIENT_LockCheckFail\n  - DM_BadRevision", []string{"CLIENT_LockCheckFail", "DM_BadRevision"}},
+		{"ErrorLabelsTopN", func(c *Config) interface{} { return c.ErrorLabelsTopN }, 20, "error_labels_top_n: 0", 0},
+		{"PersistCounters", func(c *Config) interface{} { return c.PersistCounters }, false, "persist_counters: true", true},
+		{"StateDir", func(c *Config) interface{} { return c.StateDir }, "", "state_dir: /p4/1/tmp", "/p4/1/tmp"},
+		{"ParseAuthLog", func(c *Config) interface{} { return c.ParseAuthLog }, false, "parse_auth_log: true", true},
+		{"AuthByUser", func(c *Config) interface{} { return c.AuthByUser }, false, "auth_by_user: true", true},
+		{"AuthByIP", func(c *Config) interface{} { return c.AuthByIP }, false, "auth_by_ip: true", true},
+		{"AuthTopN", func(c *Config) interface{} { return c.AuthTopN }, 20, "auth_top_n: 5", 5},
+		{"AuthFailedWindow", func(c *Config) interface{} { return c.AuthFailedWindow }, 15 * time.Minute, "auth_failed_window: 1h", time.Hour},
+		{"ParseTriggerLog", func(c *Config) interface{} { return c.ParseTriggerLog }, false, "parse_trigger_log: true", true},
+		{"TriggerBuckets", func(c *Config) interface{} { return c.TriggerBuckets }, []float64(nil),
+			"trigger_duration_buckets: [0.5, 2, 20]", []float64{0.5, 2, 20}},
+		{"TriggerLongRunning", func(c *Config) interface{} { return c.TriggerLongRunning }, 30 * time.Second, "trigger_long_running: 2m", 2 * time.Minute},
+		{"ParseIntegrityLog", func(c *Config) interface{} { return c.ParseIntegrityLog }, false, "parse_integrity_log: true", true},
+		{"JournalDBChecksumsInterval", func(c *Config) interface{} { return c.JournalDBChecksumsInterval }, time.Duration(0),
+			"journaldbchecksums_interval: 24h", 24 * time.Hour},
+		{"JournalDBChecksumsLevel", func(c *Config) interface{} { return c.JournalDBChecksumsLevel }, 0, "journaldbchecksums_level: 2", 2},
+		{"Remote", func(c *Config) interface{} { return c.Remote }, false, "remote: true\np4port: ssl:appliance:1666", true},
+		{"Target", func(c *Config) interface{} { return c.Target }, "", "target: appliance-east", "appliance-east"},
+		{"MonitorTopology", func(c *Config) interface{} { return c.MonitorTopology }, false, "monitor_topology: true", true},
+		{"TopologyTimeout", func(c *Config) interface{} { return c.TopologyTimeout }, 10 * time.Second, "topology_timeout: 30s", 30 * time.Second},
+		{"Canary", func(c *Config) interface{} { return c.Canary }, false, "canary: true\ncanary_depot_path: //p4metrics/canary", true},
+		{"CanaryInterval", func(c *Config) interface{} { return c.CanaryInterval }, time.Hour, "canary_interval: 5m", 5 * time.Minute},
+		{"CanaryDepotPath", func(c *Config) interface{} { return c.CanaryDepotPath }, "",
+			"canary: true\ncanary_depot_path: //p4metrics/canary/...", "//p4metrics/canary"},
+		{"ReplicationCanary", func(c *Config) interface{} { return c.ReplicationCanary }, false, "replication_canary: true", true},
+		{"ReplicationCanaryCounter", func(c *Config) interface{} { return c.ReplicationCanaryCounter }, "p4metrics_replication_canary",
+			"replication_canary_counter: lag", "lag"},
+		{"ReplicationCanaryPoll", func(c *Config) interface{} { return c.ReplicationCanaryPoll }, time.Second, "replication_canary_poll: 500ms", 500 * time.Millisecond},
+		{"LoginCheck", func(c *Config) interface{} { return c.LoginCheck }, false, "login_check: true", true},
+		{"LoginRenewBefore", func(c *Config) interface{} { return c.LoginRenewBefore }, 24 * time.Hour, "login_renew_before: 2h", 2 * time.Hour},
+		{"PasswordFile", func(c *Config) interface{} { return c.PasswordFile }, "", "p4passwd_file: /p4/common/config/.p4passwd", "/p4/common/config/.p4passwd"},
+		{"PasswordEnv", func(c *Config) interface{} { return c.PasswordEnv }, "", "p4passwd_env: P4PASSWD", "P4PASSWD"},
+		{"MonitorUserHygiene", func(c *Config) interface{} { return c.MonitorUserHygiene }, false, "monitor_user_hygiene: true", true},
+		{"LongUpdateInterval", func(c *Config) interface{} { return c.LongUpdateInterval }, time.Hour, "long_update_interval: 6h", 6 * time.Hour},
+		// Configs from before long_update_interval existed may have a longer update_interval
+		{"LongUpdateInterval", func(c *Config) interface{} { return c.LongUpdateInterval }, time.Hour, "update_interval: 2h", 2 * time.Hour},
+		{"PasswordExpiryWarningDays", func(c *Config) interface{} { return c.PasswordExpiryWarningDays }, 14, "password_expiry_warning_days: 30", 30},
+		{"MonitorWorkspaceHygiene", func(c *Config) interface{} { return c.MonitorWorkspaceHygiene }, false, "monitor_workspace_hygiene: true", true},
+		{"WorkspaceStreamsTopN", func(c *Config) interface{} { return c.WorkspaceStreamsTopN }, 20, "workspace_streams_top_n: 5", 5},
+		{"MonitorDepotStorage", func(c *Config) interface{} { return c.MonitorDepotStorage }, false, "monitor_depot_storage: true", true},
+		{"DepotStorageDelay", func(c *Config) interface{} { return c.DepotStorageDelay }, 10 * time.Second, "depot_storage_delay: 1m", time.Minute},
+		{"MonitorDBTables", func(c *Config) interface{} { return c.MonitorDBTables }, false, "monitor_db_tables: true", true},
+		{"MonitorDBFragmentation", func(c *Config) interface{} { return c.MonitorDBFragmentation }, false, "monitor_db_fragmentation: true", true},
+		{"DBFragmentationDelay", func(c *Config) interface{} { return c.DBFragmentationDelay }, time.Minute, "db_fragmentation_delay: 5m", 5 * time.Minute},
+		{"MonitorDrift", func(c *Config) interface{} { return c.MonitorDrift }, false, "monitor_drift: true", true},
+		{"DriftDir", func(c *Config) interface{} { return c.DriftDir }, "", "drift_dir: /p4/1/drift", "/p4/1/drift"},
+		{"DriftLog", func(c *Config) interface{} { return c.DriftLog }, "", "drift_log: /p4/1/logs/drift.log", "/p4/1/logs/drift.log"},
+	}
+	for _, tc := range tests {
+		if v := tc.value(defaults); !reflect.DeepEqual(v, tc.expected) {
+			t.Errorf("%s: expected default %v got %v", tc.name, tc.expected, v)
+		}
+		cfg := loadOrFail(t, base+tc.yaml+"\n")
+		if v := tc.value(cfg); !reflect.DeepEqual(v, tc.override) {
+			t.Errorf("%s: expected %v with %q got %v", tc.name, tc.override, tc.yaml, v)
+		}
+	}
+}
+
+func TestInvalidOptionalConfig(t *testing.T) {
+	for _, tc := range []struct {
+		yaml string
+		desc string
+	}{
+		{"locks_log_chains: -1", "negative locks_log_chains"},
+		{"error_labels_top_n: -1", "negative error_labels_top_n"},
+		{"auth_top_n: -1", "negative auth_top_n"},
+		{"auth_failed_window: 10s", "auth_failed_window too short"},
+		{"trigger_duration_buckets: [5, 1]", "trigger_duration_buckets not increasing"},
+		{"trigger_long_running: 0s", "zero trigger_long_running"},
+		{"journaldbchecksums_interval: 10m", "journaldbchecksums_interval too short"},
+		{"journaldbchecksums_level: 4", "journaldbchecksums_level too large"},
+		{"remote: true\nsdp_instance: 1", "remote with sdp_instance"},
+		{"topology_timeout: 100ms", "topology_timeout too short"},
+		{"canary: true", "canary without canary_depot_path"},
+		{"canary: true\ncanary_depot_path: //p4metrics/*/canary", "canary_depot_path with wildcard"},
+		{"canary_duration_buckets: [1, 0.5]", "canary_duration_buckets not increasing"},
+		{"canary_interval: 30s", "canary_interval less than update_interval"},
+		{"replication_canary_poll: 10ms", "replication_canary_poll too short"},
+		{"replication_canary_counter: \"a b\"", "replication_canary_counter with space"},
+		{"login_renew_before: 10s", "login_renew_before too short"},
+		{"long_update_interval: 30s", "long_update_interval less than update_interval"},
+		{"password_expiry_warning_days: 0", "password_expiry_warning_days zero"},
+		{"workspace_streams_top_n: -1", "workspace_streams_top_n negative"},
+		{"depot_storage_delay: -1s", "depot_storage_delay negative"},
+		{"db_fragmentation_delay: -1s", "db_fragmentation_delay negative"},
+	} {
+		ensureFail(t, "metrics_root: /hxlogs/metrics\n"+tc.yaml+"\n", tc.desc)
+	}
+}
+
+func TestPolicyConfig(t *testing.T) {
+	// Sample policy shipped with p4metrics is valid
+	p, err := LoadPolicyFile("../p4metrics_policy.yaml")
+	if err != nil {
+		t.Fatalf("Failed to load sample policy: %v", err)
+	}
+	checkValue(t, "Name", p.Rules[0].Name, "security")
+	checkValue(t, "Name", p.Rules[len(p.Rules)-1].Name, "ssl")
+
+	for _, bad := range []string{
+		"rules:\n  - default: 1\n    value: 2\n",                                                   // no configurable or info
+		"rules:\n  - configurable: security\n    info: serverAddress\n    value: 2\n",              // both
+		"rules:\n  - configurable: security\n",                                                     // no check
+		"rules:\n  - configurable: security\n    value: 3\n    min: 3\n",                           // two checks
+		"rules:\n  - configurable: security\n    regex: '('\n",                                     // bad regex
+		"rules:\n  - configurable: security\n    min: 3\n  - configurable: security\n    max: 4\n", // duplicate
+		"rules:\n  - configurable: security\n    minimum: 3\n",                                     // unknown field
+	} {
+		if _, err := LoadPolicyString([]byte(bad)); err == nil {
+			t.Fatalf("Expected policy err not found: %q", bad)
+		}
+	}
+
+	// Relative to config file
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "policy.yaml"), []byte("rules:\n  - configurable: security\n    min: 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfgFile := filepath.Join(dir, "p4metrics.yaml")
+	if err := os.WriteFile(cfgFile, []byte("metrics_root: /hxlogs/metrics\nsecurity_policy: policy.yaml\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfigFile(cfgFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if cfg.Policy == nil || len(cfg.Policy.Rules) != 1 {
+		t.Fatalf("Expected security_policy to be loaded")
+	}
+	if err := os.WriteFile(cfgFile, []byte("metrics_root: /hxlogs/metrics\nsecurity_policy: missing.yaml\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfigFile(cfgFile); err == nil {
+		t.Fatalf("Expected missing security_policy to fail")
+	}
+}
+
+func TestPolicyRuleCheck(t *testing.T) {
+	p, err := LoadPolicyString([]byte(`rules:
+  - configurable: security
+    default: "0"
+    min: 3
+  - configurable: run.users.authorize
+    value: "1"
+  - configurable: auth.default.method
+    values: [perforce, ldap]
+  - info: serverAddress
+    regex: ^ssl
+`))
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+	tests := []struct {
+		rule  int
+		value string
+		found bool
+		pass  bool
+	}{
+		{0, "4", true, true},
+		{0, "2", true, false},
+		{0, "", false, false}, // default 0
+		{0, "x", true, false},
+		{1, "1", true, true},
+		{1, "", false, false}, // no default
+		{2, "ldap", true, true},
+		{2, "none", true, false},
+		{3, "ssl:1666", true, true},
+		{3, "1666", true, false},
+	}
+	for _, tc := range tests {
+		if pass := p.Rules[tc.rule].Check(tc.value, tc.found); pass != tc.pass {
+			t.Errorf("rule %s value %q: expected pass %v (%s)", p.Rules[tc.rule].Name, tc.value, tc.pass, p.Rules[tc.rule].Expected())
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// PolicyRule is a check of a configurable (from p4 configure show allservers) or p4 info field against expected values
+type PolicyRule struct {
+	Name         string         `yaml:"name"`         // Rule name used as label value - defaults to configurable or info field
+	Configurable string         `yaml:"configurable"` // Configurable to check, e.g. security
+	Info         string         `yaml:"info"`         // Or p4 -ztag info field to check, e.g. serverCertExpires
+	Default      string         `yaml:"default"`      // Value to assume if the configurable is not set (the p4d default)
+	Value        string         `yaml:"value"`        // Expected value
+	Values       []string       `yaml:"values"`       // Or list of allowed values
+	Min          *float64       `yaml:"min"`          // Or minimum numeric value
+	Max          *float64       `yaml:"max"`          // And/or maximum numeric value
+	Regex        string         `yaml:"regex"`        // Or Go regex the value must match
+	ReRegex      *regexp.Regexp `yaml:"-"`            // Compiled regex - not set from YAML
+}
+
+// Policy is a list of rules - the security baseline for p4d
+type Policy struct {
+	Rules []*PolicyRule `yaml:"rules"`
+}
+
+// Expected describes the values which pass the rule
+func (r *PolicyRule) Expected() string {
+	switch {
+	case r.Value != "":
+		return fmt.Sprintf("expected %q", r.Value)
+	case len(r.Values) > 0:
+		return fmt.Sprintf("expected one of %q", r.Values)
+	case r.Regex != "":
+		return fmt.Sprintf("expected to match %q", r.Regex)
+	}
+	expected := "expected"
+	if r.Min != nil {
+		expected += fmt.Sprintf(" >= %v", *r.Min)
+	}
+	if r.Max != nil {
+		expected += fmt.Sprintf(" <= %v", *r.Max)
+	}
+	return expected
+}
+
+// Check returns whether value (found false if not set, in which case the default is used) meets the rule
+func (r *PolicyRule) Check(value string, found bool) bool {
+	if !found {
+		if r.Default == "" {
+			return false
+		}
+		value = r.Default
+	}
+	switch {
+	case r.Value != "":
+		return value == r.Value
+	case len(r.Values) > 0:
+		for _, v := range r.Values {
+			if value == v {
+				return true
+			}
+		}
+		return false
+	case r.ReRegex != nil:
+		return r.ReRegex.MatchString(value)
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return false
+	}
+	return (r.Min == nil || v >= *r.Min) && (r.Max == nil || v <= *r.Max)
+}
+
+func (p *Policy) validate() error {
+	names := make(map[string]bool)
+	for i, r := range p.Rules {
+		if (r.Configurable == "") == (r.Info == "") {
+			return fmt.Errorf("rule %d: specify one of configurable or info", i+1)
+		}
+		if r.Name == "" {
+			r.Name = r.Configurable
+			if r.Info != "" {
+				r.Name = r.Info
+			}
+		}
+		if names[r.Name] {
+			return fmt.Errorf("rule %d: duplicate name %q", i+1, r.Name)
+		}
+		names[r.Name] = true
+		checks := 0
+		if r.Value != "" {
+			checks++
+		}
+		if len(r.Values) > 0 {
+			checks++
+		}
+		if r.Regex != "" {
+			checks++
+			var err error
+			if r.ReRegex, err = regexp.Compile(r.Regex); err != nil {
+				return fmt.Errorf("rule %q: invalid regex %q: %v", r.Name, r.Regex, err)
+			}
+		}
+		if r.Min != nil || r.Max != nil {
+			checks++
+		}
+		if checks != 1 {
+			return fmt.Errorf("rule %q: specify one of value, values, regex or min/max", r.Name)
+		}
+	}
+	return nil
+}
+
+// LoadPolicyString parses and validates a policy
+func LoadPolicyString(content []byte) (*Policy, error) {
+	p := &Policy{}
+	if err := yaml.UnmarshalStrict(content, p); err != nil {
+		return nil, err
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// LoadPolicyFile loads the security_policy file
+func LoadPolicyFile(filename string) (*Policy, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load security_policy %v: %v", filename, err)
+	}
+	p, err := LoadPolicyString(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load security_policy %v: %v", filename, err)
+	}
+	return p, nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuthMetric is the key for p4_auth_logins_count
+type AuthMetric struct {
+	Method string
+	Result string // success, failure or unknown
+}
+
+// AuthRecord holds the interesting fields from a single parsed auth.csv line
+type AuthRecord struct {
+	Method    string
+	Result    string
+	User      string
+	IP        string
+	Timestamp time.Time
+}
+
+// Field names for the Auth record (auth.csv) from p4 logschema -a. f_host is the client IP address.
+const (
+	authMethodField = "f_authmethod"
+	authStatusField = "f_status"
+	authIPField     = "f_host"
+)
+
+// topNCounter counts by a label value (e.g. user). At most topN values are output with their own label,
+// the rest being summed as "other". Values are allocated their own label in order of count, and allocations
+// are kept so that counters stay monotonic - counts already output as "other" stay in "other".
+type topNCounter struct {
+	Counts        map[string]int  `json:"counts"`
+	Allocated     map[string]bool `json:"allocated"`
+	Offsets       map[string]int  `json:"offsets,omitempty"`
+	ReportedOther map[string]int  `json:"reported_other,omitempty"`
+}
+
+func newTopNCounter() *topNCounter {
+	return &topNCounter{
+		Counts:        make(map[string]int),
+		Allocated:     make(map[string]bool),
+		Offsets:       make(map[string]int),
+		ReportedOther: make(map[string]int),
+	}
+}
+
+// clone returns a copy - also allocating any maps missing when loaded from the state file
+func (c *topNCounter) clone() *topNCounter {
+	result := newTopNCounter()
+	for k, v := range c.Counts {
+		result.Counts[k] = v
+	}
+	for k, v := range c.Allocated {
+		result.Allocated[k] = v
+	}
+	for k, v := range c.Offsets {
+		result.Offsets[k] = v
+	}
+	for k, v := range c.ReportedOther {
+		result.ReportedOther[k] = v
+	}
+	return result
+}
+
+func (c *topNCounter) inc(key string) {
+	c.Counts[key] += 1
+}
+
+// labelled returns counts by label value, with values not allocated their own label summed as "other"
+func (c *topNCounter) labelled(topN int) map[string]int {
+	candidates := make([]string, 0)
+	for k := range c.Counts {
+		if !c.Allocated[k] {
+			candidates = append(candidates, k)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if c.Counts[candidates[i]] != c.Counts[candidates[j]] {
+			return c.Counts[candidates[i]] > c.Counts[candidates[j]]
+		}
+		return candidates[i] < candidates[j]
+	})
+	for _, k := range candidates {
+		if len(c.Allocated) >= topN {
+			break
+		}
+		c.Allocated[k] = true
+		c.Offsets[k] = c.ReportedOther[k]
+	}
+	result := make(map[string]int)
+	for k, count := range c.Counts {
+		if c.Allocated[k] {
+			result[k] += count - c.Offsets[k]
+			result["other"] += c.Offsets[k]
+		} else {
+			result["other"] += count
+			c.ReportedOther[k] = count
+		}
+	}
+	if result["other"] == 0 {
+		delete(result, "other")
+	}
+	return result
+}
+
+// authResult normalises the f_status of an auth record to success or failure. Anything else is "unknown" rather
+// than a failure, so that new or unexpected values don't trigger brute force alerts.
+func authResult(status string) string {
+	switch strings.ToLower(strings.TrimSpace(status)) {
+	case "success":
+		return "success"
+	case "failure":
+		return "failure"
+	}
+	return "unknown"
+}
+
+// parseAuthRecord parses an auth.csv line using the schema for its record type
+func (p4m *P4MonitorMetrics) parseAuthRecord(line string) (*AuthRecord, error) {
+	fields, rs, err := p4m.parseLogRecord(line)
+	if err != nil {
+		return nil, err
+	}
+	rec := &AuthRecord{
+		Method: strings.TrimSpace(rs.field(fields, authMethodField)),
+		Result: authResult(rs.field(fields, authStatusField)),
+		User:   strings.TrimSpace(rs.field(fields, "f_user")),
+		IP:     strings.TrimSpace(rs.field(fields, authIPField)),
+	}
+	if rec.Method == "" {
+		rec.Method = "unknown"
+	}
+	if secs, err := strconv.ParseInt(strings.TrimSpace(rs.field(fields, "f_timestamp")), 10, 64); err == nil && secs > 0 {
+		rec.Timestamp = time.Unix(secs, 0)
+	} else {
+		rec.Timestamp = time.Now()
+	}
+	return rec, nil
+}
+
+// countAuthLine parses the line and updates counters. Must be called with authLock held.
+func (p4m *P4MonitorMetrics) countAuthLine(line string) {
+	rec, err := p4m.parseAuthRecord(line)
+	if err != nil {
+		p4m.logger.Debugf("Failed to parse auth line %q: %v", line, err)
+		p4m.authParseFailures++
+		return
+	}
+	p4m.authLogins[AuthMetric{Method: rec.Method, Result: rec.Result}] += 1
+	if p4m.config.AuthByUser {
+		if _, ok := p4m.authByUser[rec.Result]; !ok {
+			p4m.authByUser[rec.Result] = newTopNCounter()
+		}
+		p4m.authByUser[rec.Result].inc(rec.User)
+	}
+	if p4m.config.AuthByIP {
+		if _, ok := p4m.authByIP[rec.Result]; !ok {
+			p4m.authByIP[rec.Result] = newTopNCounter()
+		}
+		p4m.authByIP[rec.Result].inc(rec.IP)
+	}
+	if rec.Result == "failure" && time.Since(rec.Timestamp) < p4m.config.AuthFailedWindow {
+		// User names are only kept (and so saved in state) if auth_by_user is set
+		user := ""
+		if p4m.config.AuthByUser {
+			user = rec.User
+		}
+		p4m.authFailures[user] = append(p4m.authFailures[user], rec.Timestamp)
+	}
+}
+
+// recentAuthFailures drops failures outside auth_failed_window and returns the count per user.
+// Must be called with authLock held.
+func (p4m *P4MonitorMetrics) recentAuthFailures() map[string]int {
+	cutoff := time.Now().Add(-p4m.config.AuthFailedWindow)
+	result := make(map[string]int)
+	for user, times := range p4m.authFailures {
+		recent := times[:0]
+		for _, t := range times {
+			if t.After(cutoff) {
+				recent = append(recent, t)
+			}
+		}
+		if len(recent) == 0 {
+			delete(p4m.authFailures, user)
+			continue
+		}
+		p4m.authFailures[user] = recent
+		result[user] = len(recent)
+	}
+	return result
+}
+
+func (p4m *P4MonitorMetrics) setupAuthMonitoring() {
+	p4m.logger.Debugf("setupAuthMonitoring starting")
+	if p4m.p4authCSV == "" {
+		p4m.logger.Debugf("setupAuthMonitoring exiting as no auth.csv")
+		return
+	}
+	p4m.authLog.path = p4m.p4authCSV
+	p4m.setupStructuredLog(p4m.authLog)
+}
+
+func (p4m *P4MonitorMetrics) monitorAuth() {
+	p4m.startMonitor("monitorAuth", "p4_auth")
+	defer p4m.completeMonitor()
+	if p4m.p4authCSV == "" {
+		return
+	}
+	p4m.authLock.Lock()
+	defer p4m.authLock.Unlock()
+
+	keys := make([]AuthMetric, 0, len(p4m.authLogins))
+	for m := range p4m.authLogins {
+		keys = append(keys, m)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Method != keys[j].Method {
+			return keys[i].Method < keys[j].Method
+		}
+		return keys[i].Result < keys[j].Result
+	})
+	for _, m := range keys {
+		p4m.metrics = append(p4m.metrics,
+			metricStruct{name: "p4_auth_logins_count",
+				help:  "P4D login attempts from auth.csv by auth method and result",
+				mtype: "counter",
+				value: fmt.Sprintf("%d", p4m.authLogins[m]),
+				labels: []labelStruct{{name: "method", value: m.Method},
+					{name: "result", value: m.Result},
+				}})
+	}
+	p4m.metrics = append(p4m.metrics,
+		metricStruct{name: "p4_auth_parse_failures",
+			help:  "Count of auth.csv lines which could not be parsed",
+			mtype: "counter",
+			value: fmt.Sprintf("%d", p4m.authParseFailures)})
+	for _, byLabel := range []struct {
+		enabled           bool
+		name, help, label string
+		counters          map[string]*topNCounter
+	}{
+		{p4m.config.AuthByUser, "p4_auth_logins_by_user", "P4D login attempts by user and result", "user", p4m.authByUser},
+		{p4m.config.AuthByIP, "p4_auth_logins_by_ip", "P4D login attempts by IP address and result", "ip", p4m.authByIP},
+	} {
+		if !byLabel.enabled {
+			continue
+		}
+		results := make([]string, 0, len(byLabel.counters))
+		for r := range byLabel.counters {
+			results = append(results, r)
+		}
+		sort.Strings(results)
+		for _, r := range results {
+			counts := byLabel.counters[r].labelled(p4m.config.AuthTopN)
+			names := make([]string, 0, len(counts))
+			for k := range counts {
+				names = append(names, k)
+			}
+			sort.Strings(names)
+			for _, k := range names {
+				p4m.metrics = append(p4m.metrics,
+					metricStruct{name: byLabel.name,
+						help:  byLabel.help,
+						mtype: "counter",
+						value: fmt.Sprintf("%d", counts[k]),
+						labels: []labelStruct{{name: byLabel.label, value: k},
+							{name: "result", value: r},
+						}})
+			}
+		}
+	}
+	recent := p4m.recentAuthFailures()
+	if !p4m.config.AuthByUser {
+		total := 0
+		for _, c := range recent {
+			total += c
+		}
+		p4m.metrics = append(p4m.metrics,
+			metricStruct{name: "p4_auth_failed_logins_recent",
+				help:  fmt.Sprintf("P4D failed logins in the last %v (auth_failed_window)", p4m.config.AuthFailedWindow),
+				mtype: "gauge",
+				value: fmt.Sprintf("%d", total)})
+		p4m.writeMetricsFile()
+		return
+	}
+	users := make([]string, 0, len(recent))
+	for u := range recent {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if recent[users[i]] != recent[users[j]] {
+			return recent[users[i]] > recent[users[j]]
+		}
+		return users[i] < users[j]
+	})
+	if len(users) > p4m.config.AuthTopN {
+		users = users[:p4m.config.AuthTopN]
+	}
+	for _, u := range users {
+		p4m.metrics = append(p4m.metrics,
+			metricStruct{name: "p4_auth_failed_logins_recent",
+				help:   fmt.Sprintf("P4D failed logins by user in the last %v (auth_failed_window)", p4m.config.AuthFailedWindow),
+				mtype:  "gauge",
+				value:  fmt.Sprintf("%d", recent[u]),
+				labels: []labelStruct{{name: "user", value: u}}})
+	}
+	p4m.writeMetricsFile()
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Canary steps in the order run
+var canarySteps = []string{"setup", "info", "sync", "submit", "print", "cleanup"}
+
+var defaultCanaryBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	reCanarySubmitted = regexp.MustCompile(`Change (\d+) (?:renamed change \d+ and )?submitted`)
+	reCanaryPending   = regexp.MustCompile(`p4 submit -c (\d+)`)
+	reCanaryHeadRev   = regexp.MustCompile(`headRev (\d+)`)
+	reCanaryChange    = regexp.MustCompile(`^Change (\d+) `)
+)
+
+// canaryResult is the outcome of one step of the canary
+type canaryResult struct {
+	ok      bool
+	skipped bool // Not run because an earlier step failed
+	elapsed time.Duration
+}
+
+func (p4m *P4MonitorMetrics) canaryClient() string {
+	if p4m.config.CanaryClient != "" {
+		return p4m.config.CanaryClient
+	}
+	return fmt.Sprintf("p4metrics_canary_%s", p4m.serverID)
+}
+
+func (p4m *P4MonitorMetrics) canaryRoot() string {
+	if p4m.config.CanaryRoot != "" {
+		return p4m.config.CanaryRoot
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("p4metrics_canary%s-%s", p4m.sdpInstanceSuffix, p4m.serverID))
+}
+
+func (p4m *P4MonitorMetrics) canaryBuckets() []float64 {
+	if len(p4m.config.CanaryBuckets) > 0 {
+		return p4m.config.CanaryBuckets
+	}
+	return defaultCanaryBuckets
+}
+
+// canaryClientSpec returns the spec for the canary workspace - mapping only canary_depot_path
+func (p4m *P4MonitorMetrics) canaryClientSpec() string {
+	client := p4m.canaryClient()
+	return fmt.Sprintf("Client: %s\n\nOwner: %s\n\nRoot: %s\n\nOptions: allwrite clobber nocompress unlocked nomodtime rmdir\n\n"+
+		"LineEnd: local\n\nDescription:\n\tp4metrics canary workspace - see canary in p4metrics.yaml\n\nView:\n\t\"%s/...\" \"//%s/...\"\n",
+		client, p4m.p4User, p4m.canaryRoot(), p4m.config.CanaryDepotPath, client)
+}
+
+// runCanary runs the canary steps in order, stopping at the first failure (apart from cleanup which is always run).
+// After a successful submit, cleanup removes the history of earlier runs so that changes don't build up.
+func (p4m *P4MonitorMetrics) runCanary() map[string]*canaryResult {
+	results := make(map[string]*canaryResult)
+	r := p4m.p4Runner
+	client := p4m.canaryClient()
+	fileName := fmt.Sprintf("canary-%s.txt", p4m.serverID)
+	depotFile := fmt.Sprintf("%s/%s", p4m.config.CanaryDepotPath, fileName)
+	localFile := filepath.Join(p4m.canaryRoot(), fileName)
+	content := fmt.Sprintf("p4metrics canary %s %d", p4m.serverID, time.Now().UnixNano())
+	failed := false
+	prevHeadRev := 0 // Head revision of the canary file before this run's submit
+	submitted := ""  // Change submitted by this run
+
+	step := func(name string, fn func() error) {
+		if failed && name != "cleanup" {
+			results[name] = &canaryResult{skipped: true}
+			return
+		}
+		start := time.Now()
+		err := fn()
+		results[name] = &canaryResult{ok: err == nil, elapsed: time.Since(start)}
+		if err != nil {
+			p4m.logger.Warnf("Canary step %s failed: %v", name, err)
+			failed = true
+		}
+	}
+
+	step("setup", func() error {
+		if p4m.canaryReady {
+			return nil
+		}
+		if err := os.MkdirAll(p4m.canaryRoot(), 0755); err != nil {
+			return err
+		}
+		if _, err := r.Run("client -i", p4m.canaryClientSpec()); err != nil {
+			return err
+		}
+		p4m.canaryReady = true
+		return nil
+	})
+	step("info", func() error {
+		lines, err := r.Run("info -s", "")
+		if err != nil {
+			return err
+		}
+		if parseInfoLines(lines)["Server version"] == "" {
+			return fmt.Errorf("no server version in p4 info")
+		}
+		return nil
+	})
+	step("sync", func() error {
+		_, err := r.Run(fmt.Sprintf("-c %s sync -f \"%s/...\"", client, p4m.config.CanaryDepotPath), "")
+		if err != nil && !strings.Contains(err.Error(), "no such file") && !strings.Contains(err.Error(), "up-to-date") {
+			return err
+		}
+		return nil
+	})
+	step("submit", func() error {
+		lines, err := r.Run(fmt.Sprintf("fstat -T headRev,headAction \"%s\"", depotFile), "")
+		action := "add -t text+S"
+		if m := reCanaryHeadRev.FindStringSubmatch(strings.Join(lines, " ")); err == nil && m != nil {
+			prevHeadRev, _ = strconv.Atoi(m[1])
+			if !strings.Contains(strings.Join(lines, " "), "delete") {
+				action = "edit"
+			}
+		}
+		if err := os.WriteFile(localFile, []byte(content+"\n"), 0644); err != nil {
+			return err
+		}
+		if _, err := r.Run(fmt.Sprintf("-c %s %s \"%s\"", client, action, localFile), ""); err != nil {
+			p4m.canaryRevert(client, localFile, "")
+			return err
+		}
+		lines, err = r.Run(fmt.Sprintf("-c %s submit -d \"p4metrics canary\" \"%s\"", client, localFile), "")
+		if err != nil {
+			p4m.canaryRevert(client, localFile, err.Error()+strings.Join(lines, " "))
+			return err
+		}
+		m := reCanarySubmitted.FindStringSubmatch(strings.Join(lines, "\n"))
+		if m == nil {
+			return fmt.Errorf("no submitted change in output: %q", lines)
+		}
+		submitted = m[1]
+		return nil
+	})
+	step("print", func() error {
+		lines, err := r.Run(fmt.Sprintf("print -q \"%s\"", depotFile), "")
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(strings.Join(lines, "\n")) != content {
+			return fmt.Errorf("printed content %q does not match submitted %q", lines, content)
+		}
+		return nil
+	})
+	step("cleanup", func() error {
+		// Revert anything left open in the canary workspace (e.g. by an interrupted run) and delete its pending changes.
+		// Deleting without -f fails if a change still has files, so submitted history is never touched.
+		if _, err := r.Run(fmt.Sprintf("-c %s revert \"//%s/...\"", client, client), ""); err != nil &&
+			!strings.Contains(err.Error(), "not opened") {
+			return err
+		}
+		lines, err := r.Run(fmt.Sprintf("changes -s pending -c %s", client), "")
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			if m := reCanaryChange.FindStringSubmatch(line); m != nil {
+				if _, err := r.Run(fmt.Sprintf("-c %s change -d %s", client, m[1]), ""); err != nil {
+					return err
+				}
+			}
+		}
+		if submitted == "" {
+			return nil
+		}
+		// Remove earlier runs: older revisions of the canary file only, then the canary workspace's other submitted
+		// changes. p4 refuses to delete a submitted change which still has files, even with -f, so anything
+		// else submitted from the workspace is left alone.
+		if prevHeadRev > 0 {
+			if _, err := r.Run(fmt.Sprintf("obliterate -y \"%s#1,#%d\"", depotFile, prevHeadRev), ""); err != nil {
+				return err
+			}
+		}
+		lines, err = r.Run(fmt.Sprintf("changes -s submitted -c %s", client), "")
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			if m := reCanaryChange.FindStringSubmatch(line); m != nil && m[1] != submitted {
+				if _, err := r.Run(fmt.Sprintf("-c %s change -d -f %s", client, m[1]), ""); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return results
+}
+
+// canaryRevert reverts the canary file and deletes any pending change left by a failed submit
+func (p4m *P4MonitorMetrics) canaryRevert(client, localFile, submitOutput string) {
+	if _, err := p4m.p4Runner.Run(fmt.Sprintf("-c %s revert \"%s\"", client, localFile), ""); err != nil {
+		p4m.logger.Warnf("Canary failed to revert: %v", err)
+	}
+	if m := reCanaryPending.FindStringSubmatch(submitOutput); m != nil {
+		if _, err := p4m.p4Runner.Run(fmt.Sprintf("-c %s change -d %s", client, m[1]), ""); err != nil {
+			p4m.logger.Warnf("Canary failed to delete pending change %s: %v", m[1], err)
+		}
+	}
+}
+
+func (p4m *P4MonitorMetrics) monitorCanary() {
+	if !p4m.config.Canary || !p4m.intervalDue("monitorCanary", p4m.config.CanaryInterval) {
+		return
+	}
+	p4m.startMonitor("monitorCanary", "p4_canary")
+	defer p4m.completeMonitor()
+	results := p4m.runCanary()
+	buckets := p4m.canaryBuckets()
+	allOK := "1"
+	for _, name := range canarySteps {
+		res := results[name]
+		if res == nil || res.skipped {
+			allOK = "0"
+			continue
+		}
+		if _, ok := p4m.canaryDurations[name]; !ok {
+			p4m.canaryDurations[name] = newDurationHistogram(buckets)
+		}
+		p4m.canaryDurations[name].observe(buckets, res.elapsed.Seconds())
+		if !res.ok {
+			p4m.canaryFailures[name] += 1
+			allOK = "0"
+		}
+	}
+	p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_canary_success",
+		help:  "Whether all steps of the most recent canary run succeeded",
+		mtype: "gauge",
+		value: allOK})
+	p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_canary_last_run_time",
+		help:  "Time (epoch secs) of the most recent canary run",
+		mtype: "gauge",
+		value: fmt.Sprintf("%d", time.Now().Unix())})
+	for _, name := range canarySteps {
+		res := results[name]
+		if res == nil || res.skipped {
+			continue
+		}
+		ok := "0"
+		if res.ok {
+			ok = "1"
+		}
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_canary_step_success",
+			help:   "Whether the canary step succeeded in the most recent run (not output if skipped due to an earlier failure)",
+			mtype:  "gauge",
+			value:  ok,
+			labels: []labelStruct{{name: "step", value: name}}})
+	}
+	for _, name := range canarySteps {
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_canary_step_failures_count",
+			help:   "Count of canary step failures",
+			mtype:  "counter",
+			value:  fmt.Sprintf("%d", p4m.canaryFailures[name]),
+			labels: []labelStruct{{name: "step", value: name}}})
+	}
+	for _, name := range canarySteps {
+		if h, ok := p4m.canaryDurations[name]; ok {
+			p4m.metrics = append(p4m.metrics, h.metrics("p4_canary_step_duration_seconds",
+				"Canary step duration in seconds", buckets, labelStruct{name: "step", value: name})...)
+		}
+	}
+	p4m.writeMetricsFile()
+}
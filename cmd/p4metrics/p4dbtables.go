@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// P4D db page size - used to convert between bytes and pages
+const dbPageSize = 8192
+
+// DBTable is the size of a db.* table in P4ROOT
+type DBTable struct {
+	Name  string // Without the db. prefix
+	Bytes int64
+	Pages int64
+}
+
+// p4 dbstat -s gives sizes only - fragmentation comes from p4 dbstat -f <table>, which scans the whole
+// table so is run for one table at a time in the background, e.g.
+//
+//	db.have internal+leaf 3+1240 pages, 97% / 76% full, 2 levels, 101432 items, 9.7M, 12.5% fragmented
+var (
+	reDBStatTable = regexp.MustCompile(`^db\.(\S+)\s+([\d,]+)\s+pages?`)
+	reDBStatFrag  = regexp.MustCompile(`^db\.(\S+)\s.*?(?:([\d.]+)%\s*fragmented|fragmentation:?\s*([\d.]+)%)`)
+)
+
+// parseDBStatFrag returns the table and fragmentation percent from p4 dbstat -f output
+func parseDBStatFrag(lines []string) (string, float64, bool) {
+	for _, line := range lines {
+		m := reDBStatFrag.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		pct := m[2]
+		if pct == "" {
+			pct = m[3]
+		}
+		if v, err := strconv.ParseFloat(pct, 64); err == nil {
+			return m[1], v, true
+		}
+	}
+	return "", 0, false
+}
+
+// scanDBFragmentation runs p4 dbstat -f for each table in turn, sleeping for db_fragmentation_delay between tables
+func (p4m *P4MonitorMetrics) scanDBFragmentation(tables []string, sleep func(time.Duration)) map[string]float64 {
+	frag := make(map[string]float64, len(tables))
+	for i, t := range tables {
+		if i > 0 {
+			sleep(p4m.config.DBFragmentationDelay)
+		}
+		lines, err := p4m.p4Runner.Run(fmt.Sprintf("dbstat -f db.%s", t), "")
+		if err != nil {
+			p4m.logger.Errorf("Error running dbstat -f db.%s: %v", t, err)
+			continue
+		}
+		if name, v, ok := parseDBStatFrag(lines); ok && name == t {
+			frag[t] = v
+		} else {
+			p4m.logger.Debugf("No fragmentation in dbstat -f db.%s output: %q", t, lines)
+		}
+	}
+	return frag
+}
+
+// startDBFragmentationScan starts a background scan of the tables unless one is already running - results are
+// output on the next long_update_interval
+func (p4m *P4MonitorMetrics) startDBFragmentationScan(tables []*DBTable) {
+	if !p4m.config.MonitorDBFragmentation {
+		return
+	}
+	if !p4m.isSuper {
+		p4m.logger.Debugf("monitorDBTables: p4 dbstat -f requires super user")
+		return
+	}
+	p4m.dbFragLock.Lock()
+	defer p4m.dbFragLock.Unlock()
+	if p4m.dbFragScanning {
+		return
+	}
+	p4m.dbFragScanning = true
+	names := make([]string, 0, len(tables))
+	for _, t := range tables {
+		names = append(names, t.Name)
+	}
+	go func() {
+		frag := p4m.scanDBFragmentation(names, time.Sleep)
+		p4m.dbFragLock.Lock()
+		defer p4m.dbFragLock.Unlock()
+		p4m.dbFragScanning = false
+		p4m.dbFrag = frag
+	}()
+}
+
+// parseDBStat parses p4 dbstat -s output
+func parseDBStat(lines []string) []*DBTable {
+	tables := make([]*DBTable, 0)
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		m := reDBStatTable.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		pages, err := strconv.ParseInt(strings.ReplaceAll(m[2], ",", ""), 10, 64)
+		if err != nil {
+			continue
+		}
+		tables = append(tables, &DBTable{Name: m[1], Pages: pages, Bytes: pages * dbPageSize})
+	}
+	return tables
+}
+
+// statDBTables stats the db.* files in P4ROOT
+func statDBTables(p4root string) ([]*DBTable, error) {
+	files, err := filepath.Glob(filepath.Join(p4root, "db.*"))
+	if err != nil {
+		return nil, err
+	}
+	tables := make([]*DBTable, 0, len(files))
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		tables = append(tables, &DBTable{Name: strings.TrimPrefix(filepath.Base(f), "db."), Bytes: fi.Size(),
+			Pages: fi.Size() / dbPageSize})
+	}
+	return tables, nil
+}
+
+// localP4Root returns true if the db files in P4ROOT can be read directly
+func (p4m *P4MonitorMetrics) localP4Root() bool {
+	if !p4m.monitorEnabled("monitorDBTablesLocal") || p4m.p4root == "" {
+		return false
+	}
+	fi, err := os.Stat(p4m.p4root)
+	return err == nil && fi.IsDir()
+}
+
+// dbTableMetrics outputs table sizes, growth since the previous sample and fragmentation from the most recent dbstat -f scan
+func (p4m *P4MonitorMetrics) dbTableMetrics(tables []*DBTable, now time.Time) {
+	sort.Slice(tables, func(i, j int) bool { return tables[i].Name < tables[j].Name })
+	p4m.dbFragLock.Lock()
+	frag := p4m.dbFrag
+	p4m.dbFragLock.Unlock()
+	hours := now.Sub(p4m.dbTablesSampled).Hours()
+	for _, t := range tables {
+		labels := []labelStruct{{name: "table", value: t.Name}}
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_db_table_bytes",
+			help:   "Size of db table in P4ROOT in bytes",
+			mtype:  "gauge",
+			value:  fmt.Sprintf("%d", t.Bytes),
+			labels: labels})
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_db_table_pages",
+			help:   "Size of db table in P4ROOT in pages",
+			mtype:  "gauge",
+			value:  fmt.Sprintf("%d", t.Pages),
+			labels: labels})
+		if prev, ok := p4m.dbTablesPrev[t.Name]; ok && hours > 0 {
+			p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_db_table_growth_bytes_per_hour",
+				help:   "Growth of db table in bytes per hour since the previous sample (long_update_interval)",
+				mtype:  "gauge",
+				value:  fmt.Sprintf("%.0f", float64(t.Bytes-prev)/hours),
+				labels: labels})
+		}
+		if v, ok := frag[t.Name]; ok {
+			p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_db_table_fragmentation_percent",
+				help:   "Fragmentation of db table as reported by p4 dbstat -f (most recent background scan)",
+				mtype:  "gauge",
+				value:  fmt.Sprintf("%.1f", v),
+				labels: labels})
+		}
+	}
+	p4m.dbTablesPrev = make(map[string]int64, len(tables))
+	for _, t := range tables {
+		p4m.dbTablesPrev[t.Name] = t.Bytes
+	}
+	p4m.dbTablesSampled = now
+}
+
+func (p4m *P4MonitorMetrics) monitorDBTables() {
+	// Size of db.* tables - from P4ROOT if local, otherwise p4 dbstat -s (which requires super)
+	if !p4m.config.MonitorDBTables || !p4m.longIntervalDue("monitorDBTables") {
+		return
+	}
+	p4m.startMonitor("monitorDBTables", "p4_db_table")
+	defer p4m.completeMonitor()
+	var tables []*DBTable
+	if p4m.localP4Root() {
+		var err error
+		if tables, err = statDBTables(p4m.p4root); err != nil {
+			p4m.logger.Errorf("Error reading db tables in %s: %v", p4m.p4root, err)
+			return
+		}
+	} else {
+		if !p4m.isSuper {
+			p4m.logger.Debugf("monitorDBTables: p4 dbstat requires super user")
+			return
+		}
+		p4cmd, errbuf, p := p4m.newP4CmdPipe("dbstat -s")
+		lines, err := p.Exec(p4cmd).Slice()
+		if err != nil {
+			p4m.handleP4Error("Error running %s: %v, err:%q", p4cmd, err, errbuf)
+			return
+		}
+		tables = parseDBStat(lines)
+	}
+	p4m.dbTableMetrics(tables, time.Now())
+	p4m.writeMetricsFile()
+	p4m.startDBFragmentationScan(tables)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// driftArtefacts are the p4 commands snapshotted to detect configuration drift - in output order
+var driftArtefacts = []struct {
+	name string
+	args string
+}{
+	{"configure", "configure show allservers"},
+	{"triggers", "triggers -o"},
+	{"protect", "protect -o"},
+	{"typemap", "typemap -o"},
+}
+
+// driftContent removes comments from spec output - these are help text which changes with p4d version
+func driftContent(lines []string) string {
+	var sb strings.Builder
+	for _, line := range lines {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		sb.WriteString(strings.TrimRight(line, " \t\r"))
+		sb.WriteString("\n")
+	}
+	return strings.TrimSpace(sb.String()) + "\n"
+}
+
+func driftHash(content string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(content)))[:16]
+}
+
+// driftDir defaults to state_dir or the SDP logs dir - never metrics_root, which is typically readable by
+// node_exporter and others. Returns "" if none are set.
+func (p4m *P4MonitorMetrics) driftDir() string {
+	if p4m.config.DriftDir != "" {
+		return p4m.config.DriftDir
+	}
+	dir := p4m.config.StateDir
+	if dir == "" {
+		dir = p4m.logsDir
+	}
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, fmt.Sprintf("p4metrics_drift%s-%s", p4m.sdpInstanceSuffix, p4m.serverID))
+}
+
+func (p4m *P4MonitorMetrics) driftLog() string {
+	if p4m.config.DriftLog != "" {
+		return p4m.config.DriftLog
+	}
+	return filepath.Join(p4m.driftDir(), "drift.log")
+}
+
+// checkDrift compares the content with the previous snapshot, writing a diff to the drift log and saving the new
+// snapshot if changed. Returns the time of the last change - the modification time of the snapshot file.
+func (p4m *P4MonitorMetrics) checkDrift(name, content string, now time.Time) (time.Time, bool, error) {
+	snapshot := filepath.Join(p4m.driftDir(), name+".txt")
+	prev, err := os.ReadFile(snapshot)
+	if err == nil && string(prev) == content {
+		fi, err := os.Stat(snapshot)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		return fi.ModTime(), false, nil
+	}
+	changed := err == nil // No drift reported for the first snapshot
+	if changed {
+		diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        difflib.SplitLines(string(prev)),
+			B:        difflib.SplitLines(content),
+			FromFile: name + " (previous)",
+			ToFile:   name,
+			Context:  3,
+		})
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		// Diffs include protections and configurables (which may hold credentials) so only the owner can read them
+		f, err := os.OpenFile(p4m.driftLog(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		if err := f.Chmod(0600); err != nil {
+			f.Close()
+			return time.Time{}, false, err
+		}
+		fmt.Fprintf(f, "=== %s %s changed on %s\n%s\n", now.Format(time.RFC3339), name, p4m.serverID, diff)
+		if err := f.Close(); err != nil {
+			return time.Time{}, false, err
+		}
+		p4m.logger.Warnf("Drift: %s changed - see %s", name, p4m.driftLog())
+	}
+	if err := os.WriteFile(snapshot, []byte(content), 0600); err != nil {
+		return time.Time{}, false, err
+	}
+	if err := os.Chtimes(snapshot, now, now); err != nil {
+		return time.Time{}, false, err
+	}
+	return now, changed, nil
+}
+
+func (p4m *P4MonitorMetrics) monitorDrift() {
+	// Changes to configurables, triggers, protections and typemap - snapshots are kept in drift_dir
+	if !p4m.config.MonitorDrift {
+		return
+	}
+	if !p4m.isSuper {
+		p4m.logger.Debugf("monitorDrift: requires super user")
+		return
+	}
+	if p4m.driftDir() == "" {
+		p4m.logger.Errorf("monitorDrift: requires drift_dir or state_dir to be set (or sdp_instance)")
+		return
+	}
+	p4m.startMonitor("monitorDrift", "p4_drift")
+	defer p4m.completeMonitor()
+	// Snapshots include protections and configurables, so drift_dir is only accessible by the owner - including
+	// any created by earlier versions
+	if err := os.MkdirAll(p4m.driftDir(), 0700); err != nil {
+		p4m.logger.Errorf("Error creating drift_dir: %v", err)
+		return
+	}
+	if err := os.Chmod(p4m.driftDir(), 0700); err != nil {
+		p4m.logger.Errorf("Error setting permissions of drift_dir: %v", err)
+		return
+	}
+	now := time.Now()
+	for _, a := range driftArtefacts {
+		lines, err := p4m.p4Runner.Run(a.args, "")
+		if err != nil {
+			p4m.logger.Errorf("Error running %s: %v", a.args, err)
+			continue
+		}
+		content := driftContent(lines)
+		lastChanged, changed, err := p4m.checkDrift(a.name, content, now)
+		if err != nil {
+			p4m.logger.Errorf("Error checking drift of %s: %v", a.name, err)
+			continue
+		}
+		if changed {
+			p4m.driftChanges[a.name] += 1
+		}
+		labels := []labelStruct{{name: "artefact", value: a.name}}
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_drift_hash_info",
+			help:  "Hash of the current content (comments removed) of configurables, triggers, protect and typemap",
+			mtype: "gauge",
+			value: "1",
+			labels: []labelStruct{{name: "artefact", value: a.name},
+				{name: "hash", value: driftHash(content)}}})
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_drift_last_changed_time",
+			help:   "Time (epoch secs) the content last changed - or was first snapshotted",
+			mtype:  "gauge",
+			value:  fmt.Sprintf("%d", lastChanged.Unix()),
+			labels: labels})
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_drift_changes_count",
+			help:   "Count of changes detected since p4metrics started - diffs are written to drift_log",
+			mtype:  "counter",
+			value:  fmt.Sprintf("%d", p4m.driftChanges[a.name]),
+			labels: labels})
+	}
+	p4m.writeMetricsFile()
+}
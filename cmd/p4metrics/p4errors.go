@@ -2,12 +2,17 @@
 package main
 
 import (
+	"encoding/csv"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/perforce/p4prometheus/errlookup"
 	"github.com/rcowham/go-libtail/tailer"
 	"github.com/rcowham/go-libtail/tailer/fswatcher"
 	"github.com/rcowham/go-libtail/tailer/glob"
@@ -173,21 +178,99 @@ func ParseLogSchema(lines []string) []LogSchema {
 	return records
 }
 
+// ErrorRecordSchema holds the field indexes of one record type and version from p4 logschema -a
+type ErrorRecordSchema struct {
+	RecordType    string
+	RecordVersion int
+	RecordName    string
+	FieldCount    int
+	Fields        map[string]int // Field name (e.g. f_severity) -> index in CSV line
+}
+
+// ErrorRecord holds the interesting fields from a single parsed errors.csv line
+type ErrorRecord struct {
+	RecordName string // e.g. Error or FatalError
+	Severity   string
+	Subsystem  string // Name, e.g. DM
+	Subcode    string
+	Name       string // e.g. CLIENT_LockCheckFail from errlookup, or <Subsystem>_<Subcode> if not known
+	User       string
+	Command    string // f_func
+	Program    string // f_prog
+}
+
+// buildErrorSchemas groups parsed logschema records by record type, with versions in descending order
+func buildErrorSchemas(schema []LogSchema) map[string][]*ErrorRecordSchema {
+	byTypeVersion := make(map[string]*ErrorRecordSchema)
+	for _, s := range schema {
+		version, _ := strconv.Atoi(s.RecordVersion)
+		k := fmt.Sprintf("%s:%d", s.RecordType, version)
+		rs, ok := byTypeVersion[k]
+		if !ok {
+			rs = &ErrorRecordSchema{RecordType: s.RecordType, RecordVersion: version,
+				RecordName: s.RecordName, Fields: make(map[string]int)}
+			byTypeVersion[k] = rs
+		}
+		rs.Fields[s.Name] = s.FieldIndex
+		if s.FieldIndex+1 > rs.FieldCount {
+			rs.FieldCount = s.FieldIndex + 1
+		}
+	}
+	result := make(map[string][]*ErrorRecordSchema)
+	for _, rs := range byTypeVersion {
+		result[rs.RecordType] = append(result[rs.RecordType], rs)
+	}
+	for _, versions := range result {
+		sort.Slice(versions, func(i, j int) bool { return versions[i].RecordVersion > versions[j].RecordVersion })
+	}
+	return result
+}
+
+// findErrorSchema returns the schema for a line's record type and version. The version isn't recorded in the line
+// so it is chosen by field count: the newest version with an exact match, otherwise the newest version
+// with fewer fields (allowing for fields added by newer p4d versions), otherwise nil.
+func findErrorSchema(schemas map[string][]*ErrorRecordSchema, recordType string, fieldCount int) *ErrorRecordSchema {
+	versions := schemas[recordType]
+	for _, rs := range versions {
+		if rs.FieldCount == fieldCount {
+			return rs
+		}
+	}
+	for _, rs := range versions {
+		if rs.FieldCount < fieldCount {
+			return rs
+		}
+	}
+	return nil
+}
+
 // Processes the output of p4 logschema -a
 func (p4m *P4MonitorMetrics) setupErrorParsing(schemaLines []string) {
 	schema := ParseLogSchema(schemaLines)
 	p4m.logger.Debugf("logschema count: %d", len(schema))
-	for _, s := range schema {
-		if s.RecordName == "Error" {
-			switch s.Name {
-			case "f_severity":
-				p4m.indErrSeverity = s.FieldIndex
-			case "f_subsys":
-				p4m.indErrSubsys = s.FieldIndex
-			}
-		}
+	p4m.errSchemas = buildErrorSchemas(schema)
+	p4m.logger.Debugf("logschema record types: %d", len(p4m.errSchemas))
+}
+
+// loadLogSchemas runs p4 logschema -a (once) for parsing structured logs - called by each structured log tailer
+func (p4m *P4MonitorMetrics) loadLogSchemas() bool {
+	p4m.schemaLock.Lock()
+	defer p4m.schemaLock.Unlock()
+	if len(p4m.errSchemas) > 0 {
+		return true
+	}
+	p4cmd, errbuf, p := p4m.newP4CmdPipe("logschema -a")
+	schema, err := p.Exec(p4cmd).Slice()
+	if err != nil {
+		p4m.logger.Errorf("Error running %s: %v, err:%q", p4cmd, err, errbuf.String())
+		return false
+	}
+	if len(schema) == 0 {
+		p4m.logger.Debug("No logschema found!")
+		return false
 	}
-	p4m.logger.Debugf("logschema error indexes: %d %d", p4m.indErrSeverity, p4m.indErrSubsys)
+	p4m.setupErrorParsing(schema)
+	return true
 }
 
 // Returns a tailer object for specified file
@@ -218,26 +301,162 @@ func (p4m *P4MonitorMetrics) getTailer(cfgInput *logConfig) (fswatcher.FileTaile
 	return tail, nil
 }
 
+// parseLogRecord parses a structured log line (e.g. from errors.csv or auth.csv) as CSV, returning the fields
+// and the schema for its record type (the first field)
+func (p4m *P4MonitorMetrics) parseLogRecord(line string) ([]string, *ErrorRecordSchema, error) {
+	r := csv.NewReader(strings.NewReader(line))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	fields, err := r.Read()
+	if err != nil {
+		return nil, nil, err
+	}
+	rs := findErrorSchema(p4m.errSchemas, strings.TrimSpace(fields[0]), len(fields))
+	if rs == nil {
+		return nil, nil, fmt.Errorf("no schema for record type %q with %d fields", fields[0], len(fields))
+	}
+	return fields, rs, nil
+}
+
+// field returns the value of the first of the named fields which is in the schema, or "" if none are
+func (rs *ErrorRecordSchema) field(fields []string, names ...string) string {
+	for _, name := range names {
+		if ind, ok := rs.Fields[name]; ok && ind < len(fields) {
+			return fields[ind]
+		}
+	}
+	return ""
+}
+
+// parseErrorRecord parses an errors.csv line using the schema for its record type (the first field)
+func (p4m *P4MonitorMetrics) parseErrorRecord(line string) (*ErrorRecord, error) {
+	fields, rs, err := p4m.parseLogRecord(line)
+	if err != nil {
+		return nil, err
+	}
+	getField := func(name string) string {
+		return rs.field(fields, name)
+	}
+	rec := &ErrorRecord{
+		RecordName: rs.RecordName,
+		Severity:   getField("f_severity"),
+		Subcode:    getField("f_subcode"),
+		User:       getField("f_user"),
+		Command:    getField("f_func"),
+		Program:    getField("f_prog"),
+	}
+	subsys, err := strconv.Atoi(getField("f_subsys"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid subsys %q", getField("f_subsys"))
+	}
+	if s, ok := subsystems[ErrorSubsystem(subsys)]; ok {
+		rec.Subsystem = s
+	} else {
+		rec.Subsystem = "unknown"
+	}
+	rec.Name = errlookup.ShortNameFromStrings(getField("f_subsys"), rec.Subcode)
+	if rec.Name == "" {
+		rec.Name = fmt.Sprintf("%s_%s", rec.Subsystem, strings.TrimSpace(rec.Subcode))
+	}
+	return rec, nil
+}
+
 func (p4m *P4MonitorMetrics) parseErrorLine(line string) {
-	fields := strings.Split(line, ",")
-	if len(fields) < p4m.indErrSeverity || len(fields) < p4m.indErrSubsys {
-		p4m.logger.Debugf("Failed to parse %q", line)
+	p4m.errLock.Lock() // Because accessing on a different thread
+	defer p4m.errLock.Unlock()
+	p4m.countErrorLine(line)
+}
+
+// countErrorLine parses the line and updates counters. Must be called with errLock held.
+func (p4m *P4MonitorMetrics) countErrorLine(line string) {
+	rec, err := p4m.parseErrorRecord(line)
+	if err != nil {
+		p4m.logger.Debugf("Failed to parse %q: %v", line, err)
+		p4m.errParseFailures++
 		return
 	}
-	var m ErrorMetric
-	m.Severity = fields[p4m.indErrSeverity]
-	if subsys, err := strconv.Atoi(fields[p4m.indErrSubsys]); err == nil {
-		if subsys < len(subsystems) {
-			m.Subsystem = subsystems[ErrorSubsystem(subsys)]
+	m := ErrorMetric{Subsystem: rec.Subsystem, Severity: rec.Severity, Name: rec.Name}
+	p4m.logger.Debugf("Incrementing error count %v, user %q, cmd %q, prog %q", m, rec.User, rec.Command, rec.Program)
+	p4m.errorMetrics[m] += 1
+	if p4m.config.CmdsByUser {
+		p4m.errorsByUser[rec.User] += 1
+		p4m.errorsByCmd[strings.TrimPrefix(rec.Command, "user-")] += 1
+	}
+}
+
+// allocateErrorLabels decides which error names get their own value for the error label: those in the
+// error_labels allow-list, plus up to error_labels_top_n of the most frequent other names. Allocations are kept
+// so that counters stay monotonic - counts already output as "other" for a newly allocated name stay in "other".
+// Must be called with errLock held.
+func (p4m *P4MonitorMetrics) allocateErrorLabels() {
+	nameCounts := make(map[string]int)
+	for m, count := range p4m.errorMetrics {
+		nameCounts[m.Name] += count
+	}
+	allowed := make(map[string]bool)
+	for _, name := range p4m.config.ErrorLabels {
+		allowed[name] = true
+	}
+	topN := 0
+	for name := range p4m.errorLabels {
+		if !allowed[name] {
+			topN++
+		}
+	}
+	candidates := make([]string, 0)
+	for name := range nameCounts {
+		if p4m.errorLabels[name] {
+			continue
+		}
+		if allowed[name] {
+			p4m.allocateErrorLabel(name)
 		} else {
-			m.Subsystem = "unknown"
+			candidates = append(candidates, name)
 		}
 	}
-	p4m.logger.Debugf("Incrementing error count %v", m)
-	p4m.errLock.Lock() // Because accessing on a different thread
-	p4m.errorMetrics[m] += 1
-	p4m.errLock.Unlock()
-	p4m.logger.Debugf("All error count %v", p4m.errorMetrics)
+	sort.Slice(candidates, func(i, j int) bool {
+		if nameCounts[candidates[i]] != nameCounts[candidates[j]] {
+			return nameCounts[candidates[i]] > nameCounts[candidates[j]]
+		}
+		return candidates[i] < candidates[j]
+	})
+	for _, name := range candidates {
+		if topN >= p4m.config.ErrorLabelsTopN {
+			break
+		}
+		p4m.allocateErrorLabel(name)
+		topN++
+	}
+}
+
+func (p4m *P4MonitorMetrics) allocateErrorLabel(name string) {
+	p4m.errorLabels[name] = true
+	for m := range p4m.errorMetrics {
+		if m.Name == name {
+			p4m.errorLabelOffsets[m] = p4m.errorsReportedOther[m]
+		}
+	}
+}
+
+// errorCountsByLabel returns error counts keyed by ErrorMetric with Name set to the error label value.
+// Must be called with errLock held.
+func (p4m *P4MonitorMetrics) errorCountsByLabel() map[ErrorMetric]int {
+	p4m.allocateErrorLabels()
+	result := make(map[ErrorMetric]int)
+	for m, count := range p4m.errorMetrics {
+		other := ErrorMetric{Subsystem: m.Subsystem, Severity: m.Severity, Name: "other"}
+		if p4m.errorLabels[m.Name] {
+			offset := p4m.errorLabelOffsets[m]
+			result[m] += count - offset
+			if offset > 0 {
+				result[other] += offset
+			}
+		} else {
+			result[other] += count
+			p4m.errorsReportedOther[m] = count
+		}
+	}
+	return result
 }
 
 // Loop reading tailing error log and writing metrics when appropriate
@@ -256,7 +475,11 @@ func (p4m *P4MonitorMetrics) runLogTailer(logger *logrus.Logger, logcfg *logConf
 		case line, ok := <-tailer.Lines():
 			if ok {
 				p4m.logger.Debugf("Error line %q", line.Line)
-				p4m.parseErrorLine(line.Line)
+				p4m.errLock.Lock()
+				if p4m.errorsFile == nil || p4m.errorsFile.advance() {
+					p4m.countErrorLine(line.Line)
+				}
+				p4m.errLock.Unlock()
 			} else {
 				p4m.logger.Debug("Tail error")
 				p4m.errTailer = nil
@@ -292,23 +515,100 @@ func (p4m *P4MonitorMetrics) setupErrorMonitoring() {
 		return
 	}
 
-	p4cmd, errbuf, p := p4m.newP4CmdPipe("logschema -a")
-	schema, err := p.Exec(p4cmd).Slice()
-	if err != nil {
-		p4m.logger.Errorf("Error running %s: %v, err:%q", p4cmd, err, errbuf.String())
+	if !p4m.loadLogSchemas() {
 		return
 	}
-	if len(schema) == 0 {
-		p4m.logger.Debug("No logschema found!")
-		return
+	if p4m.config.PersistCounters {
+		// Count any lines written since last processed - either by a previous run or before reinitialising
+		p4m.errLock.Lock()
+		saved := p4m.savedErrorsFile
+		if p4m.errorsFile != nil {
+			saved = p4m.errorsFile.state()
+			p4m.errorsFile.close()
+		}
+		p4m.errLock.Unlock()
+		p4m.resumeTracking(&p4m.errorsFile, &p4m.errLock, saved, p4m.p4errorsCSV, []string{filepath.Dir(p4m.p4errorsCSV)}, p4m.countErrorLine)
 	}
-	p4m.setupErrorParsing(schema)
 	logcfg := &logConfig{
 		Type:                 "file",
 		Path:                 p4m.p4errorsCSV,
 		PollInterval:         time.Second * 30,
-		Readall:              false,
+		Readall:              p4m.config.PersistCounters, // Lines already counted are skipped by errorsFile
 		FailOnMissingLogfile: false,
 	}
 	p4m.runLogTailer(p4m.logger, logcfg)
 }
+
+// structuredLog is a structured log file other than errors.csv (e.g. auth.csv) which is tailed in the background,
+// with countLine updating the relevant counters. countLine is called with lock held.
+type structuredLog struct {
+	name      string // Used in messages, e.g. auth.csv
+	path      string
+	lock      *sync.Mutex
+	countLine func(line string)
+	tailer    *fswatcher.FileTailer
+	file      *fileTracker // Offset processed by tailer - see persist_counters
+	savedFile *fileState   // Offset from state file
+}
+
+// Loop reading tailed structured log lines
+func (p4m *P4MonitorMetrics) runStructuredLogTailer(sl *structuredLog, logcfg *logConfig) {
+	tailer, err := p4m.getTailer(logcfg)
+	if err != nil {
+		p4m.logger.Errorf("error starting to tail %s lines: %v", sl.name, err)
+		return
+	}
+	p4m.logger.Debugf("runStructuredLogTailer on %s", sl.name)
+	sl.tailer = &tailer
+
+	for {
+		select {
+		case line, ok := <-tailer.Lines():
+			if !ok {
+				sl.tailer = nil
+				return
+			}
+			sl.lock.Lock()
+			if sl.file == nil || sl.file.advance() {
+				sl.countLine(line.Line)
+			}
+			sl.lock.Unlock()
+		case err := <-tailer.Errors():
+			if err != nil {
+				p4m.logger.Errorf("error reading %s lines: %v", sl.name, err)
+			}
+			sl.tailer = nil
+			return
+		}
+	}
+}
+
+// setupStructuredLog replays any lines missed (if persist_counters) and then tails the file
+func (p4m *P4MonitorMetrics) setupStructuredLog(sl *structuredLog) {
+	p4m.logger.Debugf("setupStructuredLog %s starting", sl.name)
+	if sl.tailer != nil {
+		p4m.logger.Debugf("setupStructuredLog %s exiting as already running", sl.name)
+		return
+	}
+	if !p4m.loadLogSchemas() {
+		return
+	}
+	if p4m.config.PersistCounters {
+		sl.lock.Lock()
+		saved := sl.savedFile
+		if sl.file != nil {
+			saved = sl.file.state()
+			sl.file.close()
+		}
+		sl.lock.Unlock()
+		p4m.resumeTracking(&sl.file, sl.lock, saved, sl.path, []string{filepath.Dir(sl.path)}, sl.countLine)
+	}
+	logcfg := &logConfig{
+		Type:                 "file",
+		Path:                 sl.path,
+		PollInterval:         time.Second * 30,
+		Readall:              p4m.config.PersistCounters, // Lines already counted are skipped by sl.file
+		FailOnMissingLogfile: false,
+	}
+	p4m.runStructuredLogTailer(sl, logcfg)
+}
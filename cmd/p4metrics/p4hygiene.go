@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Hygiene monitors report on users, groups, workspaces etc - they run every long_update_interval as the
+// commands can be expensive on large servers. Values are counts only - nothing identifying individuals.
+
+// Thresholds (days) for users not accessed
+var userAccessDays = []int{30, 90, 365}
+
+// User types from p4 users -a
+var userTypes = []string{"standard", "service", "operator"}
+
+// parseZtagRecords parses p4 -ztag output into records - split on blank lines, or when a field repeats
+func parseZtagRecords(lines []string) []map[string]string {
+	records := make([]map[string]string, 0)
+	var rec map[string]string
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "... ") {
+			if line == "" {
+				rec = nil
+			}
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(line, "... "), " ", 2)
+		val := ""
+		if len(parts) == 2 {
+			val = parts[1]
+		}
+		if _, repeated := rec[parts[0]]; rec == nil || repeated {
+			rec = make(map[string]string)
+			records = append(records, rec)
+		}
+		rec[parts[0]] = val
+	}
+	return records
+}
+
+// ztagTime parses an epoch secs field, returning zero time if not set
+func ztagTime(rec map[string]string, field string) time.Time {
+	secs, err := strconv.ParseInt(rec[field], 10, 64)
+	if err != nil || secs <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(secs, 0)
+}
+
+// parsePassTimeout returns password timeout seconds from p4 groups passTimeout: 0 for unset, -1 for unlimited
+func parsePassTimeout(v string) int64 {
+	if v == "unlimited" {
+		return -1
+	}
+	secs, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return secs
+}
+
+// userPasswordTimeouts returns the password timeout for each user from p4 -ztag groups output.
+// As for p4d, the highest value of the user's groups applies, with unlimited (-1) highest of all and unset ignored.
+func userPasswordTimeouts(groups []map[string]string) map[string]int64 {
+	timeouts := make(map[string]int64)
+	for _, g := range groups {
+		if g["isUser"] != "1" || g["user"] == "" {
+			continue
+		}
+		t := parsePassTimeout(g["passTimeout"])
+		if t == 0 {
+			continue
+		}
+		cur, ok := timeouts[g["user"]]
+		if !ok || (cur != -1 && (t == -1 || t > cur)) {
+			timeouts[g["user"]] = t
+		}
+	}
+	return timeouts
+}
+
+// userHygieneMetrics outputs counts from p4 -ztag users -a and p4 -ztag groups
+func (p4m *P4MonitorMetrics) userHygieneMetrics(users, groups []map[string]string, now time.Time) {
+	timeouts := userPasswordTimeouts(groups)
+	typeCounts := make(map[string]int)
+	notAccessed := make(map[string]map[int]int) // by type then days
+	for _, t := range userTypes {
+		notAccessed[t] = make(map[int]int)
+	}
+	expiring := 0
+	expired := 0
+	warn := time.Duration(p4m.config.PasswordExpiryWarningDays) * 24 * time.Hour
+	for _, u := range users {
+		utype := u["Type"]
+		if utype == "" {
+			utype = "standard"
+		}
+		typeCounts[utype] += 1
+		if _, ok := notAccessed[utype]; !ok {
+			notAccessed[utype] = make(map[int]int)
+		}
+		access := ztagTime(u, "Access")
+		if access.IsZero() {
+			access = ztagTime(u, "Update")
+		}
+		for _, days := range userAccessDays {
+			if now.Sub(access) > time.Duration(days)*24*time.Hour {
+				notAccessed[utype][days] += 1
+			}
+		}
+		changed := ztagTime(u, "PasswordChange")
+		if timeout := timeouts[u["User"]]; timeout > 0 && !changed.IsZero() {
+			expires := changed.Add(time.Duration(timeout) * time.Second)
+			if !expires.After(now) {
+				expired += 1
+			} else if expires.Sub(now) <= warn {
+				expiring += 1
+			}
+		}
+	}
+	types := make([]string, 0, len(typeCounts))
+	types = append(types, userTypes...)
+	for t := range typeCounts {
+		if t != "standard" && t != "service" && t != "operator" {
+			types = append(types, t)
+		}
+	}
+	sort.Strings(types[len(userTypes):])
+	for _, t := range types {
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_users_count",
+			help:   "Count of users by type (from p4 users -a)",
+			mtype:  "gauge",
+			value:  fmt.Sprintf("%d", typeCounts[t]),
+			labels: []labelStruct{{name: "type", value: t}}})
+	}
+	for _, days := range userAccessDays {
+		for _, t := range types {
+			p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_users_not_accessed_count",
+				help:  "Count of users by type not accessed within days",
+				mtype: "gauge",
+				value: fmt.Sprintf("%d", notAccessed[t][days]),
+				labels: []labelStruct{{name: "days", value: fmt.Sprintf("%d", days)},
+					{name: "type", value: t}}})
+		}
+	}
+	p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_users_password_expiring_count",
+		help:   "Count of users whose password expires within password_expiry_warning_days (from group PasswordTimeout)",
+		mtype:  "gauge",
+		value:  fmt.Sprintf("%d", expiring),
+		labels: []labelStruct{{name: "days", value: fmt.Sprintf("%d", p4m.config.PasswordExpiryWarningDays)}}})
+	p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_users_password_expired_count",
+		help:  "Count of users whose password has expired (from group PasswordTimeout)",
+		mtype: "gauge",
+		value: fmt.Sprintf("%d", expired)})
+	groupNames := make(map[string]bool)
+	for _, g := range groups {
+		if g["group"] != "" {
+			groupNames[g["group"]] = true
+		}
+	}
+	p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_groups_count",
+		help:  "Count of groups (from p4 groups)",
+		mtype: "gauge",
+		value: fmt.Sprintf("%d", len(groupNames))})
+}
+
+// runZtag runs a p4 -ztag command returning the records
+func (p4m *P4MonitorMetrics) runZtag(args string) ([]map[string]string, bool) {
+	p4cmd, errbuf, p := p4m.newP4CmdPipe("-ztag " + args)
+	lines, err := p.Exec(p4cmd).Slice()
+	if err != nil {
+		p4m.handleP4Error("Error running %s: %v, err:%q", p4cmd, err, errbuf)
+		return nil, false
+	}
+	return parseZtagRecords(lines), true
+}
+
+func (p4m *P4MonitorMetrics) monitorUserHygiene() {
+	// Counts of users by type/last access/password expiry, and groups
+	if !p4m.config.MonitorUserHygiene || !p4m.longIntervalDue("monitorUserHygiene") {
+		return
+	}
+	p4m.startMonitor("monitorUserHygiene", "p4_users")
+	defer p4m.completeMonitor()
+	users, ok := p4m.runZtag("users -a")
+	if !ok {
+		return
+	}
+	groups, ok := p4m.runZtag("groups")
+	if !ok {
+		return
+	}
+	p4m.userHygieneMetrics(users, groups, time.Now())
+	p4m.writeMetricsFile()
+}
+
+// Age buckets for workspace last access and pending/shelved changes
+var hygieneAgeBuckets = []struct {
+	label string
+	days  int
+}{{"30d", 30}, {"90d", 90}, {"1y", 365}}
+
+const hygieneAgeOlder = "older"
+
+// hygieneAgeLabels returns the age bucket labels in order
+func hygieneAgeLabels() []string {
+	labels := make([]string, 0, len(hygieneAgeBuckets)+1)
+	for _, b := range hygieneAgeBuckets {
+		labels = append(labels, b.label)
+	}
+	return append(labels, hygieneAgeOlder)
+}
+
+// hygieneAge returns the bucket for an age: 30d (less than 30 days), 90d, 1y or older
+func hygieneAge(t, now time.Time) string {
+	for _, b := range hygieneAgeBuckets {
+		if now.Sub(t) < time.Duration(b.days)*24*time.Hour {
+			return b.label
+		}
+	}
+	return hygieneAgeOlder
+}
+
+// workspaceHygieneMetrics outputs counts from p4 -ztag clients, clients -U and changes -s pending/shelved
+func (p4m *P4MonitorMetrics) workspaceHygieneMetrics(clients, unloaded, pending, shelved []map[string]string, now time.Time) {
+	p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_workspaces_count",
+		help:  "Count of workspaces (including unloaded)",
+		mtype: "gauge",
+		value: fmt.Sprintf("%d", len(clients)+len(unloaded))})
+	p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_workspaces_unloaded_count",
+		help:  "Count of unloaded workspaces (from p4 clients -U)",
+		mtype: "gauge",
+		value: fmt.Sprintf("%d", len(unloaded))})
+	byAge := make(map[string]int)
+	byStream := make(map[string]int)
+	for _, c := range clients {
+		access := ztagTime(c, "Access")
+		if access.IsZero() {
+			access = ztagTime(c, "Update")
+		}
+		byAge[hygieneAge(access, now)] += 1
+		stream := c["Stream"]
+		if stream == "" {
+			stream = "none"
+		}
+		byStream[stream] += 1
+	}
+	for _, age := range hygieneAgeLabels() {
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_workspaces_by_access_age_count",
+			help:   "Count of (loaded) workspaces by time since last access - 30d means accessed within 30 days, older means over a year",
+			mtype:  "gauge",
+			value:  fmt.Sprintf("%d", byAge[age]),
+			labels: []labelStruct{{name: "age", value: age}}})
+	}
+	streams := make([]string, 0, len(byStream))
+	for s := range byStream {
+		streams = append(streams, s)
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		if byStream[streams[i]] != byStream[streams[j]] {
+			return byStream[streams[i]] > byStream[streams[j]]
+		}
+		return streams[i] < streams[j]
+	})
+	other := 0
+	if len(streams) > p4m.config.WorkspaceStreamsTopN {
+		for _, s := range streams[p4m.config.WorkspaceStreamsTopN:] {
+			other += byStream[s]
+		}
+		streams = streams[:p4m.config.WorkspaceStreamsTopN]
+	}
+	for _, s := range streams {
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_workspaces_by_stream_count",
+			help:   "Count of (loaded) workspaces by stream for the workspace_streams_top_n streams - none for classic workspaces, the rest are other",
+			mtype:  "gauge",
+			value:  fmt.Sprintf("%d", byStream[s]),
+			labels: []labelStruct{{name: "stream", value: s}}})
+	}
+	if other > 0 {
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_workspaces_by_stream_count",
+			help:   "Count of (loaded) workspaces by stream for the workspace_streams_top_n streams - none for classic workspaces, the rest are other",
+			mtype:  "gauge",
+			value:  fmt.Sprintf("%d", other),
+			labels: []labelStruct{{name: "stream", value: "other"}}})
+	}
+	for _, c := range []struct {
+		name    string
+		help    string
+		changes []map[string]string
+	}{
+		{"p4_changes_pending_count", "Count of pending changelists (including shelved) by time since last update", pending},
+		{"p4_changes_shelved_count", "Count of shelved changelists by time since last update", shelved},
+	} {
+		counts := make(map[string]int)
+		for _, ch := range c.changes {
+			counts[hygieneAge(ztagTime(ch, "time"), now)] += 1
+		}
+		for _, age := range hygieneAgeLabels() {
+			p4m.metrics = append(p4m.metrics, metricStruct{name: c.name,
+				help:   c.help,
+				mtype:  "gauge",
+				value:  fmt.Sprintf("%d", counts[age]),
+				labels: []labelStruct{{name: "age", value: age}}})
+		}
+	}
+}
+
+func (p4m *P4MonitorMetrics) monitorWorkspaceHygiene() {
+	// Counts of workspaces by last access/stream and pending/shelved changes by age
+	if !p4m.config.MonitorWorkspaceHygiene || !p4m.longIntervalDue("monitorWorkspaceHygiene") {
+		return
+	}
+	p4m.startMonitor("monitorWorkspaceHygiene", "p4_workspaces")
+	defer p4m.completeMonitor()
+	results := make([][]map[string]string, 0, 4)
+	for _, args := range []string{"clients", "clients -U", "changes -s pending", "changes -s shelved"} {
+		records, ok := p4m.runZtag(args)
+		if !ok {
+			return
+		}
+		results = append(results, records)
+	}
+	p4m.workspaceHygieneMetrics(results[0], results[1], results[2], results[3], time.Now())
+	p4m.writeMetricsFile()
+}
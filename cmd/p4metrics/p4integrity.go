@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Field names for the Integrity record (integrity.csv) from p4 logschema -a. f_serverid is the replica which
+// verified the table.
+const (
+	integrityTableField   = "f_table"
+	integrityReplicaField = "f_serverid"
+	integrityResultField  = "f_result"
+)
+
+// IntegrityMetric is the key for integrity.csv check counts
+type IntegrityMetric struct {
+	Table   string
+	Replica string
+}
+
+// IntegrityRecord holds the interesting fields from a single parsed integrity.csv line
+type IntegrityRecord struct {
+	Table     string
+	Replica   string
+	Mismatch  bool
+	Timestamp time.Time
+}
+
+// integrityMismatch returns whether the f_result of a table verification is a mismatch, or an error if it is
+// neither "match" nor "mismatch" - so that unexpected values are counted as parse failures rather than matches
+func integrityMismatch(result string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(result)) {
+	case "match":
+		return false, nil
+	case "mismatch":
+		return true, nil
+	}
+	return false, fmt.Errorf("unrecognised result %q", result)
+}
+
+// parseIntegrityRecord parses an integrity.csv line using the schema for its record type
+func (p4m *P4MonitorMetrics) parseIntegrityRecord(line string) (*IntegrityRecord, error) {
+	fields, rs, err := p4m.parseLogRecord(line)
+	if err != nil {
+		return nil, err
+	}
+	rec := &IntegrityRecord{
+		Table:   strings.TrimPrefix(strings.TrimSpace(rs.field(fields, integrityTableField)), "db."),
+		Replica: strings.TrimSpace(rs.field(fields, integrityReplicaField)),
+	}
+	if rec.Table == "" {
+		return nil, fmt.Errorf("no table name")
+	}
+	if rec.Mismatch, err = integrityMismatch(rs.field(fields, integrityResultField)); err != nil {
+		return nil, err
+	}
+	if rec.Replica == "" {
+		rec.Replica = p4m.serverID
+	}
+	if secs, err := strconv.ParseInt(strings.TrimSpace(rs.field(fields, "f_timestamp")), 10, 64); err == nil && secs > 0 {
+		rec.Timestamp = time.Unix(secs, 0)
+	} else {
+		rec.Timestamp = time.Now()
+	}
+	return rec, nil
+}
+
+// countIntegrityLine parses the line and updates counters. Must be called with integrityLock held.
+func (p4m *P4MonitorMetrics) countIntegrityLine(line string) {
+	rec, err := p4m.parseIntegrityRecord(line)
+	if err != nil {
+		p4m.logger.Debugf("Failed to parse integrity line %q: %v", line, err)
+		p4m.integrityParseFailures++
+		return
+	}
+	m := IntegrityMetric{Table: rec.Table, Replica: rec.Replica}
+	p4m.integrityChecks[m] += 1
+	if rec.Mismatch {
+		p4m.integrityMismatches[m] += 1
+	}
+	if rec.Timestamp.After(p4m.integrityLastCheck[rec.Replica]) {
+		p4m.integrityLastCheck[rec.Replica] = rec.Timestamp
+	}
+}
+
+func (p4m *P4MonitorMetrics) setupIntegrityMonitoring() {
+	p4m.logger.Debugf("setupIntegrityMonitoring starting")
+	if p4m.p4integrityCSV == "" {
+		p4m.logger.Debugf("setupIntegrityMonitoring exiting as no integrity.csv")
+		return
+	}
+	p4m.integrityLog.path = p4m.p4integrityCSV
+	p4m.setupStructuredLog(p4m.integrityLog)
+}
+
+// isCommitServer returns true for servers where p4 journaldbchecksums should be run
+func (p4m *P4MonitorMetrics) isCommitServer() bool {
+	services := strings.TrimSpace(p4m.p4info["Server services"])
+	return services == "" || services == "standard" || services == "commit-server"
+}
+
+// runJournalDBChecksums runs p4 journaldbchecksums, which writes table checksums to the journal. Replicas verify
+// them as they replay it, recording the results in their integrity.csv - so mismatches are reported by p4metrics
+// on each replica.
+func (p4m *P4MonitorMetrics) runJournalDBChecksums() error {
+	args := "journaldbchecksums"
+	if p4m.config.JournalDBChecksumsLevel > 0 {
+		args = fmt.Sprintf("%s -l %d", args, p4m.config.JournalDBChecksumsLevel)
+	}
+	_, err := p4m.p4Runner.Run(args, "")
+	return err
+}
+
+func (p4m *P4MonitorMetrics) monitorJournalDBChecksums() {
+	// Run on a commit server every journaldbchecksums_interval - in the background as it can take a while
+	if p4m.config.JournalDBChecksumsInterval == 0 || !p4m.isCommitServer() || !p4m.isSuper {
+		return
+	}
+	p4m.integrityLock.Lock()
+	defer p4m.integrityLock.Unlock()
+	if !p4m.integrityChecksumsRunning && time.Since(p4m.integrityChecksumsLastRun) >= p4m.config.JournalDBChecksumsInterval {
+		p4m.integrityChecksumsRunning = true
+		go func() {
+			err := p4m.runJournalDBChecksums()
+			if err != nil {
+				p4m.logger.Errorf("Error running journaldbchecksums: %v", err)
+			}
+			p4m.integrityLock.Lock()
+			defer p4m.integrityLock.Unlock()
+			p4m.integrityChecksumsRunning = false
+			if err == nil {
+				p4m.integrityChecksumsLastRun = time.Now()
+			}
+		}()
+	}
+	if p4m.integrityChecksumsLastRun.IsZero() {
+		return
+	}
+	p4m.startMonitor("monitorJournalDBChecksums", "p4_integrity_journaldbchecksums")
+	defer p4m.completeMonitor()
+	p4m.metrics = append(p4m.metrics,
+		metricStruct{name: "p4_integrity_journaldbchecksums_last_run",
+			help:  "Time (epoch secs) p4 journaldbchecksums was last run by p4metrics on this commit server",
+			mtype: "gauge",
+			value: fmt.Sprintf("%d", p4m.integrityChecksumsLastRun.Unix())})
+	p4m.writeMetricsFile()
+}
+
+func (p4m *P4MonitorMetrics) monitorIntegrity() {
+	if p4m.p4integrityCSV == "" {
+		return
+	}
+	p4m.startMonitor("monitorIntegrity", "p4_integrity")
+	defer p4m.completeMonitor()
+	p4m.integrityLock.Lock()
+	defer p4m.integrityLock.Unlock()
+
+	keys := make([]IntegrityMetric, 0, len(p4m.integrityChecks))
+	for m := range p4m.integrityChecks {
+		keys = append(keys, m)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Table != keys[j].Table {
+			return keys[i].Table < keys[j].Table
+		}
+		return keys[i].Replica < keys[j].Replica
+	})
+	for _, m := range keys {
+		labels := []labelStruct{{name: "table", value: m.Table}, {name: "replica", value: m.Replica}}
+		p4m.metrics = append(p4m.metrics,
+			metricStruct{name: "p4_integrity_checks_count",
+				help:   "Table verifications (e.g. from journaldbchecksums) in integrity.csv by table and replica",
+				mtype:  "counter",
+				value:  fmt.Sprintf("%d", p4m.integrityChecks[m]),
+				labels: labels})
+		p4m.metrics = append(p4m.metrics,
+			metricStruct{name: "p4_integrity_mismatches_count",
+				help:   "Table verifications which did not match in integrity.csv by table and replica",
+				mtype:  "counter",
+				value:  fmt.Sprintf("%d", p4m.integrityMismatches[m]),
+				labels: labels})
+	}
+	replicas := make([]string, 0, len(p4m.integrityLastCheck))
+	for r := range p4m.integrityLastCheck {
+		replicas = append(replicas, r)
+	}
+	sort.Strings(replicas)
+	for _, r := range replicas {
+		p4m.metrics = append(p4m.metrics,
+			metricStruct{name: "p4_integrity_last_check_time",
+				help:   "Time (epoch secs) of the most recent table verification in integrity.csv by replica",
+				mtype:  "gauge",
+				value:  fmt.Sprintf("%d", p4m.integrityLastCheck[r].Unix()),
+				labels: []labelStruct{{name: "replica", value: r}}})
+	}
+	p4m.metrics = append(p4m.metrics,
+		metricStruct{name: "p4_integrity_parse_failures",
+			help:  "Count of integrity.csv lines which could not be parsed",
+			mtype: "counter",
+			value: fmt.Sprintf("%d", p4m.integrityParseFailures)})
+	p4m.writeMetricsFile()
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -15,6 +16,9 @@ type JournalMetric struct {
 }
 
 func (p4m *P4MonitorMetrics) shouldMonitorJournal() bool {
+	if !p4m.monitorEnabled("monitorJournalRecords") {
+		return false
+	}
 	services := strings.TrimSpace(p4m.p4info["Server services"])
 	if services == "standby" || services == "forwarding-standby" {
 		return false
@@ -33,6 +37,13 @@ func extractJournalField(token string) string {
 }
 
 func (p4m *P4MonitorMetrics) parseJournalLine(line string) {
+	p4m.journalLock.Lock() // Accessed from tailer goroutine and monitor loop.
+	defer p4m.journalLock.Unlock()
+	p4m.countJournalLine(line)
+}
+
+// countJournalLine updates counters for the line. Must be called with journalLock held.
+func (p4m *P4MonitorMetrics) countJournalLine(line string) {
 	if !(strings.HasPrefix(line, "@rv@") || strings.HasPrefix(line, "@pv@") || strings.HasPrefix(line, "@dv@")) {
 		return
 	}
@@ -59,9 +70,7 @@ func (p4m *P4MonitorMetrics) parseJournalLine(line string) {
 	}
 
 	m := JournalMetric{Table: table, Action: recordType}
-	p4m.journalLock.Lock() // Accessed from tailer goroutine and monitor loop.
 	p4m.journalMetrics[m] += 1
-	p4m.journalLock.Unlock()
 }
 
 // Loop reading tailing journal log and recording per-table counts for rv/pv/dv records.
@@ -78,7 +87,11 @@ func (p4m *P4MonitorMetrics) runJournalTailer(logger *logrus.Logger, logcfg *log
 		select {
 		case line, ok := <-tailer.Lines():
 			if ok {
-				p4m.parseJournalLine(line.Line)
+				p4m.journalLock.Lock()
+				if p4m.journalFile == nil || p4m.journalFile.advance() {
+					p4m.countJournalLine(line.Line)
+				}
+				p4m.journalLock.Unlock()
 			} else {
 				p4m.journalTailer = nil
 				return
@@ -115,11 +128,30 @@ func (p4m *P4MonitorMetrics) setupJournalMonitoring() {
 		return
 	}
 
+	if p4m.config.PersistCounters {
+		// Rotated journals are normally moved to the checkpoints directory (journalPrefix)
+		dirs := []string{filepath.Dir(p4m.p4journal)}
+		if p4m.journalPrefix != "" {
+			prefix := p4m.journalPrefix
+			if !filepath.IsAbs(prefix) {
+				prefix = filepath.Join(p4m.p4root, prefix)
+			}
+			dirs = append(dirs, filepath.Dir(prefix))
+		}
+		p4m.journalLock.Lock()
+		saved := p4m.savedJournalFile
+		if p4m.journalFile != nil {
+			saved = p4m.journalFile.state()
+			p4m.journalFile.close()
+		}
+		p4m.journalLock.Unlock()
+		p4m.resumeTracking(&p4m.journalFile, &p4m.journalLock, saved, p4m.p4journal, dirs, p4m.countJournalLine)
+	}
 	logcfg := &logConfig{
 		Type:                 "file",
 		Path:                 p4m.p4journal,
 		PollInterval:         time.Second * 30,
-		Readall:              false,
+		Readall:              p4m.config.PersistCounters, // Lines already counted are skipped by journalFile
 		FailOnMissingLogfile: false,
 		MaxLineBytes:         100,
 	}
@@ -0,0 +1,373 @@
+package main
+
+// This module monitors p4d file locks (db.* tables and server.locks) by reading /proc/locks directly,
+// replacing monitor_metrics.py which required lslocks (and sudo) to be run from cron.
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lockFileID identifies a locked file by device and inode - as in /proc/locks (MAJ:MIN:INODE)
+type lockFileID struct {
+	Major uint32
+	Minor uint32
+	Inode uint64
+}
+
+// ProcLock represents a single entry from /proc/locks
+type ProcLock struct {
+	ID      int    // Lock id - waiting entries have the same id as the lock blocking them
+	Waiting bool   // Set for "->" entries which are waiting for (blocked by) the lock with the same id
+	Type    string // FLOCK, POSIX, OFDLCK etc
+	Mode    string // READ or WRITE
+	Pid     int
+	File    lockFileID
+}
+
+// LockEvaluation holds the results of matching /proc/locks entries to p4d files and processes
+type LockEvaluation struct {
+	ReadByTable       map[string]int // table -> count of read locks held
+	WriteByTable      map[string]int // table -> count of write locks held
+	BlockedByTable    map[string]int // table -> count of commands waiting for a lock
+	DbRead            int
+	DbWrite           int
+	ClientEntityRead  int
+	ClientEntityWrite int
+	MetaRead          int
+	MetaWrite         int
+	BlockedCmds       int      // Count of distinct pids waiting for a lock
+	Chains            []string // Formatted blocking chains - one per blocked pid
+}
+
+// parseProcLocks parses the contents of /proc/locks, e.g.
+//
+//	1: FLOCK  ADVISORY  WRITE 1234 08:02:131090 0 EOF
+//	1: -> FLOCK  ADVISORY  READ 1235 08:02:131090 0 EOF
+func parseProcLocks(lines []string) []ProcLock {
+	locks := make([]ProcLock, 0)
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(fields[0], ":"))
+		if err != nil {
+			continue
+		}
+		lock := ProcLock{ID: id}
+		fields = fields[1:]
+		if fields[0] == "->" {
+			lock.Waiting = true
+			fields = fields[1:]
+		}
+		if len(fields) < 5 {
+			continue
+		}
+		lock.Type = fields[0]
+		lock.Mode = fields[2]
+		if lock.Pid, err = strconv.Atoi(fields[3]); err != nil || lock.Pid <= 0 {
+			continue // OFD locks have pid -1
+		}
+		devIno := strings.Split(fields[4], ":") // Device major/minor are hex
+		if len(devIno) != 3 {
+			continue
+		}
+		major, err := strconv.ParseUint(devIno[0], 16, 32)
+		if err != nil {
+			continue
+		}
+		minor, err := strconv.ParseUint(devIno[1], 16, 32)
+		if err != nil {
+			continue
+		}
+		lock.File.Major, lock.File.Minor = uint32(major), uint32(minor)
+		if lock.File.Inode, err = strconv.ParseUint(devIno[2], 10, 64); err != nil {
+			continue
+		}
+		locks = append(locks, lock)
+	}
+	return locks
+}
+
+// lockTableName returns the name used as the table label for a lockable file relative to P4ROOT:
+// db.* files without the db. prefix, and server.locks/<subdir>/... as the subdir (e.g. clientEntity or meta)
+func lockTableName(relPath string) string {
+	relPath = filepath.ToSlash(relPath)
+	if strings.HasPrefix(relPath, "server.locks/") {
+		parts := strings.Split(relPath, "/")
+		return parts[1]
+	}
+	if !strings.Contains(relPath, "/") && strings.HasPrefix(relPath, "db.") {
+		return strings.TrimPrefix(relPath, "db.")
+	}
+	return ""
+}
+
+// getLockFileInodes maps device/inodes of db.* files in P4ROOT and files under P4ROOT/server.locks to table names
+func getLockFileInodes(p4root string) map[lockFileID]string {
+	inodes := make(map[lockFileID]string)
+	entries, err := os.ReadDir(p4root)
+	if err != nil {
+		return inodes
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), "db.") {
+			continue
+		}
+		if fi, err := e.Info(); err == nil {
+			if id, ok := fileID(fi); ok {
+				inodes[id] = lockTableName(e.Name())
+			}
+		}
+	}
+	locksDir := path.Join(p4root, "server.locks")
+	_ = filepath.WalkDir(locksDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(p4root, p)
+		if err != nil {
+			return nil
+		}
+		if fi, err := d.Info(); err == nil {
+			if id, ok := fileID(fi); ok && lockTableName(rel) != "" {
+				inodes[id] = lockTableName(rel)
+			}
+		}
+		return nil
+	})
+	return inodes
+}
+
+// formatLockProc formats a pid with user/cmd/runtime details from the monitor table (if present)
+func formatLockProc(pid int, procs map[int]MonitorProcess) string {
+	if p, ok := procs[pid]; ok {
+		return fmt.Sprintf("pid %d user %s cmd %s time %ds", pid, p.User, p.Cmd, p.TimeSeconds)
+	}
+	return fmt.Sprintf("pid %d user unknown cmd unknown", pid)
+}
+
+// evaluateLocks counts locks held on p4d tables and finds commands blocked by locks.
+// Only locks on files in inodes (db.* and server.locks) are considered.
+// For each blocked pid, the chain of blockers is followed (a blocker may itself be blocked) with loops avoided.
+func evaluateLocks(locks []ProcLock, inodes map[lockFileID]string, procs map[int]MonitorProcess) *LockEvaluation {
+	eval := &LockEvaluation{
+		ReadByTable:    make(map[string]int),
+		WriteByTable:   make(map[string]int),
+		BlockedByTable: make(map[string]int),
+		Chains:         make([]string, 0),
+	}
+	holders := make(map[int]ProcLock)      // lock id -> holder
+	waitingFor := make(map[int][]ProcLock) // pid -> locks it is waiting for
+	blockedPids := make([]int, 0)
+	for _, l := range locks {
+		table, ok := inodes[l.File]
+		if !ok {
+			continue
+		}
+		if l.Waiting {
+			if _, seen := waitingFor[l.Pid]; !seen {
+				blockedPids = append(blockedPids, l.Pid)
+			}
+			waitingFor[l.Pid] = append(waitingFor[l.Pid], l)
+			eval.BlockedByTable[table]++
+			continue
+		}
+		holders[l.ID] = l
+		switch l.Mode {
+		case "READ":
+			eval.ReadByTable[table]++
+		case "WRITE":
+			eval.WriteByTable[table]++
+		}
+		switch table {
+		case "clientEntity":
+			if l.Mode == "READ" {
+				eval.ClientEntityRead++
+			} else if l.Mode == "WRITE" {
+				eval.ClientEntityWrite++
+			}
+		case "meta":
+			if l.Mode == "READ" {
+				eval.MetaRead++
+			} else if l.Mode == "WRITE" {
+				eval.MetaWrite++
+			}
+		default:
+			if l.Mode == "READ" {
+				eval.DbRead++
+			} else if l.Mode == "WRITE" {
+				eval.DbWrite++
+			}
+		}
+	}
+	eval.BlockedCmds = len(blockedPids)
+	sort.Ints(blockedPids)
+	for _, pid := range blockedPids {
+		var sb strings.Builder
+		sb.WriteString(formatLockProc(pid, procs))
+		visited := map[int]bool{pid: true}
+		cur := pid
+		for {
+			waits, ok := waitingFor[cur]
+			if !ok {
+				break
+			}
+			w := waits[0]
+			h, ok := holders[w.ID]
+			if !ok {
+				break
+			}
+			fmt.Fprintf(&sb, " wants %s %s, blocked by %s holding %s", w.Mode, inodes[w.File], formatLockProc(h.Pid, procs), h.Mode)
+			if visited[h.Pid] {
+				sb.WriteString(" (loop)")
+				break
+			}
+			visited[h.Pid] = true
+			cur = h.Pid
+		}
+		eval.Chains = append(eval.Chains, sb.String())
+	}
+	return eval
+}
+
+// writeLocksLog adds chains to the list of recent chains (keeping the last LocksLogChains) and rewrites the log
+func (p4m *P4MonitorMetrics) writeLocksLog(chains []string) {
+	if len(chains) == 0 {
+		return
+	}
+	logFile := p4m.config.LocksLog
+	if logFile == "" && p4m.logsDir != "" {
+		logFile = path.Join(p4m.logsDir, "p4metrics_locks.log")
+	}
+	if logFile == "" || p4m.config.LocksLogChains == 0 {
+		return
+	}
+	prefix := time.Now().Format("2006-01-02 15:04:05")
+	for _, c := range chains {
+		p4m.lockChains = append(p4m.lockChains, fmt.Sprintf("%s %s", prefix, c))
+	}
+	if len(p4m.lockChains) > p4m.config.LocksLogChains {
+		p4m.lockChains = p4m.lockChains[len(p4m.lockChains)-p4m.config.LocksLogChains:]
+	}
+	if p4m.dryrun {
+		p4m.logger.Infof("Blocking chains: %q", chains)
+		return
+	}
+	tmpFile := logFile + ".tmp"
+	if err := os.WriteFile(tmpFile, []byte(strings.Join(p4m.lockChains, "\n")+"\n"), 0644); err != nil {
+		p4m.logger.Errorf("Error writing locks log %s: %v", tmpFile, err)
+		return
+	}
+	if err := os.Rename(tmpFile, logFile); err != nil {
+		p4m.logger.Errorf("Error renaming %s to %s: %v", tmpFile, logFile, err)
+	}
+}
+
+// appendLockMetrics outputs metrics for a lock evaluation
+func (p4m *P4MonitorMetrics) appendLockMetrics(eval *LockEvaluation) {
+	totals := []struct {
+		name  string
+		help  string
+		value int
+	}{
+		{"p4_locks_db_read", "Database read locks", eval.DbRead},
+		{"p4_locks_db_write", "Database write locks", eval.DbWrite},
+		{"p4_locks_cliententity_read", "clientEntity read locks", eval.ClientEntityRead},
+		{"p4_locks_cliententity_write", "clientEntity write locks", eval.ClientEntityWrite},
+		{"p4_locks_meta_read", "meta db read locks", eval.MetaRead},
+		{"p4_locks_meta_write", "meta db write locks", eval.MetaWrite},
+		{"p4_locks_cmds_blocked", "cmds blocked by locks", eval.BlockedCmds},
+	}
+	for _, m := range totals {
+		p4m.metrics = append(p4m.metrics, metricStruct{name: m.name,
+			help:  m.help,
+			mtype: "gauge",
+			value: fmt.Sprintf("%d", m.value)})
+	}
+	for table, count := range eval.ReadByTable {
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_locks_table_read",
+			help:   "Read locks held by table",
+			mtype:  "gauge",
+			value:  fmt.Sprintf("%d", count),
+			labels: []labelStruct{{name: "table", value: table}}})
+	}
+	for table, count := range eval.WriteByTable {
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_locks_table_write",
+			help:   "Write locks held by table",
+			mtype:  "gauge",
+			value:  fmt.Sprintf("%d", count),
+			labels: []labelStruct{{name: "table", value: table}}})
+	}
+	for table, count := range eval.BlockedByTable {
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_locks_table_blocked",
+			help:   "Commands waiting for a lock by table",
+			mtype:  "gauge",
+			value:  fmt.Sprintf("%d", count),
+			labels: []labelStruct{{name: "table", value: table}}})
+	}
+}
+
+// monitorLocks reads /proc/locks and outputs lock metrics for db.* and server.locks files under P4ROOT.
+// Uses the processes from the most recent monitorProcesses call to identify users/cmds.
+func (p4m *P4MonitorMetrics) monitorLocks() {
+	if !p4m.config.MonitorLocks || runtime.GOOS != "linux" {
+		return
+	}
+	p4m.startMonitor("monitorLocks", "p4_locks")
+	defer p4m.completeMonitor()
+	if p4m.p4root == "" {
+		p4m.logger.Debugf("monitorLocks exiting as P4ROOT not known")
+		return
+	}
+	content, err := os.ReadFile("/proc/locks")
+	if err != nil {
+		p4m.logger.Errorf("Error reading /proc/locks: %v", err)
+		return
+	}
+	locks := parseProcLocks(strings.Split(string(content), "\n"))
+
+	procs := make(map[int]MonitorProcess)
+	if p4m.monitorResult != nil {
+		for _, p := range p4m.monitorResult.processes {
+			procs[p.Pid] = p
+		}
+	}
+	// Walking server.locks can be expensive, so inodes are refreshed every long_update_interval, or if a p4d command
+	// has a lock on a file not seen before. Files found not to be db.* or server.locks files (journal, logs etc) are
+	// remembered as misses so they don't cause a refresh every time.
+	refresh := p4m.lockInodes == nil || p4m.longIntervalDue("monitorLocks")
+	for _, l := range locks {
+		if _, ok := p4m.lockInodes[l.File]; ok || p4m.lockInodeMisses[l.File] {
+			continue
+		}
+		if _, ok := procs[l.Pid]; ok {
+			refresh = true
+			break
+		}
+	}
+	if refresh {
+		p4m.lockInodes = getLockFileInodes(p4m.p4root)
+		p4m.lockInodeMisses = make(map[lockFileID]bool)
+		for _, l := range locks {
+			if _, ok := p4m.lockInodes[l.File]; !ok {
+				p4m.lockInodeMisses[l.File] = true
+			}
+		}
+		p4m.logger.Debugf("monitorLocks found %d lockable files under %s", len(p4m.lockInodes), p4m.p4root)
+	}
+
+	eval := evaluateLocks(locks, p4m.lockInodes, procs)
+	p4m.appendLockMetrics(eval)
+	p4m.writeLocksLog(eval.Chains)
+	p4m.writeMetricsFile()
+}
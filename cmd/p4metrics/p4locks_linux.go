@@ -0,0 +1,30 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID returns the device and inode of a file, matching the MAJ:MIN:INODE format of /proc/locks
+func fileID(fi os.FileInfo) (lockFileID, bool) {
+	if fi == nil {
+		return lockFileID{}, false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return lockFileID{}, false
+	}
+	// Decode as glibc major()/minor() do
+	dev := uint64(st.Dev)
+	major := uint32((dev>>8)&0xfff) | uint32((dev>>32)&^0xfff)
+	minor := uint32(dev&0xff) | uint32((dev>>12)&^0xff)
+	return lockFileID{Major: major, Minor: minor, Inode: st.Ino}, true
+}
+
+// fileInode returns the inode number for a file, or 0 if not available
+func fileInode(fi os.FileInfo) uint64 {
+	id, _ := fileID(fi)
+	return id.Inode
+}
@@ -0,0 +1,37 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestProcLocksFileID checks that a lock taken on a db file is matched to the table via /proc/locks device and inode
+func TestProcLocksFileID(t *testing.T) {
+	root := t.TempDir()
+	fname := filepath.Join(root, "db.rev")
+	assert.NoError(t, os.WriteFile(fname, []byte("x"), 0644))
+	f, err := os.Open(fname)
+	assert.NoError(t, err)
+	defer f.Close()
+	assert.NoError(t, syscall.Flock(int(f.Fd()), syscall.LOCK_EX))
+
+	content, err := os.ReadFile("/proc/locks")
+	if err != nil {
+		t.Skipf("/proc/locks not available: %v", err)
+	}
+	locks := make([]ProcLock, 0)
+	for _, l := range parseProcLocks(strings.Split(string(content), "\n")) {
+		if l.Pid == os.Getpid() {
+			locks = append(locks, l)
+		}
+	}
+	eval := evaluateLocks(locks, getLockFileInodes(root), map[int]MonitorProcess{})
+	assert.Equal(t, map[string]int{"rev": 1}, eval.WriteByTable)
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// fileID is not available as lock monitoring requires /proc/locks
+func fileID(fi os.FileInfo) (lockFileID, bool) {
+	return lockFileID{}, false
+}
+
+// fileInode returns 0 - log rotation is then detected by file size only
+func fileInode(fi os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/perforce/p4prometheus/sdpenv"
+)
+
+// Backoff between failed login renewal attempts - doubled on each failure up to the max
+const (
+	loginBackoffMin = time.Minute
+	loginBackoffMax = time.Hour
+)
+
+var reTicketExpiration = regexp.MustCompile(`^\.\.\. TicketExpiration (\d+)`)
+
+// isLoginError returns true if p4 error output means the monitoring user needs to login
+func isLoginError(errText string) bool {
+	return strings.Contains(errText, "Perforce password (P4PASSWD) invalid or unset") ||
+		strings.Contains(errText, "Your session has expired") ||
+		strings.Contains(errText, "Password invalid")
+}
+
+// parseTicketExpiration returns the seconds until ticket expiry from p4 -ztag login -s, or -1 if not found
+// (e.g. user authenticated by password rather than ticket, or unlimited ticket timeout)
+func parseTicketExpiration(lines []string) int64 {
+	for _, line := range lines {
+		if m := reTicketExpiration.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+			if v, err := strconv.ParseInt(m[1], 10, 64); err == nil {
+				return v
+			}
+		}
+	}
+	return -1
+}
+
+// loginPassword returns the monitoring user's password from p4passwd_env, p4passwd_file or the SDP admin password file
+func (p4m *P4MonitorMetrics) loginPassword() (string, error) {
+	if p4m.config.PasswordEnv != "" {
+		if v := sdpenv.GetVar(*p4m.env, p4m.config.PasswordEnv); v != "" {
+			return v, nil
+		}
+	}
+	passwdFile := p4m.config.PasswordFile
+	if passwdFile == "" && p4m.config.SDPInstance != "" {
+		passwdFile = sdpenv.GetVar(*p4m.env, "SDP_ADMIN_PASSWORD_FILE")
+	}
+	if passwdFile == "" {
+		return "", nil
+	}
+	buf, err := os.ReadFile(passwdFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(strings.SplitN(string(buf), "\n", 2)[0]), nil
+}
+
+// checkLogin runs p4 login -s, returning seconds to ticket expiry (-1 if not known) and whether logged in
+func (p4m *P4MonitorMetrics) checkLogin() (int64, bool) {
+	lines, err := p4m.p4Runner.Run("-ztag login -s", "")
+	if err != nil {
+		if isLoginError(err.Error()) {
+			p4m.loginError = true
+		} else {
+			p4m.logger.Errorf("Error running login -s: %v", err)
+		}
+		return -1, false
+	}
+	p4m.loginError = false
+	return parseTicketExpiration(lines), true
+}
+
+// renewLogin logs in using the configured password, backing off after failures
+func (p4m *P4MonitorMetrics) renewLogin(password string) bool {
+	if time.Now().Before(p4m.loginNextAttempt) {
+		p4m.logger.Debugf("renewLogin: backing off until %v", p4m.loginNextAttempt)
+		return false
+	}
+	_, err := p4m.p4Runner.Run("login", password+"\n")
+	if err != nil {
+		p4m.loginRenewals["failure"] += 1
+		p4m.loginBackoff *= 2
+		if p4m.loginBackoff < loginBackoffMin {
+			p4m.loginBackoff = loginBackoffMin
+		}
+		if p4m.loginBackoff > loginBackoffMax {
+			p4m.loginBackoff = loginBackoffMax
+		}
+		p4m.loginNextAttempt = time.Now().Add(p4m.loginBackoff)
+		p4m.logger.Errorf("Failed to login as %s, retrying after %v: %v", p4m.p4User, p4m.loginBackoff, err)
+		return false
+	}
+	p4m.loginRenewals["success"] += 1
+	p4m.loginBackoff = 0
+	p4m.loginNextAttempt = time.Time{}
+	p4m.logger.Infof("Logged in as %s", p4m.p4User)
+	return true
+}
+
+func (p4m *P4MonitorMetrics) monitorLogin() {
+	// Ticket expiry of the monitoring user - renewing it if a password is available
+	if !p4m.config.LoginCheck {
+		return
+	}
+	p4m.startMonitor("monitorLogin", "p4_login")
+	defer p4m.completeMonitor()
+	expiry, ok := p4m.checkLogin()
+	if !ok || (expiry >= 0 && expiry < int64(p4m.config.LoginRenewBefore.Seconds())) {
+		password, err := p4m.loginPassword()
+		if err != nil {
+			p4m.logger.Errorf("Failed to read password for login: %v", err)
+		} else if password != "" && p4m.renewLogin(password) {
+			expiry, _ = p4m.checkLogin()
+		}
+	}
+	if expiry >= 0 {
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_login_ticket_expiry_seconds",
+			help:  "Seconds until the monitoring user's ticket expires (from p4 login -s)",
+			mtype: "gauge",
+			value: fmt.Sprintf("%d", expiry)})
+	}
+	for _, result := range []string{"success", "failure"} {
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_login_renewals_count",
+			help:   "Count of p4metrics attempts to login as the monitoring user by result",
+			mtype:  "counter",
+			value:  fmt.Sprintf("%d", p4m.loginRenewals[result]),
+			labels: []labelStruct{{name: "result", value: result}}})
+	}
+	p4m.writeMetricsFile()
+}
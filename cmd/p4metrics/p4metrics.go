@@ -15,6 +15,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path"
 	"path/filepath"
@@ -31,6 +32,7 @@ import (
 	"github.com/rcowham/go-libtail/tailer/fswatcher"
 
 	"github.com/bitfield/script"
+	"github.com/perforce/p4prometheus/sdpenv"
 	"github.com/perforce/p4prometheus/version"
 	"github.com/rcowham/kingpin"
 	"github.com/sirupsen/logrus"
@@ -147,71 +149,7 @@ func humanizeBytes(bytes int64) string {
 	}
 }
 
-func sourceEnvVars() map[string]string {
-	// Return a list of p4 env vars
-	env := make(map[string]string)
-	for _, e := range os.Environ() {
-		pair := strings.SplitN(e, "=", 2)
-		env[pair[0]] = pair[1]
-	}
-	return env
-}
-
-func sourceSDPVars(sdpInstance string, logger *logrus.Logger) map[string]string {
-	// Source SDP vars and return a list
-	logger.Debugf("sourceSDPVars: %s", sdpInstance)
-	// Get the current environment
-	oldEnv := make(map[string]string)
-	for _, e := range os.Environ() {
-		pair := strings.SplitN(e, "=", 2)
-		oldEnv[pair[0]] = pair[1]
-	}
-
-	errbuf := new(bytes.Buffer)
-	p := script.NewPipe().WithStderr(errbuf)
-	cmd := fmt.Sprintf("bash -c \"source /p4/common/bin/p4_vars %s && env\"", sdpInstance)
-	logger.Debugf("cmd: %s", cmd)
-	output, err := p.Exec(cmd).Slice()
-	if err != nil {
-		logger.Errorf("Error: %v, %q", err, errbuf.String())
-		logger.Fatalf("Can't source SDP vars: %s", sdpInstance)
-	}
-
-	// Parse the new environment
-	newEnv := make(map[string]string)
-	for _, line := range output {
-		line = strings.TrimSpace(line)
-		pair := strings.SplitN(line, "=", 2)
-		if len(pair) == 2 {
-			newEnv[pair[0]] = pair[1]
-		}
-	}
-
-	// Other interesting env vars
-	results := make(map[string]string, 0)
-	otherVars := []string{"KEEPCKPS", "KEEPJNLS", "KEEPLOGS", "CHECKPOINTS", "LOGS", "OSUSER"}
-	for k, v := range newEnv {
-		if strings.HasPrefix(k, "P4") || strings.Contains(k, "SDP") {
-			results[k] = v
-		}
-		for _, s := range otherVars {
-			if k == s {
-				results[k] = v
-			}
-		}
-	}
-	logger.Debugf("envVars: %q", results)
-	return results
-}
-
-func getVar(vars map[string]string, k string) string {
-	if v, ok := vars[k]; ok {
-		return v
-	}
-	return ""
-}
-
-// LinuxProcMemReader reads memory information from /proc on Linux
+// LinuxProcMemReader reads memory, CPU and I/O information from /proc on Linux
 type LinuxProcMemReader struct{}
 
 // GetPIDRSSBytes returns the resident set size in bytes for a given PID by reading /proc/<pid>/status
@@ -255,6 +193,162 @@ func (r *LinuxProcMemReader) GetMemTotalBytes() (int64, error) {
 	return 0, fmt.Errorf("MemTotal not found in /proc/meminfo")
 }
 
+// userHZ is the kernel clock tick rate used for utime/stime in /proc/<pid>/stat.
+// USER_HZ is part of the kernel ABI and is 100 on all architectures p4d runs on (x86_64, arm64), regardless
+// of the kernel's internal CONFIG_HZ. Reading it with sysconf(_SC_CLK_TCK) would need cgo, so it is fixed here.
+const userHZ = 100
+
+// parseProcStat extracts utime and stime (in clock ticks) from the contents of /proc/<pid>/stat.
+// The command name (field 2) is in parentheses and may contain spaces, so fields are counted from the last ')'
+func parseProcStat(content string) (int64, int64, error) {
+	ind := strings.LastIndex(content, ")")
+	if ind < 0 {
+		return 0, 0, fmt.Errorf("invalid stat format")
+	}
+	// Fields after ')' start with state (field 3), so utime (field 14) is index 11 and stime (field 15) index 12
+	fields := strings.Fields(content[ind+1:])
+	if len(fields) < 13 {
+		return 0, 0, fmt.Errorf("too few fields in stat: %d", len(fields))
+	}
+	utime, err := strconv.ParseInt(fields[11], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid utime %q: %v", fields[11], err)
+	}
+	stime, err := strconv.ParseInt(fields[12], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid stime %q: %v", fields[12], err)
+	}
+	return utime, stime, nil
+}
+
+// parseProcIO extracts read_bytes and write_bytes from the contents of /proc/<pid>/io
+// These are bytes actually fetched from/sent to the storage layer (as opposed to rchar/wchar)
+func parseProcIO(content string) (int64, int64, error) {
+	var readBytes, writeBytes int64
+	found := 0
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "read_bytes:":
+			v, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid read_bytes %q: %v", fields[1], err)
+			}
+			readBytes = v
+			found++
+		case "write_bytes:":
+			v, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid write_bytes %q: %v", fields[1], err)
+			}
+			writeBytes = v
+			found++
+		}
+	}
+	if found < 2 {
+		return 0, 0, fmt.Errorf("read_bytes/write_bytes not found")
+	}
+	return readBytes, writeBytes, nil
+}
+
+// GetPIDStats returns CPU, I/O and open file descriptor stats for a given PID by reading
+// /proc/<pid>/stat, /proc/<pid>/io and /proc/<pid>/fd
+func (r *LinuxProcMemReader) GetPIDStats(pid int) (*ProcStats, error) {
+	content, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err // PID may have exited
+	}
+	utime, stime, err := parseProcStat(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("/proc/%d/stat: %v", pid, err)
+	}
+	stats := &ProcStats{
+		CPUUserSeconds:   float64(utime) / userHZ,
+		CPUSystemSeconds: float64(stime) / userHZ,
+	}
+	// io and fd require same user (or root) - so treat failures as missing values rather than errors
+	if content, err = os.ReadFile(fmt.Sprintf("/proc/%d/io", pid)); err == nil {
+		if stats.ReadBytes, stats.WriteBytes, err = parseProcIO(string(content)); err != nil {
+			return nil, fmt.Errorf("/proc/%d/io: %v", pid, err)
+		}
+	}
+	if entries, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", pid)); err == nil {
+		stats.OpenFDs = len(entries)
+	}
+	return stats, nil
+}
+
+// collectProcStats reads process stats for each monitor process and sums them by cmd and user (all states)
+func collectProcStats(processes []MonitorProcess, memReader MemReader, logger *logrus.Logger) *ProcStatsSummary {
+	summary := &ProcStatsSummary{
+		ByCmd:  make(map[string]*ProcStats),
+		ByUser: make(map[string]*ProcStats),
+	}
+	if memReader == nil {
+		return summary
+	}
+	add := func(m map[string]*ProcStats, k string, s *ProcStats) {
+		t, ok := m[k]
+		if !ok {
+			t = &ProcStats{}
+			m[k] = t
+		}
+		t.CPUUserSeconds += s.CPUUserSeconds
+		t.CPUSystemSeconds += s.CPUSystemSeconds
+		t.ReadBytes += s.ReadBytes
+		t.WriteBytes += s.WriteBytes
+		t.OpenFDs += s.OpenFDs
+	}
+	for _, proc := range processes {
+		stats, err := memReader.GetPIDStats(proc.Pid)
+		if err != nil {
+			logger.Debugf("Could not get stats for PID %d: %v", proc.Pid, err)
+			continue
+		}
+		logger.Debugf("PID %d (%s from user %s) cpu user/sys: %.2f/%.2f io read/write: %s/%s fds: %d", proc.Pid, proc.Cmd, proc.User,
+			stats.CPUUserSeconds, stats.CPUSystemSeconds, humanizeBytes(stats.ReadBytes), humanizeBytes(stats.WriteBytes), stats.OpenFDs)
+		add(summary.ByCmd, proc.Cmd, stats)
+		add(summary.ByUser, proc.User, stats)
+	}
+	return summary
+}
+
+// procStatsMetrics appends per-label process stats metrics, e.g. p4_active_cpu_user_seconds_by_cmd
+func (p4m *P4MonitorMetrics) procStatsMetrics(byLabel map[string]*ProcStats, labelName string) {
+	for k, s := range byLabel {
+		labels := []labelStruct{{name: labelName, value: k}}
+		p4m.metrics = append(p4m.metrics,
+			metricStruct{name: "p4_active_cpu_user_seconds_by_" + labelName,
+				help:   fmt.Sprintf("User CPU seconds used by monitor processes by %s (all states)", labelName),
+				mtype:  "gauge",
+				value:  fmt.Sprintf("%.2f", s.CPUUserSeconds),
+				labels: labels},
+			metricStruct{name: "p4_active_cpu_system_seconds_by_" + labelName,
+				help:   fmt.Sprintf("System CPU seconds used by monitor processes by %s (all states)", labelName),
+				mtype:  "gauge",
+				value:  fmt.Sprintf("%.2f", s.CPUSystemSeconds),
+				labels: labels},
+			metricStruct{name: "p4_active_io_read_bytes_by_" + labelName,
+				help:   fmt.Sprintf("Bytes read from storage by monitor processes by %s (all states)", labelName),
+				mtype:  "gauge",
+				value:  fmt.Sprintf("%d", s.ReadBytes),
+				labels: labels},
+			metricStruct{name: "p4_active_io_write_bytes_by_" + labelName,
+				help:   fmt.Sprintf("Bytes written to storage by monitor processes by %s (all states)", labelName),
+				mtype:  "gauge",
+				value:  fmt.Sprintf("%d", s.WriteBytes),
+				labels: labels},
+			metricStruct{name: "p4_active_open_fds_by_" + labelName,
+				help:   fmt.Sprintf("Open file descriptors of monitor processes by %s (all states)", labelName),
+				mtype:  "gauge",
+				value:  fmt.Sprintf("%d", s.OpenFDs),
+				labels: labels})
+	}
+}
+
 // evaluateMemLimits evaluates memory limits and returns metrics and kill actions
 // evaluateMemLimits analyzes running processes against configured memory thresholds.
 // It identifies processes exceeding limits across four dimensions:
@@ -548,6 +642,7 @@ func (p4m *P4MonitorMetrics) terminateMemLimitViolators(eval *MemLimitEvaluation
 		if success {
 			killed++
 			p4m.memlimitKillCount++
+			p4m.memlimitKilled[action.Pid] = true
 			p4m.logger.Infof("Memlimit process terminated: PID %d user=%s cmd=%s reason=%s usage=%.1f%%",
 				action.Pid, action.User, action.Cmd, action.ReasonType, action.MemPercentage)
 		} else {
@@ -598,17 +693,85 @@ type metricStruct struct {
 	labels []labelStruct
 }
 
+// durationHistogram holds cumulative duration histogram values, e.g. for a trigger
+type durationHistogram struct {
+	Buckets []int   `json:"buckets"` // Count of values <= corresponding bucket (not cumulative across buckets)
+	Sum     float64 `json:"sum"`
+	Count   int     `json:"count"`
+}
+
+func newDurationHistogram(buckets []float64) *durationHistogram {
+	return &durationHistogram{Buckets: make([]int, len(buckets))}
+}
+
+func (h *durationHistogram) observe(buckets []float64, value float64) {
+	for i, b := range buckets {
+		if value <= b && i < len(h.Buckets) {
+			h.Buckets[i] += 1
+			break
+		}
+	}
+	h.Sum += value
+	h.Count += 1
+}
+
+// metrics returns the _bucket, _sum and _count series for the histogram with the specified label
+func (h *durationHistogram) metrics(name, help string, buckets []float64, label labelStruct) []metricStruct {
+	result := make([]metricStruct, 0, len(buckets)+3)
+	cumulative := 0
+	for i, b := range buckets {
+		if i < len(h.Buckets) {
+			cumulative += h.Buckets[i]
+		}
+		result = append(result,
+			metricStruct{name: name + "_bucket", help: help, mtype: "histogram",
+				value:  fmt.Sprintf("%d", cumulative),
+				labels: []labelStruct{label, {name: "le", value: strconv.FormatFloat(b, 'f', -1, 64)}}})
+	}
+	result = append(result,
+		metricStruct{name: name + "_bucket", help: help, mtype: "histogram",
+			value:  fmt.Sprintf("%d", h.Count),
+			labels: []labelStruct{label, {name: "le", value: "+Inf"}}})
+	result = append(result,
+		metricStruct{name: name + "_sum", help: help, mtype: "histogram",
+			value:  strconv.FormatFloat(h.Sum, 'f', -1, 64),
+			labels: []labelStruct{label}})
+	result = append(result,
+		metricStruct{name: name + "_count", help: help, mtype: "histogram",
+			value:  fmt.Sprintf("%d", h.Count),
+			labels: []labelStruct{label}})
+	return result
+}
+
 type ErrorMetric struct {
 	Subsystem string
 	Severity  string
+	Name      string // Error name, e.g. CLIENT_LockCheckFail
 }
 
-// MemReader provides memory usage information for processes
+// MemReader provides memory, CPU and I/O usage information for processes
 type MemReader interface {
 	// GetPIDRSSBytes returns the resident set size in bytes for a given PID
 	GetPIDRSSBytes(pid int) (int64, error)
 	// GetMemTotalBytes returns the total system memory in bytes
 	GetMemTotalBytes() (int64, error)
+	// GetPIDStats returns CPU, I/O and open FD stats for a given PID
+	GetPIDStats(pid int) (*ProcStats, error)
+}
+
+// ProcStats holds CPU, I/O and file descriptor usage for a process (or a sum of processes)
+type ProcStats struct {
+	CPUUserSeconds   float64 // utime from /proc/<pid>/stat
+	CPUSystemSeconds float64 // stime from /proc/<pid>/stat
+	ReadBytes        int64   // read_bytes from /proc/<pid>/io
+	WriteBytes       int64   // write_bytes from /proc/<pid>/io
+	OpenFDs          int     // count of entries in /proc/<pid>/fd
+}
+
+// ProcStatsSummary holds process stats summed by cmd and user
+type ProcStatsSummary struct {
+	ByCmd  map[string]*ProcStats // Command -> summed stats
+	ByUser map[string]*ProcStats // User -> summed stats
 }
 
 // KillAction represents a process to be killed
@@ -618,8 +781,9 @@ type KillAction struct {
 	Cmd            string
 	RSSBytes       int64
 	MemPercentage  float64
-	ReasonType     string // "cmd_max_percentage", "cmd_max_value", "user_cumulative_max_percentage", "user_cumulative_max_value"
-	MatchedGroup   string // Name of the matched memlimit group
+	RuntimeSeconds int    // Runtime from monitor table (runtimelimits only)
+	ReasonType     string // "cmd_max_percentage", "cmd_max_value", "user_cumulative_max_percentage", "user_cumulative_max_value", "max_running_time", "max_idle_time"
+	MatchedGroup   string // Name of the matched memlimit/runtimelimit group
 	ThresholdValue string // The threshold that was exceeded (e.g., "30%" or "2G")
 }
 
@@ -675,68 +839,165 @@ func (t *P4ProcessTerminator) TerminateProcess(pid int, user, cmd string) (bool,
 // P4MonitorMetrics structure
 
 type P4MonitorMetrics struct {
-	config                 *config.Config
-	initialised            bool
-	loginError             bool
-	dryrun                 bool
-	env                    *map[string]string
-	logger                 *logrus.Logger
-	p4User                 string
-	isSuper                bool // Is this user a super user?
-	serverID               string
-	p4port                 string
-	p4root                 string
-	logsDir                string
-	p4Cmd                  string
-	sdpInstance            string
-	sdpInstanceLabel       string
-	sdpInstanceSuffix      string
-	p4info                 map[string]string
-	p4license              map[string]string
-	p4log                  string
-	p4journal              string
-	journalPrefix          string
-	p4errorsCSV            string
-	version                string
-	rotatedJournals        int       // Number of rotated journals
-	rotatedLogs            int       // Number of rotated logs
-	indErrSeverity         int       // Index of Severity in errors.csv
-	indErrSubsys           int       // Index of subsys
-	verifyLogModTime       time.Time // Time when last looked at verify
-	verifyErrsSubmitted    int64
-	verifyErrsSpec         int64
-	verifyErrsUnload       int64
-	verifyErrsShelved      int64
-	verifyDuration         int
-	errorMetrics           map[ErrorMetric]int
-	errLock                sync.Mutex
-	journalMetrics         map[JournalMetric]int
-	journalLock            sync.Mutex
-	metricsFilePrefix      string
-	metricsFunction        string
-	metricsWritten         bool           // Set to true when metrics have been written
-	metricNames            map[string]int // Used when printing to avoid duplicate headers
-	metrics                []metricStruct
-	errTailer              *fswatcher.FileTailer
-	journalTailer          *fswatcher.FileTailer
-	memReader              MemReader         // Interface for reading process memory (Linux /proc)
-	memlimitKillCandidates int               // Cumulative count of processes that would be killed by memlimit enforcement (if enabled)
-	memlimitKillCount      int               // Cumulative count of processes actually killed by memlimit enforcement
-	terminator             ProcessTerminator // Interface for terminating processes
+	config                    *config.Config
+	initialised               bool
+	loginError                bool
+	storageScan               *depotStorageScan // Results of the most recent depot storage scan
+	storageScanning           bool              // Set while a depot storage scan is running in the background
+	storageLock               sync.Mutex
+	dbTablesPrev              map[string]int64   // Bytes by db table at the previous sample
+	dbTablesSampled           time.Time          // Time of the previous db table sample
+	dbFrag                    map[string]float64 // Fragmentation percent by db table from the most recent dbstat -f scan
+	dbFragScanning            bool               // Set while a dbstat -f scan is running in the background
+	dbFragLock                sync.Mutex
+	driftChanges              map[string]int       // Count of changes detected by artefact (configure, triggers etc)
+	longLastRun               map[string]time.Time // Last run of monitors which run every long_update_interval (or their own interval)
+	loginRenewals             map[string]int       // Count of login attempts by result
+	loginBackoff              time.Duration        // Current backoff after failed logins
+	loginNextAttempt          time.Time            // No login attempts before this time
+	dryrun                    bool
+	env                       *map[string]string
+	logger                    *logrus.Logger
+	p4User                    string
+	isSuper                   bool // Is this user a super user?
+	serverID                  string
+	p4port                    string
+	p4root                    string
+	logsDir                   string
+	p4Cmd                     string
+	p4bin                     string
+	sdpInstance               string
+	sdpInstanceLabel          string
+	sdpInstanceSuffix         string
+	target                    string // Label value for the p4d server being monitored - only set if remote: true
+	p4info                    map[string]string
+	p4license                 map[string]string
+	p4log                     string
+	p4journal                 string
+	journalPrefix             string
+	p4errorsCSV               string
+	p4authCSV                 string
+	p4triggersCSV             string
+	p4integrityCSV            string
+	version                   string
+	rotatedJournals           int       // Number of rotated journals
+	rotatedLogs               int       // Number of rotated logs
+	verifyLogModTime          time.Time // Time when last looked at verify
+	verifyErrsSubmitted       int64
+	verifyErrsSpec            int64
+	verifyErrsUnload          int64
+	verifyErrsShelved         int64
+	verifyDuration            int
+	errorMetrics              map[ErrorMetric]int
+	errParseFailures          int64                           // Count of errors.csv lines which couldn't be parsed
+	errSchemas                map[string][]*ErrorRecordSchema // Structured log schemas by record type - from p4 logschema -a
+	schemaLock                sync.Mutex                      // Held while running p4 logschema -a
+	errorLabels               map[string]bool                 // Error names which have been allocated their own error label value
+	errorLabelOffsets         map[ErrorMetric]int             // Counts already output as "other" when error label was allocated
+	errorsReportedOther       map[ErrorMetric]int             // Counts most recently output as "other"
+	errorsByUser              map[string]int                  // Only counted if cmds_by_user
+	errorsByCmd               map[string]int                  // ditto
+	errorsFile                *fileTracker                    // Offset of errors.csv processed by tailer
+	savedErrorsFile           *fileState                      // Offset of errors.csv from state file - replayed from when tailer starts
+	errLock                   sync.Mutex
+	journalMetrics            map[JournalMetric]int
+	journalFile               *fileTracker // Offset of P4JOURNAL processed by tailer
+	savedJournalFile          *fileState   // Offset of P4JOURNAL from state file
+	journalLock               sync.Mutex
+	stateLoaded               bool // Set when counters have been restored from state file (see persist_counters)
+	authLog                   *structuredLog
+	authLogins                map[AuthMetric]int
+	authByUser                map[string]*topNCounter // By result - only counted if auth_by_user
+	authByIP                  map[string]*topNCounter // By result - only counted if auth_by_ip
+	authFailures              map[string][]time.Time  // Recent failed login times by user - within auth_failed_window
+	authParseFailures         int64
+	authLock                  sync.Mutex
+	triggerLog                *structuredLog
+	triggerExecutions         map[TriggerMetric]int
+	triggerFailures           map[TriggerMetric]int
+	triggerDurations          map[string]*durationHistogram // By trigger name
+	triggerParseFailures      int64
+	triggerLock               sync.Mutex
+	childReader               ChildProcReader               // Interface for finding running triggers (Linux /proc)
+	p4Runner                  P4Runner                      // Interface for running p4 commands which need stdin or are faked in tests
+	canaryReady               bool                          // Set when canary client has been created
+	canaryFailures            map[string]int                // By step
+	canaryDurations           map[string]*durationHistogram // By step
+	replicationLastWrite      time.Time                     // When the replication canary counter was last written (commit server)
+	replicationValue          int64                         // Most recent replication canary counter value seen (replica)
+	replicationPropagation    time.Duration                 // Most recent propagation time of the replication canary counter (replica)
+	replicationObserved       bool                          // Set when a propagation time has been measured
+	replicationStop           chan struct{}                 // Closed to stop polling the replication canary counter
+	replicationPoll           time.Duration                 // Poll interval of the running replication canary poller
+	replicationLock           sync.Mutex
+	topologyProber            TopologyProber // Interface for connecting to the other servers in p4 servers
+	integrityLog              *structuredLog
+	integrityChecks           map[IntegrityMetric]int
+	integrityMismatches       map[IntegrityMetric]int
+	integrityLastCheck        map[string]time.Time // Most recent table verification by replica
+	integrityParseFailures    int64
+	integrityChecksumsLastRun time.Time // When p4 journaldbchecksums was last run - see journaldbchecksums_interval
+	integrityChecksumsRunning bool      // Set while p4 journaldbchecksums is running in the background
+	integrityLock             sync.Mutex
+	metricsFilePrefix         string
+	metricsFunction           string
+	metricsWritten            bool           // Set to true when metrics have been written
+	metricNames               map[string]int // Used when printing to avoid duplicate headers
+	metrics                   []metricStruct
+	errTailer                 *fswatcher.FileTailer
+	journalTailer             *fswatcher.FileTailer
+	memReader                 MemReader             // Interface for reading process memory, CPU and I/O (Linux /proc)
+	memlimitKillCandidates    int                   // Cumulative count of processes that would be killed by memlimit enforcement (if enabled)
+	memlimitKillCount         int                   // Cumulative count of processes actually killed by memlimit enforcement
+	runtimelimitCandidates    int                   // Cumulative count of processes that would be killed by runtimelimit enforcement (if enabled)
+	runtimelimitKillCount     int                   // Cumulative count of processes actually killed by runtimelimit enforcement
+	memlimitKilled            map[int]bool          // PIDs terminated by memlimit enforcement in the current monitorProcesses run
+	terminator                ProcessTerminator     // Interface for terminating processes
+	monitorResult             *monitorShowResult    // Most recent parsed monitor show - used by monitorLocks
+	lockInodes                map[lockFileID]string // Device/inode -> table name for db.* and server.locks files
+	lockInodeMisses           map[lockFileID]bool   // Locked files which are not db.* or server.locks files
+	lockChains                []string              // Most recent blocking chains written to locks_log
 }
 
 func newP4MonitorMetrics(config *config.Config, envVars *map[string]string, logger *logrus.Logger) (p4m *P4MonitorMetrics) {
 	p4m = &P4MonitorMetrics{
-		config:         config,
-		env:            envVars,
-		logger:         logger,
-		p4info:         make(map[string]string),
-		p4license:      make(map[string]string),
-		errorMetrics:   make(map[ErrorMetric]int),
-		journalMetrics: make(map[JournalMetric]int),
-		metrics:        make([]metricStruct, 0),
-		memReader:      &LinuxProcMemReader{},
-	}
+		config:              config,
+		env:                 envVars,
+		logger:              logger,
+		p4info:              make(map[string]string),
+		p4license:           make(map[string]string),
+		errorMetrics:        make(map[ErrorMetric]int),
+		memlimitKilled:      make(map[int]bool),
+		errorLabels:         make(map[string]bool),
+		errorLabelOffsets:   make(map[ErrorMetric]int),
+		errorsReportedOther: make(map[ErrorMetric]int),
+		errorsByUser:        make(map[string]int),
+		errorsByCmd:         make(map[string]int),
+		journalMetrics:      make(map[JournalMetric]int),
+		authLogins:          make(map[AuthMetric]int),
+		authByUser:          make(map[string]*topNCounter),
+		authByIP:            make(map[string]*topNCounter),
+		authFailures:        make(map[string][]time.Time),
+		triggerExecutions:   make(map[TriggerMetric]int),
+		triggerFailures:     make(map[TriggerMetric]int),
+		triggerDurations:    make(map[string]*durationHistogram),
+		childReader:         &LinuxChildProcReader{},
+		canaryFailures:      make(map[string]int),
+		driftChanges:        make(map[string]int),
+		longLastRun:         make(map[string]time.Time),
+		loginRenewals:       make(map[string]int),
+		canaryDurations:     make(map[string]*durationHistogram),
+		integrityChecks:     make(map[IntegrityMetric]int),
+		integrityMismatches: make(map[IntegrityMetric]int),
+		integrityLastCheck:  make(map[string]time.Time),
+		metrics:             make([]metricStruct, 0),
+		memReader:           &LinuxProcMemReader{},
+	}
+	p4m.authLog = &structuredLog{name: "auth.csv", lock: &p4m.authLock, countLine: p4m.countAuthLine}
+	p4m.triggerLog = &structuredLog{name: "triggers.csv", lock: &p4m.triggerLock, countLine: p4m.countTriggerLine}
+	p4m.topologyProber = &P4InfoProber{p4m: p4m}
+	p4m.p4Runner = &P4PipeRunner{p4m: p4m}
+	p4m.integrityLog = &structuredLog{name: "integrity.csv", lock: &p4m.integrityLock, countLine: p4m.countIntegrityLine}
 	// Initialize terminator
 	p4m.terminator = &P4ProcessTerminator{
 		p4m:    p4m,
@@ -758,6 +1019,18 @@ func (p4m *P4MonitorMetrics) parseConfigShow(cfg []string) {
 			p4m.p4errorsCSV = strings.TrimSpace(strings.Split(v, " ")[0])
 			continue
 		}
+		if strings.HasPrefix(k, "serverlog.") && strings.Contains(v, "auth.csv") {
+			p4m.p4authCSV = strings.TrimSpace(strings.Split(v, " ")[0])
+			continue
+		}
+		if strings.HasPrefix(k, "serverlog.") && strings.Contains(v, "triggers.csv") {
+			p4m.p4triggersCSV = strings.TrimSpace(strings.Split(v, " ")[0])
+			continue
+		}
+		if strings.HasPrefix(k, "serverlog.") && strings.Contains(v, "integrity.csv") {
+			p4m.p4integrityCSV = strings.TrimSpace(strings.Split(v, " ")[0])
+			continue
+		}
 		if k == "P4LOG" {
 			p4m.p4log = strings.TrimSpace(strings.Split(v, " ")[0])
 			continue
@@ -781,12 +1054,12 @@ func (p4m *P4MonitorMetrics) initVars() {
 	}
 	// Note that P4BIN is defined by SDP by sourcing above file, as are P4USER, P4PORT
 	p4bin := "p4"
-	p4m.p4User = getVar(*p4m.env, "P4USER")
+	p4m.p4User = sdpenv.GetVar(*p4m.env, "P4USER")
 	p4m.logger.Debugf("p4User: %s", p4m.p4User)
-	p4port := getVar(*p4m.env, "P4PORT")
-	p4trust := getVar(*p4m.env, "P4TRUST")
-	p4tickets := getVar(*p4m.env, "P4TICKETS")
-	p4config := getVar(*p4m.env, "P4CONFIG")
+	p4port := sdpenv.GetVar(*p4m.env, "P4PORT")
+	p4trust := sdpenv.GetVar(*p4m.env, "P4TRUST")
+	p4tickets := sdpenv.GetVar(*p4m.env, "P4TICKETS")
+	p4config := sdpenv.GetVar(*p4m.env, "P4CONFIG")
 	p4configEnv := ""
 	if p4m.config.SDPInstance == "" {
 		p4m.logger.Debug("Non-SDP")
@@ -810,13 +1083,13 @@ func (p4m *P4MonitorMetrics) initVars() {
 		p4m.sdpInstanceLabel = ""
 		p4m.sdpInstanceSuffix = ""
 	} else {
-		p4m.sdpInstance = getVar(*p4m.env, "SDP_INSTANCE")
+		p4m.sdpInstance = sdpenv.GetVar(*p4m.env, "SDP_INSTANCE")
 		p4m.logger.Debugf("SDP: %s", p4m.sdpInstance)
-		p4bin = getVar(*p4m.env, "P4BIN")
-		p4m.config.P4DBin = getVar(*p4m.env, "P4DBIN")
-		p4m.p4log = getVar(*p4m.env, "P4LOG")
+		p4bin = sdpenv.GetVar(*p4m.env, "P4BIN")
+		p4m.config.P4DBin = sdpenv.GetVar(*p4m.env, "P4DBIN")
+		p4m.p4log = sdpenv.GetVar(*p4m.env, "P4LOG")
 		p4m.logger.Debugf("logFile: %s", p4m.p4log)
-		p4m.logsDir = getVar(*p4m.env, "LOGS")
+		p4m.logsDir = sdpenv.GetVar(*p4m.env, "LOGS")
 		p4m.logger.Debugf("LOGS: %s", p4m.logsDir)
 		p4m.sdpInstanceLabel = fmt.Sprintf(",sdpinst=\"%s\"", p4m.sdpInstance)
 		p4m.logger.Debugf("sdpInstanceLabel: %s", p4m.sdpInstanceLabel)
@@ -851,6 +1124,7 @@ func (p4m *P4MonitorMetrics) initVars() {
 		p4m.p4port = p4port
 	}
 	p4m.p4Cmd = fmt.Sprintf("%s %s %s %s", p4bin, p4configEnv, p4userStr, p4portStr)
+	p4m.p4bin = p4bin
 	p4m.logger.Debugf("p4Cmd: %s", p4m.p4Cmd)
 	err := p4m.runInfo()
 	if err != nil {
@@ -884,6 +1158,18 @@ func (p4m *P4MonitorMetrics) initVars() {
 		p4m.p4errorsCSV = path.Join(p4m.p4root, p4m.p4errorsCSV)
 		p4m.logger.Debugf("errorsFile abspath: %s", p4m.p4errorsCSV)
 	}
+	if runtime.GOOS != "windows" && p4m.p4authCSV != "" && !strings.HasPrefix(p4m.p4authCSV, "/") {
+		p4m.p4authCSV = path.Join(p4m.p4root, p4m.p4authCSV)
+		p4m.logger.Debugf("authFile abspath: %s", p4m.p4authCSV)
+	}
+	if runtime.GOOS != "windows" && p4m.p4triggersCSV != "" && !strings.HasPrefix(p4m.p4triggersCSV, "/") {
+		p4m.p4triggersCSV = path.Join(p4m.p4root, p4m.p4triggersCSV)
+		p4m.logger.Debugf("triggersFile abspath: %s", p4m.p4triggersCSV)
+	}
+	if runtime.GOOS != "windows" && p4m.p4integrityCSV != "" && !strings.HasPrefix(p4m.p4integrityCSV, "/") {
+		p4m.p4integrityCSV = path.Join(p4m.p4root, p4m.p4integrityCSV)
+		p4m.logger.Debugf("integrityFile abspath: %s", p4m.p4integrityCSV)
+	}
 	if runtime.GOOS != "windows" && p4m.p4journal != "" && !strings.HasPrefix(p4m.p4journal, "/") {
 		// If the path is not absolute, it is relative to the rootDir
 		p4m.p4journal = path.Join(p4m.p4root, p4m.p4journal)
@@ -902,6 +1188,9 @@ func (p4m *P4MonitorMetrics) initVars() {
 	if protects == "super" {
 		p4m.isSuper = true
 	}
+	p4m.setTarget()
+	p4m.logDisabledMonitors()
+	p4m.canaryReady = false // Recreate canary client in case config changed
 
 	p4m.initialised = true
 }
@@ -925,9 +1214,9 @@ func (p4m *P4MonitorMetrics) runInfo() error {
 }
 
 func (p4m *P4MonitorMetrics) checkServerID() {
-	if p4m.serverID == "" {
+	if p4m.serverID == "" && !p4m.config.Remote { // server.id is not accessible for remote servers
 		if p4m.p4root == "" {
-			p4m.p4root = getVar(*p4m.env, "P4ROOT")
+			p4m.p4root = sdpenv.GetVar(*p4m.env, "P4ROOT")
 		}
 		idFile := path.Join(p4m.p4root, "server.id")
 		p4m.logger.Debugf("serverID file: %q", idFile)
@@ -1029,11 +1318,18 @@ func (p4m *P4MonitorMetrics) printMetric(metrics *bytes.Buffer, mname string, la
 }
 
 func (p4m *P4MonitorMetrics) outputMetric(metrics *bytes.Buffer, mname string, mhelp string, mtype string, metricVal string, fixedLabels []labelStruct) {
-	if _, ok := p4m.metricNames[mname]; !ok {
+	headerName := mname
+	if mtype == "histogram" {
+		// Series are <name>_bucket, <name>_sum and <name>_count with a single header for <name>
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			headerName = strings.TrimSuffix(headerName, suffix)
+		}
+	}
+	if _, ok := p4m.metricNames[headerName]; !ok {
 		// Only write metric header once for any particular name
-		p4m.printMetricHeader(metrics, mname, mhelp, mtype)
+		p4m.printMetricHeader(metrics, headerName, mhelp, mtype)
 	}
-	p4m.metricNames[mname] = 1
+	p4m.metricNames[headerName] = 1
 	p4m.printMetric(metrics, mname, fixedLabels, metricVal)
 }
 
@@ -1043,6 +1339,9 @@ func (p4m *P4MonitorMetrics) getCumulativeMetrics() string {
 	if p4m.config.SDPInstance != "" {
 		fixedLabels = append(fixedLabels, labelStruct{name: "sdpinst", value: p4m.sdpInstance})
 	}
+	if p4m.target != "" {
+		fixedLabels = append(fixedLabels, labelStruct{name: "target", value: p4m.target})
+	}
 	metrics := new(bytes.Buffer)
 	for _, m := range p4m.metrics {
 		labels := fixedLabels
@@ -1058,7 +1357,7 @@ func (p4m *P4MonitorMetrics) metricsFilename(filePrefix string) string {
 		instanceStr = fmt.Sprintf("-%s", p4m.config.SDPInstance)
 	}
 	return path.Join(p4m.config.MetricsRoot,
-		fmt.Sprintf("%s%s-%s.prom", filePrefix, instanceStr, p4m.serverID))
+		fmt.Sprintf("%s%s%s-%s.prom", filePrefix, instanceStr, p4m.targetSuffix(), p4m.serverID))
 }
 
 func (p4m *P4MonitorMetrics) deleteMetricsFile() {
@@ -1139,6 +1438,45 @@ func (p4m *P4MonitorMetrics) newP4CmdPipe(cmd string) (string, *bytes.Buffer, *s
 	return cmd, errbuf, p
 }
 
+// longIntervalDue returns true if the named monitor has not run within long_update_interval, recording
+// that it is running now
+func (p4m *P4MonitorMetrics) longIntervalDue(name string) bool {
+	return p4m.intervalDue(name, p4m.config.LongUpdateInterval)
+}
+
+// intervalDue is as longIntervalDue for monitors with their own interval
+func (p4m *P4MonitorMetrics) intervalDue(name string, interval time.Duration) bool {
+	if last, ok := p4m.longLastRun[name]; ok && time.Since(last) < interval {
+		p4m.logger.Debugf("%s: not due until %v", name, last.Add(interval))
+		return false
+	}
+	p4m.longLastRun[name] = time.Now()
+	return true
+}
+
+// P4Runner runs p4 commands - an interface so tests don't need a server
+type P4Runner interface {
+	Run(args string, input string) ([]string, error)
+}
+
+// P4PipeRunner runs p4 commands using the p4 connection of p4metrics
+type P4PipeRunner struct {
+	p4m *P4MonitorMetrics
+}
+
+// Run runs p4 with args, passing input (if any) as stdin
+func (r *P4PipeRunner) Run(args string, input string) ([]string, error) {
+	p4cmd, errbuf, p := r.p4m.newP4CmdPipe(args)
+	if input != "" {
+		p = p.Echo(input)
+	}
+	lines, err := p.Exec(p4cmd).Slice()
+	if err != nil {
+		return lines, fmt.Errorf("%v: %s", err, strings.TrimSpace(errbuf.String()))
+	}
+	return lines, nil
+}
+
 func (p4m *P4MonitorMetrics) monitorUptime() {
 	// Server uptime as a simple seconds parameter - parsed from p4 info:
 	// Server uptime: 168:39:20
@@ -1278,6 +1616,61 @@ func (p4m *P4MonitorMetrics) parseLicense() {
 				value:  "1",
 				labels: []labelStruct{{name: "licenseIP", value: licenseIP}}})
 	}
+	p4m.licenseUsageMetrics()
+}
+
+// Resources in p4 license -u output, e.g. clientCount/clientLimit/clientSoftLimit
+var licenseResources = []string{"user", "client", "file", "repo"}
+
+// licenseUsageMetrics outputs count, limits and percent of limit for users, clients, files and repos from p4 license -u.
+// Unlicensed servers have "unlimited" limits but soft limits (e.g. 20 clients) which are then used for the percentage.
+func (p4m *P4MonitorMetrics) licenseUsageMetrics() {
+	parse := func(k string) (int64, bool) {
+		v, err := strconv.ParseInt(p4m.p4license[k], 10, 64) // Can see strings like "unlimited" or "-"
+		return v, err == nil
+	}
+	for _, res := range licenseResources {
+		count, ok := parse(res + "Count")
+		if !ok {
+			continue
+		}
+		labels := []labelStruct{{name: "resource", value: res + "s"}}
+		p4m.metrics = append(p4m.metrics,
+			metricStruct{name: "p4_license_usage_count",
+				help:   "P4D license usage count by resource (users, clients, files, repos) from p4 license -u",
+				mtype:  "gauge",
+				value:  fmt.Sprintf("%d", count),
+				labels: labels})
+		limit, hasLimit := parse(res + "Limit")
+		if hasLimit {
+			p4m.metrics = append(p4m.metrics,
+				metricStruct{name: "p4_license_usage_limit",
+					help:   "P4D license limit by resource (not output if unlimited)",
+					mtype:  "gauge",
+					value:  fmt.Sprintf("%d", limit),
+					labels: labels})
+		}
+		softLimit, hasSoftLimit := parse(res + "SoftLimit")
+		if hasSoftLimit {
+			p4m.metrics = append(p4m.metrics,
+				metricStruct{name: "p4_license_usage_soft_limit",
+					help:   "P4D license soft limit by resource - e.g. for unlicensed servers",
+					mtype:  "gauge",
+					value:  fmt.Sprintf("%d", softLimit),
+					labels: labels})
+		}
+		if !hasLimit && hasSoftLimit {
+			limit, hasLimit = softLimit, true
+		}
+		if hasLimit && limit > 0 {
+			p4m.metrics = append(p4m.metrics,
+				metricStruct{name: "p4_license_usage_percent",
+					help:   "P4D license usage as percent of limit (or soft limit if unlimited) by resource",
+					mtype:  "gauge",
+					value:  fmt.Sprintf("%.1f", float64(count)*100/float64(limit)),
+					labels: labels})
+		}
+	}
 }
 
 func (p4m *P4MonitorMetrics) monitorLicense() {
@@ -1879,6 +2272,7 @@ func (p4m *P4MonitorMetrics) monitorMonitoring() {
 		help:  "P4 monitoring login error",
 		mtype: "gauge",
 		value: loginVal})
+	p4m.disabledMonitorMetrics()
 	p4m.writeMetricsFile()
 }
 
@@ -2067,6 +2461,7 @@ func (p4m *P4MonitorMetrics) monitorProcesses() {
 	// Exepected columns in monitor show -l output:
 	// Pid, state, user, time, cmd
 	// 	8764 R user 00:00:00 edit
+	p4m.memlimitKilled = make(map[int]bool)
 	p4cmd, errbuf, p := p4m.newP4CmdPipe("monitor show -l")
 	monitorOutput, err := p.Exec(p4cmd).Slice()
 	if err != nil {
@@ -2077,6 +2472,7 @@ func (p4m *P4MonitorMetrics) monitorProcesses() {
 
 	// Parse monitor output using testable function
 	result := p4m.parseMonitorShow(monitorOutput)
+	p4m.monitorResult = result
 
 	// Generate metrics from parsed results
 	for cmd, count := range result.cmdCounts {
@@ -2134,7 +2530,8 @@ func (p4m *P4MonitorMetrics) monitorProcesses() {
 		help:  "P4 monitor max (non-svc) command run time",
 		mtype: "gauge",
 		value: fmt.Sprintf("%d", result.maxNonSvcTime)})
-	if runtime.GOOS == "linux" { // Don't bother on Windows
+
+	if runtime.GOOS == "linux" && p4m.monitorEnabled("monitorProcessesLocal") { // Don't bother on Windows
 		var proc string
 		if p4m.config.SDPInstance != "" {
 			proc = fmt.Sprintf("p4d_%s", p4m.config.SDPInstance)
@@ -2155,6 +2552,13 @@ func (p4m *P4MonitorMetrics) monitorProcesses() {
 				value: fmt.Sprintf("%d", pcount)})
 		}
 
+		// CPU/IO stats per process - per user only if allowed
+		procStats := collectProcStats(result.processes, p4m.memReader, p4m.logger)
+		p4m.procStatsMetrics(procStats.ByCmd, "cmd")
+		if p4m.config.CmdsByUser {
+			p4m.procStatsMetrics(procStats.ByUser, "user")
+		}
+
 		// Evaluate memory limits if configured
 		if p4m.config.MemLimits != nil && p4m.config.MemLimits.Enabled {
 			eval, err := evaluateMemLimits(result.processes, p4m.config.MemLimits, p4m.memReader, p4m.logger)
@@ -2202,6 +2606,10 @@ func (p4m *P4MonitorMetrics) monitorProcesses() {
 			}
 		}
 	}
+
+	// Evaluate runtime limits if configured - works on all platforms as based on monitor table.
+	// After memlimits so that processes it has just terminated are not terminated again.
+	p4m.monitorRuntimeLimits(result.processes)
 	p4m.writeMetricsFile()
 }
 
@@ -2746,40 +3154,50 @@ func (p4m *P4MonitorMetrics) monitorPull() {
 	p4m.writeMetricsFile()
 }
 
-func (p4m *P4MonitorMetrics) monitorRealTime() {
-	// p4d --show-realtime - only for 2021.1 or greater
-	p4m.startMonitor("monitorRealTime", "p4_realtime")
-	defer p4m.completeMonitor()
+var reP4DVersion = regexp.MustCompile(`(\d{4})\.(\d+)`)
 
-	if p4m.config.P4DBin == "" {
-		p4m.logger.Debugf("No P4DBIN found so exiting")
-		return
+// parseP4DVersion returns the release year and number from a version string such as
+// "P4D/LINUX26X86_64/2024.2/2697822 (2024/12/18)" (p4 info) or "Rev. P4D/LINUX26X86_64/2024.2/2697822 (2024/12/18)." (p4d -V)
+func parseP4DVersion(v string) (int, int, bool) {
+	parts := strings.Split(v, "/")
+	if len(parts) < 3 {
+		return 0, 0, false
 	}
-	errbuf := new(bytes.Buffer)
-	p := script.NewPipe().WithStderr(errbuf)
-	p4dVersion, err := p.Exec(fmt.Sprintf("%s -V", p4m.config.P4DBin)).Match("Rev.").String()
-	if err != nil {
-		p4m.logger.Errorf("Error running %s: %v, err:%q", p4m.config.P4DBin, err, errbuf.String())
-		return
+	m := reP4DVersion.FindStringSubmatch(parts[2])
+	if m == nil {
+		return 0, 0, false
 	}
-	parts := strings.Split(p4dVersion, "/")
-	if len(parts) >= 3 {
-		v := parts[2]
-		if strings.Compare("2020.0", v) >= 0 {
-			p4m.logger.Debugf("P4D Version < 2020.0: %s", v)
-			return
-		}
+	year, _ := strconv.Atoi(m[1])
+	rel, _ := strconv.Atoi(m[2])
+	return year, rel, true
+}
+
+// p4dVersionAtLeast returns true if the p4d version (from p4 info) is at least year.rel
+func (p4m *P4MonitorMetrics) p4dVersionAtLeast(year, rel int) bool {
+	y, r, ok := parseP4DVersion(p4m.p4info["Server version"])
+	if !ok {
+		return false
 	}
+	return y > year || (y == year && r >= rel)
+}
 
-	errbuf = new(bytes.Buffer)
-	p = script.NewPipe().WithStderr(errbuf)
-	cmd := fmt.Sprintf("%s -r %s --show-realtime", p4m.config.P4DBin, p4m.p4root)
-	lines, err := p.Exec(cmd).Slice()
-	if err != nil {
-		p4m.handleP4Error("Error running %s: %v, err:%q", cmd, err, errbuf)
-		return
+// localP4D returns true if there is a p4d binary and P4ROOT available locally to run p4d --show-realtime
+func (p4m *P4MonitorMetrics) localP4D() bool {
+	if !p4m.monitorEnabled("monitorRealTimeLocalP4D") || p4m.config.P4DBin == "" || p4m.p4root == "" {
+		return false
 	}
-	p4m.logger.Debugf("Realtime values: %q", lines)
+	if _, err := exec.LookPath(p4m.config.P4DBin); err != nil {
+		return false
+	}
+	if fi, err := os.Stat(p4m.p4root); err != nil || !fi.IsDir() {
+		return false
+	}
+	return true
+}
+
+// parseRealTime converts realtime counters to metrics - each counter gives a _max series too if p4d reports one.
+// Lines are the same format whether from p4d --show-realtime or p4 monitor realtime
+func parseRealTime(lines []string) []metricStruct {
 	// Output format examples:
 	// rtv.db.lockwait (flags 0) 0 max 382
 	// rtv.db.ckp.active (flags 0) 0
@@ -2789,24 +3207,75 @@ func (p4m *P4MonitorMetrics) monitorRealTime() {
 	// rtv.rpl.behind.journals (flags 0) 0 max -1
 	// rtv.svr.sessions.active (flags 0) 110 max 585
 	// rtv.svr.sessions.total (flags 0) 5997080
+	metrics := make([]metricStruct, 0)
 	for _, line := range lines {
-		if !strings.HasPrefix(line, "rtv.") {
+		fields := strings.Fields(strings.TrimSpace(line))
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "rtv.") {
 			continue
 		}
-		fields := strings.Fields(line)
-		if len(fields) < 4 {
+		rtv := fields[0]
+		values := make([]string, 0)
+		for i := 1; i < len(fields); i++ {
+			if fields[i] == "(flags" {
+				i++ // skip flags value
+				continue
+			}
+			values = append(values, fields[i])
+		}
+		if len(values) == 0 {
 			continue
 		}
-		name := "p4_" + strings.ReplaceAll(fields[0], ".", "_")
+		if _, err := strconv.ParseInt(values[0], 10, 64); err != nil {
+			continue
+		}
+		name := "p4_" + strings.ReplaceAll(rtv, ".", "_")
 		mtype := "gauge"
-		if fields[0] == "rtv.db.io.records" || fields[0] == "rtv.svr.sessions.total" {
+		if rtv == "rtv.db.io.records" || rtv == "rtv.svr.sessions.total" {
 			mtype = "counter" // For backwards compatibility with monitor_metrics.sh and historical data
 		}
-		p4m.metrics = append(p4m.metrics, metricStruct{name: name,
-			help:  fmt.Sprintf("P4 realtime metric %s", fields[0]),
+		metrics = append(metrics, metricStruct{name: name,
+			help:  fmt.Sprintf("P4 realtime metric %s", rtv),
 			mtype: mtype,
-			value: fields[3]})
+			value: values[0]})
+		// A max of -1 means not applicable, e.g. rtv.rpl.behind.* on a commit server
+		if len(values) >= 3 && values[1] == "max" {
+			if max, err := strconv.ParseInt(values[2], 10, 64); err == nil && max >= 0 {
+				metrics = append(metrics, metricStruct{name: name + "_max",
+					help:  fmt.Sprintf("P4 realtime metric %s max value", rtv),
+					mtype: "gauge",
+					value: values[2]})
+			}
+		}
+	}
+	return metrics
+}
+
+func (p4m *P4MonitorMetrics) monitorRealTime() {
+	// Realtime counters are only available for 2021.1 or greater - p4d --show-realtime if p4d is local, otherwise p4 monitor realtime
+	p4m.startMonitor("monitorRealTime", "p4_realtime")
+	defer p4m.completeMonitor()
+
+	if !p4m.p4dVersionAtLeast(2021, 1) {
+		p4m.logger.Debugf("P4D Version < 2021.1 or unknown: %s", p4m.p4info["Server version"])
+		return
+	}
+	var cmd string
+	var errbuf *bytes.Buffer
+	var p *script.Pipe
+	if p4m.localP4D() {
+		errbuf = new(bytes.Buffer)
+		p = script.NewPipe().WithStderr(errbuf)
+		cmd = fmt.Sprintf("%s -r %s --show-realtime", p4m.config.P4DBin, p4m.p4root)
+	} else {
+		cmd, errbuf, p = p4m.newP4CmdPipe("monitor realtime")
 	}
+	lines, err := p.Exec(cmd).Slice()
+	if err != nil {
+		p4m.handleP4Error("Error running %s: %v, err:%q", cmd, err, errbuf)
+		return
+	}
+	p4m.logger.Debugf("Realtime values: %q", lines)
+	p4m.metrics = append(p4m.metrics, parseRealTime(lines)...)
 	p4m.writeMetricsFile()
 }
 
@@ -3033,16 +3502,59 @@ func (p4m *P4MonitorMetrics) monitorErrors() {
 	defer p4m.completeMonitor()
 	p4m.errLock.Lock()
 	defer p4m.errLock.Unlock()
-	for m, count := range p4m.errorMetrics {
+	counts := p4m.errorCountsByLabel()
+	keys := make([]ErrorMetric, 0, len(counts))
+	for m := range counts {
+		keys = append(keys, m)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Subsystem != keys[j].Subsystem {
+			return keys[i].Subsystem < keys[j].Subsystem
+		}
+		if keys[i].Severity != keys[j].Severity {
+			return keys[i].Severity < keys[j].Severity
+		}
+		return keys[i].Name < keys[j].Name
+	})
+	for _, m := range keys {
 		p4m.metrics = append(p4m.metrics,
 			metricStruct{name: "p4_errors_count",
-				help:  "P4D error count by subsystem and level",
+				help:  "P4D error count by subsystem, level and error name",
 				mtype: "counter",
-				value: fmt.Sprintf("%d", count),
+				value: fmt.Sprintf("%d", counts[m]),
 				labels: []labelStruct{{name: "subsys", value: m.Subsystem},
 					{name: "severity", value: m.Severity},
+					{name: "error", value: m.Name},
 				}})
 	}
+	p4m.metrics = append(p4m.metrics,
+		metricStruct{name: "p4_errors_parse_failures",
+			help:  "Count of errors.csv lines which could not be parsed",
+			mtype: "counter",
+			value: fmt.Sprintf("%d", p4m.errParseFailures)})
+	if p4m.config.CmdsByUser {
+		for _, byLabel := range []struct {
+			name, help, label string
+			counts            map[string]int
+		}{
+			{"p4_errors_by_user", "P4D error count by user", "user", p4m.errorsByUser},
+			{"p4_errors_by_cmd", "P4D error count by cmd", "cmd", p4m.errorsByCmd},
+		} {
+			names := make([]string, 0, len(byLabel.counts))
+			for k := range byLabel.counts {
+				names = append(names, k)
+			}
+			sort.Strings(names)
+			for _, k := range names {
+				p4m.metrics = append(p4m.metrics,
+					metricStruct{name: byLabel.name,
+						help:   byLabel.help,
+						mtype:  "counter",
+						value:  fmt.Sprintf("%d", byLabel.counts[k]),
+						labels: []labelStruct{{name: byLabel.label, value: k}}})
+			}
+		}
+	}
 	p4m.writeMetricsFile()
 }
 
@@ -3055,6 +3567,14 @@ func (p4m *P4MonitorMetrics) stopTailers() {
 		(*p4m.journalTailer).Close()
 		p4m.journalTailer = nil
 	}
+	p4m.stopReplicationCanary()
+	for _, sl := range []*structuredLog{p4m.authLog, p4m.triggerLog, p4m.integrityLog} {
+		if sl.tailer != nil {
+			(*sl.tailer).Close()
+			sl.tailer = nil
+		}
+	}
+	p4m.saveState()
 }
 
 func loadConfigFile(logger *logrus.Logger, configFileName string, sdpInstance string, p4port string, p4user string, p4config string) (*config.Config, error) {
@@ -3067,6 +3587,9 @@ func loadConfigFile(logger *logrus.Logger, configFileName string, sdpInstance st
 	if len(sdpInstance) > 0 {
 		cfg.SDPInstance = sdpInstance
 	}
+	if cfg.Remote && cfg.SDPInstance != "" {
+		return nil, fmt.Errorf("remote: true cannot be used with SDP instance %q", cfg.SDPInstance)
+	}
 
 	logger.Infof("%v", version.Print("p4metrics"))
 	logger.Infof("Config: %+v", *cfg)
@@ -3120,14 +3643,35 @@ func (p4m *P4MonitorMetrics) runMonitorFunctions() {
 
 		// Manages its own updates on a seperate thread because of log tailing
 		if p4m.initialised {
-			go func() {
-				p4m.setupErrorMonitoring()
-			}()
+			if !p4m.stateLoaded {
+				p4m.loadState()
+			}
+			if p4m.monitorEnabled("monitorErrors") {
+				go func() {
+					p4m.setupErrorMonitoring()
+				}()
+			}
 			if p4m.config.ParseJournal && p4m.shouldMonitorJournal() {
 				go func() {
 					p4m.setupJournalMonitoring()
 				}()
 			}
+			if p4m.config.ParseAuthLog && p4m.monitorEnabled("monitorAuth") {
+				go func() {
+					p4m.setupAuthMonitoring()
+				}()
+			}
+			if p4m.config.ParseTriggerLog && p4m.monitorEnabled("monitorTriggers") {
+				go func() {
+					p4m.setupTriggerMonitoring()
+				}()
+			}
+			p4m.setupReplicationCanary()
+			if p4m.config.ParseIntegrityLog && p4m.monitorEnabled("monitorIntegrityLog") {
+				go func() {
+					p4m.setupIntegrityMonitoring()
+				}()
+			}
 		}
 	} else {
 		err := p4m.runInfo() // update p4info to check connection and collect basic info
@@ -3139,30 +3683,69 @@ func (p4m *P4MonitorMetrics) runMonitorFunctions() {
 		if (!p4m.config.ParseJournal || !p4m.shouldMonitorJournal()) && p4m.journalTailer != nil {
 			(*p4m.journalTailer).Close()
 			p4m.journalTailer = nil
+			p4m.journalLock.Lock()
+			if p4m.journalFile != nil {
+				p4m.journalFile.close()
+				p4m.journalFile = nil
+			}
+			p4m.journalLock.Unlock()
 		}
 	}
 
+	p4m.monitorLogin()
 	if p4m.config.MonitorSwarm {
 		p4m.monitorSwarm()
 	}
 	p4m.monitorUptime()
 	p4m.monitorChange()
-	p4m.monitorCheckpoint()
-	p4m.monitorJournalAndLogs()
+	if p4m.monitorEnabled("monitorCheckpoint") {
+		p4m.monitorCheckpoint()
+	}
+	if p4m.monitorEnabled("monitorJournalAndLogs") {
+		p4m.monitorJournalAndLogs()
+	}
+	p4m.monitorDiskspace()
 	p4m.monitorFilesys()
 	p4m.monitorHelixAuthSvc()
 	p4m.monitorLicense()
+	p4m.monitorUserHygiene()
+	p4m.monitorWorkspaceHygiene()
+	p4m.monitorDepotStorage()
+	p4m.monitorDBTables()
+	p4m.monitorDrift()
+	p4m.monitorPolicy()
 	p4m.monitorProcesses()
+	if p4m.monitorEnabled("monitorLocks") {
+		p4m.monitorLocks()
+	}
 	p4m.monitorReplicas()
+	p4m.monitorTopology()
+	p4m.monitorCanary()
+	p4m.monitorReplicationCanary()
 	p4m.monitorSSL()
 	p4m.monitorPull()
 	p4m.monitorRealTime()
 	p4m.monitorVersions()
-	p4m.monitorVerify()
-	p4m.monitorErrors()
+	if p4m.monitorEnabled("monitorVerify") {
+		p4m.monitorVerify()
+	}
+	if p4m.monitorEnabled("monitorErrors") {
+		p4m.monitorErrors()
+	}
+	if p4m.config.ParseAuthLog && p4m.monitorEnabled("monitorAuth") {
+		p4m.monitorAuth()
+	}
+	if p4m.config.ParseTriggerLog && p4m.monitorEnabled("monitorTriggers") {
+		p4m.monitorTriggers()
+	}
+	if p4m.config.ParseIntegrityLog && p4m.monitorEnabled("monitorIntegrityLog") {
+		p4m.monitorIntegrity()
+	}
+	p4m.monitorJournalDBChecksums()
 	if p4m.config.ParseJournal && p4m.shouldMonitorJournal() {
 		p4m.monitorJournalRecords()
 	}
+	p4m.saveState()
 	p4m.monitorMonitoring()
 }
 
@@ -3204,6 +3787,10 @@ func main() {
 			"sample.config",
 			"Output a sample config file and exit. Useful for getting started to create p4metrics.yaml. E.g. p4metrics --sample.config > p4metrics.yaml",
 		).Short('C').Bool()
+		checkPolicy = kingpin.Flag(
+			"check.policy",
+			"Check the security_policy rules against p4d, print a report and exit (status 1 if any rules fail).",
+		).Bool()
 	)
 
 	kingpin.Version(version.Print("p4metrics"))
@@ -3234,12 +3821,30 @@ func main() {
 
 	var env map[string]string
 	if cfg.SDPInstance != "" {
-		env = sourceSDPVars(cfg.SDPInstance, logger)
+		env = sdpenv.SourceSDPVars(cfg.SDPInstance, logger)
 	} else {
-		env = sourceEnvVars()
+		env = sdpenv.SourceEnvVars()
 	}
 	p4m := newP4MonitorMetrics(cfg, &env, logger)
 	p4m.version = version.Version
+	if *checkPolicy {
+		if cfg.Policy == nil {
+			logger.Fatalf("No security_policy specified in config file: %q", *configFilename)
+		}
+		p4m.initVars()
+		if !p4m.initialised {
+			logger.Fatalf("Failed to connect to p4d")
+		}
+		results, err := p4m.checkPolicy()
+		if err != nil {
+			logger.Fatalf("Failed to check security_policy: %v", err)
+		}
+		fmt.Print(policyReport(results))
+		if _, failed := policyScore(results); failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
 	iterations := -1
 	if *dryrun {
 		p4m.dryrun = true
@@ -3270,10 +3875,11 @@ func main() {
 					break
 				}
 				if cfg.SDPInstance != "" {
-					env = sourceSDPVars(cfg.SDPInstance, logger)
+					env = sdpenv.SourceSDPVars(cfg.SDPInstance, logger)
 				} else {
-					env = sourceEnvVars()
+					env = sdpenv.SourceEnvVars()
 				}
+				p4m.stopReplicationCanary() // Restarted on re-init with the new config
 				p4m.config = cfg
 				p4m.env = &env
 				p4m.initialised = false // Force re-init
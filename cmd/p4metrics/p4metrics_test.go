@@ -8,12 +8,14 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
 	"runtime"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/perforce/p4prometheus/cmd/p4metrics/config"
 	"github.com/sirupsen/logrus"
@@ -120,7 +122,7 @@ func TestP4MetricsLicense(t *testing.T) {
 		"licenseTimeRemaining": "34431485",
 		"supportExpires":       "1677628800"}
 	p4m.parseLicense()
-	assert.Equal(t, 5, len(p4m.metrics))
+	assert.Equal(t, 8, len(p4m.metrics))
 	tlogger.Debugf("Metrics: %q", p4m.metrics)
 
 	p4m.metrics = make([]metricStruct, 0)
@@ -137,6 +139,9 @@ func TestP4MetricsLicense(t *testing.T) {
 		{name: "p4_license_time_remaining", value: "34259402"},
 		{name: "p4_license_support_expires", value: "1772323200"},
 		{name: "p4_license_info", value: "1", labelName: "licenseInfo", labelValue: "Perforce Software, Inc. 999 users"},
+		{name: "p4_license_usage_count", labelName: "resource", labelValue: "users", value: "893"},
+		{name: "p4_license_usage_limit", labelName: "resource", labelValue: "users", value: "1000"},
+		{name: "p4_license_usage_percent", labelName: "resource", labelValue: "users", value: "89.3"},
 	}
 	assert.Equal(t, len(expected), len(p4m.metrics))
 	tlogger.Debugf("Metrics: %q", p4m.metrics)
@@ -164,6 +169,20 @@ func TestP4MetricsLicense(t *testing.T) {
 		{name: "p4_licensed_user_count", value: "1"},
 		// {name: "p4_licensed_user_limit", value: "unlimited"},
 		{name: "p4_license_info", value: "1", labelName: "licenseInfo", labelValue: "none"},
+		// Unlicensed so percentages are of the soft limits
+		{name: "p4_license_usage_count", labelName: "resource", labelValue: "users", value: "1"},
+		{name: "p4_license_usage_soft_limit", labelName: "resource", labelValue: "users", value: "5"},
+		{name: "p4_license_usage_percent", labelName: "resource", labelValue: "users", value: "20.0"},
+		{name: "p4_license_usage_count", labelName: "resource", labelValue: "clients", value: "0"},
+		{name: "p4_license_usage_soft_limit", labelName: "resource", labelValue: "clients", value: "20"},
+		{name: "p4_license_usage_percent", labelName: "resource", labelValue: "clients", value: "0.0"},
+		{name: "p4_license_usage_count", labelName: "resource", labelValue: "files", value: "0"},
+		{name: "p4_license_usage_soft_limit", labelName: "resource", labelValue: "files", value: "1000"},
+		{name: "p4_license_usage_percent", labelName: "resource", labelValue: "files", value: "0.0"},
+		{name: "p4_license_usage_count", labelName: "resource", labelValue: "repos", value: "0"},
+		{name: "p4_license_usage_limit", labelName: "resource", labelValue: "repos", value: "3"},
+		{name: "p4_license_usage_soft_limit", labelName: "resource", labelValue: "repos", value: "3"},
+		{name: "p4_license_usage_percent", labelName: "resource", labelValue: "repos", value: "0.0"},
 	}
 	assert.Equal(t, len(expected), len(p4m.metrics))
 	tlogger.Debugf("Metrics: %q", p4m.metrics)
@@ -191,6 +210,10 @@ func TestP4MetricsLicense(t *testing.T) {
 		{name: "p4_license_time_remaining", value: "19053002"},
 		{name: "p4_license_support_expires", value: "1764892800"},
 		{name: "p4_license_info", value: "1", labelName: "licenseInfo", labelValue: "none"},
+		// Counts of "-" are not output
+		{name: "p4_license_usage_count", labelName: "resource", labelValue: "users", value: "84"},
+		{name: "p4_license_usage_limit", labelName: "resource", labelValue: "users", value: "472"},
+		{name: "p4_license_usage_percent", labelName: "resource", labelValue: "users", value: "17.8"},
 	}
 	assert.Equal(t, len(expected), len(p4m.metrics))
 	tlogger.Debugf("Metrics: %q", p4m.metrics)
@@ -231,6 +254,8 @@ func TestP4ConfigParsing(t *testing.T) {
 	assert.Equal(t, "/p4/1/logs/log", p4m.p4log)
 	assert.Equal(t, "/p4/1/logs/journal", p4m.p4journal)
 	assert.Equal(t, "/p4/1/logs/errors.csv", p4m.p4errorsCSV)
+	assert.Equal(t, "/p4/1/logs/auth.csv", p4m.p4authCSV)
+	assert.Equal(t, "/p4/1/logs/integrity.csv", p4m.p4integrityCSV)
 	assert.Equal(t, "/p4/1/checkpoints/p4_1", p4m.journalPrefix)
 }
 
@@ -414,8 +439,139 @@ func TestP4MetricsSchemaParsing(t *testing.T) {
 `
 	lines := strings.Split(schemaLines, "\n")
 	p4m.setupErrorParsing(lines)
-	assert.Equal(t, 16, p4m.indErrSeverity)
-	assert.Equal(t, 17, p4m.indErrSubsys)
+	rs := findErrorSchema(p4m.errSchemas, "4", 20)
+	assert.NotNil(t, rs)
+	assert.Equal(t, "Error", rs.RecordName)
+	assert.Equal(t, 58, rs.RecordVersion)
+	assert.Equal(t, 16, rs.Fields["f_severity"])
+	assert.Equal(t, 17, rs.Fields["f_subsys"])
+}
+
+// readLogSchema returns the p4 logschema -a output in testdata/logschema.txt - the records used by p4metrics,
+// including an older version of Error
+func readLogSchema(t *testing.T) []string {
+	content, err := os.ReadFile("testdata/logschema.txt")
+	assert.NoError(t, err)
+	return strings.Split(string(content), "\n")
+}
+
+func TestParseErrorLine(t *testing.T) {
+	cfg := config.Config{}
+	initLogger()
+	env := map[string]string{}
+	p4m := newP4MonitorMetrics(&cfg, &env, tlogger)
+
+	p4m.setupErrorParsing(readLogSchema(t))
+
+	// Current version with quoted commas in args and text
+	rec, err := p4m.parseErrorRecord(`4,1734000000,123,2024/12/12 10:40:00 123456,1234,abc,master.1,3,fred,fred_ws,user-sync,10.1.2.3,p4v,2024.2,"//depot/a,b/...",sync,3,6,17,"File(s) not in client view, check mapping"`)
+	assert.NoError(t, err)
+	assert.Equal(t, &ErrorRecord{RecordName: "Error", Severity: "3", Subsystem: "DM", Subcode: "17",
+		Name: "DM_BadRevision", User: "fred", Command: "user-sync", Program: "p4v"}, rec)
+
+	// FatalError record type
+	rec, err = p4m.parseErrorRecord(`5,1734000000,123,2024/12/12 10:40:00 123456,1234,abc,master.1,3,bob,bob_ws,user-submit,10.1.2.3,p4,2024.2,-d,submit,4,4,12,Database corrupt`)
+	assert.NoError(t, err)
+	assert.Equal(t, "FatalError", rec.RecordName)
+	assert.Equal(t, "4", rec.Severity)
+	assert.Equal(t, "DB", rec.Subsystem)
+	assert.Equal(t, "bob", rec.User)
+
+	// Older version of Error record (from before an upgrade)
+	rec, err = p4m.parseErrorRecord(`4,1734000000,123,2024/12/12 10:40:00 123456,1234,abc,master.1,3,jim,jim_ws,user-edit,10.1.2.3,p4,2023.1,file.c,2,1,99,Warning`)
+	assert.NoError(t, err)
+	assert.Equal(t, &ErrorRecord{RecordName: "Error", Severity: "2", Subsystem: "SUPP", Subcode: "99",
+		Name: "SUPP_99", User: "jim", Command: "user-edit", Program: "p4"}, rec)
+
+	// Unknown record type, too few fields and bad subsystem are all failures
+	for _, line := range []string{
+		`9,1734000000,123,2024/12/12 10:40:00 123456,1234`,
+		`4,1734000000,123`,
+		`4,1734000000,123,2024/12/12 10:40:00 123456,1234,abc,master.1,3,jim,jim_ws,user-edit,10.1.2.3,p4,2023.1,file.c,2,xx,99,Warning`,
+	} {
+		_, err = p4m.parseErrorRecord(line)
+		assert.Error(t, err, line)
+		p4m.parseErrorLine(line)
+	}
+	p4m.parseErrorLine(`4,1734000000,123,2024/12/12 10:40:00 123456,1234,abc,master.1,3,jim,jim_ws,user-edit,10.1.2.3,p4,2023.1,file.c,2,1,99,Warning`)
+	p4m.parseErrorLine(`4,1734000000,123,2024/12/12 10:40:00 123456,1234,abc,master.1,3,jim,jim_ws,user-edit,10.1.2.3,p4,2023.1,"file,c",2,1,99,"Warning, warning"`)
+	assert.Equal(t, int64(3), p4m.errParseFailures)
+	assert.Equal(t, 2, p4m.errorMetrics[ErrorMetric{Subsystem: "SUPP", Severity: "2", Name: "SUPP_99"}])
+
+	p4m.dryrun = true
+	p4m.monitorErrors()
+	compareMetricValues(t, metricValues{
+		{name: "p4_errors_count", labelName: "subsys", labelValue: "SUPP", value: "2"},
+		{name: "p4_errors_parse_failures", value: "3"},
+	}, p4m.metrics)
+}
+
+func TestErrorLabels(t *testing.T) {
+	cfg := config.Config{ErrorLabels: []string{"CLIENT_LockCheckFail"}, ErrorLabelsTopN: 1, CmdsByUser: true}
+	initLogger()
+	env := map[string]string{}
+	p4m := newP4MonitorMetrics(&cfg, &env, tlogger)
+	p4m.dryrun = true
+	p4m.setupErrorParsing(readLogSchema(t))
+	errLine := func(user, cmd string, subsys, subcode int) string {
+		return fmt.Sprintf("4,1734000000,123,2024/12/12 10:40:00 123456,1234,abc,master.1,3,%s,ws,user-%s,10.1.2.3,p4,2024.2,,%s,3,%d,%d,text",
+			user, cmd, cmd, subsys, subcode)
+	}
+	// Values of error label with subsys and severity - as compareMetricValues only checks the first label
+	errorCounts := func() map[string]string {
+		result := make(map[string]string)
+		for _, m := range p4m.metrics {
+			if m.name == "p4_errors_count" {
+				result[fmt.Sprintf("%s/%s/%s", m.labels[0].value, m.labels[1].value, m.labels[2].value)] = m.value
+			}
+		}
+		return result
+	}
+
+	p4m.parseErrorLine(errLine("fred", "sync", 6, 17))
+	p4m.parseErrorLine(errLine("fred", "sync", 6, 17))
+	p4m.parseErrorLine(errLine("bob", "sync", 6, 17))
+	p4m.parseErrorLine(errLine("bob", "edit", 4, 12))
+	p4m.monitorErrors()
+	// DM_BadRevision is the most frequent so gets the one top N label
+	assert.Equal(t, map[string]string{"DM/3/DM_BadRevision": "3", "DB/3/other": "1"}, errorCounts())
+
+	p4m.metrics = make([]metricStruct, 0)
+	p4m.parseErrorLine(errLine("bob", "edit", 4, 12))
+	p4m.parseErrorLine(errLine("bob", "edit", 4, 12))
+	p4m.parseErrorLine(errLine("jim", "submit", 8, 44))
+	p4m.monitorErrors()
+	// DB_JnlReplay is now more frequent but no label is available, CLIENT_LockCheckFail is in allow-list
+	assert.Equal(t, map[string]string{"DM/3/DM_BadRevision": "3", "DB/3/other": "3", "CLIENT/3/CLIENT_LockCheckFail": "1"}, errorCounts())
+	compareMetricValues(t, metricValues{
+		{name: "p4_errors_count", labelName: "subsys", labelValue: "DM", value: "3"},
+		{name: "p4_errors_count", labelName: "subsys", labelValue: "DB", value: "3"},
+		{name: "p4_errors_count", labelName: "subsys", labelValue: "CLIENT", value: "1"},
+		{name: "p4_errors_parse_failures", value: "0"},
+		{name: "p4_errors_by_user", labelName: "user", labelValue: "fred", value: "2"},
+		{name: "p4_errors_by_user", labelName: "user", labelValue: "bob", value: "4"},
+		{name: "p4_errors_by_user", labelName: "user", labelValue: "jim", value: "1"},
+		{name: "p4_errors_by_cmd", labelName: "cmd", labelValue: "sync", value: "3"},
+		{name: "p4_errors_by_cmd", labelName: "cmd", labelValue: "edit", value: "3"},
+		{name: "p4_errors_by_cmd", labelName: "cmd", labelValue: "submit", value: "1"},
+	}, p4m.metrics)
+
+	// Labels allocated after counts were output as other keep those counts in other so counters are monotonic
+	cfg.ErrorLabelsTopN = 2
+	p4m.metrics = make([]metricStruct, 0)
+	p4m.parseErrorLine(errLine("bob", "edit", 4, 12))
+	p4m.monitorErrors()
+	assert.Equal(t, map[string]string{"DM/3/DM_BadRevision": "3", "DB/3/other": "3", "DB/3/DB_JnlReplay": "1",
+		"CLIENT/3/CLIENT_LockCheckFail": "1"}, errorCounts())
+
+	// Privacy switch
+	cfg.CmdsByUser = false
+	p4m.metrics = make([]metricStruct, 0)
+	p4m.monitorErrors()
+	for _, m := range p4m.metrics {
+		assert.NotEqual(t, "p4_errors_by_user", m.name)
+		assert.NotEqual(t, "p4_errors_by_cmd", m.name)
+	}
 }
 
 func TestP4MonitorParsing(t *testing.T) {
@@ -438,6 +594,1121 @@ func TestP4MonitorParsing(t *testing.T) {
 	assert.Equal(t, 3821, p4m.getMaxNonSvcCmdTime(lines))
 }
 
+func TestTopNCounter(t *testing.T) {
+	c := newTopNCounter()
+	for _, k := range []string{"fred", "fred", "bob", "jim"} {
+		c.inc(k)
+	}
+	assert.Equal(t, map[string]int{"fred": 2, "other": 2}, c.labelled(1))
+	// Counts already output as "other" stay there when a value is later allocated its own label
+	c.inc("bob")
+	c.inc("bob")
+	assert.Equal(t, map[string]int{"fred": 2, "bob": 2, "other": 2}, c.labelled(2))
+	assert.Equal(t, map[string]int{"fred": 2, "bob": 2, "other": 2}, c.clone().labelled(2))
+}
+
+func TestAuthLog(t *testing.T) {
+	cfg := config.Config{AuthByUser: true, AuthByIP: true, AuthTopN: 1, AuthFailedWindow: 15 * time.Minute}
+	initLogger()
+	env := map[string]string{}
+	p4m := newP4MonitorMetrics(&cfg, &env, tlogger)
+	p4m.p4authCSV = "/p4/1/logs/auth.csv"
+	p4m.setupErrorParsing(readLogSchema(t))
+
+	now := time.Now().Unix()
+	old := now - 3600
+	for _, l := range []struct {
+		ts                       int64
+		user, ip, method, status string
+	}{
+		{now, "fred", "10.1.2.3", "ldap", "success"},
+		{now, "fred", "10.1.2.3", "ldap", "failure"},
+		{now, "fred", "10.1.2.4", "ldap", "failure"},
+		{now, "bob", "10.1.2.5", "ldap", "failure"},
+		{old, "jim", "10.1.2.6", "password", "failure"},
+		{now, "jim", "10.1.2.6", "sso", "success"},
+		{now, "jim", "10.1.2.6", "sso", "pending"},
+	} {
+		p4m.countAuthLine(fmt.Sprintf("16,%d,1,2026/10/18 10:00:00 123456,1234,abc,master.1,3,%s,%s_ws,user-login,%s,p4,2025.1/LINUX26X86_64/2751207,,login,%s,%s,\"message, with comma\"",
+			l.ts, l.user, l.user, l.ip, l.method, l.status))
+	}
+	p4m.countAuthLine("99,bad")
+	assert.Equal(t, 3, p4m.authLogins[AuthMetric{Method: "ldap", Result: "failure"}])
+	// Unrecognised status is neither success nor failure, so not a recent failure
+	assert.Equal(t, 1, p4m.authLogins[AuthMetric{Method: "sso", Result: "unknown"}])
+	assert.Equal(t, int64(1), p4m.authParseFailures)
+
+	p4m.dryrun = true
+	p4m.monitorAuth()
+	compareMetricValues(t, metricValues{
+		{name: "p4_auth_logins_count", labelName: "method", labelValue: "ldap", value: "3"},
+		{name: "p4_auth_logins_count", labelName: "method", labelValue: "ldap", value: "1"},
+		{name: "p4_auth_logins_count", labelName: "method", labelValue: "password", value: "1"},
+		{name: "p4_auth_logins_count", labelName: "method", labelValue: "sso", value: "1"},
+		{name: "p4_auth_logins_count", labelName: "method", labelValue: "sso", value: "1"},
+		{name: "p4_auth_parse_failures", value: "1"},
+		{name: "p4_auth_logins_by_user", labelName: "user", labelValue: "fred", value: "2"},
+		{name: "p4_auth_logins_by_user", labelName: "user", labelValue: "other", value: "2"},
+		{name: "p4_auth_logins_by_user", labelName: "user", labelValue: "fred", value: "1"},
+		{name: "p4_auth_logins_by_user", labelName: "user", labelValue: "other", value: "1"},
+		{name: "p4_auth_logins_by_user", labelName: "user", labelValue: "jim", value: "1"},
+		{name: "p4_auth_logins_by_ip", labelName: "ip", labelValue: "10.1.2.3", value: "1"},
+		{name: "p4_auth_logins_by_ip", labelName: "ip", labelValue: "other", value: "3"},
+		{name: "p4_auth_logins_by_ip", labelName: "ip", labelValue: "10.1.2.3", value: "1"},
+		{name: "p4_auth_logins_by_ip", labelName: "ip", labelValue: "other", value: "1"},
+		{name: "p4_auth_logins_by_ip", labelName: "ip", labelValue: "10.1.2.6", value: "1"},
+		{name: "p4_auth_failed_logins_recent", labelName: "user", labelValue: "fred", value: "2"},
+	}, p4m.metrics)
+}
+
+func TestAuthLogNotByUser(t *testing.T) {
+	cfg := config.Config{AuthTopN: 1, AuthFailedWindow: 15 * time.Minute}
+	initLogger()
+	env := map[string]string{}
+	p4m := newP4MonitorMetrics(&cfg, &env, tlogger)
+	p4m.p4authCSV = "/p4/1/logs/auth.csv"
+	p4m.setupErrorParsing(readLogSchema(t))
+
+	now := time.Now().Unix()
+	for _, user := range []string{"fred", "fred", "bob"} {
+		p4m.countAuthLine(fmt.Sprintf("16,%d,1,2026/10/18 10:00:00 123456,1234,abc,master.1,3,%s,%s_ws,user-login,10.1.2.3,p4,2025.1/LINUX26X86_64/2751207,,login,ldap,failure,\"bad password\"",
+			now, user, user))
+	}
+	// No user names kept (or saved in state) without auth_by_user
+	st := p4m.getState()
+	assert.Equal(t, 1, len(st.AuthFailures))
+	assert.Equal(t, 3, len(st.AuthFailures[""]))
+
+	p4m.dryrun = true
+	p4m.monitorAuth()
+	compareMetricValues(t, metricValues{
+		{name: "p4_auth_logins_count", labelName: "method", labelValue: "ldap", value: "3"},
+		{name: "p4_auth_parse_failures", value: "0"},
+		{name: "p4_auth_failed_logins_recent", value: "3"},
+	}, p4m.metrics)
+}
+
+// FakeChildProcReader is a mock implementation of ChildProcReader for testing
+type FakeChildProcReader struct {
+	Children []ChildProcess
+}
+
+func (f *FakeChildProcReader) GetChildProcesses(parents map[int]bool) ([]ChildProcess, error) {
+	result := make([]ChildProcess, 0)
+	for _, c := range f.Children {
+		if parents[c.PPID] {
+			result = append(result, c)
+		}
+	}
+	return result, nil
+}
+
+func TestTriggerLog(t *testing.T) {
+	cfg := config.Config{TriggerBuckets: []float64{1, 10}, TriggerLongRunning: 30 * time.Second}
+	initLogger()
+	env := map[string]string{}
+	p4m := newP4MonitorMetrics(&cfg, &env, tlogger)
+	p4m.p4triggersCSV = "/p4/1/logs/triggers.csv"
+	p4m.setupErrorParsing(readLogSchema(t))
+
+	triggerLine := func(user, cmd, trigType, name, lapse, exitCode string) string {
+		return fmt.Sprintf("18,1734000000,1,2026/10/18 10:00:00 123456,1234,abc,master.1,3,%s,%s_ws,user-%s,10.1.2.3,p4,2025.1/LINUX26X86_64/2751207,,%s,%s,%s,%s,%s",
+			user, user, cmd, cmd, trigType, name, lapse, exitCode)
+	}
+	for _, l := range []string{
+		triggerLine("fred", "submit", "change-submit", "check-jobs", "0.5", "0"),
+		triggerLine("fred", "submit", "change-submit", "check-jobs", "5", "1"),
+		triggerLine("bob", "submit", "change-submit", "check-jobs", "45", "0"),
+		triggerLine("bob", "login", "auth-check", "ldap-auth", "0.2", "0"),
+		triggerLine("bob", "login", "auth-check", "ldap-auth", "", ""), // Counted, but not as a failure
+		"18,1734000000",
+	} {
+		p4m.countTriggerLine(l)
+	}
+	assert.Equal(t, 3, p4m.triggerExecutions[TriggerMetric{Name: "check-jobs", Type: "change-submit"}])
+	assert.Equal(t, 0, p4m.triggerFailures[TriggerMetric{Name: "ldap-auth", Type: "auth-check"}])
+	assert.Equal(t, 1, p4m.triggerFailures[TriggerMetric{Name: "check-jobs", Type: "change-submit"}])
+	assert.Equal(t, &durationHistogram{Buckets: []int{1, 1}, Sum: 50.5, Count: 3}, p4m.triggerDurations["check-jobs"])
+	assert.Equal(t, int64(1), p4m.triggerParseFailures)
+
+	// Running trigger for one of the commands in the monitor table
+	p4m.monitorResult = p4m.parseMonitorShow([]string{"1000 R fred 00:01:00 submit", "1001 R bob 00:00:01 login"})
+	p4m.childReader = &FakeChildProcReader{Children: []ChildProcess{
+		{PID: 2000, PPID: 1000, Cmdline: "/usr/bin/python3 /p4/common/bin/triggers/CheckJobs.py 1234", ElapsedSeconds: 59},
+		{PID: 2001, PPID: 1001, Cmdline: "/p4/common/bin/triggers/ldap_auth.sh bob", ElapsedSeconds: 1},
+		{PID: 2002, PPID: 999, Cmdline: "/bin/other", ElapsedSeconds: 100},
+	}}
+	p4m.dryrun = true
+	p4m.monitorTriggers()
+	expected := metricValues{
+		{name: "p4_triggers_executions_count", labelName: "trigger", labelValue: "check-jobs", value: "3"},
+		{name: "p4_triggers_failures_count", labelName: "trigger", labelValue: "check-jobs", value: "1"},
+		{name: "p4_triggers_executions_count", labelName: "trigger", labelValue: "ldap-auth", value: "2"},
+		{name: "p4_triggers_failures_count", labelName: "trigger", labelValue: "ldap-auth", value: "0"},
+		{name: "p4_triggers_duration_seconds_bucket", labelName: "trigger", labelValue: "check-jobs", value: "1"},
+		{name: "p4_triggers_duration_seconds_bucket", labelName: "trigger", labelValue: "check-jobs", value: "2"},
+		{name: "p4_triggers_duration_seconds_bucket", labelName: "trigger", labelValue: "check-jobs", value: "3"},
+		{name: "p4_triggers_duration_seconds_sum", labelName: "trigger", labelValue: "check-jobs", value: "50.5"},
+		{name: "p4_triggers_duration_seconds_count", labelName: "trigger", labelValue: "check-jobs", value: "3"},
+		{name: "p4_triggers_duration_seconds_bucket", labelName: "trigger", labelValue: "ldap-auth", value: "1"},
+		{name: "p4_triggers_duration_seconds_bucket", labelName: "trigger", labelValue: "ldap-auth", value: "1"},
+		{name: "p4_triggers_duration_seconds_bucket", labelName: "trigger", labelValue: "ldap-auth", value: "1"},
+		{name: "p4_triggers_duration_seconds_sum", labelName: "trigger", labelValue: "ldap-auth", value: "0.2"},
+		{name: "p4_triggers_duration_seconds_count", labelName: "trigger", labelValue: "ldap-auth", value: "1"},
+		{name: "p4_triggers_parse_failures", value: "1"},
+	}
+	if runtime.GOOS == "linux" {
+		// Trigger table not available (not super user) so names are unknown
+		expected = append(expected,
+			metricValue{name: "p4_triggers_long_running", labelName: "trigger", labelValue: "unknown", value: "1"},
+			metricValue{name: "p4_triggers_running_max_seconds", labelName: "trigger", labelValue: "unknown", value: "59"})
+	}
+	compareMetricValues(t, expected, p4m.metrics)
+
+	buf := p4m.getCumulativeMetrics()
+	assert.Equal(t, 1, strings.Count(buf, "# TYPE p4_triggers_duration_seconds histogram"))
+	assert.Contains(t, buf, `p4_triggers_duration_seconds_bucket{trigger="check-jobs",le="+Inf"} 3`)
+}
+
+func TestTriggerTable(t *testing.T) {
+	triggers := parseTriggerTable([]string{
+		"# A Perforce Triggers Specification.",
+		"Triggers:",
+		"\tcheck-jobs change-submit //depot/... \"python3 /p4/common/bin/triggers/CheckJobs.py %change%\"",
+		"\tcheck-fix change-submit //depot/fix/... \"python3 /p4/common/bin/triggers/CheckJobs.py -fix %change%\"",
+		"\tdepot-trig change-content //depot/... \"%//depot/triggers/trig.py% %change%\"",
+		"",
+	})
+	assert.Equal(t, 3, len(triggers))
+	assert.Equal(t, "python3 /p4/common/bin/triggers/CheckJobs.py %change%", triggers["check-jobs"])
+	assert.Equal(t, "check-jobs", matchTrigger(triggers, "python3 /p4/common/bin/triggers/CheckJobs.py 1234"))
+	assert.Equal(t, "check-fix", matchTrigger(triggers, "python3 /p4/common/bin/triggers/CheckJobs.py -fix 1234"))
+	assert.Equal(t, "unknown", matchTrigger(triggers, "/tmp/p4trig.12345 1234"))
+
+	ppid, starttime, err := parseProcStatParent("2000 (python3 x) S 1000 2000 1000 0 -1 4194560 1 0 0 0 1 0 0 0 20 0 1 0 123456 1000 100")
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, ppid)
+	assert.Equal(t, int64(123456), starttime)
+}
+
+func TestIntegrityLog(t *testing.T) {
+	cfg := config.Config{}
+	initLogger()
+	env := map[string]string{}
+	p4m := newP4MonitorMetrics(&cfg, &env, tlogger)
+	p4m.p4integrityCSV = "/p4/1/logs/integrity.csv"
+	p4m.serverID = "replica1"
+	p4m.setupErrorParsing(readLogSchema(t))
+
+	integrityLine := func(ts int64, replica, table, result string) string {
+		return fmt.Sprintf("12,%d,1,%s 123456,1234,,%s,0,,,,,,,,,%s,10,654321,%s",
+			ts, time.Unix(ts, 0).Format("2006/01/02 15:04:05"), replica, table, result)
+	}
+	for _, l := range []string{
+		integrityLine(1760781600, "replica1", "db.have", "match"),
+		integrityLine(1760781600, "replica1", "db.rev", "MISMATCH"),
+		integrityLine(1760781700, "replica1", "db.rev", "match"),
+		integrityLine(1760781500, "edge1", "db.rev", "match"),
+		integrityLine(1760781500, "", "db.user", "match"),
+		integrityLine(1760781500, "edge1", "", "match"),
+		integrityLine(1760781500, "edge1", "db.user", "skipped"), // Neither match nor mismatch
+	} {
+		p4m.countIntegrityLine(l)
+	}
+	assert.Equal(t, 2, p4m.integrityChecks[IntegrityMetric{Table: "rev", Replica: "replica1"}])
+	assert.Equal(t, 1, p4m.integrityMismatches[IntegrityMetric{Table: "rev", Replica: "replica1"}])
+	assert.Equal(t, 1, p4m.integrityChecks[IntegrityMetric{Table: "user", Replica: "replica1"}])
+	assert.Equal(t, 0, p4m.integrityChecks[IntegrityMetric{Table: "user", Replica: "edge1"}])
+	assert.Equal(t, int64(2), p4m.integrityParseFailures)
+
+	p4m.dryrun = true
+	p4m.monitorIntegrity()
+	compareMetricValues(t, metricValues{
+		{name: "p4_integrity_checks_count", labelName: "table", labelValue: "have", value: "1"},
+		{name: "p4_integrity_mismatches_count", labelName: "table", labelValue: "have", value: "0"},
+		{name: "p4_integrity_checks_count", labelName: "table", labelValue: "rev", value: "1"},
+		{name: "p4_integrity_mismatches_count", labelName: "table", labelValue: "rev", value: "0"},
+		{name: "p4_integrity_checks_count", labelName: "table", labelValue: "rev", value: "2"},
+		{name: "p4_integrity_mismatches_count", labelName: "table", labelValue: "rev", value: "1"},
+		{name: "p4_integrity_checks_count", labelName: "table", labelValue: "user", value: "1"},
+		{name: "p4_integrity_mismatches_count", labelName: "table", labelValue: "user", value: "0"},
+		{name: "p4_integrity_last_check_time", labelName: "replica", labelValue: "edge1", value: "1760781500"},
+		{name: "p4_integrity_last_check_time", labelName: "replica", labelValue: "replica1", value: "1760781700"},
+		{name: "p4_integrity_parse_failures", value: "2"},
+	}, p4m.metrics)
+}
+
+func TestJournalDBChecksums(t *testing.T) {
+	cfg := config.Config{JournalDBChecksumsInterval: 24 * time.Hour, JournalDBChecksumsLevel: 2}
+	initLogger()
+	env := map[string]string{}
+	p4m := newP4MonitorMetrics(&cfg, &env, tlogger)
+	p4m.dryrun = true
+	p4m.isSuper = true
+	p4m.p4info["Server services"] = "commit-server"
+	fake := &FakeCounterRunner{}
+	p4m.p4Runner = fake
+	waitForChecksums := func() {
+		for i := 0; i < 500; i++ {
+			p4m.integrityLock.Lock()
+			running := p4m.integrityChecksumsRunning
+			p4m.integrityLock.Unlock()
+			if !running {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("journaldbchecksums still running")
+	}
+
+	// Started in the background, then not run again until journaldbchecksums_interval has passed
+	p4m.monitorJournalDBChecksums()
+	waitForChecksums()
+	assert.Equal(t, []string{"journaldbchecksums -l 2"}, fake.cmds)
+	p4m.metrics = nil
+	p4m.monitorJournalDBChecksums()
+	waitForChecksums()
+	assert.Equal(t, 1, len(fake.cmds))
+	assert.Equal(t, 1, len(p4m.metrics))
+	assert.Equal(t, "p4_integrity_journaldbchecksums_last_run", p4m.metrics[0].name)
+
+	// Only on a commit server
+	p4m.integrityChecksumsLastRun = time.Time{}
+	p4m.p4info["Server services"] = "standby"
+	p4m.monitorJournalDBChecksums()
+	waitForChecksums()
+	assert.Equal(t, 1, len(fake.cmds))
+}
+
+func TestRealTime(t *testing.T) {
+	metrics := parseRealTime([]string{
+		"rtv.db.lockwait (flags 0) 0 max 382",
+		"rtv.db.ckp.active (flags 0) 0",
+		"rtv.db.io.records (flags 0) 126389592854",
+		"rtv.rpl.behind.bytes (flags 0) 0 max -1",
+		"rtv.svr.sessions.active (flags 0) 110 max 585",
+		"Perforce password (P4PASSWD) invalid or unset.",
+	})
+	compareMetricValues(t, metricValues{
+		{name: "p4_rtv_db_lockwait", value: "0"},
+		{name: "p4_rtv_db_lockwait_max", value: "382"},
+		{name: "p4_rtv_db_ckp_active", value: "0"},
+		{name: "p4_rtv_db_io_records", value: "126389592854"},
+		{name: "p4_rtv_rpl_behind_bytes", value: "0"},
+		{name: "p4_rtv_svr_sessions_active", value: "110"},
+		{name: "p4_rtv_svr_sessions_active_max", value: "585"},
+	}, metrics)
+	assert.Equal(t, "counter", metrics[3].mtype)
+
+	cfg := config.Config{}
+	initLogger()
+	env := map[string]string{}
+	p4m := newP4MonitorMetrics(&cfg, &env, tlogger)
+	for _, tc := range []struct {
+		version string
+		ok      bool
+	}{
+		{"P4D/LINUX26X86_64/2024.2/2697822 (2024/12/18)", true},
+		{"P4D/LINUX26X86_64/2021.1/2156517 (2021/05/04)", true},
+		{"P4D/LINUX26X86_64/2020.2/2101221 (2021/01/05)", false},
+		{"P4D/NTX64/2019.1/1234567 (2019/05/01)", false},
+		{"P4D/LINUX26X86_64/2025.1.PREP-TEST_ONLY/2750000 (2025/03/01)", true},
+		{"", false},
+	} {
+		p4m.p4info["Server version"] = tc.version
+		assert.Equal(t, tc.ok, p4m.p4dVersionAtLeast(2021, 1), tc.version)
+	}
+	year, rel, ok := parseP4DVersion("Rev. P4D/LINUX26X86_64/2023.2/2519561 (2023/11/20).")
+	assert.True(t, ok)
+	assert.Equal(t, 2023, year)
+	assert.Equal(t, 2, rel)
+}
+
+func TestRemoteMode(t *testing.T) {
+	cfg := config.Config{Remote: true, MetricsRoot: "/hxlogs/metrics"}
+	initLogger()
+	env := map[string]string{}
+	p4m := newP4MonitorMetrics(&cfg, &env, tlogger)
+	p4m.p4port = "ssl:perforce.example.com:1666"
+	p4m.serverID = "appliance1"
+	p4m.setTarget()
+	assert.Equal(t, "ssl:perforce.example.com:1666", p4m.target)
+	assert.Equal(t, "/hxlogs/metrics/p4_diskspace-ssl_perforce.example.com_1666-appliance1.prom", p4m.metricsFilename("p4_diskspace"))
+	assert.False(t, p4m.monitorEnabled("monitorLocks"))
+	assert.False(t, p4m.monitorEnabled("monitorErrors"))
+	assert.True(t, p4m.monitorEnabled("monitorPull"))
+	assert.False(t, p4m.localP4D())
+	assert.False(t, p4m.shouldMonitorJournal())
+
+	volumes, err := p4m.parseDiskspace([]string{
+		"P4ROOT (type ext4 mounted on /hxmetadata) : 100G free, 300G used, 400G total (75% full)",
+		"P4JOURNAL (type ext4 mounted on /hxlogs) : 48G free, 26G used, 74G total (35% full)",
+	})
+	assert.NoError(t, err)
+	p4m.dryrun = true
+	p4m.startMonitor("monitorDiskspace", "p4_diskspace")
+	p4m.diskspaceMetrics(volumes)
+	compareMetricValues(t, metricValues{
+		{name: "p4_diskspace_free_bytes", labelName: "volume", labelValue: "P4JOURNAL", value: "51539607552"},
+		{name: "p4_diskspace_total_bytes", labelName: "volume", labelValue: "P4JOURNAL", value: "79456894976"},
+		{name: "p4_diskspace_percent_full", labelName: "volume", labelValue: "P4JOURNAL", value: "35"},
+		{name: "p4_diskspace_free_bytes", labelName: "volume", labelValue: "P4ROOT", value: "107374182400"},
+		{name: "p4_diskspace_total_bytes", labelName: "volume", labelValue: "P4ROOT", value: "429496729600"},
+		{name: "p4_diskspace_percent_full", labelName: "volume", labelValue: "P4ROOT", value: "75"},
+	}, p4m.metrics)
+	buf := p4m.getCumulativeMetrics()
+	assert.Contains(t, buf, `p4_diskspace_percent_full{serverid="appliance1",target="ssl:perforce.example.com:1666",volume="P4ROOT",mount="/hxmetadata"} 75`)
+
+	p4m.startMonitor("monitorMonitoring", "p4_status")
+	p4m.disabledMonitorMetrics()
+	assert.Equal(t, len(remoteDisabledMonitors), len(p4m.metrics))
+
+	cfg.Target = "appliance-east"
+	p4m.setTarget()
+	assert.Equal(t, "appliance-east", p4m.target)
+
+	// Not remote so no target label or suffix
+	cfg2 := config.Config{MetricsRoot: "/hxlogs/metrics"}
+	p4m2 := newP4MonitorMetrics(&cfg2, &env, tlogger)
+	p4m2.p4port = "1666"
+	p4m2.serverID = "master.1"
+	p4m2.setTarget()
+	assert.Equal(t, "/hxlogs/metrics/p4_change-master.1.prom", p4m2.metricsFilename("p4_change"))
+	assert.True(t, p4m2.monitorEnabled("monitorLocks"))
+}
+
+// FakeTopologyProber returns canned p4 info output by address
+type FakeTopologyProber struct {
+	Info map[string][]string
+}
+
+func (f *FakeTopologyProber) Probe(address string, timeout time.Duration) ([]string, error) {
+	if lines, ok := f.Info[address]; ok {
+		return lines, nil
+	}
+	return nil, fmt.Errorf("connect to server failed; check $P4PORT")
+}
+
+func TestTopology(t *testing.T) {
+	cfg := config.Config{MonitorTopology: true, TopologyTimeout: time.Second}
+	initLogger()
+	env := map[string]string{}
+	p4m := newP4MonitorMetrics(&cfg, &env, tlogger)
+	p4m.serverID = "master.1"
+	servers := parseTopologyServers([]string{
+		"master.1|commit-server|ssl:master:1666",
+		"replica.1|standby|ssl:replica:1666",
+		"edge.1|edge-server|ssl:edge:1666",
+		"proxy.1|proxy|ssl:proxy:1666",
+		"noaddr|replica|",
+		"badline",
+	}, p4m.serverID)
+	assert.Equal(t, 2, len(servers))
+	assert.Equal(t, "edge.1", servers[0].ServerID)
+	assert.Equal(t, "replica.1", servers[1].ServerID)
+
+	p4m.topologyProber = &FakeTopologyProber{Info: map[string][]string{
+		"ssl:edge:1666": {
+			"Server uptime: 01:00:10",
+			"Server version: P4D/LINUX26X86_64/2024.2/2697822 (2024/12/18)",
+			"ServerID: edge.2",
+		},
+	}}
+	p4m.dryrun = true
+	p4m.startMonitor("monitorTopology", "p4_topology")
+	p4m.probeTopology(servers)
+	p4m.topologyMetrics(servers)
+	assert.Equal(t, 6, len(p4m.metrics))
+	compareMetricValues(t, metricValues{
+		{name: "p4_topology_server_up", labelName: "servername", labelValue: "edge.1", value: "1"},
+		{name: "p4_topology_info_latency_seconds", labelName: "servername", labelValue: "edge.1", value: p4m.metrics[1].value},
+		{name: "p4_topology_server_version_info", labelName: "servername", labelValue: "edge.1", value: "1"},
+		{name: "p4_topology_server_uptime", labelName: "servername", labelValue: "edge.1", value: "3610"},
+		{name: "p4_topology_serverid_match", labelName: "servername", labelValue: "edge.1", value: "0"},
+		{name: "p4_topology_server_up", labelName: "servername", labelValue: "replica.1", value: "0"},
+	}, p4m.metrics)
+	assert.Equal(t, "P4D/LINUX26X86_64/2024.2/2697822", p4m.metrics[2].labels[1].value)
+	assert.Error(t, servers[1].Err)
+}
+
+// FakeCanaryRunner simulates p4 commands for the canary, recording the commands run
+type FakeCanaryRunner struct {
+	localFile  string
+	headRev    int
+	change     int
+	deleted    int // Submitted changes deleted, oldest first
+	pending    []int
+	failSubmit bool
+	cmds       []string
+}
+
+func (f *FakeCanaryRunner) Run(args string, input string) ([]string, error) {
+	f.cmds = append(f.cmds, args)
+	switch {
+	case strings.HasPrefix(args, "info"):
+		return []string{"Server version: P4D/LINUX26X86_64/2024.2/2697822 (2024/12/18)"}, nil
+	case strings.HasPrefix(args, "fstat"):
+		if f.headRev == 0 {
+			return nil, fmt.Errorf("exit status 1: no such file(s).")
+		}
+		return []string{fmt.Sprintf("... headRev %d", f.headRev), "... headAction edit"}, nil
+	case strings.Contains(args, " submit "):
+		if f.failSubmit {
+			return []string{"Submit failed -- fix problems above then use 'p4 submit -c 99'."}, fmt.Errorf("exit status 1")
+		}
+		f.change++
+		f.headRev++
+		return []string{fmt.Sprintf("Change %d submitted.", f.change)}, nil
+	case strings.HasPrefix(args, "print"):
+		content, err := os.ReadFile(f.localFile)
+		return []string{strings.TrimSpace(string(content))}, err
+	case strings.HasPrefix(args, "changes -s pending"):
+		lines := make([]string, 0)
+		for _, c := range f.pending {
+			lines = append(lines, fmt.Sprintf("Change %d on 2026/10/18 by p4metrics@p4metrics_canary_master.1 *pending* 'p4metrics canary'", c))
+		}
+		return lines, nil
+	case strings.HasPrefix(args, "changes -s submitted"):
+		lines := make([]string, 0)
+		for c := f.change; c > f.deleted; c-- {
+			lines = append(lines, fmt.Sprintf("Change %d on 2026/10/18 by p4metrics@p4metrics_canary_master.1 'p4metrics canary'", c))
+		}
+		return lines, nil
+	case strings.Contains(args, " change -d -f "):
+		f.deleted++
+	}
+	return nil, nil
+}
+
+func TestCanary(t *testing.T) {
+	cfg := config.Config{Canary: true, CanaryDepotPath: "//p4metrics/canary", CanaryRoot: t.TempDir(), CanaryBuckets: []float64{1, 10}}
+	initLogger()
+	env := map[string]string{}
+	p4m := newP4MonitorMetrics(&cfg, &env, tlogger)
+	p4m.serverID = "master.1"
+	p4m.p4User = "p4metrics"
+	fake := &FakeCanaryRunner{localFile: filepath.Join(cfg.CanaryRoot, "canary-master.1.txt")}
+	p4m.p4Runner = fake
+	assert.Contains(t, p4m.canaryClientSpec(), "\t\"//p4metrics/canary/...\" \"//p4metrics_canary_master.1/...\"")
+
+	// First run adds the file
+	results := p4m.runCanary()
+	for _, step := range canarySteps {
+		assert.True(t, results[step].ok, step)
+	}
+	assert.Contains(t, fake.cmds, "-c p4metrics_canary_master.1 add -t text+S \""+fake.localFile+"\"")
+
+	// Nothing earlier to remove
+	for _, cmd := range fake.cmds {
+		assert.NotContains(t, cmd, "obliterate")
+		assert.NotContains(t, cmd, "change -d -f")
+	}
+
+	// Second run edits, and cleanup deletes a pending change left by an interrupted run, then removes the first run's
+	// revision and change - keeping the one just submitted
+	fake.cmds = nil
+	fake.pending = []int{7}
+	p4m.dryrun = true
+	p4m.monitorCanary()
+	assert.Contains(t, fake.cmds, "-c p4metrics_canary_master.1 edit \""+fake.localFile+"\"")
+	assert.Contains(t, fake.cmds, "-c p4metrics_canary_master.1 revert \"//p4metrics_canary_master.1/...\"")
+	assert.Contains(t, fake.cmds, "-c p4metrics_canary_master.1 change -d 7")
+	assert.Contains(t, fake.cmds, "obliterate -y \"//p4metrics/canary/canary-master.1.txt#1,#1\"")
+	assert.Contains(t, fake.cmds, "-c p4metrics_canary_master.1 change -d -f 1")
+	assert.NotContains(t, fake.cmds, "-c p4metrics_canary_master.1 change -d -f 2")
+	fake.pending = nil
+	assert.NotContains(t, fake.cmds, "client -i")
+	assert.Equal(t, "p4_canary_success", p4m.metrics[0].name)
+	assert.Equal(t, "1", p4m.metrics[0].value)
+
+	// Not run again until canary_interval has passed
+	fake.cmds = nil
+	cfg.CanaryInterval = time.Hour
+	p4m.monitorCanary()
+	assert.Equal(t, 0, len(fake.cmds))
+	cfg.CanaryInterval = 0
+
+	// Failed submit is reverted and later steps are skipped - apart from cleanup, which leaves history alone
+	fake.cmds = nil
+	fake.failSubmit = true
+	p4m.monitorCanary()
+	assert.Contains(t, fake.cmds, "-c p4metrics_canary_master.1 change -d 99")
+	for _, cmd := range fake.cmds {
+		assert.NotContains(t, cmd, "obliterate")
+		assert.NotContains(t, cmd, "change -d -f")
+	}
+	assert.Equal(t, "0", p4m.metrics[0].value)
+	found := map[string]string{}
+	for _, m := range p4m.metrics {
+		if m.name == "p4_canary_step_success" || m.name == "p4_canary_step_failures_count" {
+			found[m.name+"/"+m.labels[0].value] = m.value
+		}
+	}
+	assert.Equal(t, "0", found["p4_canary_step_success/submit"])
+	assert.Equal(t, "1", found["p4_canary_step_success/cleanup"])
+	assert.Equal(t, "", found["p4_canary_step_success/print"])
+	assert.Equal(t, "1", found["p4_canary_step_failures_count/submit"])
+	assert.Equal(t, "0", found["p4_canary_step_failures_count/print"])
+
+	buf := p4m.getCumulativeMetrics()
+	assert.Equal(t, 1, strings.Count(buf, "# TYPE p4_canary_step_duration_seconds histogram"))
+	assert.Contains(t, buf, `p4_canary_step_duration_seconds_count{serverid="master.1",step="print"} 1`)
+}
+
+// FakeCounterRunner simulates p4 counter for the replication canary
+type FakeCounterRunner struct {
+	value string
+	cmds  []string
+}
+
+func (f *FakeCounterRunner) Run(args string, input string) ([]string, error) {
+	f.cmds = append(f.cmds, args)
+	parts := strings.Fields(args)
+	if len(parts) == 3 {
+		f.value = parts[2]
+		return []string{}, nil
+	}
+	return []string{f.value}, nil
+}
+
+func TestReplicationCanary(t *testing.T) {
+	cfg := config.Config{ReplicationCanary: true, ReplicationCanaryCounter: "p4metrics_replication_canary", ReplicationCanaryPoll: time.Second}
+	initLogger()
+	env := map[string]string{}
+
+	// Commit server writes the counter
+	p4m := newP4MonitorMetrics(&cfg, &env, tlogger)
+	p4m.dryrun = true
+	p4m.serverID = "master.1"
+	p4m.p4info["Server services"] = "commit-server"
+	fake := &FakeCounterRunner{value: "0"}
+	p4m.p4Runner = fake
+	p4m.monitorReplicationCanary()
+	assert.Equal(t, 1, len(fake.cmds))
+	assert.True(t, strings.HasPrefix(fake.cmds[0], "counter p4metrics_replication_canary "))
+	assert.Equal(t, 1, len(p4m.metrics))
+	assert.Equal(t, "p4_replication_canary_last_write", p4m.metrics[0].name)
+
+	// Replica only reports propagation once a new value is seen after the first one
+	p4m = newP4MonitorMetrics(&cfg, &env, tlogger)
+	p4m.dryrun = true
+	p4m.serverID = "replica.1"
+	p4m.p4info["Server services"] = "standby"
+	written := time.Now().Add(-time.Hour)
+	p4m.observeReplicationCounter("0", written)
+	p4m.observeReplicationCounter(fmt.Sprintf("%d", written.UnixMilli()), written.Add(time.Hour))
+	p4m.monitorReplicationCanary()
+	assert.Equal(t, 1, len(p4m.metrics))
+	assert.Equal(t, "p4_replication_canary_age_seconds", p4m.metrics[0].name)
+	assert.Equal(t, "replica.1", p4m.metrics[0].labels[0].value)
+
+	written = time.UnixMilli(time.Now().Add(-3 * time.Second).UnixMilli()) // Counter only has millisec precision
+	p4m.observeReplicationCounter(fmt.Sprintf("%d", written.UnixMilli()), written.Add(2500*time.Millisecond))
+	p4m.observeReplicationCounter(fmt.Sprintf("%d", written.UnixMilli()), written.Add(5*time.Second)) // Same value ignored
+	p4m.monitorReplicationCanary()
+	assert.Equal(t, 2, len(p4m.metrics))
+	assert.Equal(t, "p4_replication_propagation_seconds", p4m.metrics[1].name)
+	assert.Equal(t, "2.500", p4m.metrics[1].value)
+
+	// Poller reads the counter in the background and is stopped with the tailers
+	fake = &FakeCounterRunner{value: "0"}
+	p4m.p4Runner = fake
+	p4m.setupReplicationCanary()
+	assert.NotNil(t, p4m.replicationStop)
+	// Left running on re-init unless replication_canary_poll changes
+	stop := p4m.replicationStop
+	p4m.setupReplicationCanary()
+	assert.Equal(t, stop, p4m.replicationStop)
+	cfg.ReplicationCanaryPoll = 2 * time.Second
+	p4m.setupReplicationCanary()
+	assert.NotEqual(t, stop, p4m.replicationStop)
+	assert.Equal(t, 2*time.Second, p4m.replicationPoll)
+	_, open := <-stop
+	assert.False(t, open)
+	// And stopped if disabled
+	cfg.ReplicationCanary = false
+	p4m.setupReplicationCanary()
+	assert.Nil(t, p4m.replicationStop)
+	p4m.stopReplicationCanary() // Safe when already stopped
+}
+
+// FakeLoginRunner simulates p4 login -s and p4 login
+type FakeLoginRunner struct {
+	expiry    int64 // -1 means not logged in
+	password  string
+	logins    []string
+	loginFail bool
+}
+
+func (f *FakeLoginRunner) Run(args string, input string) ([]string, error) {
+	if args == "login" {
+		f.logins = append(f.logins, input)
+		if f.loginFail || strings.TrimSpace(input) != f.password {
+			return nil, fmt.Errorf("exit status 1: Password invalid.")
+		}
+		f.expiry = 43200
+		return []string{"User p4admin logged in."}, nil
+	}
+	if f.expiry < 0 {
+		return nil, fmt.Errorf("exit status 1: Perforce password (P4PASSWD) invalid or unset.")
+	}
+	return []string{"... User p4admin", fmt.Sprintf("... TicketExpiration %d", f.expiry)}, nil
+}
+
+func TestLogin(t *testing.T) {
+	passwdFile := filepath.Join(t.TempDir(), "p4passwd")
+	assert.NoError(t, os.WriteFile(passwdFile, []byte("secret\n"), 0600))
+	cfg := config.Config{LoginCheck: true, LoginRenewBefore: time.Hour}
+	initLogger()
+	env := map[string]string{}
+	p4m := newP4MonitorMetrics(&cfg, &env, tlogger)
+	p4m.dryrun = true
+	p4m.p4User = "p4admin"
+	fake := &FakeLoginRunner{expiry: 7200, password: "secret"}
+	p4m.p4Runner = fake
+
+	// Valid ticket not near expiry
+	p4m.monitorLogin()
+	compareMetricValues(t, metricValues{
+		{name: "p4_login_ticket_expiry_seconds", value: "7200"},
+		{name: "p4_login_renewals_count", labelName: "result", labelValue: "success", value: "0"},
+		{name: "p4_login_renewals_count", labelName: "result", labelValue: "failure", value: "0"},
+	}, p4m.metrics)
+	assert.Equal(t, 0, len(fake.logins))
+
+	// Login error without a password - nothing to renew with
+	fake.expiry = -1
+	p4m.monitorLogin()
+	assert.True(t, p4m.loginError)
+	assert.Equal(t, 0, len(fake.logins))
+	assert.Equal(t, "p4_login_renewals_count", p4m.metrics[0].name)
+
+	// Renewed from password file after login error
+	cfg.PasswordFile = passwdFile
+	p4m.monitorLogin()
+	assert.False(t, p4m.loginError)
+	assert.Equal(t, []string{"secret\n"}, fake.logins)
+	compareMetricValues(t, metricValues{
+		{name: "p4_login_ticket_expiry_seconds", value: "43200"},
+		{name: "p4_login_renewals_count", labelName: "result", labelValue: "success", value: "1"},
+		{name: "p4_login_renewals_count", labelName: "result", labelValue: "failure", value: "0"},
+	}, p4m.metrics)
+
+	// Renewed before expiry - env var takes precedence over file. Failures back off.
+	cfg.PasswordEnv = "P4METRICS_TEST_PASSWD"
+	env["P4METRICS_TEST_PASSWD"] = "wrong"
+	fake.expiry = 600
+	p4m.monitorLogin()
+	p4m.monitorLogin()
+	assert.Equal(t, []string{"secret\n", "wrong\n"}, fake.logins)
+	assert.Equal(t, loginBackoffMin, p4m.loginBackoff)
+	assert.Equal(t, 1, p4m.loginRenewals["failure"])
+	p4m.loginNextAttempt = time.Now().Add(-time.Second)
+	env["P4METRICS_TEST_PASSWD"] = "secret"
+	p4m.monitorLogin()
+	assert.Equal(t, 2, p4m.loginRenewals["success"])
+	assert.Equal(t, time.Duration(0), p4m.loginBackoff)
+	assert.Equal(t, "43200", p4m.metrics[0].value)
+}
+
+func TestUserHygiene(t *testing.T) {
+	cfg := config.Config{MonitorUserHygiene: true, PasswordExpiryWarningDays: 14, LongUpdateInterval: time.Hour}
+	initLogger()
+	env := map[string]string{}
+	p4m := newP4MonitorMetrics(&cfg, &env, tlogger)
+	now := time.Unix(1760000000, 0)
+	day := int64(24 * 60 * 60)
+	users := parseZtagRecords([]string{
+		"... User alice",
+		"... Type standard",
+		fmt.Sprintf("... Access %d", now.Unix()-day),
+		fmt.Sprintf("... PasswordChange %d", now.Unix()-80*day),
+		"",
+		"... User bob",
+		fmt.Sprintf("... Access %d", now.Unix()-100*day),
+		fmt.Sprintf("... PasswordChange %d", now.Unix()-100*day),
+		"... User build",
+		"... Type service",
+		fmt.Sprintf("... Update %d", now.Unix()-400*day),
+		"",
+		"... User ops",
+		"... Type operator",
+		fmt.Sprintf("... Access %d", now.Unix()-40*day),
+	})
+	assert.Equal(t, 4, len(users))
+	groups := parseZtagRecords([]string{
+		"... group devs", "... user alice", "... isUser 1", "... passTimeout 7776000", "",
+		"... group devs", "... user bob", "... isUser 1", "... passTimeout 7776000", "",
+		"... group admins", "... user alice", "... isUser 1", "... passTimeout unset", "",
+		"... group admins", "... user devs", "... isUser 0", "... isSubGroup 1", "... passTimeout unset", "",
+	})
+	assert.Equal(t, map[string]int64{"alice": 7776000, "bob": 7776000}, userPasswordTimeouts(groups))
+	p4m.userHygieneMetrics(users, groups, now)
+	found := map[string]string{}
+	for _, m := range p4m.metrics {
+		k := m.name
+		for _, l := range m.labels {
+			k += "/" + l.value
+		}
+		found[k] = m.value
+	}
+	assert.Equal(t, "2", found["p4_users_count/standard"])
+	assert.Equal(t, "1", found["p4_users_count/service"])
+	assert.Equal(t, "1", found["p4_users_not_accessed_count/30/operator"])
+	assert.Equal(t, "1", found["p4_users_not_accessed_count/90/standard"])
+	assert.Equal(t, "1", found["p4_users_not_accessed_count/365/service"])
+	assert.Equal(t, "0", found["p4_users_not_accessed_count/365/standard"])
+	assert.Equal(t, "1", found["p4_users_password_expiring_count/14"]) // alice - 10 days left
+	assert.Equal(t, "1", found["p4_users_password_expired_count"])     // bob
+	assert.Equal(t, "2", found["p4_groups_count"])
+
+	// Only runs once per long_update_interval
+	assert.True(t, p4m.longIntervalDue("monitorUserHygiene"))
+	assert.False(t, p4m.longIntervalDue("monitorUserHygiene"))
+	p4m.longLastRun["monitorUserHygiene"] = now
+	assert.True(t, p4m.longIntervalDue("monitorUserHygiene"))
+}
+
+func TestWorkspaceHygiene(t *testing.T) {
+	cfg := config.Config{MonitorWorkspaceHygiene: true, WorkspaceStreamsTopN: 1}
+	initLogger()
+	env := map[string]string{}
+	p4m := newP4MonitorMetrics(&cfg, &env, tlogger)
+	now := time.Unix(1760000000, 0)
+	day := int64(24 * 60 * 60)
+	ago := func(days int64) string { return fmt.Sprintf("%d", now.Unix()-days*day) }
+	clients := parseZtagRecords([]string{
+		"... client ws1", "... Access " + ago(1), "... Stream //streams/main", "",
+		"... client ws2", "... Access " + ago(45), "... Stream //streams/main", "",
+		"... client ws3", "... Access " + ago(200), "... Stream //streams/dev", "",
+		"... client ws4", "... Update " + ago(500), "",
+	})
+	unloaded := parseZtagRecords([]string{"... client old1", "... Access " + ago(800), "", "... client old2", "... Access " + ago(900)})
+	pending := parseZtagRecords([]string{"... change 10", "... time " + ago(2), "... change 11", "... time " + ago(400), "... shelved "})
+	shelved := parseZtagRecords([]string{"... change 11", "... time " + ago(400), "... shelved "})
+	p4m.workspaceHygieneMetrics(clients, unloaded, pending, shelved, now)
+	compareMetricValues(t, metricValues{
+		{name: "p4_workspaces_count", value: "6"},
+		{name: "p4_workspaces_unloaded_count", value: "2"},
+		{name: "p4_workspaces_by_access_age_count", labelName: "age", labelValue: "30d", value: "1"},
+		{name: "p4_workspaces_by_access_age_count", labelName: "age", labelValue: "90d", value: "1"},
+		{name: "p4_workspaces_by_access_age_count", labelName: "age", labelValue: "1y", value: "1"},
+		{name: "p4_workspaces_by_access_age_count", labelName: "age", labelValue: "older", value: "1"},
+		{name: "p4_workspaces_by_stream_count", labelName: "stream", labelValue: "//streams/main", value: "2"},
+		{name: "p4_workspaces_by_stream_count", labelName: "stream", labelValue: "other", value: "2"},
+		{name: "p4_changes_pending_count", labelName: "age", labelValue: "30d", value: "1"},
+		{name: "p4_changes_pending_count", labelName: "age", labelValue: "90d", value: "0"},
+		{name: "p4_changes_pending_count", labelName: "age", labelValue: "1y", value: "0"},
+		{name: "p4_changes_pending_count", labelName: "age", labelValue: "older", value: "1"},
+		{name: "p4_changes_shelved_count", labelName: "age", labelValue: "30d", value: "0"},
+		{name: "p4_changes_shelved_count", labelName: "age", labelValue: "90d", value: "0"},
+		{name: "p4_changes_shelved_count", labelName: "age", labelValue: "1y", value: "0"},
+		{name: "p4_changes_shelved_count", labelName: "age", labelValue: "older", value: "1"},
+	}, p4m.metrics)
+}
+
+// FakeStorageRunner simulates p4 depots, streams, dirs and sizes
+type FakeStorageRunner struct {
+	cmds []string
+}
+
+func (f *FakeStorageRunner) Run(args string, input string) ([]string, error) {
+	f.cmds = append(f.cmds, args)
+	switch args {
+	case "-ztag depots":
+		return []string{"... name depot", "... type local", "", "... name streams", "... type stream", "",
+			"... name remote", "... type remote", "", "... name spec", "... type spec", "", "... name empty", "... type local", "",
+			"... name broken", "... type local"}, nil
+	case "-ztag streams":
+		return []string{"... Stream //streams/main", "... Type mainline", "", "... Stream //streams/dev", "... Type development", "",
+			"... Stream //streams/rel1", "... Type release"}, nil
+	case `-ztag dirs -D "//depot/*"`:
+		return []string{"... dir //depot/main", "", "... dir //depot/rel"}, nil
+	case `-ztag dirs -D "//streams/*"`:
+		return []string{"... dir //streams/main", "", "... dir //streams/dev"}, nil
+	case `-ztag dirs -D "//broken/*"`:
+		return []string{"... dir //broken/huge"}, nil
+	case `-ztag sizes -s -a -z "//depot/main/..."`:
+		return []string{"... path //depot/main/...", "... fileCount 60", "... fileSize 100000"}, nil
+	case `-ztag sizes -s -a -z "//depot/rel/..."`:
+		return []string{"... path //depot/rel/...", "... fileCount 40", "... fileSize 23456"}, nil
+	case `-ztag sizes -s -a -z "//streams/main/..."`, `-ztag sizes -s -a -z "//streams/dev/..."`:
+		return []string{"... path //streams/x/...", "... fileCount 10", "... fileSize 1000"}, nil
+	case `-ztag sizes -s -a -z "//spec/*"`:
+		return []string{"... path //spec/*", "... fileCount 5", "... fileSize 50"}, nil
+	case `-ztag sizes -s -a -z "//broken/huge/..."`:
+		return nil, fmt.Errorf("exit status 1: Request too large (over 500000); see 'p4 help maxresults'.")
+	}
+	return nil, fmt.Errorf("exit status 1: %s - no such file(s).", args)
+}
+
+func TestDepotStorage(t *testing.T) {
+	cfg := config.Config{MonitorDepotStorage: true, DepotStorageDelay: 5 * time.Second, LongUpdateInterval: time.Hour}
+	initLogger()
+	env := map[string]string{}
+	p4m := newP4MonitorMetrics(&cfg, &env, tlogger)
+	p4m.dryrun = true
+	fake := &FakeStorageRunner{}
+	p4m.p4Runner = fake
+	sleeps := make([]time.Duration, 0)
+	scan := p4m.scanDepotStorage(func(d time.Duration) { sleeps = append(sleeps, d) })
+	assert.NotContains(t, fake.cmds, `-ztag dirs -D "//remote/*"`)
+	assert.Equal(t, 9, len(sleeps)) // Between each of the 10 p4 sizes - one per top level directory and depot root
+	assert.Equal(t, 5*time.Second, sleeps[0])
+	p4m.depotStorageMetrics(scan)
+	found := map[string]string{}
+	for _, m := range p4m.metrics {
+		k := m.name
+		for _, l := range m.labels {
+			k += "/" + l.value
+		}
+		found[k] = m.value
+	}
+	assert.Equal(t, "123456", found["p4_depot_archive_bytes/depot/local"])
+	assert.Equal(t, "100", found["p4_depot_archive_files/depot/local"])
+	assert.Equal(t, "2000", found["p4_depot_archive_bytes/streams/stream"])
+	assert.Equal(t, "50", found["p4_depot_archive_bytes/spec/spec"])
+	assert.Equal(t, "0", found["p4_depot_archive_bytes/empty/local"])
+	assert.Equal(t, "", found["p4_depot_archive_bytes/remote/remote"])
+	assert.Equal(t, "", found["p4_depot_archive_bytes/broken/local"]) // Failed - not reported as empty
+	assert.Equal(t, "1", found["p4_depot_storage_scan_failures"])
+	assert.Equal(t, "3", found["p4_depots_count/local"])
+	assert.Equal(t, "1", found["p4_depots_count/remote"])
+	assert.Equal(t, "1", found["p4_streams_count/streams/mainline"])
+	assert.Equal(t, "1", found["p4_streams_count/streams/release"])
+
+	// Scan runs in the background and is output once complete
+	p4m.metrics = make([]metricStruct, 0)
+	cfg.DepotStorageDelay = 0
+	p4m.monitorDepotStorage()
+	for i := 0; i < 100; i++ {
+		p4m.storageLock.Lock()
+		done := !p4m.storageScanning
+		p4m.storageLock.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	p4m.monitorDepotStorage()
+	assert.Equal(t, "p4_depot_archive_bytes", p4m.metrics[0].name)
+	assert.False(t, p4m.storageScanning)
+}
+
+func TestDBTables(t *testing.T) {
+	cfg := config.Config{MonitorDBTables: true, LongUpdateInterval: time.Hour}
+	initLogger()
+	env := map[string]string{}
+	p4m := newP4MonitorMetrics(&cfg, &env, tlogger)
+	root := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "db.have"), make([]byte, 4*dbPageSize), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "db.rev"), make([]byte, 2*dbPageSize), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "journal"), []byte("x"), 0644))
+	tables, err := statDBTables(root)
+	assert.NoError(t, err)
+	now := time.Now()
+	p4m.dbTableMetrics(tables, now)
+	compareMetricValues(t, metricValues{
+		{name: "p4_db_table_bytes", labelName: "table", labelValue: "have", value: "32768"},
+		{name: "p4_db_table_pages", labelName: "table", labelValue: "have", value: "4"},
+		{name: "p4_db_table_bytes", labelName: "table", labelValue: "rev", value: "16384"},
+		{name: "p4_db_table_pages", labelName: "table", labelValue: "rev", value: "2"},
+	}, p4m.metrics)
+
+	// Fragmentation from p4 dbstat -f for each table in turn - db.rev fails so is not output
+	cfg.DBFragmentationDelay = time.Minute
+	fake := &FakeDriftRunner{output: map[string][]string{
+		"dbstat -f db.have": {"db.have internal+leaf 3+1240 pages, 97% / 76% full, 2 levels, 101432 items, 9.7M, 2.5% fragmented"},
+	}}
+	p4m.p4Runner = fake
+	sleeps := make([]time.Duration, 0)
+	frag := p4m.scanDBFragmentation([]string{"have", "rev"}, func(d time.Duration) { sleeps = append(sleeps, d) })
+	assert.Equal(t, map[string]float64{"have": 2.5}, frag)
+	assert.Equal(t, []time.Duration{time.Minute}, sleeps)
+
+	// Background scan is only started if enabled, for super users
+	cfg.MonitorDBFragmentation = true
+	cfg.DBFragmentationDelay = 0
+	p4m.startDBFragmentationScan([]*DBTable{{Name: "have"}})
+	assert.False(t, p4m.dbFragScanning)
+	p4m.isSuper = true
+	p4m.startDBFragmentationScan([]*DBTable{{Name: "have"}})
+	for i := 0; i < 100; i++ {
+		p4m.dbFragLock.Lock()
+		done := !p4m.dbFragScanning
+		p4m.dbFragLock.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	p4m.dbFragLock.Lock()
+	assert.Equal(t, frag, p4m.dbFrag)
+	p4m.dbFragLock.Unlock()
+
+	// Growth against previous sample from p4 dbstat -s
+	p4m.metrics = make([]metricStruct, 0)
+	tables = parseDBStat([]string{
+		"db.have 12 pages, 96K",
+		"db.rev 2 pages",
+		"some other line",
+	})
+	assert.Equal(t, 2, len(tables))
+	p4m.dbTableMetrics(tables, now.Add(2*time.Hour))
+	compareMetricValues(t, metricValues{
+		{name: "p4_db_table_bytes", labelName: "table", labelValue: "have", value: "98304"},
+		{name: "p4_db_table_pages", labelName: "table", labelValue: "have", value: "12"},
+		{name: "p4_db_table_growth_bytes_per_hour", labelName: "table", labelValue: "have", value: "32768"},
+		{name: "p4_db_table_fragmentation_percent", labelName: "table", labelValue: "have", value: "2.5"},
+		{name: "p4_db_table_bytes", labelName: "table", labelValue: "rev", value: "16384"},
+		{name: "p4_db_table_pages", labelName: "table", labelValue: "rev", value: "2"},
+		{name: "p4_db_table_growth_bytes_per_hour", labelName: "table", labelValue: "rev", value: "0"},
+	}, p4m.metrics)
+}
+
+// FakeDriftRunner returns spec output for drift artefacts
+type FakeDriftRunner struct {
+	output map[string][]string
+}
+
+func (f *FakeDriftRunner) Run(args string, input string) ([]string, error) {
+	if out, ok := f.output[args]; ok {
+		return out, nil
+	}
+	return nil, fmt.Errorf("exit status 1: unknown command %s", args)
+}
+
+func TestDriftDir(t *testing.T) {
+	cfg := config.Config{MonitorDrift: true, MetricsRoot: "/hxlogs/metrics"}
+	initLogger()
+	env := map[string]string{}
+	p4m := newP4MonitorMetrics(&cfg, &env, tlogger)
+	p4m.isSuper = true
+	p4m.serverID = "master.1"
+	p4m.p4Runner = &FakeDriftRunner{output: map[string][]string{}}
+
+	// Never defaults to metrics_root, so nothing is done without somewhere private to keep snapshots
+	assert.Equal(t, "", p4m.driftDir())
+	p4m.monitorDrift()
+	assert.Equal(t, 0, len(p4m.metrics))
+
+	p4m.logsDir = "/p4/1/logs"
+	p4m.sdpInstanceSuffix = "-1"
+	assert.Equal(t, filepath.Join("/p4/1/logs", "p4metrics_drift-1-master.1"), p4m.driftDir())
+	cfg.StateDir = "/p4/1/p4metrics"
+	assert.Equal(t, filepath.Join("/p4/1/p4metrics", "p4metrics_drift-1-master.1"), p4m.driftDir())
+	cfg.DriftDir = "/p4/1/drift"
+	assert.Equal(t, "/p4/1/drift", p4m.driftDir())
+}
+
+func TestDrift(t *testing.T) {
+	cfg := config.Config{MonitorDrift: true, DriftDir: t.TempDir()}
+	initLogger()
+	env := map[string]string{}
+	p4m := newP4MonitorMetrics(&cfg, &env, tlogger)
+	p4m.dryrun = true
+	p4m.isSuper = true
+	p4m.serverID = "master.1"
+	fake := &FakeDriftRunner{output: map[string][]string{
+		"configure show allservers": {"any: security=4", "any: dm.user.noautocreate=2"},
+		"triggers -o":               {"# A Perforce Triggers Specification.", "Triggers:", "\tcheck change-submit //... \"/p4/check.sh\""},
+		"protect -o":                {"Protections:", "\tsuper user p4admin * //..."},
+	}}
+	p4m.p4Runner = fake
+
+	// First run snapshots without reporting changes - typemap fails so is not output
+	p4m.monitorDrift()
+	assert.Equal(t, 9, len(p4m.metrics))
+	assert.Equal(t, "configure", p4m.metrics[0].labels[0].value)
+	hash := p4m.metrics[0].labels[1].value
+	assert.Equal(t, 16, len(hash))
+	_, err := os.Stat(filepath.Join(cfg.DriftDir, "drift.log"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Comment changes (e.g. from a p4d upgrade) are ignored
+	fake.output["triggers -o"][0] = "# A Helix Core Triggers Specification."
+	p4m.monitorDrift()
+	assert.Equal(t, 0, p4m.driftChanges["triggers"])
+
+	// Changed configurable is logged as a diff
+	fake.output["configure show allservers"] = []string{"any: security=3", "any: dm.user.noautocreate=2"}
+	p4m.monitorDrift()
+	assert.Equal(t, 1, p4m.driftChanges["configure"])
+	assert.NotEqual(t, hash, p4m.metrics[0].labels[1].value)
+	compareMetricValues(t, metricValues{
+		{name: "p4_drift_hash_info", labelName: "artefact", labelValue: "configure", value: "1"},
+		{name: "p4_drift_last_changed_time", labelName: "artefact", labelValue: "configure", value: p4m.metrics[1].value},
+		{name: "p4_drift_changes_count", labelName: "artefact", labelValue: "configure", value: "1"},
+		{name: "p4_drift_hash_info", labelName: "artefact", labelValue: "triggers", value: "1"},
+		{name: "p4_drift_last_changed_time", labelName: "artefact", labelValue: "triggers", value: p4m.metrics[4].value},
+		{name: "p4_drift_changes_count", labelName: "artefact", labelValue: "triggers", value: "0"},
+		{name: "p4_drift_hash_info", labelName: "artefact", labelValue: "protect", value: "1"},
+		{name: "p4_drift_last_changed_time", labelName: "artefact", labelValue: "protect", value: p4m.metrics[7].value},
+		{name: "p4_drift_changes_count", labelName: "artefact", labelValue: "protect", value: "0"},
+	}, p4m.metrics)
+	buf, err := os.ReadFile(filepath.Join(cfg.DriftDir, "drift.log"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(buf), "configure changed on master.1")
+	assert.Contains(t, string(buf), "-any: security=4\n+any: security=3\n")
+
+	// Snapshots and diffs include protections so are only readable by the owner
+	if runtime.GOOS != "windows" {
+		for name, mode := range map[string]os.FileMode{"": 0700, "drift.log": 0600, "protect.txt": 0600} {
+			fi, err := os.Stat(filepath.Join(cfg.DriftDir, name))
+			assert.NoError(t, err)
+			assert.Equal(t, mode, fi.Mode().Perm(), name)
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	policy, err := config.LoadPolicyString([]byte(`rules:
+  - configurable: security
+    default: "0"
+    min: 3
+  - configurable: server.allowpush
+    default: "0"
+    value: "0"
+  - configurable: dm.user.noautocreate
+    value: "2"
+  - name: ssl
+    info: serverAddress
+    regex: ^ssl
+`))
+	assert.NoError(t, err)
+	cfg := config.Config{Policy: policy}
+	initLogger()
+	env := map[string]string{}
+	p4m := newP4MonitorMetrics(&cfg, &env, tlogger)
+	p4m.dryrun = true
+	p4m.isSuper = true
+	p4m.serverID = "master.1"
+	p4m.p4Runner = &FakeDriftRunner{output: map[string][]string{
+		// Server specific value overrides any
+		"configure show allservers": {"any: security=4", "master.1: server.allowpush=1", "edge.1: security=0"},
+		"-ztag info":                {"... userName p4admin", "... serverAddress ssl:1666", "... serverVersion P4D/LINUX26X86_64/2024.1/2596294 (2024/04/03)"},
+	}}
+
+	p4m.monitorPolicy()
+	compareMetricValues(t, metricValues{
+		{name: "p4_policy_rule_pass", labelName: "rule", labelValue: "security", value: "1"},
+		{name: "p4_policy_rule_pass", labelName: "rule", labelValue: "server.allowpush", value: "0"},
+		{name: "p4_policy_rule_pass", labelName: "rule", labelValue: "dm.user.noautocreate", value: "0"},
+		{name: "p4_policy_rule_pass", labelName: "rule", labelValue: "ssl", value: "1"},
+		{name: "p4_policy_score", value: "50.0"},
+		{name: "p4_policy_rules_failed", value: "2"},
+	}, p4m.metrics)
+
+	results, err := p4m.checkPolicy()
+	assert.NoError(t, err)
+	assert.Equal(t, `PASS security: "4" (expected >= 3)
+FAIL server.allowpush: "1" (expected "0")
+FAIL dm.user.noautocreate: not set (expected "2")
+PASS ssl: "ssl:1666" (expected to match "^ssl")
+Score: 50% - 2 of 4 rules passed
+`, policyReport(results))
+}
+
 func TestJournalLineParsing(t *testing.T) {
 	cfg := config.Config{}
 	initLogger()
@@ -507,6 +1778,148 @@ func TestMonitorJournalRecordsSkippedForStandby(t *testing.T) {
 	assert.Equal(t, 0, len(p4m.metrics))
 }
 
+func TestStateSaveLoad(t *testing.T) {
+	cfg := config.Config{MetricsRoot: t.TempDir(), SDPInstance: "1", PersistCounters: true}
+	initLogger()
+	env := map[string]string{}
+	p4m := newP4MonitorMetrics(&cfg, &env, tlogger)
+	p4m.serverID = "master.1"
+	p4m.stateLoaded = true
+	m := ErrorMetric{Subsystem: "db", Severity: "3", Name: "DM_BadRevision"}
+	p4m.errorMetrics[m] = 5
+	p4m.errorLabels["DM_BadRevision"] = true
+	p4m.errorLabelOffsets[m] = 2
+	p4m.errParseFailures = 3
+	p4m.journalMetrics[JournalMetric{Table: "have", Action: "pv"}] = 7
+	p4m.savedJournalFile = &fileState{Path: "/p4/1/logs/journal", Inode: 42, Offset: 1234}
+	// Left over from an earlier version which wrote it 0644
+	assert.NoError(t, os.WriteFile(p4m.stateFilename()+".tmp", []byte("{}"), 0644))
+	p4m.saveState()
+	assert.Equal(t, filepath.Join(cfg.MetricsRoot, "p4metrics_state-1-master.1.json"), p4m.stateFilename())
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(p4m.stateFilename())
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	}
+
+	p4m2 := newP4MonitorMetrics(&cfg, &env, tlogger)
+	p4m2.serverID = "master.1"
+	assert.NoError(t, os.Chmod(p4m.stateFilename(), 0644))
+	p4m2.loadState()
+	assert.True(t, p4m2.stateLoaded)
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(p4m.stateFilename())
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	}
+	assert.Equal(t, 5, p4m2.errorMetrics[m])
+	assert.True(t, p4m2.errorLabels["DM_BadRevision"])
+	assert.Equal(t, 2, p4m2.errorLabelOffsets[m])
+	assert.Equal(t, int64(3), p4m2.errParseFailures)
+	assert.Equal(t, 7, p4m2.journalMetrics[JournalMetric{Table: "have", Action: "pv"}])
+	assert.Equal(t, int64(1234), p4m2.savedJournalFile.Offset)
+	assert.Nil(t, p4m2.savedErrorsFile)
+
+	// Nothing written or restored if disabled
+	cfg.PersistCounters = false
+	p4m3 := newP4MonitorMetrics(&cfg, &env, tlogger)
+	p4m3.serverID = "master.1"
+	p4m3.loadState()
+	assert.Equal(t, 0, len(p4m3.errorMetrics))
+}
+
+func TestResumeTracking(t *testing.T) {
+	cfg := config.Config{PersistCounters: true}
+	initLogger()
+	env := map[string]string{}
+	p4m := newP4MonitorMetrics(&cfg, &env, tlogger)
+	dir := t.TempDir()
+	jnl := filepath.Join(dir, "journal")
+	appendLines := func(fname string, lines ...string) {
+		f, err := os.OpenFile(fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		assert.NoError(t, err)
+		for _, l := range lines {
+			fmt.Fprintln(f, l)
+		}
+		f.Close()
+	}
+	resume := func(saved *fileState, dirs ...string) {
+		p4m.resumeTracking(&p4m.journalFile, &p4m.journalLock, saved, jnl, dirs, p4m.countJournalLine)
+	}
+	// As runJournalTailer, with the tailer reading the whole file as done for persist_counters
+	tailLines := func(count int) {
+		tailer, err := p4m.getTailer(&logConfig{Type: "file", Path: jnl, PollInterval: 10 * time.Millisecond,
+			Readall: true, MaxLineBytes: 100})
+		assert.NoError(t, err)
+		defer tailer.Close()
+		for i := 0; i < count; i++ {
+			select {
+			case line := <-tailer.Lines():
+				p4m.journalLock.Lock()
+				if p4m.journalFile.advance() {
+					p4m.countJournalLine(line.Line)
+				}
+				p4m.journalLock.Unlock()
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for line %d", i+1)
+			}
+		}
+	}
+	haveRec := "@pv@ 3 @db.have@ @//ws/file@ @//depot/file@ 1 0 0"
+	longRec := "@rv@ 3 @db.domain@ @" + strings.Repeat("x", 200) + "@ 99"
+	have := JournalMetric{Table: "have", Action: "pv"}
+	domain := JournalMetric{Table: "domain", Action: "rv"}
+	appendLines(jnl, haveRec, haveRec)
+
+	// No saved state - existing lines skipped, but one written before the tailer starts is counted.
+	// Tracker follows lines delivered by the tailer, including those truncated by MaxLineBytes
+	resume(nil)
+	appendLines(jnl, longRec)
+	tailLines(3)
+	assert.Equal(t, 0, p4m.journalMetrics[have])
+	assert.Equal(t, 1, p4m.journalMetrics[domain])
+	assert.Equal(t, int64(2*(len(haveRec)+1)+len(longRec)+1), p4m.journalFile.offset)
+	saved := p4m.journalFile.state()
+	p4m.journalFile.close()
+
+	// Lines written while not running, and between resuming and starting the tailer, are counted once
+	appendLines(jnl, haveRec)
+	resume(saved)
+	assert.Equal(t, saved.Offset, p4m.journalFile.state().Offset)
+	appendLines(jnl, haveRec)
+	tailLines(5)
+	assert.Equal(t, 2, p4m.journalMetrics[have])
+	assert.Equal(t, 1, p4m.journalMetrics[domain])
+	fi, err := os.Stat(jnl)
+	assert.NoError(t, err)
+	assert.Equal(t, fi.Size(), p4m.journalFile.state().Offset)
+	saved = p4m.journalFile.state()
+	p4m.journalFile.close()
+
+	if runtime.GOOS != "linux" {
+		return
+	}
+	// Rotated - rest of old file (found by inode) is replayed and all of new file is counted
+	appendLines(jnl, haveRec)
+	ckpDir := filepath.Join(dir, "checkpoints")
+	assert.NoError(t, os.Mkdir(ckpDir, 0755))
+	assert.NoError(t, os.Rename(jnl, filepath.Join(ckpDir, "p4_1.jnl.1")))
+	appendLines(jnl, longRec, haveRec)
+	resume(saved, dir, ckpDir)
+	assert.Equal(t, 3, p4m.journalMetrics[have])
+	tailLines(2)
+	assert.Equal(t, 4, p4m.journalMetrics[have])
+	assert.Equal(t, 2, p4m.journalMetrics[domain])
+	assert.Equal(t, int64(len(longRec)+len(haveRec)+2), p4m.journalFile.offset)
+
+	// Tracker restarts at beginning of file after tailer follows a rotation
+	assert.NoError(t, os.Rename(jnl, filepath.Join(ckpDir, "p4_1.jnl.2")))
+	appendLines(jnl, haveRec)
+	assert.True(t, p4m.journalFile.advance())
+	assert.Equal(t, int64(len(haveRec)+1), p4m.journalFile.offset)
+	p4m.journalFile.close()
+}
+
 func TestP4PullParsing(t *testing.T) {
 	cfg := config.Config{}
 	initLogger()
@@ -1099,6 +2512,7 @@ func TestParseMonitorShow(t *testing.T) {
 type FakeMemReader struct {
 	RSSByPid    map[int]int64
 	TotalMemory int64
+	StatsByPid  map[int]*ProcStats
 }
 
 func (f *FakeMemReader) GetPIDRSSBytes(pid int) (int64, error) {
@@ -1115,6 +2529,13 @@ func (f *FakeMemReader) GetMemTotalBytes() (int64, error) {
 	return 0, fmt.Errorf("total memory not set in fake reader")
 }
 
+func (f *FakeMemReader) GetPIDStats(pid int) (*ProcStats, error) {
+	if s, ok := f.StatsByPid[pid]; ok {
+		return s, nil
+	}
+	return nil, fmt.Errorf("PID %d not in fake reader", pid)
+}
+
 // TestEvaluateMemLimits tests the evaluateMemLimits function with various scenarios
 func TestEvaluateMemLimits(t *testing.T) {
 	initLogger()
@@ -1768,3 +3189,340 @@ func TestMemLimitsIntegrationWithEnforcement(t *testing.T) {
 	assert.Equal(t, 2, p4m.memlimitKillCount, "kill counter should be 2")
 	assert.Equal(t, []int{1000, 1001}, fakeTerminator.TerminatedPIDs, "correct PIDs terminated")
 }
+
+// TestEvaluateRuntimeLimits tests the evaluateRuntimeLimits function with various scenarios
+func TestEvaluateRuntimeLimits(t *testing.T) {
+	initLogger()
+
+	runtimeLimits := &config.RuntimeLimits{
+		Enabled: true,
+		Groups: []config.RuntimeLimitGroup{
+			{
+				Description: "exempt_admins",
+				Users:       "super|svc_.*",
+				ReUsers:     regexp.MustCompile("super|svc_.*"),
+			},
+			{
+				Description:       "reporting_cmds",
+				Users:             ".*",
+				ReUsers:           regexp.MustCompile(".*"),
+				Commands:          "^(files|fstat)$",
+				ReCommands:        regexp.MustCompile("^(files|fstat)$"),
+				MaxRunningSeconds: 600,
+				MaxIdleSeconds:    1800,
+			},
+			{
+				Description:       "default",
+				Users:             ".*",
+				ReUsers:           regexp.MustCompile(".*"),
+				MaxRunningSeconds: 3600,
+			},
+		},
+	}
+
+	tests := []struct {
+		name          string
+		processes     []MonitorProcess
+		runtimeLimits *config.RuntimeLimits
+		expectPIDs    []int
+		expectReasons []string
+	}{
+		{
+			name:          "no_runtimelimits_configured",
+			processes:     []MonitorProcess{{Pid: 100, State: "R", User: "alice", Cmd: "files", TimeSeconds: 9999}},
+			runtimeLimits: nil,
+		},
+		{
+			name: "under_limits",
+			processes: []MonitorProcess{
+				{Pid: 100, State: "R", User: "alice", Cmd: "files", TimeSeconds: 600},
+				{Pid: 101, State: "I", User: "alice", Cmd: "fstat", TimeSeconds: 1000},
+				{Pid: 102, State: "R", User: "bob", Cmd: "sync", TimeSeconds: 3000},
+			},
+			runtimeLimits: runtimeLimits,
+		},
+		{
+			name: "running_and_idle_over_limits",
+			processes: []MonitorProcess{
+				{Pid: 100, State: "R", User: "alice", Cmd: "files", TimeSeconds: 2400},
+				{Pid: 101, State: "I", User: "alice", Cmd: "fstat", TimeSeconds: 2000},
+				{Pid: 102, State: "R", User: "bob", Cmd: "sync", TimeSeconds: 4000},
+			},
+			runtimeLimits: runtimeLimits,
+			expectPIDs:    []int{100, 101, 102},
+			expectReasons: []string{"max_running_time", "max_idle_time", "max_running_time"},
+		},
+		{
+			name: "exempt_users_and_no_idle_limit",
+			processes: []MonitorProcess{
+				{Pid: 100, State: "R", User: "super", Cmd: "files", TimeSeconds: 99999},
+				{Pid: 101, State: "I", User: "bob", Cmd: "sync", TimeSeconds: 99999},
+			},
+			runtimeLimits: runtimeLimits,
+		},
+		{
+			name: "background_ignored",
+			processes: []MonitorProcess{
+				{Pid: 100, State: "B", User: "alice", Cmd: "files", TimeSeconds: 99999},
+			},
+			runtimeLimits: runtimeLimits,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eval := evaluateRuntimeLimits(tt.processes, tt.runtimeLimits, tlogger)
+			assert.NotNil(t, eval)
+			pids := make([]int, 0)
+			reasons := make([]string, 0)
+			for _, a := range eval.KillCandidates {
+				pids = append(pids, a.Pid)
+				reasons = append(reasons, a.ReasonType)
+			}
+			if tt.expectPIDs == nil {
+				assert.Equal(t, 0, len(eval.KillCandidates))
+			} else {
+				assert.Equal(t, tt.expectPIDs, pids)
+				assert.Equal(t, tt.expectReasons, reasons)
+			}
+		})
+	}
+}
+
+// TestMonitorRuntimeLimitsWithEnforcement tests full flow from monitor output to termination and metrics
+func TestMonitorRuntimeLimitsWithEnforcement(t *testing.T) {
+	initLogger()
+
+	cfg := &config.Config{
+		RuntimeLimits: &config.RuntimeLimits{
+			Enabled:      true,
+			EnforceKills: true,
+			Groups: []config.RuntimeLimitGroup{
+				{
+					Description:       "strict_group",
+					Users:             ".*",
+					ReUsers:           regexp.MustCompile(".*"),
+					MaxRunningSeconds: 1800,
+				},
+			},
+		},
+	}
+
+	env := map[string]string{}
+	p4m := newP4MonitorMetrics(cfg, &env, tlogger)
+	fakeTerminator := &FakeTerminator{}
+	p4m.terminator = fakeTerminator
+
+	monitorOutput := []string{
+		"1000 R alice 00:40:00 files",
+		"1001 R bob 00:10:00 sync",
+	}
+	result := p4m.parseMonitorShow(monitorOutput)
+	p4m.monitorRuntimeLimits(result.processes)
+
+	assert.Equal(t, []int{1000}, fakeTerminator.TerminatedPIDs, "correct PIDs terminated")
+	assert.Equal(t, 1, p4m.runtimelimitKillCount, "kill counter should be 1")
+	compareMetricValues(t, metricValues{
+		{name: "p4_runtimelimit_kill_candidates", value: "1"},
+		{name: "p4_runtimelimit_kills_total", value: "1"},
+	}, p4m.metrics)
+
+	// Without enforcement candidates are reported but nothing terminated - candidates are cumulative as for memlimits
+	cfg.RuntimeLimits.EnforceKills = false
+	fakeTerminator.TerminatedPIDs = nil
+	p4m.metrics = make([]metricStruct, 0)
+	p4m.monitorRuntimeLimits(result.processes)
+	assert.Nil(t, fakeTerminator.TerminatedPIDs)
+	compareMetricValues(t, metricValues{
+		{name: "p4_runtimelimit_kill_candidates", value: "2"},
+		{name: "p4_runtimelimit_kills_total", value: "1"},
+	}, p4m.metrics)
+
+	// Processes already terminated by memlimit enforcement in the same run are skipped
+	cfg.RuntimeLimits.EnforceKills = true
+	p4m.metrics = make([]metricStruct, 0)
+	p4m.terminateMemLimitViolators(&MemLimitEvaluation{KillCandidates: []KillAction{{Pid: 1000, User: "alice", Cmd: "files"}}}, fakeTerminator)
+	fakeTerminator.TerminatedPIDs = nil
+	p4m.monitorRuntimeLimits(result.processes)
+	assert.Nil(t, fakeTerminator.TerminatedPIDs)
+	compareMetricValues(t, metricValues{
+		{name: "p4_runtimelimit_kill_candidates", value: "2"},
+		{name: "p4_runtimelimit_kills_total", value: "1"},
+	}, p4m.metrics)
+}
+
+func TestParseProcStatAndIO(t *testing.T) {
+	// Command name with spaces and parens must not upset field counting
+	stat := "12345 (p4d_1 (x) y) S 1 12345 12345 0 -1 4194560 1234 0 0 0 250 75 0 0 20 0 4 0 1000 123456789 2345 18446744073709551615"
+	utime, stime, err := parseProcStat(stat)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(250), utime)
+	assert.Equal(t, int64(75), stime)
+	_, _, err = parseProcStat("12345 (p4d) S 1 2")
+	assert.Error(t, err)
+
+	io := `rchar: 323934931
+wchar: 323929600
+syscr: 632687
+syscw: 632675
+read_bytes: 4096
+write_bytes: 323932160
+cancelled_write_bytes: 0
+`
+	readBytes, writeBytes, err := parseProcIO(io)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4096), readBytes)
+	assert.Equal(t, int64(323932160), writeBytes)
+	_, _, err = parseProcIO("rchar: 1\n")
+	assert.Error(t, err)
+}
+
+func TestCollectProcStats(t *testing.T) {
+	initLogger()
+	cfg := &config.Config{}
+	env := map[string]string{}
+	p4m := newP4MonitorMetrics(cfg, &env, tlogger)
+	result := p4m.parseMonitorShow([]string{
+		"1000 R alice 00:00:05 sync",
+		"1001 B alice 00:00:10 sync",
+		"1002 R bob 00:00:10 edit",
+		"1003 R bob 00:00:10 fstat", // exited - no stats
+	})
+	reader := &FakeMemReader{StatsByPid: map[int]*ProcStats{
+		1000: {CPUUserSeconds: 1.5, CPUSystemSeconds: 0.5, ReadBytes: 1000, WriteBytes: 10, OpenFDs: 20},
+		1001: {CPUUserSeconds: 2.0, CPUSystemSeconds: 1.0, ReadBytes: 500, WriteBytes: 0, OpenFDs: 5},
+		1002: {CPUUserSeconds: 0.25, CPUSystemSeconds: 0.0, ReadBytes: 0, WriteBytes: 4096, OpenFDs: 7},
+	}}
+	summary := collectProcStats(result.processes, reader, tlogger)
+	assert.Equal(t, 2, len(summary.ByCmd))
+	assert.Equal(t, ProcStats{CPUUserSeconds: 3.5, CPUSystemSeconds: 1.5, ReadBytes: 1500, WriteBytes: 10, OpenFDs: 25}, *summary.ByCmd["sync"])
+	assert.Equal(t, ProcStats{CPUUserSeconds: 0.25, ReadBytes: 0, WriteBytes: 4096, OpenFDs: 7}, *summary.ByUser["bob"])
+
+	p4m.procStatsMetrics(summary.ByUser, "user")
+	compareMetricValues(t, metricValues{
+		{name: "p4_active_cpu_user_seconds_by_user", labelName: "user", labelValue: "alice", value: "3.50"},
+		{name: "p4_active_cpu_system_seconds_by_user", labelName: "user", labelValue: "alice", value: "1.50"},
+		{name: "p4_active_io_read_bytes_by_user", labelName: "user", labelValue: "alice", value: "1500"},
+		{name: "p4_active_io_write_bytes_by_user", labelName: "user", labelValue: "alice", value: "10"},
+		{name: "p4_active_open_fds_by_user", labelName: "user", labelValue: "alice", value: "25"},
+		{name: "p4_active_cpu_user_seconds_by_user", labelName: "user", labelValue: "bob", value: "0.25"},
+		{name: "p4_active_cpu_system_seconds_by_user", labelName: "user", labelValue: "bob", value: "0.00"},
+		{name: "p4_active_io_read_bytes_by_user", labelName: "user", labelValue: "bob", value: "0"},
+		{name: "p4_active_io_write_bytes_by_user", labelName: "user", labelValue: "bob", value: "4096"},
+		{name: "p4_active_open_fds_by_user", labelName: "user", labelValue: "bob", value: "7"},
+	}, p4m.metrics)
+}
+
+// TestLinuxProcStatsReader tests the real Linux /proc-based stats reader (if running on Linux)
+func TestLinuxProcStatsReader(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skipf("Test only runs on Linux (GOOS=%s)", runtime.GOOS)
+		return
+	}
+	reader := &LinuxProcMemReader{}
+	stats, err := reader.GetPIDStats(os.Getpid())
+	assert.NoError(t, err, "Should be able to read stats")
+	assert.GreaterOrEqual(t, stats.CPUUserSeconds, 0.0)
+	assert.Greater(t, stats.OpenFDs, 0, "Test process should have open fds")
+	_, err = reader.GetPIDStats(-1)
+	assert.Error(t, err)
+}
+
+func TestParseProcLocks(t *testing.T) {
+	lines := []string{
+		"1: FLOCK  ADVISORY  WRITE 1000 08:02:1001 0 EOF",
+		"1: -> FLOCK  ADVISORY  READ 1001 08:02:1001 0 EOF",
+		"2: POSIX  ADVISORY  READ 1002 fd:00:2002 0 EOF",
+		"3: OFDLCK ADVISORY  READ  -1 00:05:3003 0 EOF",
+		"invalid line",
+	}
+	locks := parseProcLocks(lines)
+	assert.Equal(t, []ProcLock{
+		{ID: 1, Type: "FLOCK", Mode: "WRITE", Pid: 1000, File: lockFileID{8, 2, 1001}},
+		{ID: 1, Waiting: true, Type: "FLOCK", Mode: "READ", Pid: 1001, File: lockFileID{8, 2, 1001}},
+		{ID: 2, Type: "POSIX", Mode: "READ", Pid: 1002, File: lockFileID{0xfd, 0, 2002}},
+	}, locks)
+}
+
+func TestEvaluateLocks(t *testing.T) {
+	inodes := map[lockFileID]string{
+		{8, 2, 101}: "rev",
+		{8, 2, 102}: "have",
+		{8, 2, 201}: "clientEntity",
+		{8, 2, 301}: "meta",
+	}
+	procs := map[int]MonitorProcess{
+		1000: {Pid: 1000, State: "R", User: "alice", Cmd: "submit", TimeSeconds: 300},
+		1001: {Pid: 1001, State: "R", User: "bob", Cmd: "sync", TimeSeconds: 40},
+		1002: {Pid: 1002, State: "R", User: "carol", Cmd: "files", TimeSeconds: 20},
+	}
+	lines := []string{
+		"1: FLOCK  ADVISORY  WRITE 1000 08:02:101 0 EOF",
+		"1: -> FLOCK  ADVISORY  READ 1001 08:02:101 0 EOF",
+		"2: FLOCK  ADVISORY  WRITE 1001 08:02:102 0 EOF",
+		"2: -> FLOCK  ADVISORY  READ 1002 08:02:102 0 EOF",
+		"3: FLOCK  ADVISORY  READ 1002 08:02:201 0 EOF",
+		"4: FLOCK  ADVISORY  READ 1000 08:02:301 0 EOF",
+		"5: FLOCK  ADVISORY  WRITE 999 08:02:999 0 EOF",  // not a p4d file
+		"6: FLOCK  ADVISORY  WRITE 1000 08:03:101 0 EOF", // same inode as db.rev on another filesystem
+	}
+	eval := evaluateLocks(parseProcLocks(lines), inodes, procs)
+	assert.Equal(t, 2, eval.DbWrite)
+	assert.Equal(t, 0, eval.DbRead)
+	assert.Equal(t, 1, eval.ClientEntityRead)
+	assert.Equal(t, 1, eval.MetaRead)
+	assert.Equal(t, 2, eval.BlockedCmds)
+	assert.Equal(t, map[string]int{"rev": 1, "have": 1}, eval.WriteByTable)
+	assert.Equal(t, map[string]int{"rev": 1, "have": 1}, eval.BlockedByTable)
+	assert.Equal(t, []string{
+		"pid 1001 user bob cmd sync time 40s wants READ rev, blocked by pid 1000 user alice cmd submit time 300s holding WRITE",
+		"pid 1002 user carol cmd files time 20s wants READ have, blocked by pid 1001 user bob cmd sync time 40s holding WRITE" +
+			" wants READ rev, blocked by pid 1000 user alice cmd submit time 300s holding WRITE",
+	}, eval.Chains)
+
+	// Loops must terminate
+	lines = []string{
+		"1: FLOCK  ADVISORY  WRITE 1000 08:02:101 0 EOF",
+		"1: -> FLOCK  ADVISORY  WRITE 1001 08:02:101 0 EOF",
+		"2: FLOCK  ADVISORY  WRITE 1001 08:02:102 0 EOF",
+		"2: -> FLOCK  ADVISORY  WRITE 1000 08:02:102 0 EOF",
+	}
+	eval = evaluateLocks(parseProcLocks(lines), inodes, procs)
+	assert.Equal(t, 2, eval.BlockedCmds)
+	assert.True(t, strings.HasSuffix(eval.Chains[0], "(loop)"))
+}
+
+func TestLockFileInodes(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skipf("Test only runs on Linux (GOOS=%s)", runtime.GOOS)
+		return
+	}
+	root := t.TempDir()
+	assert.NoError(t, os.MkdirAll(root+"/server.locks/clientEntity/10", 0755))
+	for _, f := range []string{"db.rev", "db.have", "journal", "server.locks/clientEntity/10/ws1", "server.locks/meta", "server.locks/other.txt"} {
+		assert.NoError(t, os.WriteFile(root+"/"+f, []byte("x"), 0644))
+	}
+	inodes := getLockFileInodes(root)
+	names := make([]string, 0)
+	for _, n := range inodes {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"clientEntity", "have", "meta", "other.txt", "rev"}, names)
+}
+
+func TestWriteLocksLog(t *testing.T) {
+	initLogger()
+	logFile := t.TempDir() + "/locks.log"
+	cfg := &config.Config{LocksLog: logFile, LocksLogChains: 3}
+	env := map[string]string{}
+	p4m := newP4MonitorMetrics(cfg, &env, tlogger)
+	p4m.writeLocksLog([]string{"chain1", "chain2"})
+	p4m.writeLocksLog([]string{"chain3", "chain4"})
+	content, err := os.ReadFile(logFile)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Equal(t, 3, len(lines))
+	assert.True(t, strings.HasSuffix(lines[0], " chain2"))
+	assert.True(t, strings.HasSuffix(lines[2], " chain4"))
+}
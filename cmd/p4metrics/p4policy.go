@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PolicyResult is the outcome of checking a security_policy rule
+type PolicyResult struct {
+	Name     string
+	Value    string // Value found - empty if not set
+	Found    bool
+	Pass     bool
+	Expected string
+}
+
+// parseConfigureAllServers parses p4 configure show allservers, e.g.
+//
+//	any: security=4
+//	master.1: server.depot.root=/p4/1/depots
+//
+// Values set for serverID override those set for any.
+func parseConfigureAllServers(lines []string, serverID string) map[string]string {
+	anyValues := make(map[string]string)
+	serverValues := make(map[string]string)
+	for _, line := range lines {
+		server, setting, ok := strings.Cut(strings.TrimSpace(line), ": ")
+		if !ok {
+			continue
+		}
+		name, value, ok := strings.Cut(setting, "=")
+		if !ok {
+			continue
+		}
+		if server == "any" {
+			anyValues[name] = value
+		} else if serverID != "" && server == serverID {
+			serverValues[name] = value
+		}
+	}
+	for k, v := range serverValues {
+		anyValues[k] = v
+	}
+	return anyValues
+}
+
+// checkPolicy runs the security_policy rules against configurables and p4 -ztag info
+func (p4m *P4MonitorMetrics) checkPolicy() ([]*PolicyResult, error) {
+	lines, err := p4m.p4Runner.Run("configure show allservers", "")
+	if err != nil {
+		return nil, fmt.Errorf("error running configure show allservers: %v", err)
+	}
+	configurables := parseConfigureAllServers(lines, p4m.serverID)
+	lines, err = p4m.p4Runner.Run("-ztag info", "")
+	if err != nil {
+		return nil, fmt.Errorf("error running info: %v", err)
+	}
+	info := make(map[string]string)
+	for _, rec := range parseZtagRecords(lines) {
+		for k, v := range rec {
+			info[k] = v
+		}
+	}
+	results := make([]*PolicyResult, 0, len(p4m.config.Policy.Rules))
+	for _, r := range p4m.config.Policy.Rules {
+		var value string
+		var found bool
+		if r.Configurable != "" {
+			value, found = configurables[r.Configurable]
+		} else {
+			value, found = info[r.Info]
+		}
+		results = append(results, &PolicyResult{Name: r.Name, Value: value, Found: found,
+			Pass: r.Check(value, found), Expected: r.Expected()})
+	}
+	return results, nil
+}
+
+// policyScore returns the percentage of rules passed, and the count failed
+func policyScore(results []*PolicyResult) (float64, int) {
+	if len(results) == 0 {
+		return 100, 0
+	}
+	failed := 0
+	for _, r := range results {
+		if !r.Pass {
+			failed++
+		}
+	}
+	return float64(len(results)-failed) * 100 / float64(len(results)), failed
+}
+
+// policyReport formats results for --check.policy
+func policyReport(results []*PolicyResult) string {
+	var sb strings.Builder
+	for _, r := range results {
+		status := "PASS"
+		if !r.Pass {
+			status = "FAIL"
+		}
+		value := fmt.Sprintf("%q", r.Value)
+		if !r.Found {
+			value = "not set"
+		}
+		fmt.Fprintf(&sb, "%s %s: %s (%s)\n", status, r.Name, value, r.Expected)
+	}
+	score, failed := policyScore(results)
+	fmt.Fprintf(&sb, "Score: %.0f%% - %d of %d rules passed\n", score, len(results)-failed, len(results))
+	return sb.String()
+}
+
+func (p4m *P4MonitorMetrics) monitorPolicy() {
+	// Security baseline compliance - security_policy rules checked against configurables and p4 info
+	if p4m.config.Policy == nil {
+		return
+	}
+	if !p4m.isSuper {
+		p4m.logger.Debugf("monitorPolicy: p4 configure show requires super user")
+		return
+	}
+	p4m.startMonitor("monitorPolicy", "p4_policy")
+	defer p4m.completeMonitor()
+	results, err := p4m.checkPolicy()
+	if err != nil {
+		p4m.logger.Errorf("Error checking security_policy: %v", err)
+		return
+	}
+	for _, r := range results {
+		pass := "0"
+		if r.Pass {
+			pass = "1"
+		}
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_policy_rule_pass",
+			help:   "Whether the security_policy rule passes (1) or fails (0)",
+			mtype:  "gauge",
+			value:  pass,
+			labels: []labelStruct{{name: "rule", value: r.Name}}})
+	}
+	score, failed := policyScore(results)
+	p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_policy_score",
+		help:  "Percentage of security_policy rules which pass",
+		mtype: "gauge",
+		value: fmt.Sprintf("%.1f", score)})
+	p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_policy_rules_failed",
+		help:  "Count of security_policy rules which fail",
+		mtype: "gauge",
+		value: fmt.Sprintf("%d", failed)})
+	p4m.writeMetricsFile()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// Monitors which need local access to the p4d server's files or processes, and so are not run if remote: true
+var remoteDisabledMonitors = map[string]string{
+	"monitorCheckpoint":       "reads SDP checkpoint logs",
+	"monitorVerify":           "reads SDP verify logs",
+	"monitorJournalAndLogs":   "stats and rotates P4JOURNAL/P4LOG files - see p4_diskspace_* instead",
+	"monitorLocks":            "reads /proc/locks",
+	"monitorProcessesLocal":   "reads process counts, CPU/IO and memory (memlimits) from ps and /proc",
+	"monitorErrors":           "tails errors.csv",
+	"monitorJournalRecords":   "tails P4JOURNAL",
+	"monitorAuth":             "tails auth.csv",
+	"monitorTriggers":         "tails triggers.csv",
+	"monitorIntegrityLog":     "tails integrity.csv",
+	"monitorRealTimeLocalP4D": "runs p4d --show-realtime - p4 monitor realtime is used instead",
+	"monitorDBTablesLocal":    "stats db.* files in P4ROOT - p4 dbstat -s is used instead",
+}
+
+var reTargetChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// monitorEnabled returns false for monitors which can't be used in remote mode
+func (p4m *P4MonitorMetrics) monitorEnabled(name string) bool {
+	if !p4m.config.Remote {
+		return true
+	}
+	_, disabled := remoteDisabledMonitors[name]
+	return !disabled
+}
+
+// setTarget sets the target label value used in remote mode - target from config, or else P4PORT/server address
+func (p4m *P4MonitorMetrics) setTarget() {
+	if !p4m.config.Remote {
+		p4m.target = ""
+		return
+	}
+	p4m.target = p4m.config.Target
+	if p4m.target == "" {
+		p4m.target = p4m.p4port
+	}
+	if p4m.target == "" {
+		p4m.target = p4m.p4info["Server address"]
+	}
+	if p4m.target == "" {
+		p4m.target = "unknown"
+	}
+	p4m.logger.Debugf("remote target: %q", p4m.target)
+}
+
+// targetSuffix is used in metrics filenames so that one metrics_root can be shared by collectors for different targets
+func (p4m *P4MonitorMetrics) targetSuffix() string {
+	if p4m.target == "" {
+		return ""
+	}
+	return "-" + reTargetChars.ReplaceAllString(p4m.target, "_")
+}
+
+// logDisabledMonitors logs the monitors not run in remote mode - once on initialisation
+func (p4m *P4MonitorMetrics) logDisabledMonitors() {
+	if !p4m.config.Remote {
+		return
+	}
+	for _, name := range sortedDisabledMonitors() {
+		p4m.logger.Infof("Remote mode: %s disabled as it %s", name, remoteDisabledMonitors[name])
+	}
+}
+
+func sortedDisabledMonitors() []string {
+	names := make([]string, 0, len(remoteDisabledMonitors))
+	for name := range remoteDisabledMonitors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// disabledMonitorMetrics reports which monitors are not run in remote mode, and why
+func (p4m *P4MonitorMetrics) disabledMonitorMetrics() {
+	if !p4m.config.Remote {
+		return
+	}
+	for _, name := range sortedDisabledMonitors() {
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_monitor_disabled",
+			help:  "Monitors not run by p4metrics (value 1) - e.g. as they need local access in remote mode",
+			mtype: "gauge",
+			value: "1",
+			labels: []labelStruct{{name: "monitor", value: name},
+				{name: "reason", value: remoteDisabledMonitors[name]}}})
+	}
+}
+
+// diskspaceMetrics converts p4 diskspace output to metrics by volume (P4ROOT, P4JOURNAL, depot etc)
+func (p4m *P4MonitorMetrics) diskspaceMetrics(volumes map[string]VolumeInfo) {
+	names := make([]string, 0, len(volumes))
+	for name := range volumes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v := volumes[name]
+		labels := []labelStruct{{name: "volume", value: v.Name}, {name: "mount", value: v.MountPoint}}
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_diskspace_free_bytes",
+			help:   "Free space on volume from p4 diskspace",
+			mtype:  "gauge",
+			value:  fmt.Sprintf("%d", v.Free),
+			labels: labels})
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_diskspace_total_bytes",
+			help:   "Total space on volume from p4 diskspace",
+			mtype:  "gauge",
+			value:  fmt.Sprintf("%d", v.Total),
+			labels: labels})
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_diskspace_percent_full",
+			help:   "Percent full of volume from p4 diskspace",
+			mtype:  "gauge",
+			value:  fmt.Sprintf("%d", v.PercentFull),
+			labels: labels})
+	}
+}
+
+// monitorDiskspace outputs p4 diskspace values - in remote mode only, as otherwise node_exporter reports filesystems
+func (p4m *P4MonitorMetrics) monitorDiskspace() {
+	if !p4m.config.Remote {
+		return
+	}
+	p4m.startMonitor("monitorDiskspace", "p4_diskspace")
+	defer p4m.completeMonitor()
+	p4cmd, errbuf, p := p4m.newP4CmdPipe("diskspace")
+	vals, err := p.Exec(p4cmd).Slice()
+	if err != nil {
+		p4m.handleP4Error("Error running %s: %v, err:%q", p4cmd, err, errbuf)
+		return
+	}
+	volumes, err := p4m.parseDiskspace(vals)
+	if err != nil {
+		p4m.logger.Errorf("Error parsing diskspace: %v", err)
+		return
+	}
+	p4m.diskspaceMetrics(volumes)
+	p4m.writeMetricsFile()
+}
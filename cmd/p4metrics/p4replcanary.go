@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The replication canary: the commit server writes the current time (epoch millisecs) to a counter on every update,
+// and replicas poll the counter, recording when each new value is first seen. The difference is the end-to-end
+// replication propagation time - rather than journal position which says nothing about when data is visible.
+
+// writeReplicationCounter writes the current time to the replication canary counter on the commit server
+func (p4m *P4MonitorMetrics) writeReplicationCounter() {
+	now := time.Now()
+	_, err := p4m.p4Runner.Run(fmt.Sprintf("counter %s %d", p4m.config.ReplicationCanaryCounter, now.UnixMilli()), "")
+	if err != nil {
+		p4m.logger.Warnf("Failed to write replication canary counter: %v", err)
+		return
+	}
+	p4m.replicationLock.Lock()
+	p4m.replicationLastWrite = now
+	p4m.replicationLock.Unlock()
+}
+
+// observeReplicationCounter records when a new counter value is first seen on a replica
+func (p4m *P4MonitorMetrics) observeReplicationCounter(value string, seen time.Time) {
+	ms, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || ms <= 0 {
+		// Counter not yet written (value 0) or not replicated
+		return
+	}
+	p4m.replicationLock.Lock()
+	defer p4m.replicationLock.Unlock()
+	if ms == p4m.replicationValue {
+		return
+	}
+	written := time.UnixMilli(ms)
+	first := p4m.replicationValue == 0
+	p4m.replicationValue = ms
+	if first {
+		// May have been written long before p4metrics started, so not a valid propagation time
+		return
+	}
+	lag := seen.Sub(written)
+	if lag < 0 {
+		lag = 0 // Clock skew between servers
+	}
+	p4m.replicationPropagation = lag
+	p4m.replicationObserved = true
+}
+
+// readReplicationCounter reads the replication canary counter on a replica
+func (p4m *P4MonitorMetrics) readReplicationCounter() {
+	lines, err := p4m.p4Runner.Run(fmt.Sprintf("counter %s", p4m.config.ReplicationCanaryCounter), "")
+	if err != nil {
+		p4m.logger.Debugf("Failed to read replication canary counter: %v", err)
+		return
+	}
+	if len(lines) > 0 {
+		p4m.observeReplicationCounter(lines[0], time.Now())
+	}
+}
+
+// setupReplicationCanary starts polling the counter in the background on a replica - more often than
+// update_interval so that propagation time is accurate to replication_canary_poll.
+// Called on each re-init, so restarts the poller if the config has changed (e.g. on SIGHUP).
+func (p4m *P4MonitorMetrics) setupReplicationCanary() {
+	if !p4m.config.ReplicationCanary || p4m.isCommitServer() {
+		p4m.stopReplicationCanary() // Disabled, or now the commit server after a failover
+		return
+	}
+	if p4m.replicationStop != nil {
+		if p4m.replicationPoll == p4m.config.ReplicationCanaryPoll {
+			return
+		}
+		p4m.logger.Debugf("setupReplicationCanary: replication_canary_poll changed from %v", p4m.replicationPoll)
+		p4m.stopReplicationCanary()
+	}
+	p4m.logger.Debugf("setupReplicationCanary starting")
+	stop := make(chan struct{})
+	poll := p4m.config.ReplicationCanaryPoll
+	p4m.replicationStop = stop
+	p4m.replicationPoll = poll
+	go func() {
+		ticker := time.NewTicker(poll)
+		defer ticker.Stop()
+		for {
+			p4m.readReplicationCounter()
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (p4m *P4MonitorMetrics) stopReplicationCanary() {
+	if p4m.replicationStop != nil {
+		close(p4m.replicationStop)
+		p4m.replicationStop = nil
+	}
+}
+
+func (p4m *P4MonitorMetrics) monitorReplicationCanary() {
+	if !p4m.config.ReplicationCanary {
+		return
+	}
+	p4m.startMonitor("monitorReplicationCanary", "p4_replication_canary")
+	defer p4m.completeMonitor()
+	if p4m.isCommitServer() {
+		p4m.writeReplicationCounter()
+	}
+	p4m.replicationLock.Lock()
+	defer p4m.replicationLock.Unlock()
+	if !p4m.replicationLastWrite.IsZero() {
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_replication_canary_last_write",
+			help:  "Time (epoch secs) the replication canary counter was last written on the commit server",
+			mtype: "gauge",
+			value: fmt.Sprintf("%d", p4m.replicationLastWrite.Unix())})
+	}
+	labels := []labelStruct{{name: "servername", value: p4m.serverID}}
+	if p4m.replicationValue > 0 {
+		age := time.Since(time.UnixMilli(p4m.replicationValue))
+		if age < 0 {
+			age = 0
+		}
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_replication_canary_age_seconds",
+			help:   "Age of the replication canary counter value visible on this replica - keeps increasing if replication stops",
+			mtype:  "gauge",
+			value:  fmt.Sprintf("%.3f", age.Seconds()),
+			labels: labels})
+	}
+	if p4m.replicationObserved {
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_replication_propagation_seconds",
+			help:   "Time between the replication canary counter being written on the commit server and first seen on this replica",
+			mtype:  "gauge",
+			value:  fmt.Sprintf("%.3f", p4m.replicationPropagation.Seconds()),
+			labels: labels})
+	}
+	p4m.writeMetricsFile()
+}
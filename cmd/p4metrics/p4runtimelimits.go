@@ -0,0 +1,153 @@
+package main
+
+// This module evaluates wall-clock runtime limits for commands in the p4d monitor table
+// and (optionally) terminates runaway commands - similar in approach to memlimits.
+
+import (
+	"fmt"
+
+	"github.com/perforce/p4prometheus/cmd/p4metrics/config"
+	"github.com/sirupsen/logrus"
+)
+
+// RuntimeLimitEvaluation holds the results of evaluating runtime limits
+type RuntimeLimitEvaluation struct {
+	KillCandidates []KillAction // Processes to kill (if enabled)
+}
+
+// findRuntimeLimitGroup returns the first group matching both user and command (or nil)
+func findRuntimeLimitGroup(runtimelimits *config.RuntimeLimits, user, cmd string) *config.RuntimeLimitGroup {
+	for i := range runtimelimits.Groups {
+		g := &runtimelimits.Groups[i]
+		if g.ReUsers == nil || !g.ReUsers.MatchString(user) {
+			continue
+		}
+		if g.ReCommands != nil && !g.ReCommands.MatchString(cmd) {
+			continue
+		}
+		return g
+	}
+	return nil
+}
+
+// evaluateRuntimeLimits analyzes monitor table processes against configured runtime thresholds.
+// Only Running ('R') and Idle ('I') processes are considered, each against the limit for its state
+// in the first group matching both user and command. A matching group with no limits exempts the process.
+// Kill candidates are only identified; actual termination requires EnforceKills config.
+func evaluateRuntimeLimits(
+	processes []MonitorProcess,
+	runtimelimits *config.RuntimeLimits,
+	logger *logrus.Logger) *RuntimeLimitEvaluation {
+
+	eval := &RuntimeLimitEvaluation{
+		KillCandidates: make([]KillAction, 0),
+	}
+	if runtimelimits == nil {
+		return eval
+	}
+
+	for _, proc := range processes {
+		var reasonType string
+		switch proc.State {
+		case "R":
+			reasonType = "max_running_time"
+		case "I":
+			reasonType = "max_idle_time"
+		default:
+			continue
+		}
+		grp := findRuntimeLimitGroup(runtimelimits, proc.User, proc.Cmd)
+		if grp == nil {
+			continue
+		}
+		limit := grp.MaxRunningSeconds
+		if proc.State == "I" {
+			limit = grp.MaxIdleSeconds
+		}
+		if limit <= 0 || proc.TimeSeconds <= limit {
+			continue
+		}
+		eval.KillCandidates = append(eval.KillCandidates, KillAction{
+			Pid:            proc.Pid,
+			User:           proc.User,
+			Cmd:            proc.Cmd,
+			RuntimeSeconds: proc.TimeSeconds,
+			ReasonType:     reasonType,
+			MatchedGroup:   grp.Description,
+			ThresholdValue: fmt.Sprintf("%ds", limit),
+		})
+	}
+
+	if len(eval.KillCandidates) > 0 {
+		logger.Infof("Runtimelimit evaluation: %d kill candidates identified", len(eval.KillCandidates))
+		for _, action := range eval.KillCandidates {
+			logger.Debugf("Runtimelimit kill candidate: PID %d user=%s cmd=%s reason=%s threshold=%s runtime=%ds",
+				action.Pid, action.User, action.Cmd, action.ReasonType, action.ThresholdValue, action.RuntimeSeconds)
+		}
+	}
+	return eval
+}
+
+// terminateRuntimeLimitViolators executes termination of processes in kill candidates list.
+// Behaves like terminateMemLimitViolators, including dryrun handling by the ProcessTerminator.
+// Returns the count of successfully terminated processes.
+func (p4m *P4MonitorMetrics) terminateRuntimeLimitViolators(eval *RuntimeLimitEvaluation, terminator ProcessTerminator) int {
+	if eval == nil || len(eval.KillCandidates) == 0 {
+		return 0
+	}
+
+	killed := 0
+	for _, action := range eval.KillCandidates {
+		success, err := terminator.TerminateProcess(action.Pid, action.User, action.Cmd)
+		if success {
+			killed++
+			p4m.runtimelimitKillCount++
+			p4m.logger.Infof("Runtimelimit process terminated: PID %d user=%s cmd=%s reason=%s runtime=%ds",
+				action.Pid, action.User, action.Cmd, action.ReasonType, action.RuntimeSeconds)
+		} else {
+			p4m.logger.Warnf("Runtimelimit failed to kill PID %d (%s from %s): %v", action.Pid, action.Cmd, action.User, err)
+		}
+	}
+
+	if killed > 0 {
+		p4m.logger.Infof("Runtimelimit terminated %d processes due to runtime limits (total: %d)", killed, p4m.runtimelimitKillCount)
+	}
+	return killed
+}
+
+// monitorRuntimeLimits evaluates runtime limits and appends metrics - called from monitorProcesses
+func (p4m *P4MonitorMetrics) monitorRuntimeLimits(processes []MonitorProcess) {
+	if p4m.config.RuntimeLimits == nil || !p4m.config.RuntimeLimits.Enabled {
+		return
+	}
+	eval := evaluateRuntimeLimits(processes, p4m.config.RuntimeLimits, p4m.logger)
+	// Skip processes already terminated by memlimit enforcement in this run
+	candidates := make([]KillAction, 0, len(eval.KillCandidates))
+	for _, action := range eval.KillCandidates {
+		if p4m.memlimitKilled[action.Pid] {
+			p4m.logger.Debugf("Runtimelimit skipping PID %d already terminated by memlimit", action.Pid)
+			continue
+		}
+		candidates = append(candidates, action)
+	}
+	eval.KillCandidates = candidates
+
+	// Cumulative - as for p4_memlimit_kill_candidates
+	p4m.runtimelimitCandidates += len(eval.KillCandidates)
+	p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_runtimelimit_kill_candidates",
+		help:  "Number of processes exceeding runtime limits",
+		mtype: "gauge",
+		value: fmt.Sprintf("%d", p4m.runtimelimitCandidates)})
+
+	if p4m.config.RuntimeLimits.EnforceKills && len(eval.KillCandidates) > 0 {
+		p4m.logger.Infof("Runtimelimit enforcing limits: terminating %d violating processes", len(eval.KillCandidates))
+		p4m.terminateRuntimeLimitViolators(eval, p4m.terminator)
+	} else if len(eval.KillCandidates) > 0 {
+		p4m.logger.Infof("Runtimelimit violations detected (%d processes) but enforcement disabled (enforce_kills: false)", len(eval.KillCandidates))
+	}
+
+	p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_runtimelimit_kills_total",
+		help:  "Total number of processes killed by runtimelimit enforcement",
+		mtype: "counter",
+		value: fmt.Sprintf("%d", p4m.runtimelimitKillCount)})
+}
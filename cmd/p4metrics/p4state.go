@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileState records how far a tailed file (e.g. errors.csv or P4JOURNAL) has been processed
+type fileState struct {
+	Path   string `json:"path"`
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+type errorCountState struct {
+	Subsystem     string `json:"subsystem"`
+	Severity      string `json:"severity"`
+	Name          string `json:"name"`
+	Count         int    `json:"count"`
+	LabelOffset   int    `json:"label_offset,omitempty"`
+	ReportedOther int    `json:"reported_other,omitempty"`
+}
+
+type authCountState struct {
+	Method string `json:"method"`
+	Result string `json:"result"`
+	Count  int    `json:"count"`
+}
+
+type triggerCountState struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Executions int    `json:"executions"`
+	Failures   int    `json:"failures"`
+}
+
+type integrityCountState struct {
+	Table      string `json:"table"`
+	Replica    string `json:"replica"`
+	Checks     int    `json:"checks"`
+	Mismatches int    `json:"mismatches"`
+}
+
+type journalCountState struct {
+	Table  string `json:"table"`
+	Action string `json:"action"`
+	Count  int    `json:"count"`
+}
+
+// counterState is the content of the state file - counters derived from tailing files, and the file offsets
+// they correspond to.
+type counterState struct {
+	Saved                  time.Time                     `json:"saved"`
+	Errors                 []errorCountState             `json:"errors"`
+	ErrorLabels            []string                      `json:"error_labels"`
+	ErrParseFailures       int64                         `json:"error_parse_failures"`
+	ErrorsByUser           map[string]int                `json:"errors_by_user,omitempty"`
+	ErrorsByCmd            map[string]int                `json:"errors_by_cmd,omitempty"`
+	Journal                []journalCountState           `json:"journal"`
+	ErrorsFile             *fileState                    `json:"errors_file,omitempty"`
+	JournalFile            *fileState                    `json:"journal_file,omitempty"`
+	AuthLogins             []authCountState              `json:"auth_logins,omitempty"`
+	AuthByUser             map[string]*topNCounter       `json:"auth_by_user,omitempty"`
+	AuthByIP               map[string]*topNCounter       `json:"auth_by_ip,omitempty"`
+	AuthFailures           map[string][]time.Time        `json:"auth_failures,omitempty"`
+	AuthParseFailures      int64                         `json:"auth_parse_failures"`
+	AuthFile               *fileState                    `json:"auth_file,omitempty"`
+	Triggers               []triggerCountState           `json:"triggers,omitempty"`
+	TriggerDurations       map[string]*durationHistogram `json:"trigger_durations,omitempty"`
+	TriggerParseFailures   int64                         `json:"trigger_parse_failures"`
+	TriggersFile           *fileState                    `json:"triggers_file,omitempty"`
+	Integrity              []integrityCountState         `json:"integrity,omitempty"`
+	IntegrityLastCheck     map[string]time.Time          `json:"integrity_last_check,omitempty"`
+	IntegrityParseFailures int64                         `json:"integrity_parse_failures"`
+	IntegrityChecksumsRun  time.Time                     `json:"integrity_checksums_run,omitempty"`
+	IntegrityFile          *fileState                    `json:"integrity_file,omitempty"`
+}
+
+// fileTracker follows the offset of a file being tailed. The tailer doesn't report offsets, and truncates long
+// lines (see MaxLineBytes), so the tracker reads the file independently and moves past one line for every
+// line the tailer delivers. With persist_counters the tailer reads the file from the beginning, and lines
+// ending at or before start (already counted) are skipped, so counts and offsets cannot drift apart.
+type fileTracker struct {
+	path   string
+	inode  uint64
+	offset int64
+	start  int64
+	file   *os.File
+	reader *bufio.Reader
+}
+
+func newFileTracker(path string, offset int64) *fileTracker {
+	ft := &fileTracker{path: path}
+	ft.open(offset)
+	return ft
+}
+
+func (ft *fileTracker) open(offset int64) error {
+	ft.close()
+	ft.offset = offset
+	f, err := os.Open(ft.path)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	ft.inode = fileInode(fi)
+	ft.file = f
+	ft.reader = bufio.NewReaderSize(f, 64*1024)
+	return nil
+}
+
+func (ft *fileTracker) close() {
+	if ft.file != nil {
+		ft.file.Close()
+	}
+	ft.file = nil
+	ft.reader = nil
+}
+
+// skipLine reads up to and including the next newline, returning the number of bytes read
+func (ft *fileTracker) skipLine() (int64, error) {
+	var n int64
+	for {
+		b, err := ft.reader.ReadSlice('\n')
+		n += int64(len(b))
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return n, err
+	}
+}
+
+// advance moves the offset past the line just delivered by the tailer, returning false if the line
+// has already been counted and should be skipped
+func (ft *fileTracker) advance() bool {
+	if ft.reader == nil && ft.open(ft.offset) != nil {
+		return true
+	}
+	n, err := ft.skipLine()
+	if err == nil {
+		ft.offset += n
+		return ft.offset > ft.start
+	}
+	// No complete line, so the tailer must have moved on to a new file after rotation or truncation
+	fi, serr := os.Stat(ft.path)
+	if serr == nil && (fileInode(fi) != ft.inode || fi.Size() < ft.offset+n) {
+		if ft.open(0) == nil {
+			n, _ = ft.skipLine()
+		}
+		ft.offset = n
+		ft.start = 0
+		return true
+	}
+	ft.offset += n
+	return ft.offset > ft.start
+}
+
+func (ft *fileTracker) state() *fileState {
+	offset := ft.offset
+	if offset < ft.start {
+		offset = ft.start // Still catching up with lines already counted
+	}
+	return &fileState{Path: ft.path, Inode: ft.inode, Offset: offset}
+}
+
+// replayFile passes the lines from offset to the current end of the file to fn, along with the offset
+// following each line. A final partial line is left unread.
+func replayFile(filename string, offset int64, fn func(line string, offset int64)) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReaderSize(f, 64*1024)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		offset += int64(len(line))
+		fn(strings.TrimRight(line, "\r\n"), offset)
+	}
+}
+
+// findFileByInode looks in dirs for a file with the specified inode, e.g. a rotated journal
+func findFileByInode(dirs []string, inode uint64, exclude string) string {
+	if inode == 0 {
+		return ""
+	}
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			fname := filepath.Join(dir, e.Name())
+			if !e.Type().IsRegular() || fname == exclude {
+				continue
+			}
+			if fi, err := e.Info(); err == nil && fileInode(fi) == inode {
+				return fname
+			}
+		}
+	}
+	return ""
+}
+
+// resumeTracking sets *ft to a tracker for filename, for use with a tailer started with Readall, so that the
+// tailer counts all lines written since saved was recorded (by a previous run, or before the tailer was restarted).
+// Without a saved state the lines already in the file are skipped, as when not persisting counters.
+// If the file has been rotated since (different inode) the rest of the old file is replayed if it can be found in
+// rotatedDirs, and all of the new file is counted. lock (which guards *ft and the counters updated by fn) is
+// taken per line rather than for the whole replay so that monitors and saveState aren't held up by a large backlog.
+func (p4m *P4MonitorMetrics) resumeTracking(ft **fileTracker, lock *sync.Mutex, saved *fileState, filename string,
+	rotatedDirs []string, fn func(string)) {
+	var start int64
+	fi, err := os.Stat(filename)
+	switch {
+	case err != nil:
+		p4m.logger.Debugf("resumeTracking: %v", err)
+	case saved == nil || saved.Path != filename:
+		start = fi.Size()
+	case fileInode(fi) == saved.Inode && fi.Size() >= saved.Offset:
+		start = saved.Offset
+		p4m.logger.Infof("Counting lines written to %s since last run from offset %d", filename, start)
+	default:
+		// Until the old file is finished, state is saved against it, so that any lines not yet replayed aren't lost
+		old := &fileTracker{path: filename, inode: saved.Inode, offset: saved.Offset}
+		lock.Lock()
+		*ft = old
+		lock.Unlock()
+		if rotated := findFileByInode(rotatedDirs, saved.Inode, filename); rotated != "" {
+			p4m.logger.Infof("%s rotated since last run, replaying rest of %s", filename, rotated)
+			count := 0
+			err := replayFile(rotated, saved.Offset, func(line string, offset int64) {
+				lock.Lock()
+				fn(line)
+				old.offset = offset
+				lock.Unlock()
+				count++
+			})
+			if err != nil {
+				p4m.logger.Errorf("error replaying %s: %v", rotated, err)
+			}
+			p4m.logger.Infof("Replayed %d lines from %s", count, rotated)
+		} else {
+			p4m.logger.Warnf("%s rotated since last run and previous file not found - some lines not counted", filename)
+		}
+	}
+	tracker := newFileTracker(filename, 0)
+	tracker.start = start
+	lock.Lock()
+	*ft = tracker
+	lock.Unlock()
+}
+
+func (p4m *P4MonitorMetrics) stateFilename() string {
+	dir := p4m.config.StateDir
+	if dir == "" {
+		dir = p4m.config.MetricsRoot
+	}
+	instanceStr := ""
+	if p4m.config.SDPInstance != "" {
+		instanceStr = fmt.Sprintf("-%s", p4m.config.SDPInstance)
+	}
+	return path.Join(dir, fmt.Sprintf("p4metrics_state%s-%s.json", instanceStr, p4m.serverID))
+}
+
+// getState returns the current counters and file offsets
+func (p4m *P4MonitorMetrics) getState() *counterState {
+	st := &counterState{Saved: time.Now()}
+	p4m.errLock.Lock()
+	for m, count := range p4m.errorMetrics {
+		st.Errors = append(st.Errors, errorCountState{Subsystem: m.Subsystem, Severity: m.Severity, Name: m.Name,
+			Count: count, LabelOffset: p4m.errorLabelOffsets[m], ReportedOther: p4m.errorsReportedOther[m]})
+	}
+	for name := range p4m.errorLabels {
+		st.ErrorLabels = append(st.ErrorLabels, name)
+	}
+	st.ErrParseFailures = p4m.errParseFailures
+	if len(p4m.errorsByUser) > 0 {
+		st.ErrorsByUser = make(map[string]int)
+		for k, v := range p4m.errorsByUser {
+			st.ErrorsByUser[k] = v
+		}
+		st.ErrorsByCmd = make(map[string]int)
+		for k, v := range p4m.errorsByCmd {
+			st.ErrorsByCmd[k] = v
+		}
+	}
+	st.ErrorsFile = p4m.savedErrorsFile
+	if p4m.errorsFile != nil {
+		st.ErrorsFile = p4m.errorsFile.state()
+	}
+	p4m.errLock.Unlock()
+
+	p4m.journalLock.Lock()
+	for m, count := range p4m.journalMetrics {
+		st.Journal = append(st.Journal, journalCountState{Table: m.Table, Action: m.Action, Count: count})
+	}
+	st.JournalFile = p4m.savedJournalFile
+	if p4m.journalFile != nil {
+		st.JournalFile = p4m.journalFile.state()
+	}
+	p4m.journalLock.Unlock()
+
+	p4m.authLock.Lock()
+	for m, count := range p4m.authLogins {
+		st.AuthLogins = append(st.AuthLogins, authCountState{Method: m.Method, Result: m.Result, Count: count})
+	}
+	st.AuthByUser = cloneTopNCounters(p4m.authByUser)
+	st.AuthByIP = cloneTopNCounters(p4m.authByIP)
+	st.AuthFailures = make(map[string][]time.Time)
+	for user, times := range p4m.authFailures {
+		st.AuthFailures[user] = append([]time.Time(nil), times...)
+	}
+	st.AuthParseFailures = p4m.authParseFailures
+	st.AuthFile = p4m.authLog.savedFile
+	if p4m.authLog.file != nil {
+		st.AuthFile = p4m.authLog.file.state()
+	}
+	p4m.authLock.Unlock()
+
+	p4m.triggerLock.Lock()
+	for m, count := range p4m.triggerExecutions {
+		st.Triggers = append(st.Triggers, triggerCountState{Name: m.Name, Type: m.Type, Executions: count, Failures: p4m.triggerFailures[m]})
+	}
+	st.TriggerDurations = make(map[string]*durationHistogram)
+	for name, h := range p4m.triggerDurations {
+		st.TriggerDurations[name] = &durationHistogram{Buckets: append([]int(nil), h.Buckets...), Sum: h.Sum, Count: h.Count}
+	}
+	st.TriggerParseFailures = p4m.triggerParseFailures
+	st.TriggersFile = p4m.triggerLog.savedFile
+	if p4m.triggerLog.file != nil {
+		st.TriggersFile = p4m.triggerLog.file.state()
+	}
+	p4m.triggerLock.Unlock()
+
+	p4m.integrityLock.Lock()
+	for m, count := range p4m.integrityChecks {
+		st.Integrity = append(st.Integrity, integrityCountState{Table: m.Table, Replica: m.Replica, Checks: count, Mismatches: p4m.integrityMismatches[m]})
+	}
+	st.IntegrityLastCheck = make(map[string]time.Time)
+	for r, t := range p4m.integrityLastCheck {
+		st.IntegrityLastCheck[r] = t
+	}
+	st.IntegrityParseFailures = p4m.integrityParseFailures
+	st.IntegrityChecksumsRun = p4m.integrityChecksumsLastRun
+	st.IntegrityFile = p4m.integrityLog.savedFile
+	if p4m.integrityLog.file != nil {
+		st.IntegrityFile = p4m.integrityLog.file.state()
+	}
+	p4m.integrityLock.Unlock()
+
+	sort.Slice(st.Errors, func(i, j int) bool {
+		a, b := st.Errors[i], st.Errors[j]
+		if a.Subsystem != b.Subsystem {
+			return a.Subsystem < b.Subsystem
+		}
+		if a.Severity != b.Severity {
+			return a.Severity < b.Severity
+		}
+		return a.Name < b.Name
+	})
+	sort.Strings(st.ErrorLabels)
+	sort.Slice(st.Triggers, func(i, j int) bool {
+		if st.Triggers[i].Name != st.Triggers[j].Name {
+			return st.Triggers[i].Name < st.Triggers[j].Name
+		}
+		return st.Triggers[i].Type < st.Triggers[j].Type
+	})
+	sort.Slice(st.Integrity, func(i, j int) bool {
+		if st.Integrity[i].Table != st.Integrity[j].Table {
+			return st.Integrity[i].Table < st.Integrity[j].Table
+		}
+		return st.Integrity[i].Replica < st.Integrity[j].Replica
+	})
+	sort.Slice(st.AuthLogins, func(i, j int) bool {
+		if st.AuthLogins[i].Method != st.AuthLogins[j].Method {
+			return st.AuthLogins[i].Method < st.AuthLogins[j].Method
+		}
+		return st.AuthLogins[i].Result < st.AuthLogins[j].Result
+	})
+	sort.Slice(st.Journal, func(i, j int) bool {
+		if st.Journal[i].Table != st.Journal[j].Table {
+			return st.Journal[i].Table < st.Journal[j].Table
+		}
+		return st.Journal[i].Action < st.Journal[j].Action
+	})
+	return st
+}
+
+// setState restores counters and saved file offsets - called before tailers are started
+func (p4m *P4MonitorMetrics) setState(st *counterState) {
+	p4m.errLock.Lock()
+	for _, e := range st.Errors {
+		m := ErrorMetric{Subsystem: e.Subsystem, Severity: e.Severity, Name: e.Name}
+		p4m.errorMetrics[m] = e.Count
+		if e.LabelOffset > 0 {
+			p4m.errorLabelOffsets[m] = e.LabelOffset
+		}
+		if e.ReportedOther > 0 {
+			p4m.errorsReportedOther[m] = e.ReportedOther
+		}
+	}
+	for _, name := range st.ErrorLabels {
+		p4m.errorLabels[name] = true
+	}
+	p4m.errParseFailures = st.ErrParseFailures
+	for k, v := range st.ErrorsByUser {
+		p4m.errorsByUser[k] = v
+	}
+	for k, v := range st.ErrorsByCmd {
+		p4m.errorsByCmd[k] = v
+	}
+	p4m.savedErrorsFile = st.ErrorsFile
+	p4m.errLock.Unlock()
+
+	p4m.journalLock.Lock()
+	for _, j := range st.Journal {
+		p4m.journalMetrics[JournalMetric{Table: j.Table, Action: j.Action}] = j.Count
+	}
+	p4m.savedJournalFile = st.JournalFile
+	p4m.journalLock.Unlock()
+
+	p4m.authLock.Lock()
+	for _, a := range st.AuthLogins {
+		p4m.authLogins[AuthMetric{Method: a.Method, Result: a.Result}] = a.Count
+	}
+	for r, c := range st.AuthByUser {
+		p4m.authByUser[r] = c.clone()
+	}
+	for r, c := range st.AuthByIP {
+		p4m.authByIP[r] = c.clone()
+	}
+	for user, times := range st.AuthFailures {
+		if !p4m.config.AuthByUser {
+			// Drop any user names saved while auth_by_user was set
+			user = ""
+		}
+		p4m.authFailures[user] = append(p4m.authFailures[user], times...)
+	}
+	p4m.authParseFailures = st.AuthParseFailures
+	p4m.authLog.savedFile = st.AuthFile
+	p4m.authLock.Unlock()
+
+	p4m.triggerLock.Lock()
+	for _, tr := range st.Triggers {
+		m := TriggerMetric{Name: tr.Name, Type: tr.Type}
+		p4m.triggerExecutions[m] = tr.Executions
+		if tr.Failures > 0 {
+			p4m.triggerFailures[m] = tr.Failures
+		}
+	}
+	for name, h := range st.TriggerDurations {
+		p4m.triggerDurations[name] = h
+	}
+	p4m.triggerParseFailures = st.TriggerParseFailures
+	p4m.triggerLog.savedFile = st.TriggersFile
+	p4m.triggerLock.Unlock()
+
+	p4m.integrityLock.Lock()
+	for _, i := range st.Integrity {
+		m := IntegrityMetric{Table: i.Table, Replica: i.Replica}
+		p4m.integrityChecks[m] = i.Checks
+		if i.Mismatches > 0 {
+			p4m.integrityMismatches[m] = i.Mismatches
+		}
+	}
+	for r, t := range st.IntegrityLastCheck {
+		p4m.integrityLastCheck[r] = t
+	}
+	p4m.integrityParseFailures = st.IntegrityParseFailures
+	p4m.integrityChecksumsLastRun = st.IntegrityChecksumsRun
+	p4m.integrityLog.savedFile = st.IntegrityFile
+	p4m.integrityLock.Unlock()
+}
+
+func cloneTopNCounters(counters map[string]*topNCounter) map[string]*topNCounter {
+	if len(counters) == 0 {
+		return nil
+	}
+	result := make(map[string]*topNCounter)
+	for k, c := range counters {
+		result[k] = c.clone()
+	}
+	return result
+}
+
+// loadState restores counters saved by a previous run, if any
+func (p4m *P4MonitorMetrics) loadState() {
+	p4m.stateLoaded = true
+	if !p4m.config.PersistCounters || p4m.dryrun || p4m.config.Remote {
+		return
+	}
+	fname := p4m.stateFilename()
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			p4m.logger.Errorf("error reading state file %s: %v", fname, err)
+		}
+		return
+	}
+	// Written by earlier versions with mode 0644 - see saveState
+	if err := os.Chmod(fname, 0600); err != nil {
+		p4m.logger.Errorf("error setting permissions of state file %s: %v", fname, err)
+	}
+	st := &counterState{}
+	if err := json.Unmarshal(data, st); err != nil {
+		p4m.logger.Errorf("error parsing state file %s: %v", fname, err)
+		return
+	}
+	p4m.logger.Infof("Restoring counters from %s saved at %v", fname, st.Saved)
+	p4m.setState(st)
+}
+
+// saveState writes counters and file offsets - to a temp file first which is then renamed. Only the owner can read
+// it as it may contain user names and IP addresses (from auth.csv).
+func (p4m *P4MonitorMetrics) saveState() {
+	if !p4m.config.PersistCounters || p4m.dryrun || p4m.config.Remote || !p4m.stateLoaded {
+		return
+	}
+	fname := p4m.stateFilename()
+	data, err := json.MarshalIndent(p4m.getState(), "", " ")
+	if err != nil {
+		p4m.logger.Errorf("error encoding state: %v", err)
+		return
+	}
+	tmpName := fname + ".tmp"
+	if err := os.WriteFile(tmpName, data, 0600); err != nil {
+		p4m.logger.Errorf("error writing state file %s: %v", tmpName, err)
+		return
+	}
+	if err := os.Chmod(tmpName, 0600); err != nil {
+		p4m.logger.Errorf("error setting permissions of state file %s: %v", tmpName, err)
+		return
+	}
+	if err := os.Rename(tmpName, fname); err != nil {
+		p4m.logger.Errorf("error renaming %s to %s: %v", tmpName, fname, err)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DepotStorage is the archive size of a depot from p4 sizes
+type DepotStorage struct {
+	Name  string
+	Type  string
+	Files int64
+	Bytes int64
+}
+
+// depotStorageScan holds the results of the most recent scan of all depots
+type depotStorageScan struct {
+	depots   []*DepotStorage           // Depots successfully sized
+	failures int                       // Count of depots which could not be sized
+	depotsBy map[string]int            // Count of depots by type
+	streams  map[string]map[string]int // Count of streams by depot and type
+	finished time.Time
+	elapsed  time.Duration
+}
+
+// Depot types without local archive files to size
+var depotTypesNotSized = map[string]bool{"remote": true, "graph": true}
+
+// noSuchFiles returns true if a p4 error is just that the path has no files
+func noSuchFiles(err error) bool {
+	return strings.Contains(err.Error(), "no such file")
+}
+
+// sizeDepot sums p4 sizes for each top level directory of a depot (and the files in its root) in turn, rather than
+// sizing the whole depot with one command, calling pause before each p4 sizes
+func (p4m *P4MonitorMetrics) sizeDepot(d *DepotStorage, pause func()) error {
+	paths := []string{fmt.Sprintf("//%s/*", d.Name)}
+	lines, err := p4m.p4Runner.Run(fmt.Sprintf("-ztag dirs -D \"//%s/*\"", d.Name), "")
+	if err != nil && !noSuchFiles(err) {
+		return fmt.Errorf("error running dirs: %v", err)
+	}
+	for _, rec := range parseZtagRecords(lines) {
+		if rec["dir"] != "" {
+			paths = append(paths, rec["dir"]+"/...")
+		}
+	}
+	for _, path := range paths {
+		pause()
+		lines, err := p4m.p4Runner.Run(fmt.Sprintf("-ztag sizes -s -a -z \"%s\"", path), "")
+		if err != nil {
+			if noSuchFiles(err) {
+				continue
+			}
+			return fmt.Errorf("error running sizes for %s: %v", path, err)
+		}
+		for _, rec := range parseZtagRecords(lines) {
+			files, err := strconv.ParseInt(rec["fileCount"], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid sizes output for %s: %q", path, lines)
+			}
+			bytes, err := strconv.ParseInt(rec["fileSize"], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid sizes output for %s: %q", path, lines)
+			}
+			d.Files += files
+			d.Bytes += bytes
+		}
+	}
+	return nil
+}
+
+// scanDepotStorage runs p4 depots, p4 streams and then p4 sizes for each top level directory of each depot in turn,
+// sleeping for depot_storage_delay between each p4 sizes so that a scan of a large server never overloads it.
+// Depots which fail to be sized are left out and counted in failures, rather than reported as empty.
+func (p4m *P4MonitorMetrics) scanDepotStorage(sleep func(time.Duration)) *depotStorageScan {
+	start := time.Now()
+	scan := &depotStorageScan{depotsBy: make(map[string]int), streams: make(map[string]map[string]int)}
+	lines, err := p4m.p4Runner.Run("-ztag depots", "")
+	if err != nil {
+		p4m.logger.Errorf("Error running depots: %v", err)
+		return nil
+	}
+	for _, d := range parseZtagRecords(lines) {
+		if d["name"] == "" {
+			continue
+		}
+		scan.depotsBy[d["type"]] += 1
+		scan.depots = append(scan.depots, &DepotStorage{Name: d["name"], Type: d["type"]})
+	}
+	sort.Slice(scan.depots, func(i, j int) bool { return scan.depots[i].Name < scan.depots[j].Name })
+	if lines, err = p4m.p4Runner.Run("-ztag streams", ""); err != nil {
+		p4m.logger.Errorf("Error running streams: %v", err)
+	} else {
+		for _, s := range parseZtagRecords(lines) {
+			depot := depotFromPath(s["Stream"])
+			if depot == "" {
+				continue
+			}
+			if _, ok := scan.streams[depot]; !ok {
+				scan.streams[depot] = make(map[string]int)
+			}
+			scan.streams[depot][s["Type"]] += 1
+		}
+	}
+	calls := 0
+	pause := func() {
+		if calls > 0 {
+			sleep(p4m.config.DepotStorageDelay)
+		}
+		calls++
+	}
+	sized := make([]*DepotStorage, 0, len(scan.depots))
+	for _, d := range scan.depots {
+		if depotTypesNotSized[d.Type] {
+			continue
+		}
+		if err := p4m.sizeDepot(d, pause); err != nil {
+			p4m.logger.Errorf("Error sizing depot %s: %v", d.Name, err)
+			scan.failures++
+			continue
+		}
+		sized = append(sized, d)
+	}
+	scan.depots = sized
+	scan.finished = time.Now()
+	scan.elapsed = time.Since(start)
+	return scan
+}
+
+// depotFromPath returns the depot name from a depot path such as //streams/main
+func depotFromPath(path string) string {
+	if len(path) < 3 || path[:2] != "//" {
+		return ""
+	}
+	for i := 2; i < len(path); i++ {
+		if path[i] == '/' {
+			return path[2:i]
+		}
+	}
+	return path[2:]
+}
+
+func (p4m *P4MonitorMetrics) depotStorageMetrics(scan *depotStorageScan) {
+	for _, d := range scan.depots {
+		labels := []labelStruct{{name: "depot", value: d.Name}, {name: "type", value: d.Type}}
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_depot_archive_bytes",
+			help:   "Size of all revisions of files in depot excluding lazy copies (p4 sizes -s -a -z)",
+			mtype:  "gauge",
+			value:  fmt.Sprintf("%d", d.Bytes),
+			labels: labels})
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_depot_archive_files",
+			help:   "Count of all revisions of files in depot excluding lazy copies (p4 sizes -s -a -z)",
+			mtype:  "gauge",
+			value:  fmt.Sprintf("%d", d.Files),
+			labels: labels})
+	}
+	types := make([]string, 0, len(scan.depotsBy))
+	for t := range scan.depotsBy {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_depots_count",
+			help:   "Count of depots by type",
+			mtype:  "gauge",
+			value:  fmt.Sprintf("%d", scan.depotsBy[t]),
+			labels: []labelStruct{{name: "type", value: t}}})
+	}
+	depots := make([]string, 0, len(scan.streams))
+	for d := range scan.streams {
+		depots = append(depots, d)
+	}
+	sort.Strings(depots)
+	for _, d := range depots {
+		types := make([]string, 0, len(scan.streams[d]))
+		for t := range scan.streams[d] {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		for _, t := range types {
+			p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_streams_count",
+				help:   "Count of streams by depot and stream type",
+				mtype:  "gauge",
+				value:  fmt.Sprintf("%d", scan.streams[d][t]),
+				labels: []labelStruct{{name: "depot", value: d}, {name: "type", value: t}}})
+		}
+	}
+	p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_depot_storage_scan_time",
+		help:  "Time (epoch secs) the most recent depot storage scan finished",
+		mtype: "gauge",
+		value: fmt.Sprintf("%d", scan.finished.Unix())})
+	p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_depot_storage_scan_seconds",
+		help:  "Duration of the most recent depot storage scan (including depot_storage_delay between each p4 sizes)",
+		mtype: "gauge",
+		value: fmt.Sprintf("%.3f", scan.elapsed.Seconds())})
+	p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_depot_storage_scan_failures",
+		help:  "Count of depots which could not be sized in the most recent depot storage scan (not output in p4_depot_archive_*)",
+		mtype: "gauge",
+		value: fmt.Sprintf("%d", scan.failures)})
+}
+
+func (p4m *P4MonitorMetrics) monitorDepotStorage() {
+	// Archive sizes by depot - scanned in the background every long_update_interval, one depot at a time
+	if !p4m.config.MonitorDepotStorage {
+		return
+	}
+	p4m.storageLock.Lock()
+	defer p4m.storageLock.Unlock()
+	if !p4m.storageScanning && p4m.longIntervalDue("monitorDepotStorage") {
+		p4m.storageScanning = true
+		go func() {
+			scan := p4m.scanDepotStorage(time.Sleep)
+			p4m.storageLock.Lock()
+			defer p4m.storageLock.Unlock()
+			p4m.storageScanning = false
+			if scan != nil {
+				p4m.storageScan = scan
+			}
+		}()
+	}
+	if p4m.storageScan == nil {
+		return
+	}
+	p4m.startMonitor("monitorDepotStorage", "p4_depot_storage")
+	defer p4m.completeMonitor()
+	p4m.depotStorageMetrics(p4m.storageScan)
+	p4m.writeMetricsFile()
+}
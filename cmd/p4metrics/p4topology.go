@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TopologyServer is a server from p4 servers with the results of connecting to its Address
+type TopologyServer struct {
+	ServerID string
+	Services string
+	Address  string
+	Up       bool
+	Latency  time.Duration
+	Info     map[string]string // p4 info -s output
+	Err      error
+}
+
+// TopologyProber runs p4 info against a server address - an interface so that tests don't need servers
+type TopologyProber interface {
+	Probe(address string, timeout time.Duration) ([]string, error)
+}
+
+// P4InfoProber runs p4 -p <address> info -s
+type P4InfoProber struct {
+	p4m *P4MonitorMetrics
+}
+
+// Probe runs p4 info -s against address, killing it if it takes longer than timeout
+func (pr *P4InfoProber) Probe(address string, timeout time.Duration) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	args := make([]string, 0)
+	if pr.p4m.p4User != "" {
+		args = append(args, "-u", pr.p4m.p4User)
+	}
+	args = append(args, "-p", address, fmt.Sprintf("-vnet.maxwait=%d", int(timeout.Seconds())), "info", "-s")
+	out, err := exec.CommandContext(ctx, pr.p4m.p4bin, args...).CombinedOutput()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("timed out after %v", timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return strings.Split(strings.TrimSpace(string(out)), "\n"), nil
+}
+
+// Services which are p4d servers (rather than proxies/brokers etc) - as for monitorReplicas
+var reTopologyServices = regexp.MustCompile("standard|replica|commit-server|edge-server|forwarding-replica|build-server|standby|forwarding-standby")
+
+// parseTopologyServers parses the output of p4 -F "%serverID%|%services%|%address%" servers, ignoring
+// this server and any without an address
+func parseTopologyServers(lines []string, thisServerID string) []*TopologyServer {
+	servers := make([]*TopologyServer, 0)
+	for _, line := range lines {
+		parts := strings.SplitN(strings.TrimSpace(line), "|", 3)
+		if len(parts) < 3 {
+			continue
+		}
+		s := &TopologyServer{ServerID: parts[0], Services: parts[1], Address: strings.TrimSpace(parts[2])}
+		if s.ServerID == "" || s.ServerID == thisServerID || s.Address == "" || !reTopologyServices.MatchString(s.Services) {
+			continue
+		}
+		servers = append(servers, s)
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].ServerID < servers[j].ServerID })
+	return servers
+}
+
+// parseInfoLines parses p4 info -s output into a map
+func parseInfoLines(lines []string) map[string]string {
+	info := make(map[string]string)
+	for _, s := range lines {
+		parts := strings.SplitN(strings.TrimSpace(s), ": ", 2)
+		if len(parts) == 2 {
+			info[parts[0]] = parts[1]
+		}
+	}
+	return info
+}
+
+// probeTopology connects to all servers in parallel
+func (p4m *P4MonitorMetrics) probeTopology(servers []*TopologyServer) {
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *TopologyServer) {
+			defer wg.Done()
+			start := time.Now()
+			lines, err := p4m.topologyProber.Probe(s.Address, p4m.config.TopologyTimeout)
+			s.Latency = time.Since(start)
+			if err != nil {
+				s.Err = err
+				return
+			}
+			s.Info = parseInfoLines(lines)
+			s.Up = s.Info["Server version"] != ""
+			if !s.Up {
+				s.Err = fmt.Errorf("no server version in p4 info: %q", lines)
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
+func (p4m *P4MonitorMetrics) topologyMetrics(servers []*TopologyServer) {
+	reDate := regexp.MustCompile(` \([0-9/]+\)`)
+	for _, s := range servers {
+		labels := []labelStruct{{name: "servername", value: s.ServerID}}
+		up := "0"
+		if s.Up {
+			up = "1"
+		} else {
+			p4m.logger.Warnf("Topology: server %s at %q not reachable: %v", s.ServerID, s.Address, s.Err)
+		}
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_topology_server_up",
+			help:  "Whether p4 info succeeds against the Address of the server in p4 servers",
+			mtype: "gauge",
+			value: up,
+			labels: []labelStruct{{name: "servername", value: s.ServerID},
+				{name: "address", value: s.Address}, {name: "services", value: s.Services}}})
+		if !s.Up {
+			continue
+		}
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_topology_info_latency_seconds",
+			help:   "Round trip time of p4 info against the server",
+			mtype:  "gauge",
+			value:  fmt.Sprintf("%.3f", s.Latency.Seconds()),
+			labels: labels})
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_topology_server_version_info",
+			help:  "P4D version of the server",
+			mtype: "gauge",
+			value: "1",
+			labels: []labelStruct{{name: "servername", value: s.ServerID},
+				{name: "version", value: reDate.ReplaceAllString(s.Info["Server version"], "")}}})
+		if v, ok := s.Info["Server uptime"]; ok {
+			p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_topology_server_uptime",
+				help:   "Uptime of the server in seconds",
+				mtype:  "gauge",
+				value:  fmt.Sprintf("%d", p4m.parseUptime(v)),
+				labels: labels})
+		}
+		// The server at the address should report the ServerID it is configured as in p4 servers
+		match := "1"
+		if s.Info["ServerID"] != s.ServerID {
+			match = "0"
+			p4m.logger.Warnf("Topology: server %s at %q reports ServerID %q", s.ServerID, s.Address, s.Info["ServerID"])
+		}
+		p4m.metrics = append(p4m.metrics, metricStruct{name: "p4_topology_serverid_match",
+			help:   "Whether the server at the Address reports the same ServerID as in p4 servers",
+			mtype:  "gauge",
+			value:  match,
+			labels: labels})
+	}
+}
+
+func (p4m *P4MonitorMetrics) monitorTopology() {
+	// Health of all servers in p4 servers - from the commit server only
+	if !p4m.config.MonitorTopology || !p4m.isCommitServer() {
+		return
+	}
+	p4m.startMonitor("monitorTopology", "p4_topology")
+	defer p4m.completeMonitor()
+	p4cmd, errbuf, p := p4m.newP4CmdPipe("-F \"%serverID%|%services%|%address%\" servers")
+	lines, err := p.Exec(p4cmd).Slice()
+	if err != nil {
+		p4m.handleP4Error("Error running %s: %v, err:%q", p4cmd, err, errbuf)
+		return
+	}
+	servers := parseTopologyServers(lines, p4m.serverID)
+	p4m.logger.Debugf("topology servers: %d", len(servers))
+	p4m.probeTopology(servers)
+	p4m.topologyMetrics(servers)
+	p4m.writeMetricsFile()
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Field names for the Trigger record (triggers.csv) from p4 logschema -a
+const (
+	triggerNameField  = "f_triggername"
+	triggerTypeField  = "f_triggertype"
+	triggerLapseField = "f_lapse"
+	triggerExitField  = "f_exitcode"
+)
+
+// Default buckets (seconds) for p4_triggers_duration_seconds
+var defaultTriggerBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300}
+
+// TriggerMetric is the key for trigger execution counts
+type TriggerMetric struct {
+	Name string
+	Type string
+}
+
+// TriggerRecord holds the interesting fields from a single parsed triggers.csv line
+type TriggerRecord struct {
+	Name     string
+	Type     string
+	Lapse    float64 // seconds
+	HasLapse bool
+	Failed   bool // Non-zero exit code
+}
+
+// ChildProcess is a process started by a p4d process, e.g. a trigger
+type ChildProcess struct {
+	PID            int
+	PPID           int
+	Cmdline        string
+	ElapsedSeconds float64
+}
+
+// ChildProcReader interface for reading child processes of p4d processes (Linux /proc)
+type ChildProcReader interface {
+	// GetChildProcesses returns the processes whose parent is one of parents
+	GetChildProcesses(parents map[int]bool) ([]ChildProcess, error)
+}
+
+// LinuxChildProcReader reads child processes from /proc on Linux
+type LinuxChildProcReader struct{}
+
+// parseProcStatParent extracts ppid and starttime (in clock ticks since boot) from the contents of /proc/<pid>/stat
+func parseProcStatParent(content string) (int, int64, error) {
+	ind := strings.LastIndex(content, ")")
+	if ind < 0 {
+		return 0, 0, fmt.Errorf("invalid stat format")
+	}
+	// Fields after ')' start with state (field 3), so ppid (field 4) is index 1 and starttime (field 22) index 19
+	fields := strings.Fields(content[ind+1:])
+	if len(fields) < 20 {
+		return 0, 0, fmt.Errorf("too few fields in stat: %d", len(fields))
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid ppid %q: %v", fields[1], err)
+	}
+	starttime, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid starttime %q: %v", fields[19], err)
+	}
+	return ppid, starttime, nil
+}
+
+// GetChildProcesses scans /proc for processes whose parent is in parents
+func (r *LinuxChildProcReader) GetChildProcesses(parents map[int]bool) ([]ChildProcess, error) {
+	content, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) < 1 {
+		return nil, fmt.Errorf("invalid /proc/uptime")
+	}
+	uptime, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid /proc/uptime: %v", err)
+	}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	result := make([]ChildProcess, 0)
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		content, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			continue // PID may have exited
+		}
+		ppid, starttime, err := parseProcStatParent(string(content))
+		if err != nil || !parents[ppid] {
+			continue
+		}
+		cmdline, _ := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+		result = append(result, ChildProcess{PID: pid, PPID: ppid,
+			Cmdline:        strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " ")),
+			ElapsedSeconds: uptime - float64(starttime)/userHZ})
+	}
+	return result, nil
+}
+
+// parseTriggerRecord parses a triggers.csv line using the schema for its record type
+func (p4m *P4MonitorMetrics) parseTriggerRecord(line string) (*TriggerRecord, error) {
+	fields, rs, err := p4m.parseLogRecord(line)
+	if err != nil {
+		return nil, err
+	}
+	rec := &TriggerRecord{
+		Name: strings.TrimSpace(rs.field(fields, triggerNameField)),
+		Type: strings.TrimSpace(rs.field(fields, triggerTypeField)),
+	}
+	if rec.Name == "" {
+		return nil, fmt.Errorf("no trigger name")
+	}
+	lapse := strings.TrimSuffix(strings.TrimSpace(rs.field(fields, triggerLapseField)), "s")
+	if v, err := strconv.ParseFloat(lapse, 64); err == nil {
+		rec.Lapse = v
+		rec.HasLapse = true
+	}
+	// Only a non-zero exit code is a failure - anything else (e.g. empty if the trigger couldn't be run) is counted
+	// as an execution only
+	exitCode := strings.TrimSpace(rs.field(fields, triggerExitField))
+	if v, err := strconv.Atoi(exitCode); err == nil {
+		rec.Failed = v != 0
+	} else {
+		p4m.logger.Debugf("Trigger %s has unrecognised exit code %q", rec.Name, exitCode)
+	}
+	return rec, nil
+}
+
+// countTriggerLine parses the line and updates counters. Must be called with triggerLock held.
+func (p4m *P4MonitorMetrics) countTriggerLine(line string) {
+	rec, err := p4m.parseTriggerRecord(line)
+	if err != nil {
+		p4m.logger.Debugf("Failed to parse trigger line %q: %v", line, err)
+		p4m.triggerParseFailures++
+		return
+	}
+	m := TriggerMetric{Name: rec.Name, Type: rec.Type}
+	p4m.triggerExecutions[m] += 1
+	if rec.Failed {
+		p4m.triggerFailures[m] += 1
+	}
+	if !rec.HasLapse {
+		return
+	}
+	buckets := p4m.triggerBuckets()
+	h, ok := p4m.triggerDurations[rec.Name]
+	if !ok || len(h.Buckets) != len(buckets) {
+		h = newDurationHistogram(buckets)
+		p4m.triggerDurations[rec.Name] = h
+	}
+	h.observe(buckets, rec.Lapse)
+}
+
+func (p4m *P4MonitorMetrics) triggerBuckets() []float64 {
+	if len(p4m.config.TriggerBuckets) > 0 {
+		return p4m.config.TriggerBuckets
+	}
+	return defaultTriggerBuckets
+}
+
+// parseTriggerTable parses p4 triggers -o output returning the command for each trigger name
+func parseTriggerTable(lines []string) map[string]string {
+	result := make(map[string]string)
+	inTriggers := false
+	for _, line := range lines {
+		if strings.HasPrefix(line, "Triggers:") {
+			inTriggers = true
+			continue
+		}
+		if !inTriggers || !strings.HasPrefix(line, "\t") {
+			inTriggers = inTriggers && strings.TrimSpace(line) == ""
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		result[fields[0]] = strings.Trim(strings.Join(fields[3:], " "), `"`)
+	}
+	return result
+}
+
+// matchTrigger returns the name of the trigger whose command best matches a process command line, or "unknown".
+// The command's script must appear in the command line, and the trigger with most other matching (and fewest
+// non-matching) arguments wins.
+// Depot file triggers (%//depot/...%) are run from temp files so can't be matched.
+func matchTrigger(triggers map[string]string, cmdline string) string {
+	names := make([]string, 0, len(triggers))
+	for name := range triggers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	best := "unknown"
+	bestScore := 0
+	for _, name := range names {
+		tokens := strings.Fields(triggers[name])
+		if len(tokens) == 0 {
+			continue
+		}
+		script := filepath.Base(strings.Trim(tokens[0], `"'`))
+		if strings.HasPrefix(tokens[0], "%") || !strings.Contains(cmdline, script) {
+			continue
+		}
+		score := 1
+		for _, t := range tokens[1:] {
+			if strings.Contains(t, "%") {
+				continue
+			}
+			if strings.Contains(cmdline, strings.Trim(t, `"'`)) {
+				score++
+			} else {
+				score--
+			}
+		}
+		if best == "unknown" || score > bestScore {
+			best = name
+			bestScore = score
+		}
+	}
+	return best
+}
+
+func (p4m *P4MonitorMetrics) setupTriggerMonitoring() {
+	p4m.logger.Debugf("setupTriggerMonitoring starting")
+	if p4m.p4triggersCSV == "" {
+		p4m.logger.Debugf("setupTriggerMonitoring exiting as no triggers.csv")
+		return
+	}
+	p4m.triggerLog.path = p4m.p4triggersCSV
+	p4m.setupStructuredLog(p4m.triggerLog)
+}
+
+// getRunningTriggers returns trigger processes (children of p4d processes in the monitor table) by trigger name
+func (p4m *P4MonitorMetrics) getRunningTriggers() map[string][]ChildProcess {
+	result := make(map[string][]ChildProcess)
+	if runtime.GOOS != "linux" || p4m.childReader == nil || p4m.monitorResult == nil || len(p4m.monitorResult.processes) == 0 {
+		return result
+	}
+	parents := make(map[int]bool)
+	for _, proc := range p4m.monitorResult.processes {
+		parents[proc.Pid] = true
+	}
+	children, err := p4m.childReader.GetChildProcesses(parents)
+	if err != nil {
+		p4m.logger.Debugf("Error reading child processes: %v", err)
+		return result
+	}
+	if len(children) == 0 {
+		return result
+	}
+	triggers := make(map[string]string)
+	if p4m.isSuper {
+		p4cmd, errbuf, p := p4m.newP4CmdPipe("triggers -o")
+		lines, err := p.Exec(p4cmd).Slice()
+		if err != nil {
+			p4m.logger.Errorf("Error running %s: %v, err:%q", p4cmd, err, errbuf.String())
+		} else {
+			triggers = parseTriggerTable(lines)
+		}
+	}
+	for _, c := range children {
+		name := matchTrigger(triggers, c.Cmdline)
+		result[name] = append(result[name], c)
+	}
+	return result
+}
+
+func (p4m *P4MonitorMetrics) monitorTriggers() {
+	p4m.startMonitor("monitorTriggers", "p4_triggers")
+	defer p4m.completeMonitor()
+	if p4m.p4triggersCSV == "" {
+		return
+	}
+	p4m.triggerLock.Lock()
+	keys := make([]TriggerMetric, 0, len(p4m.triggerExecutions))
+	for m := range p4m.triggerExecutions {
+		keys = append(keys, m)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Name != keys[j].Name {
+			return keys[i].Name < keys[j].Name
+		}
+		return keys[i].Type < keys[j].Type
+	})
+	for _, m := range keys {
+		labels := []labelStruct{{name: "trigger", value: m.Name}, {name: "type", value: m.Type}}
+		p4m.metrics = append(p4m.metrics,
+			metricStruct{name: "p4_triggers_executions_count",
+				help:   "P4D trigger executions from triggers.csv by trigger name and type",
+				mtype:  "counter",
+				value:  fmt.Sprintf("%d", p4m.triggerExecutions[m]),
+				labels: labels})
+		p4m.metrics = append(p4m.metrics,
+			metricStruct{name: "p4_triggers_failures_count",
+				help:   "P4D trigger executions with non-zero exit by trigger name and type",
+				mtype:  "counter",
+				value:  fmt.Sprintf("%d", p4m.triggerFailures[m]),
+				labels: labels})
+	}
+	names := make([]string, 0, len(p4m.triggerDurations))
+	for name := range p4m.triggerDurations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buckets := p4m.triggerBuckets()
+	help := "P4D trigger execution duration in seconds by trigger name"
+	for _, name := range names {
+		p4m.metrics = append(p4m.metrics, p4m.triggerDurations[name].metrics("p4_triggers_duration_seconds", help,
+			buckets, labelStruct{name: "trigger", value: name})...)
+	}
+	p4m.metrics = append(p4m.metrics,
+		metricStruct{name: "p4_triggers_parse_failures",
+			help:  "Count of triggers.csv lines which could not be parsed",
+			mtype: "counter",
+			value: fmt.Sprintf("%d", p4m.triggerParseFailures)})
+	p4m.triggerLock.Unlock()
+
+	running := p4m.getRunningTriggers()
+	names = make([]string, 0, len(running))
+	for name := range running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		longRunning := 0
+		maxSeconds := 0.0
+		for _, c := range running[name] {
+			if c.ElapsedSeconds >= p4m.config.TriggerLongRunning.Seconds() {
+				longRunning++
+			}
+			if c.ElapsedSeconds > maxSeconds {
+				maxSeconds = c.ElapsedSeconds
+			}
+		}
+		p4m.metrics = append(p4m.metrics,
+			metricStruct{name: "p4_triggers_long_running",
+				help:   fmt.Sprintf("Trigger executions currently running for longer than %v (trigger_long_running) by trigger name", p4m.config.TriggerLongRunning),
+				mtype:  "gauge",
+				value:  fmt.Sprintf("%d", longRunning),
+				labels: []labelStruct{{name: "trigger", value: name}}})
+		p4m.metrics = append(p4m.metrics,
+			metricStruct{name: "p4_triggers_running_max_seconds",
+				help:   "Longest running current trigger execution in seconds by trigger name",
+				mtype:  "gauge",
+				value:  fmt.Sprintf("%.0f", maxSeconds),
+				labels: []labelStruct{{name: "trigger", value: name}}})
+	}
+	p4m.writeMetricsFile()
+}
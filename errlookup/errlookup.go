@@ -0,0 +1,28 @@
+// Package errlookup maps p4d error identities (subsystem, subcode) as found in errors.csv
+// to short names such as CLIENT_LockCheckFail. Shared by p4metrics and p4erroranalyzer.
+package errlookup
+
+import (
+	"strconv"
+	"strings"
+)
+
+//go:generate python3 generate_error_lookup_go.py --errors all_errors.txt --errornum errornum.h --out error_lookup_generated.go
+
+// ShortName returns the short name for the error, or "" if not known
+func ShortName(subsys, subcode int) string {
+	return generatedErrorShortBySubsysSubcode[[2]int{subsys, subcode}]
+}
+
+// ShortNameFromStrings is as ShortName but takes the string values of f_subsys and f_subcode fields
+func ShortNameFromStrings(subsysStr, subcodeStr string) string {
+	subsys, err := strconv.Atoi(strings.TrimSpace(subsysStr))
+	if err != nil {
+		return ""
+	}
+	subcode, err := strconv.Atoi(strings.TrimSpace(subcodeStr))
+	if err != nil {
+		return ""
+	}
+	return ShortName(subsys, subcode)
+}
@@ -0,0 +1,25 @@
+package errlookup
+
+import "testing"
+
+func TestShortName(t *testing.T) {
+	tests := []struct {
+		subsys, subcode string
+		expected        string
+	}{
+		{"8", "44", "CLIENT_LockCheckFail"},
+		{"6", "17", "DM_BadRevision"},
+		{" 8", "1 ", "CLIENT_Connect"},
+		{"8", "99999", ""},
+		{"x", "1", ""},
+		{"8", "", ""},
+	}
+	for _, tc := range tests {
+		if got := ShortNameFromStrings(tc.subsys, tc.subcode); got != tc.expected {
+			t.Errorf("ShortNameFromStrings(%q, %q) = %q, expected %q", tc.subsys, tc.subcode, got, tc.expected)
+		}
+	}
+	if got := ShortName(8, 44); got != "CLIENT_LockCheckFail" {
+		t.Errorf("ShortName(8, 44) = %q", got)
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package errlookup
 
 // Code generated by generate_error_lookup_go.py; DO NOT EDIT.
 // Sources: all_errors.txt, errornum.h
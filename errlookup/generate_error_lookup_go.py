@@ -63,7 +63,7 @@ def parse_entries(text: str, subsystems: dict[str, int]) -> tuple[dict[tuple[int
 def render_go(lookup: dict[tuple[int, int], str], source_errors: Path, source_header: Path, dup_count: int) -> str:
     ts = dt.datetime.now(dt.timezone.utc).replace(microsecond=0).isoformat()
     lines: list[str] = []
-    lines.append("package main")
+    lines.append("package errlookup")
     lines.append("")
     lines.append("// Code generated by generate_error_lookup_go.py; DO NOT EDIT.")
     lines.append(f"// Sources: {source_errors.name}, {source_header.name}")
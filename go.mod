@@ -4,6 +4,7 @@ go 1.25.0
 
 require (
 	github.com/bitfield/script v0.24.3
+	github.com/pmezard/go-difflib v1.0.0
 	github.com/rcowham/go-libp4dlog v0.15.1
 	github.com/rcowham/go-libtail v0.2.0
 	github.com/rcowham/kingpin v0.0.0-20250417115600-e1d913e1a35e
@@ -18,7 +19,6 @@ require (
 	github.com/fsnotify/fsnotify v1.10.1 // indirect
 	github.com/itchyny/gojq v0.12.19 // indirect
 	github.com/itchyny/timefmt-go v0.1.8 // indirect
-	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/xhit/go-str2duration/v2 v2.1.0 // indirect
 	golang.org/x/sys v0.46.0 // indirect
 	golang.org/x/tools v0.46.0 // indirect
@@ -0,0 +1,71 @@
+// Package sdpenv reads p4 environment variables, either from the current environment or by sourcing
+// the SDP (Server Deployment Package) p4_vars file for an instance. Shared by p4metrics and monitor_metrics.
+package sdpenv
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bitfield/script"
+	"github.com/sirupsen/logrus"
+)
+
+// otherVars are non P4*/SDP* vars set by p4_vars which are of interest
+var otherVars = []string{"KEEPCKPS", "KEEPJNLS", "KEEPLOGS", "CHECKPOINTS", "LOGS", "OSUSER"}
+
+// SourceEnvVars returns the current environment
+func SourceEnvVars() map[string]string {
+	env := make(map[string]string)
+	for _, e := range os.Environ() {
+		pair := strings.SplitN(e, "=", 2)
+		env[pair[0]] = pair[1]
+	}
+	return env
+}
+
+// SourceSDPVars sources /p4/common/bin/p4_vars for the instance and returns P4*, *SDP* and other interesting vars.
+// Exits if the vars can't be sourced.
+func SourceSDPVars(sdpInstance string, logger *logrus.Logger) map[string]string {
+	logger.Debugf("sourceSDPVars: %s", sdpInstance)
+	errbuf := new(bytes.Buffer)
+	p := script.NewPipe().WithStderr(errbuf)
+	cmd := fmt.Sprintf("bash -c \"source /p4/common/bin/p4_vars %s && env\"", sdpInstance)
+	logger.Debugf("cmd: %s", cmd)
+	output, err := p.Exec(cmd).Slice()
+	if err != nil {
+		logger.Errorf("Error: %v, %q", err, errbuf.String())
+		logger.Fatalf("Can't source SDP vars: %s", sdpInstance)
+	}
+	return parseSDPVars(output, logger)
+}
+
+func parseSDPVars(output []string, logger *logrus.Logger) map[string]string {
+	results := make(map[string]string, 0)
+	for _, line := range output {
+		pair := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(pair) != 2 {
+			continue
+		}
+		k, v := pair[0], pair[1]
+		if strings.HasPrefix(k, "P4") || strings.Contains(k, "SDP") {
+			results[k] = v
+		}
+		for _, s := range otherVars {
+			if k == s {
+				results[k] = v
+			}
+		}
+	}
+	logger.Debugf("envVars: %q", results)
+	return results
+}
+
+// GetVar returns the value of k, or "" if not set
+func GetVar(vars map[string]string, k string) string {
+	if v, ok := vars[k]; ok {
+		return v
+	}
+	return ""
+}
@@ -0,0 +1,33 @@
+package sdpenv
+
+import (
+	"io"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseSDPVars(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	env := parseSDPVars([]string{
+		"P4PORT=ssl:1666",
+		"SDP_INSTANCE=1",
+		"LOGS=/p4/1/logs",
+		"HOME=/home/perforce",
+		"KEEPCKPS=7",
+		"invalid",
+	}, logger)
+	expected := map[string]string{"P4PORT": "ssl:1666", "SDP_INSTANCE": "1", "LOGS": "/p4/1/logs", "KEEPCKPS": "7"}
+	if len(env) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, env)
+	}
+	for k, v := range expected {
+		if GetVar(env, k) != v {
+			t.Errorf("Expected %s=%q, got %q", k, v, GetVar(env, k))
+		}
+	}
+	if GetVar(env, "HOME") != "" {
+		t.Errorf("Expected HOME to be excluded")
+	}
+}